@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/spq/pkappa2/internal/index"
+	"github.com/spq/pkappa2/internal/tools/diff"
+)
+
+func TestDiffStreams(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.ImportPcaps([]string{
+		writeTestPcap(t, dirs.pcap, "a.pcap", layers.LinkTypeIPv4, start, 1000),
+	})
+	for deadline := time.Now().Add(10 * time.Second); mgr.Status().StreamCount != 4; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pcap was not imported: %+v", mgr.Status())
+		}
+	}
+	r := setupRouter(mgr, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/diff.json?a=0&b=1", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /api/diff.json returned status code %d: %s", rr.Code, rr.Body.String())
+	}
+	response := struct {
+		A, B struct {
+			Stream struct {
+				ID uint64
+			}
+			ActiveConverter string
+		}
+		Chunks []struct {
+			Kind      string
+			Direction index.Direction
+			A, B      int
+			Runs      []index.DiffRun
+		}
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Decode failed with error: %v", err)
+	}
+	if response.A.Stream.ID != 0 || response.B.Stream.ID != 1 {
+		t.Errorf("got streams %d and %d, want 0 and 1", response.A.Stream.ID, response.B.Stream.ID)
+	}
+	if len(response.Chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1: %+v", len(response.Chunks), response.Chunks)
+	}
+	c := response.Chunks[0]
+	if c.Kind != "equal" || c.Direction != index.DirectionClientToServer || c.A != 0 || c.B != 0 {
+		t.Errorf("unexpected chunk %+v", c)
+	}
+	if len(c.Runs) != 1 || c.Runs[0].Kind != diff.Equal || string(c.Runs[0].Data) != "foo" {
+		t.Errorf("unexpected runs %+v", c.Runs)
+	}
+
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{"a=0", http.StatusBadRequest},
+		{"a=0&b=x", http.StatusBadRequest},
+		{"a=0&b=1234", http.StatusNotFound},
+		{"a=0&b=1&converter=foo", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/diff.json?"+tc.query, nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("GET /api/diff.json?%s returned status code %d, want %d", tc.query, rr.Code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/spq/pkappa2/internal/tools"
+)
+
+type (
+	// exportedPcap lists the packets of a pcap file that are exported.
+	exportedPcap struct {
+		filename      string
+		firstPacket   time.Time
+		packetIndexes []uint64
+	}
+
+	exportReader struct {
+		holder        *tools.SeekablePcapHolder
+		packetIndexes []uint64
+		data          []byte
+		ci            gopacket.CaptureInfo
+		linkType      layers.LinkType
+	}
+	exportReaders []*exportReader
+)
+
+func (h exportReaders) Len() int { return len(h) }
+func (h exportReaders) Less(i, j int) bool {
+	return h[i].ci.Timestamp.Before(h[j].ci.Timestamp)
+}
+func (h exportReaders) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *exportReaders) Push(x any)   { *h = append(*h, x.(*exportReader)) }
+func (h *exportReaders) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// next reads the next exported packet, it returns false when all packets
+// of the pcap were read.
+func (r *exportReader) next() (bool, error) {
+	if len(r.packetIndexes) == 0 {
+		return false, nil
+	}
+	data, ci, linkType, err := r.holder.PacketData(r.packetIndexes[0])
+	if err != nil {
+		return false, fmt.Errorf("PacketData failed: %w", err)
+	}
+	r.packetIndexes = r.packetIndexes[1:]
+	r.data, r.ci, r.linkType = data, ci, linkType
+	return true, nil
+}
+
+// writeMergedPcapng writes the exported packets of all pcaps ordered by
+// their timestamp into one pcapng file, every link type gets its own
+// interface. The pcaps are opened in the order of their first packet and
+// closed once all of their packets are written, so only pcaps with
+// overlapping time ranges are open at the same time. flush is called
+// whenever a pcap was completely written. The packets are read using the
+// offset tables of the pcaps.
+func writeMergedPcapng(w io.Writer, flush func(), pcapDir string, pcaps []exportedPcap) error {
+	pcaps = slices.Clone(pcaps)
+	slices.SortStableFunc(pcaps, func(a, b exportedPcap) int {
+		return a.firstPacket.Compare(b.firstPacket)
+	})
+	options := pcapgo.DefaultNgWriterOptions
+	options.SectionInfo.Application = "pkappa2"
+	var ngWriter *pcapgo.NgWriter
+	interfaces := map[layers.LinkType]int{}
+	addInterface := func(linkType layers.LinkType) error {
+		if _, ok := interfaces[linkType]; ok {
+			return nil
+		}
+		intf := pcapgo.DefaultNgInterface
+		intf.Name = linkType.String()
+		intf.LinkType = linkType
+		if ngWriter == nil {
+			nw, err := pcapgo.NewNgWriterInterface(w, intf, options)
+			if err != nil {
+				return err
+			}
+			ngWriter = nw
+			interfaces[linkType] = 0
+			return nil
+		}
+		id, err := ngWriter.AddInterface(intf)
+		if err != nil {
+			return err
+		}
+		interfaces[linkType] = id
+		return nil
+	}
+
+	readers := exportReaders{}
+	defer func() {
+		for _, r := range readers {
+			r.holder.Close()
+		}
+	}()
+	for {
+		// open all pcaps that might contain the next packet
+		for len(pcaps) != 0 && (len(readers) == 0 || !readers[0].ci.Timestamp.Before(pcaps[0].firstPacket)) {
+			p := pcaps[0]
+			pcaps = pcaps[1:]
+			r := &exportReader{
+				holder:        tools.NewSeekablePcapHolder(filepath.Join(pcapDir, p.filename)),
+				packetIndexes: p.packetIndexes,
+			}
+			ok, err := r.next()
+			if err != nil || !ok {
+				r.holder.Close()
+				if err != nil {
+					return fmt.Errorf("reading %q failed: %w", p.filename, err)
+				}
+				continue
+			}
+			heap.Push(&readers, r)
+		}
+		if len(readers) == 0 {
+			break
+		}
+		r := readers[0]
+		if err := addInterface(r.linkType); err != nil {
+			return err
+		}
+		ci := r.ci
+		ci.InterfaceIndex = interfaces[r.linkType]
+		if err := ngWriter.WritePacket(ci, r.data); err != nil {
+			return fmt.Errorf("WritePacket failed: %w", err)
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&readers, 0)
+			continue
+		}
+		heap.Pop(&readers)
+		r.holder.Close()
+		if err := ngWriter.Flush(); err != nil {
+			return err
+		}
+		flush()
+	}
+	if ngWriter == nil {
+		// nothing matched, still produce a valid file
+		if err := addInterface(layers.LinkTypeEthernet); err != nil {
+			return err
+		}
+	}
+	return ngWriter.Flush()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+func TestDownloadSearchPcapng(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.ImportPcaps([]string{
+		writeTestPcap(t, dirs.pcap, "a.pcap", layers.LinkTypeIPv4, start, 1000),
+		writeTestPcap(t, dirs.pcap, "b.pcap", layers.LinkTypeEthernet, start.Add(500*time.Millisecond), 2000),
+	})
+	for deadline := time.Now().Add(10 * time.Second); mgr.Status().StreamCount != 8; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pcaps were not imported: %+v", mgr.Status())
+		}
+	}
+	r := setupRouter(mgr, nil, nil)
+
+	for _, tc := range []struct {
+		query string
+		want  []layers.LinkType
+	}{
+		{"sport:4321", []layers.LinkType{
+			layers.LinkTypeIPv4, layers.LinkTypeEthernet,
+			layers.LinkTypeIPv4, layers.LinkTypeEthernet,
+			layers.LinkTypeIPv4, layers.LinkTypeEthernet,
+			layers.LinkTypeIPv4, layers.LinkTypeEthernet,
+		}},
+		{"cport:1001", []layers.LinkType{layers.LinkTypeIPv4}},
+		{"cport:2002", []layers.LinkType{layers.LinkTypeEthernet}},
+		{"cport:1", nil},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/download/search.pcapng?q="+url.QueryEscape(tc.query), nil)
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("GET /api/download/search.pcapng returned status code %d: %s", rr.Code, rr.Body.String())
+			}
+			ngReader, err := pcapgo.NewNgReader(rr.Body, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+			if err != nil {
+				t.Fatalf("NewNgReader failed with error: %v", err)
+			}
+			got := []layers.LinkType(nil)
+			last := time.Time{}
+			for {
+				_, ci, err := ngReader.ReadPacketData()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("ReadPacketData failed with error: %v", err)
+				}
+				if ci.Timestamp.Before(last) {
+					t.Errorf("packet at %v is written after packet at %v", ci.Timestamp, last)
+				}
+				last = ci.Timestamp
+				intf, err := ngReader.Interface(ci.InterfaceIndex)
+				if err != nil {
+					t.Fatalf("Interface(%d) failed with error: %v", ci.InterfaceIndex, err)
+				}
+				got = append(got, intf.LinkType)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got packets with link types %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got packets with link types %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/download/search.pcapng?q=sport:", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("GET /api/download/search.pcapng with invalid query returned status code %d, want 400", rr.Code)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spq/pkappa2/internal/index"
+	"github.com/spq/pkappa2/internal/index/builder"
+	"github.com/spq/pkappa2/internal/index/manager"
+	"github.com/spq/pkappa2/internal/tools"
+)
+
+// fsckMain implements the fsck subcommand, it must not be used while
+// another pkappa2 instance uses the same directories.
+func fsckMain(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "Remove broken snapshot and state files")
+	rebuildAll := fs.Bool("rebuild-all", false, "Like -repair, but also rebuild all indexes from the pcaps if one is broken, which assigns new stream ids and clears marks, generated tags and converter caches")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] fsck [-repair] [-rebuild-all]\n\nVerifies the index, snapshot and state files. Stop pkappa2 before running this command.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	ok, err := fsck(
+		filepath.Join(*baseDir, *pcapDir),
+		filepath.Join(*baseDir, *indexDir),
+		filepath.Join(*baseDir, *snapshotDir),
+		filepath.Join(*baseDir, *stateDir),
+		*repair,
+		*rebuildAll,
+		os.Stdout,
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %v\n", err)
+		return 2
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// fsck verifies all files in the given directories and reports the
+// problems found to out. It returns whether all files are consistent
+// after the optional repair. Broken indexes are only rebuilt if
+// rebuildAll is set, as all streams get new ids then.
+func fsck(pcapDir, indexDir, snapshotDir, stateDir string, repair, rebuildAll bool, out io.Writer) (bool, error) {
+	pcaps := map[string]struct{}{}
+	entries, err := os.ReadDir(pcapDir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && (strings.HasSuffix(e.Name(), ".pcap") || strings.HasSuffix(e.Name(), ".pcapng")) {
+			pcaps[e.Name()] = struct{}{}
+		}
+	}
+
+	// check the indexes one by one, then check their stream ids
+	indexFilenames, err := tools.ListFiles(indexDir, "idx")
+	if err != nil {
+		return false, err
+	}
+	brokenIndexes := 0
+	streamIndexes := map[uint64]string{}
+	overlaps := map[[2]string]int{}
+	for _, fn := range indexFilenames {
+		problems := index.Verify(fn)
+		for _, p := range problems {
+			fmt.Fprintf(out, "index %s: %v\n", filepath.Base(fn), p)
+		}
+		if len(problems) != 0 {
+			brokenIndexes++
+			continue
+		}
+		r, err := index.NewReader(fn)
+		if err != nil {
+			return false, err
+		}
+		for id := range r.StreamIDs() {
+			if other, ok := streamIndexes[id]; ok {
+				overlaps[[2]string{other, fn}]++
+			}
+			streamIndexes[id] = fn
+		}
+		if err := r.Close(); err != nil {
+			return false, err
+		}
+	}
+	overlappingFiles := slices.SortedFunc(maps.Keys(overlaps), func(a, b [2]string) int {
+		return cmp.Or(strings.Compare(a[0], b[0]), strings.Compare(a[1], b[1]))
+	})
+	for _, files := range overlappingFiles {
+		// newer indexes supersede older ones until they are merged
+		fmt.Fprintf(out, "note: indexes %s and %s overlap in %d streams\n", filepath.Base(files[0]), filepath.Base(files[1]), overlaps[files])
+	}
+
+	snapshotFilenames, err := tools.ListFiles(snapshotDir, "snap")
+	if err != nil {
+		return false, err
+	}
+	brokenSnapshots := []string(nil)
+	for _, fn := range snapshotFilenames {
+		problems := builder.VerifySnapshots(fn, pcaps)
+		for _, p := range problems {
+			fmt.Fprintf(out, "snapshot %s: %v\n", filepath.Base(fn), p)
+		}
+		if len(problems) != 0 {
+			brokenSnapshots = append(brokenSnapshots, fn)
+		}
+	}
+
+	stateFilenames, err := tools.ListFiles(stateDir, "state.json")
+	if err != nil {
+		return false, err
+	}
+	brokenStates := []string(nil)
+	for _, fn := range stateFilenames {
+		problems := manager.VerifyState(fn)
+		for _, p := range problems {
+			fmt.Fprintf(out, "state %s: %v\n", filepath.Base(fn), p)
+		}
+		if len(problems) != 0 {
+			brokenStates = append(brokenStates, fn)
+		}
+	}
+
+	consistent := brokenIndexes == 0 && len(brokenSnapshots) == 0 && len(brokenStates) == 0
+	if consistent {
+		fmt.Fprintf(out, "checked %d indexes, %d snapshots and %d state files, no problems found\n", len(indexFilenames), len(snapshotFilenames), len(stateFilenames))
+		return true, nil
+	}
+	if !repair && !rebuildAll {
+		fmt.Fprintf(out, "found %d broken indexes, %d broken snapshots and %d broken state files, run with -repair to fix the snapshots and state files or -rebuild-all to rebuild the indexes as well\n", brokenIndexes, len(brokenSnapshots), len(brokenStates))
+		return false, nil
+	}
+
+	// the broken state files are kept for manual inspection
+	for _, fn := range brokenStates {
+		if err := os.Rename(fn, fn+".broken"); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "renamed state %s to %s.broken\n", filepath.Base(fn), filepath.Base(fn))
+	}
+	for _, fn := range brokenSnapshots {
+		if err := os.Remove(fn); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "removed snapshot %s\n", filepath.Base(fn))
+	}
+	if brokenIndexes != 0 && !rebuildAll {
+		fmt.Fprintf(out, "%d broken indexes left, run with -rebuild-all to rebuild all indexes from the pcaps, which assigns new stream ids and clears marks, generated tags and converter caches\n", brokenIndexes)
+		return false, nil
+	}
+	if brokenIndexes != 0 {
+		// the streams of a broken index are unknown and might continue in
+		// other indexes, so all indexes have to be rebuilt and the streams
+		// get new ids in the process
+		indexes, err := builder.Rebuild(pcapDir, indexDir, snapshotDir)
+		if err != nil {
+			return false, err
+		}
+		for _, idx := range indexes {
+			if err := idx.Close(); err != nil {
+				return false, err
+			}
+		}
+		// the snapshot written by the rebuild is the only valid one now
+		for _, fn := range snapshotFilenames {
+			if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+		}
+		for _, fn := range indexFilenames {
+			if err := os.Remove(fn); err != nil {
+				return false, err
+			}
+		}
+		fmt.Fprintf(out, "rebuilt %d indexes from %d pcaps\n", len(indexes), len(pcaps))
+
+		// everything referring to the old stream ids is dropped, the
+		// streams are converted and tagged again
+		cacheFilenames, err := tools.ListFiles(indexDir, "cidx")
+		if err != nil {
+			return false, err
+		}
+		for _, fn := range cacheFilenames {
+			if err := os.Remove(fn); err != nil {
+				return false, err
+			}
+		}
+		for _, fn := range stateFilenames {
+			if slices.Contains(brokenStates, fn) {
+				continue
+			}
+			if err := manager.ForgetStreamIDs(fn); err != nil {
+				return false, err
+			}
+		}
+		fmt.Fprintf(out, "removed %d converter caches and all marked streams, generated tags and tag matches\n", len(cacheFilenames))
+	}
+	return true, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+	"github.com/spq/pkappa2/internal/index/manager"
+	"github.com/spq/pkappa2/internal/tools"
+)
+
+// writeTestPcap writes a pcap with four udp streams, one packet per second
+// starting at start, from the ports firstPort to firstPort+3.
+func writeTestPcap(t *testing.T, dir, filename string, linkType layers.LinkType, start time.Time, firstPort uint16) string {
+	return writeTestPcapPayloads(t, dir, filename, linkType, start, firstPort, []string{"foo", "foo", "foo", "foo"})
+}
+
+// writeTestPcapPayloads works like writeTestPcap, but writes a udp stream
+// for every payload.
+func writeTestPcapPayloads(t *testing.T, dir, filename string, linkType layers.LinkType, start time.Time, firstPort uint16, payloads []string) string {
+	f, err := os.Create(path.Join(dir, filename))
+	if err != nil {
+		t.Fatalf("Create failed with error: %v", err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65536, linkType); err != nil {
+		t.Fatalf("WriteFileHeader failed with error: %v", err)
+	}
+	for i, payload := range payloads {
+		ip := layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			SrcIP:    []byte{1, 2, 3, 4},
+			DstIP:    []byte{4, 3, 2, 1},
+			Protocol: layers.IPProtocolUDP,
+		}
+		udp := layers.UDP{
+			SrcPort: layers.UDPPort(firstPort + uint16(i)),
+			DstPort: 4321,
+		}
+		if err := udp.SetNetworkLayerForChecksum(&ip); err != nil {
+			t.Fatalf("SetNetworkLayerForChecksum failed with error: %v", err)
+		}
+		serializableLayers := []gopacket.SerializableLayer{&ip, &udp, gopacket.Payload(payload)}
+		if linkType == layers.LinkTypeEthernet {
+			serializableLayers = append([]gopacket.SerializableLayer{&layers.Ethernet{
+				SrcMAC:       []byte{0, 0, 0, 0, 0, 1},
+				DstMAC:       []byte{0, 0, 0, 0, 0, 2},
+				EthernetType: layers.EthernetTypeIPv4,
+			}}, serializableLayers...)
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, serializableLayers...); err != nil {
+			t.Fatalf("SerializeLayers failed with error: %v", err)
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     start.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(buffer.Bytes()),
+			Length:        len(buffer.Bytes()),
+		}
+		if err := w.WritePacket(ci, buffer.Bytes()); err != nil {
+			t.Fatalf("WritePacket failed with error: %v", err)
+		}
+	}
+	return filename
+}
+
+func TestFsck(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	if err := mgr.AddTag("tag/foo", "red", "sport:4321"); err != nil {
+		mgr.Close()
+		t.Fatalf("AddTag failed with error: %v", err)
+	}
+	events, closer := mgr.Listen()
+	mgr.ImportPcaps([]string{writeTestPcap(t, dirs.pcap, "test.pcap", layers.LinkTypeIPv4, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), 1000)})
+	for e := range events {
+		if e.Type == "pcapProcessed" {
+			break
+		}
+	}
+	closer()
+	if err := mgr.AddTag("mark/bar", "blue", "id:1,2"); err != nil {
+		mgr.Close()
+		t.Fatalf("AddTag failed with error: %v", err)
+	}
+	mgr.Close()
+
+	check := func(repair, rebuildAll, wantOK bool, wantOutput string) {
+		t.Helper()
+		out := bytes.Buffer{}
+		ok, err := fsck(dirs.pcap, dirs.index, dirs.snapshot, dirs.state, repair, rebuildAll, &out)
+		if err != nil {
+			t.Fatalf("fsck failed with error: %v", err)
+		}
+		if ok != wantOK || !strings.Contains(out.String(), wantOutput) {
+			t.Fatalf("fsck(repair=%v, rebuildAll=%v) = %v with output %q, want %v with %q", repair, rebuildAll, ok, out.String(), wantOK, wantOutput)
+		}
+	}
+	check(false, false, true, "checked 1 indexes, 1 snapshots and 1 state files, no problems found")
+
+	// simulate an interrupted Writer.Finalize and a broken state file
+	indexes, err := tools.ListFiles(dirs.index, "idx")
+	if err != nil || len(indexes) != 1 {
+		t.Fatalf("ListFiles = %v, %v, want one index", indexes, err)
+	}
+	data, err := os.ReadFile(indexes[0])
+	if err != nil {
+		t.Fatalf("ReadFile failed with error: %v", err)
+	}
+	clear(data[:16])
+	if err := os.WriteFile(indexes[0], data, 0644); err != nil {
+		t.Fatalf("WriteFile failed with error: %v", err)
+	}
+	if err := os.WriteFile(path.Join(dirs.state, "broken.state.json"), []byte(`{"Tags": [{"Name": "tag/bar", "Definition": "tag:baz"}]`), 0644); err != nil {
+		t.Fatalf("WriteFile failed with error: %v", err)
+	}
+	check(false, false, false, "found 1 broken indexes, 0 broken snapshots and 1 broken state files")
+	// repairing keeps the indexes and the stream ids
+	check(true, false, false, "1 broken indexes left, run with -rebuild-all")
+	if _, err := os.Stat(path.Join(dirs.state, "broken.state.json.broken")); err != nil {
+		t.Errorf("broken state file was not renamed: %v", err)
+	}
+	if got, err := tools.ListFiles(dirs.index, "idx"); err != nil || !slices.Equal(got, indexes) {
+		t.Errorf("ListFiles = %v, %v, want the broken index %v to be kept", got, err, indexes)
+	}
+	check(false, true, true, "rebuilt 1 indexes from 1 pcaps")
+	check(false, false, true, "no problems found")
+
+	mgr = makeManager(t, dirs)
+	defer mgr.Close()
+	if got := mgr.Status(); got.IndexCount != 1 || got.StreamCount != 4 {
+		t.Errorf("Status() = %+v, want 1 index with 4 streams", got)
+	}
+	// the marked stream ids referred to the streams before the rebuild
+	tags := mgr.ListTags()
+	if i := slices.IndexFunc(tags, func(tag manager.TagInfo) bool { return tag.Name == "mark/bar" }); i == -1 || tags[i].MatchingCount != 0 {
+		t.Errorf("ListTags() = %+v, want an empty mark/bar", tags)
+	}
+}
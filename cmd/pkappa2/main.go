@@ -3,16 +3,20 @@ package main
 import (
 	"bufio"
 	"container/ring"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -22,13 +26,14 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/gopacket/gopacket/pcap"
 	"github.com/gopacket/gopacket/pcapgo"
 	"github.com/gorilla/websocket"
 	"github.com/spq/pkappa2/internal/index"
+	"github.com/spq/pkappa2/internal/index/converters"
 	"github.com/spq/pkappa2/internal/index/manager"
 	"github.com/spq/pkappa2/internal/query"
 	"github.com/spq/pkappa2/internal/tools"
+	filecarver "github.com/spq/pkappa2/internal/tools/fileCarver"
 	"github.com/spq/pkappa2/web"
 )
 
@@ -42,6 +47,9 @@ const (
 
 	// Send pings to client with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Maximum size of the stream posted to test a converter with.
+	maxConverterTestInputSize = 64 << 20
 )
 
 var (
@@ -52,6 +60,7 @@ var (
 	stateDir     = flag.String("state_dir", "", "Path where state files will be stored")
 	converterDir = flag.String("converter_dir", "./converters", "Path where converter executables are searched")
 	watchDir     = flag.String("watch_dir", "", "Path where new pcap files are searched and imported")
+	tlsKeyLog    = flag.String("tls_keylog_file", "", "Path of a SSLKEYLOGFILE whose TLS secrets are used by the tlsdecrypt converter")
 
 	userPassword = flag.String("user_password", "", "HTTP auth password for users")
 	pcapPassword = flag.String("pcap_password", "", "HTTP auth password for pcaps (/upload endpoint)")
@@ -61,6 +70,24 @@ var (
 	startupCpuprofile = flag.String("startup_cpuprofile", "", "write cpu profile to file")
 )
 
+// selectConverter maps the converter parameter of the stream endpoints
+// to the name of a converter, the empty name selects the raw data.
+func selectConverter(converter string, converters []string) (string, error) {
+	switch converter {
+	case "auto":
+		if len(converters) == 1 {
+			return converters[0], nil
+		}
+		return "", nil
+	case "none":
+		return "", nil
+	}
+	if !strings.HasPrefix(converter, "converter:") {
+		return "", fmt.Errorf("invalid converter %q", converter)
+	}
+	return converter[len("converter:"):], nil
+}
+
 func setupRouter(mgr *manager.Manager, stderrRing *ring.Ring, stderrLock *sync.RWMutex) *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.SetHeader("Access-Control-Allow-Origin", "*"))
@@ -162,7 +189,8 @@ func setupRouter(mgr *manager.Manager, stderrRing *ring.Ring, stderrLock *sync.R
 			return
 		}
 
-		var config manager.Config
+		// fields missing in the request keep their current value
+		config := mgr.Config()
 		if err = json.Unmarshal([]byte(body), &config); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -325,6 +353,107 @@ func setupRouter(mgr *manager.Manager, stderrRing *ring.Ring, stderrLock *sync.R
 			http.Error(w, fmt.Sprintf("reset failed: %v", err), http.StatusBadRequest)
 		}
 	})
+	rUser.Post("/api/converters/{name}/test", func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		var input *converters.TestInput
+		if s := r.URL.Query()["stream"]; len(s) != 0 {
+			streamID, err := strconv.ParseUint(s[0], 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid stream id %q failed: %v", s[0], err), http.StatusBadRequest)
+				return
+			}
+			v := mgr.GetView()
+			defer v.Release()
+			streamContext, err := v.Stream(streamID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Stream(%d) failed: %v", streamID, err), http.StatusInternalServerError)
+				return
+			}
+			if streamContext.Stream() == nil {
+				http.Error(w, fmt.Sprintf("Stream(%d) not found", streamID), http.StatusNotFound)
+				return
+			}
+			streamTags, err := streamContext.ConverterTags(name)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("ConverterTags(%q) failed: %v", name, err), http.StatusInternalServerError)
+				return
+			}
+			if input, err = converters.NewTestInput(streamContext.Stream(), streamTags); err != nil {
+				http.Error(w, fmt.Sprintf("NewTestInput() failed: %v", err), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			var err error
+			if input, err = converters.ParseTestInput(http.MaxBytesReader(w, r.Body, maxConverterTestInputSize)); err != nil {
+				if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		result, err := mgr.TestConverter(name, input)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("test failed: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			http.Error(w, fmt.Sprintf("Encode failed: %v", err), http.StatusInternalServerError)
+		}
+	})
+	rUser.Get("/api/remote-converters", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(mgr.ListRemoteConverters()); err != nil {
+			http.Error(w, fmt.Sprintf("Encode failed: %v", err), http.StatusInternalServerError)
+		}
+	})
+	rUser.Delete("/api/remote-converters", func(w http.ResponseWriter, r *http.Request) {
+		n := r.URL.Query()["name"]
+		if len(n) != 1 || n[0] == "" {
+			http.Error(w, "`name` parameter missing", http.StatusBadRequest)
+			return
+		}
+		if err := mgr.DelRemoteConverter(n[0]); err != nil {
+			http.Error(w, fmt.Sprintf("delete failed: %v", err), http.StatusBadRequest)
+			return
+		}
+	})
+	rUser.Put("/api/remote-converters", func(w http.ResponseWriter, r *http.Request) {
+		n := r.URL.Query()["name"]
+		if len(n) != 1 || n[0] == "" {
+			http.Error(w, "`name` parameter missing or empty", http.StatusBadRequest)
+			return
+		}
+		a := r.URL.Query()["address"]
+		if len(a) != 1 || a[0] == "" {
+			http.Error(w, "`address` parameter missing or empty", http.StatusBadRequest)
+			return
+		}
+		if err := mgr.AddRemoteConverter(n[0], a[0]); err != nil {
+			http.Error(w, fmt.Sprintf("add failed: %v", err), http.StatusBadRequest)
+			return
+		}
+	})
+	rUser.Get("/api/tls/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if err := mgr.WriteTLSKeys(w); err != nil {
+			http.Error(w, fmt.Sprintf("Write failed: %v", err), http.StatusInternalServerError)
+		}
+	})
+	rUser.Post("/api/tls/keys", func(w http.ResponseWriter, r *http.Request) {
+		added, err := mgr.AddTLSKeys(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("added %d keys: %v", added, err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct{ Added int }{added}); err != nil {
+			http.Error(w, fmt.Sprintf("Encode failed: %v", err), http.StatusInternalServerError)
+		}
+	})
 	rUser.Get(`/api/download/pcap/{file:[^/\\]+[.]pcap}`, func(w http.ResponseWriter, r *http.Request) {
 		filename := chi.URLParam(r, "file")
 		if filename != filepath.Base(filename) {
@@ -382,39 +511,83 @@ func setupRouter(mgr *manager.Manager, stderrRing *ring.Ring, stderrLock *sync.R
 		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
 		pcapProducer := pcapgo.NewWriterNanos(w)
 		for i, fn := range usedPcapFiles {
-			handle, err := pcap.OpenOffline(filepath.Join(mgr.PcapDir, fn))
-			if err != nil {
-				http.Error(w, fmt.Sprintf("OpenOffline failed: %v", err), http.StatusInternalServerError)
-				return
-			}
-			defer handle.Close()
-			if i == 0 {
-				if err := pcapProducer.WriteFileHeader(uint32(handle.SnapLen()), handle.LinkType()); err != nil {
-					http.Error(w, fmt.Sprintf("WriteFileHeader failed: %v", err), http.StatusInternalServerError)
+			holder := tools.NewSeekablePcapHolder(filepath.Join(mgr.PcapDir, fn))
+			defer holder.Close()
+			for j, p := range pcapFiles[fn] {
+				data, ci, linkType, err := holder.PacketData(p)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("PacketData failed: %v", err), http.StatusInternalServerError)
 					return
 				}
-			}
-			pos := uint64(0)
-			for _, p := range pcapFiles[fn] {
-				for {
-					data, ci, err := handle.ReadPacketData()
-					if err != nil {
-						http.Error(w, fmt.Sprintf("ReadPacketData failed: %v", err), http.StatusInternalServerError)
-						return
-					}
-					pos++
-					if p != pos-1 {
-						continue
-					}
-					if err := pcapProducer.WritePacket(ci, data); err != nil {
-						http.Error(w, fmt.Sprintf("WritePacket failed: %v", err), http.StatusInternalServerError)
+				if i == 0 && j == 0 {
+					// use the maximum snaplen of libpcap, the pcaps might use different ones
+					if err := pcapProducer.WriteFileHeader(262144, linkType); err != nil {
+						http.Error(w, fmt.Sprintf("WriteFileHeader failed: %v", err), http.StatusInternalServerError)
 						return
 					}
-					break
+				}
+				if err := pcapProducer.WritePacket(ci, data); err != nil {
+					http.Error(w, fmt.Sprintf("WritePacket failed: %v", err), http.StatusInternalServerError)
+					return
 				}
 			}
 		}
 	})
+	rUser.Get(`/api/download/search.pcapng`, func(w http.ResponseWriter, r *http.Request) {
+		qs := r.URL.Query()["q"]
+		if len(qs) != 1 {
+			http.Error(w, "Missing query", http.StatusBadRequest)
+			return
+		}
+		qq, err := query.Parse(qs[0])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+			return
+		}
+		knownPcaps := map[string]time.Time{}
+		for _, kp := range mgr.KnownPcaps() {
+			knownPcaps[kp.Filename] = kp.PacketTimestampMin
+		}
+		pcapFiles := map[string][]uint64{}
+		v := mgr.GetView()
+		defer v.Release()
+		if _, _, _, err := v.SearchStreams(r.Context(), qq, func(c manager.StreamContext) error {
+			packets, err := c.Stream().Packets()
+			if err != nil {
+				return err
+			}
+			for _, p := range packets {
+				if _, ok := knownPcaps[p.PcapFilename]; !ok {
+					return fmt.Errorf("unknown pcap %q referenced", p.PcapFilename)
+				}
+				pcapFiles[p.PcapFilename] = append(pcapFiles[p.PcapFilename], p.PcapIndex)
+			}
+			return nil
+		}); err != nil {
+			http.Error(w, fmt.Sprintf("SearchStreams failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		pcaps := []exportedPcap{}
+		for fn, packetIndexes := range pcapFiles {
+			slices.Sort(packetIndexes)
+			pcaps = append(pcaps, exportedPcap{
+				filename:      fn,
+				firstPacket:   knownPcaps[fn],
+				packetIndexes: slices.Compact(packetIndexes),
+			})
+		}
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Content-Disposition", `attachment; filename="search.pcapng"`)
+		flush := func() {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		if err := writeMergedPcapng(w, flush, mgr.PcapDir, pcaps); err != nil {
+			// the response was already started, so it's only truncated
+			log.Printf("Exporting pcapng for query %q failed: %v", qs[0], err)
+		}
+	})
 	rUser.Get(`/api/stream/{stream:\d+}.json`, func(w http.ResponseWriter, r *http.Request) {
 		streamIDStr := chi.URLParam(r, "stream")
 		streamID, err := strconv.ParseUint(streamIDStr, 10, 64)
@@ -442,21 +615,10 @@ func setupRouter(mgr *manager.Manager, stderrRing *ring.Ring, stderrLock *sync.R
 			http.Error(w, fmt.Sprintf("AllConverters() failed: %v", err), http.StatusInternalServerError)
 			return
 		}
-		switch converter {
-		case "auto":
-			if len(converters) == 1 {
-				converter = converters[0]
-			} else {
-				converter = ""
-			}
-		case "none":
-			converter = ""
-		default:
-			if !strings.HasPrefix(converter, "converter:") {
-				http.Error(w, fmt.Sprintf("invalid converter %q", converter), http.StatusBadRequest)
-				return
-			}
-			converter = converter[len("converter:"):]
+		converter, err = selectConverter(converter, converters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 		data, err := streamContext.Data(converter)
 		if err != nil {
@@ -489,6 +651,254 @@ func setupRouter(mgr *manager.Manager, stderrRing *ring.Ring, stderrLock *sync.R
 			return
 		}
 	})
+	rUser.Get(`/api/stream/{stream:\d+}/raw`, func(w http.ResponseWriter, r *http.Request) {
+		streamIDStr := chi.URLParam(r, "stream")
+		streamID, err := strconv.ParseUint(streamIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid stream id %q failed: %v", streamIDStr, err), http.StatusBadRequest)
+			return
+		}
+		directions := map[index.Direction]bool{}
+		dir := "both"
+		if f := r.URL.Query()["dir"]; len(f) == 1 {
+			dir = f[0]
+		}
+		switch dir {
+		case "client":
+			directions[index.DirectionClientToServer] = true
+		case "server":
+			directions[index.DirectionServerToClient] = true
+		case "both":
+			directions[index.DirectionClientToServer] = true
+			directions[index.DirectionServerToClient] = true
+		default:
+			http.Error(w, fmt.Sprintf("invalid direction %q", dir), http.StatusBadRequest)
+			return
+		}
+		// with framing, every chunk is prefixed by its direction as one
+		// byte and its length as big endian uint32
+		framing := "none"
+		if f := r.URL.Query()["framing"]; len(f) == 1 {
+			framing = f[0]
+		}
+		if framing != "none" && framing != "chunks" {
+			http.Error(w, fmt.Sprintf("invalid framing %q", framing), http.StatusBadRequest)
+			return
+		}
+		v := mgr.GetView()
+		defer v.Release()
+		streamContext, err := v.Stream(streamID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Stream(%d) failed: %v", streamID, err), http.StatusInternalServerError)
+			return
+		}
+		if streamContext.Stream() == nil {
+			http.Error(w, fmt.Sprintf("stream %d not found", streamID), http.StatusNotFound)
+			return
+		}
+		converter := "none"
+		if f := r.URL.Query()["converter"]; len(f) == 1 {
+			converter = f[0]
+		}
+		converters, err := streamContext.AllConverters()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("AllConverters() failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		converter, err = selectConverter(converter, converters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := streamContext.Data(converter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Data(%q) failed: %v", converter, err), http.StatusInternalServerError)
+			return
+		}
+		raw := []byte(nil)
+		for _, d := range index.DataChunks(data) {
+			if !directions[d.Direction] {
+				continue
+			}
+			if framing == "chunks" {
+				raw = append(raw, byte(d.Direction))
+				raw = binary.BigEndian.AppendUint32(raw, uint32(len(d.Content)))
+			}
+			raw = append(raw, d.Content...)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="stream-%d-%s.bin"`, streamID, dir))
+		w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+		if _, err := w.Write(raw); err != nil {
+			log.Printf("Sending raw data of stream %d failed: %v", streamID, err)
+		}
+	})
+	// streamFiles returns the files carved from a stream of the view, it
+	// writes the error response itself and returns false on failure
+	streamFiles := func(w http.ResponseWriter, v *manager.View, streamID uint64) (*index.Stream, []index.File, bool) {
+		streamContext, err := v.Stream(streamID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Stream(%d) failed: %v", streamID, err), http.StatusInternalServerError)
+			return nil, nil, false
+		}
+		stream := streamContext.Stream()
+		if stream == nil {
+			http.Error(w, fmt.Sprintf("stream %d not found", streamID), http.StatusNotFound)
+			return nil, nil, false
+		}
+		files, err := stream.Files()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Files() failed: %v", err), http.StatusInternalServerError)
+			return nil, nil, false
+		}
+		return stream, files, true
+	}
+	rUser.Get(`/api/stream/{stream:\d+}/files`, func(w http.ResponseWriter, r *http.Request) {
+		streamIDStr := chi.URLParam(r, "stream")
+		streamID, err := strconv.ParseUint(streamIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid stream id %q failed: %v", streamIDStr, err), http.StatusBadRequest)
+			return
+		}
+		v := mgr.GetView()
+		defer v.Release()
+		_, files, ok := streamFiles(w, &v, streamID)
+		if !ok {
+			return
+		}
+		type file struct {
+			Index     int
+			Name      string
+			MIMEType  string
+			Size      uint64
+			Direction index.Direction
+			Source    filecarver.Source
+			URL       string
+		}
+		response := []file{}
+		for i, f := range files {
+			response = append(response, file{
+				Index:     i,
+				Name:      f.Name,
+				MIMEType:  f.MIMEType,
+				Size:      f.Size,
+				Direction: f.Direction,
+				Source:    f.Source,
+				URL:       fmt.Sprintf("/api/stream/%d/files/%d", streamID, i),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, fmt.Sprintf("Encode failed: %v", err), http.StatusInternalServerError)
+		}
+	})
+	rUser.Get(`/api/stream/{stream:\d+}/files/{file:\d+}`, func(w http.ResponseWriter, r *http.Request) {
+		streamIDStr := chi.URLParam(r, "stream")
+		streamID, err := strconv.ParseUint(streamIDStr, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid stream id %q failed: %v", streamIDStr, err), http.StatusBadRequest)
+			return
+		}
+		fileIndexStr := chi.URLParam(r, "file")
+		fileIndex, err := strconv.Atoi(fileIndexStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid file index %q failed: %v", fileIndexStr, err), http.StatusBadRequest)
+			return
+		}
+		v := mgr.GetView()
+		defer v.Release()
+		stream, files, ok := streamFiles(w, &v, streamID)
+		if !ok {
+			return
+		}
+		if fileIndex >= len(files) {
+			http.Error(w, fmt.Sprintf("file %d of stream %d not found", fileIndex, streamID), http.StatusNotFound)
+			return
+		}
+		f := files[fileIndex]
+		data, err := stream.FileData(f)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("FileData() failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		// the carved content is untrusted, its MIME type is only part of
+		// the file listing
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Name}))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if _, err := w.Write(data); err != nil {
+			log.Printf("Sending file %d of stream %d failed: %v", fileIndex, streamID, err)
+		}
+	})
+	rUser.Get("/api/diff.json", func(w http.ResponseWriter, r *http.Request) {
+		converter := "none"
+		if f := r.URL.Query()["converter"]; len(f) == 1 {
+			converter = f[0]
+		}
+		type side struct {
+			Stream          *index.Stream
+			ActiveConverter string
+		}
+		sides := [2]side{}
+		data := [2][]index.Data{}
+		v := mgr.GetView()
+		defer v.Release()
+		for i, param := range []string{"a", "b"} {
+			f := r.URL.Query()[param]
+			if len(f) != 1 {
+				http.Error(w, fmt.Sprintf("missing parameter %q", param), http.StatusBadRequest)
+				return
+			}
+			streamID, err := strconv.ParseUint(f[0], 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid stream id %q failed: %v", f[0], err), http.StatusBadRequest)
+				return
+			}
+			streamContext, err := v.Stream(streamID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Stream(%d) failed: %v", streamID, err), http.StatusInternalServerError)
+				return
+			}
+			if streamContext.Stream() == nil {
+				http.Error(w, fmt.Sprintf("stream %d not found", streamID), http.StatusNotFound)
+				return
+			}
+			converters, err := streamContext.AllConverters()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("AllConverters() failed: %v", err), http.StatusInternalServerError)
+				return
+			}
+			activeConverter, err := selectConverter(converter, converters)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data[i], err = streamContext.Data(activeConverter)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Data(%q) failed: %v", activeConverter, err), http.StatusInternalServerError)
+				return
+			}
+			sides[i] = side{
+				Stream:          streamContext.Stream(),
+				ActiveConverter: activeConverter,
+			}
+		}
+		response := struct {
+			A, B   side
+			Chunks []index.DiffChunk
+		}{
+			A:      sides[0],
+			B:      sides[1],
+			Chunks: index.DiffData(index.DataChunks(data[0]), index.DataChunks(data[1])),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, fmt.Sprintf("Encode failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	})
 	rUser.Post("/api/search.json", func(w http.ResponseWriter, r *http.Request) {
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -1012,9 +1422,23 @@ func main() {
 	flag.Usage = func() {
 		oldUsage()
 		fmt.Println("Flags can also be set via environment variables prefixed with PKAPPA2_")
+		fmt.Println("Commands:")
+		fmt.Println("  fsck\tverify and repair the index, snapshot and state files")
+		fmt.Println("  query\tsearch the indexes without starting the server")
 	}
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "":
+	case "fsck":
+		os.Exit(fsckMain(flag.Args()[1:]))
+	case "query":
+		os.Exit(queryMain(flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	if *startupCpuprofile != "" {
 		f, err := os.Create(*startupCpuprofile)
 		if err != nil {
@@ -1039,6 +1463,11 @@ func main() {
 		log.Fatalf("manager.New failed: %v", err)
 	}
 	defer mgr.Close()
+	if *tlsKeyLog != "" {
+		if err := mgr.WatchTLSKeyLogFile(*tlsKeyLog); err != nil {
+			log.Fatalf("Manager.WatchTLSKeyLogFile failed: %v", err)
+		}
+	}
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
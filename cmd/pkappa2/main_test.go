@@ -9,11 +9,14 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gopacket/gopacket/layers"
 	"github.com/gorilla/websocket"
+	"github.com/spq/pkappa2/internal/index/converters"
 	"github.com/spq/pkappa2/internal/index/manager"
 )
 
@@ -157,6 +160,119 @@ func TestStatus(t *testing.T) {
 	// TODO: Add pcaps and check the status
 }
 
+func TestStreamRaw(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.ImportPcaps([]string{
+		writeTestPcap(t, dirs.pcap, "a.pcap", layers.LinkTypeIPv4, start, 1000),
+	})
+	for deadline := time.Now().Add(10 * time.Second); mgr.Status().StreamCount != 4; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pcap was not imported: %+v", mgr.Status())
+		}
+	}
+	r := setupRouter(mgr, nil, nil)
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"", http.StatusOK, "foo"},
+		{"?dir=client", http.StatusOK, "foo"},
+		{"?dir=server", http.StatusOK, ""},
+		{"?dir=both&framing=chunks", http.StatusOK, "\x00\x00\x00\x00\x03foo"},
+		{"?converter=none&framing=none", http.StatusOK, "foo"},
+		{"?dir=foo", http.StatusBadRequest, ""},
+		{"?framing=foo", http.StatusBadRequest, ""},
+		{"?converter=foo", http.StatusBadRequest, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/stream/0/raw"+tc.query, nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("GET /api/stream/0/raw%s returned status code %d, want %d", tc.query, rr.Code, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if got := rr.Body.String(); got != tc.want {
+			t.Errorf("GET /api/stream/0/raw%s returned %q, want %q", tc.query, got, tc.want)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/octet-stream" {
+			t.Errorf("GET /api/stream/0/raw%s returned content type %q", tc.query, ct)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stream/1234/raw", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET /api/stream/1234/raw returned status code %d, want 404", rr.Code)
+	}
+}
+
+func TestStreamFiles(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.ImportPcaps([]string{
+		writeTestPcapPayloads(t, dirs.pcap, "a.pcap", layers.LinkTypeIPv4, start, 1000, []string{
+			"foo",
+			"<script>%PDF-1.4 <script>alert(1)</script> %%EOF",
+		}),
+	})
+	for deadline := time.Now().Add(10 * time.Second); mgr.Status().StreamCount != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pcap was not imported: %+v", mgr.Status())
+		}
+	}
+	r := setupRouter(mgr, nil, nil)
+
+	for _, tc := range []struct {
+		url  string
+		code int
+		want string
+	}{
+		{"/api/stream/0/files", http.StatusOK, "[]\n"},
+		{"/api/stream/0/files/0", http.StatusNotFound, ""},
+		{"/api/stream/1/files", http.StatusOK, `[{"Index":0,"Name":"client-8.pdf","MIMEType":"application/pdf","Size":40,"Direction":0,"Source":"magic","URL":"/api/stream/1/files/0"}]` + "\n"},
+		{"/api/stream/1/files/0", http.StatusOK, "%PDF-1.4 <script>alert(1)</script> %%EOF"},
+		{"/api/stream/1/files/1", http.StatusNotFound, ""},
+		{"/api/stream/1234/files", http.StatusNotFound, ""},
+		{"/api/stream/1234/files/0", http.StatusNotFound, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("GET %s returned status code %d, want %d", tc.url, rr.Code, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if got := rr.Body.String(); got != tc.want {
+			t.Errorf("GET %s returned %q, want %q", tc.url, got, tc.want)
+		}
+	}
+
+	// the carved content is never served with its own MIME type
+	req := httptest.NewRequest(http.MethodGet, "/api/stream/1/files/0", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Content-Type = %q, want application/octet-stream", got)
+	}
+	if got := rr.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+}
+
 func TestWebsocket(t *testing.T) {
 	dirs := makeTempdirs(t)
 	mgr := makeManager(t, dirs)
@@ -202,3 +318,111 @@ func TestWebsocket(t *testing.T) {
 		t.Fatalf("expected tag color '#ff0000', got '%s'", event.Tag.Color)
 	}
 }
+
+func TestConverterTest(t *testing.T) {
+	dirs := makeTempdirs(t)
+	scripts := map[string]string{
+		// echoes the chunks and logs the metadata
+		"echo": "#!/bin/sh\nread metadata\necho \"got $metadata\" >&2\nwhile read line && [ -n \"$line\" ]; do echo \"$line\"; done\necho\necho '{\"Tags\":[\"echoed\"]}'\n",
+		"fail": "#!/bin/sh\nread metadata\necho 'failed' >&2\nexit 3\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(path.Join(dirs.converter, name), []byte(script), 0775); err != nil {
+			t.Fatalf("WriteFile failed with error: %v", err)
+		}
+	}
+	if err := os.WriteFile(path.Join(dirs.converter, "echo64.pipeline"), []byte("echo base64\n"), 0664); err != nil {
+		t.Fatalf("WriteFile failed with error: %v", err)
+	}
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.ImportPcaps([]string{
+		writeTestPcap(t, dirs.pcap, "a.pcap", layers.LinkTypeIPv4, start, 1000),
+	})
+	for deadline := time.Now().Add(10 * time.Second); mgr.Status().StreamCount != 4; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pcap was not imported: %+v", mgr.Status())
+		}
+	}
+	r := setupRouter(mgr, nil, nil)
+
+	for _, tc := range []struct {
+		url, body string
+		code      int
+		content   string
+		stderr    string
+		exitCode  int
+	}{
+		{"/api/converters/echo/test?stream=0", "", http.StatusOK, "foo", `"StreamID":0`, 0},
+		{"/api/converters/echo/test", `{"Metadata":{"StreamID":42},"Chunks":[{"Direction":"client-to-server","Content":"YmFy"}]}`, http.StatusOK, "bar", `"StreamID":42`, 0},
+		{"/api/converters/fail/test", `{}`, http.StatusOK, "", "failed", 3},
+		{"/api/converters/echo/test?stream=1234", "", http.StatusNotFound, "", "", 0},
+		{"/api/converters/echo/test", `{"Chunks":[{"Direction":"up"}]}`, http.StatusBadRequest, "", "", 0},
+		{"/api/converters/missing/test", `{}`, http.StatusBadRequest, "", "", 0},
+		{"/api/converters/echo/test", `{"Metadata":{"Tags":["` + strings.Repeat("a", maxConverterTestInputSize) + `"]}}`, http.StatusRequestEntityTooLarge, "", "", 0},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("POST %s returned status code %d, want %d: %s", tc.url, rr.Code, tc.code, rr.Body.String())
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var result converters.TestResult
+		if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to unmarshal test result: %v", err)
+		}
+		if len(result.Stderr) != 1 || !strings.Contains(result.Stderr[0], tc.stderr) {
+			t.Errorf("POST %s returned stderr %q, want it to contain %q", tc.url, result.Stderr, tc.stderr)
+		}
+		if tc.exitCode != 0 {
+			if result.Error == "" || result.ExitCode == nil || *result.ExitCode != tc.exitCode {
+				t.Errorf("POST %s returned %+v, want an error and exit code %d", tc.url, result, tc.exitCode)
+			}
+			continue
+		}
+		if result.Error != "" || len(result.Chunks) != 1 || string(result.Chunks[0].Content) != tc.content || !reflect.DeepEqual(result.Tags, []string{"echoed"}) {
+			t.Errorf("POST %s returned %+v, want chunk %q and tag echoed", tc.url, result, tc.content)
+		}
+	}
+	// built-in converters and pipelines are tested without processes of
+	// their own
+	for _, tc := range []struct {
+		url     string
+		content string
+		stderr  []string
+		tags    []string
+	}{
+		{"/api/converters/base64/test", "flag: FLAG{test}!", []string{}, []string{}},
+		{"/api/converters/echo64/test", "flag: FLAG{test}!", []string{`"StreamID":0`}, []string{"echoed"}},
+	} {
+		body := `{"Chunks":[{"Direction":"client-to-server","Content":"ZmxhZzogUmt4QlIzdDBaWE4wZlE9PSE="}]}`
+		req := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("POST %s returned status code %d, want %d: %s", tc.url, rr.Code, http.StatusOK, rr.Body.String())
+			continue
+		}
+		var result converters.TestResult
+		if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to unmarshal test result: %v", err)
+		}
+		if result.Error != "" || len(result.Chunks) != 1 || string(result.Chunks[0].Content) != tc.content || !reflect.DeepEqual(result.Tags, tc.tags) {
+			t.Errorf("POST %s returned %+v, want chunk %q and tags %q", tc.url, result, tc.content, tc.tags)
+		}
+		if len(result.Stderr) != len(tc.stderr) || (len(tc.stderr) != 0 && !strings.Contains(result.Stderr[0], tc.stderr[0])) {
+			t.Errorf("POST %s returned stderr %q, want %q", tc.url, result.Stderr, tc.stderr)
+		}
+	}
+	// the results of test runs are not cached
+	if got := mgr.ListConverters(); !slices.ContainsFunc(got, func(s *converters.Statistics) bool {
+		return s.Name == "echo" && s.CachedStreamCount == 0 && len(s.Processes) == 0
+	}) {
+		t.Errorf("ListConverters() = %v, want echo without cached streams and processes", got)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spq/pkappa2/internal/index"
+	"github.com/spq/pkappa2/internal/index/manager"
+	"github.com/spq/pkappa2/internal/query"
+)
+
+type (
+	queryOptions struct {
+		format    string
+		data      bool
+		converter string
+		limit     uint
+	}
+	queryResult struct {
+		Stream *index.Stream
+		Tags   []string
+		Data   []index.Data `json:",omitempty"`
+	}
+)
+
+// queryMain implements the query subcommand, it only reads the index,
+// state and converter cache files.
+func queryMain(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	opts := queryOptions{}
+	fs.StringVar(&opts.format, "format", "table", "Output format, either table or jsonl")
+	fs.BoolVar(&opts.data, "data", false, "Print the stream data")
+	fs.StringVar(&opts.converter, "converter", "", "Print the output of this converter instead of the stream data, implies -data")
+	fs.UintVar(&opts.limit, "limit", 0, "Maximum number of results if the query has no limit, 0 means unlimited")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] query [-format table|jsonl] [-data] [-converter name] [-limit n] <query>\n\nSearches the indexes without starting the server.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || (opts.format != "table" && opts.format != "jsonl") {
+		fs.Usage()
+		return 2
+	}
+	v, err := manager.OpenView(
+		filepath.Join(*baseDir, *indexDir),
+		filepath.Join(*baseDir, *stateDir),
+		*converterDir,
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open indexes: %v\n", err)
+		return 1
+	}
+	defer v.Release()
+	if err := runQuery(context.Background(), v, strings.Join(fs.Args(), " "), opts, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runQuery searches the streams of the view and prints the results in the
+// requested format.
+func runQuery(ctx context.Context, v *manager.View, queryString string, opts queryOptions, out io.Writer) error {
+	qq, err := query.Parse(queryString)
+	if err != nil {
+		return err
+	}
+	if opts.converter != "" {
+		opts.data = true
+	}
+	var tw *tabwriter.Writer
+	enc := json.NewEncoder(out)
+	if opts.format == "table" {
+		tw = tabwriter.NewWriter(out, 0, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPROTOCOL\tCLIENT\tSERVER\tFIRST PACKET\tCLIENT BYTES\tSERVER BYTES\tTAGS")
+	}
+	_, _, _, err = v.SearchStreams(ctx, qq, func(c manager.StreamContext) error {
+		res := queryResult{
+			Stream: c.Stream(),
+		}
+		var err error
+		if res.Tags, err = c.AllTags(); err != nil {
+			return err
+		}
+		if opts.data {
+			if res.Data, err = c.Data(opts.converter); err != nil {
+				return err
+			}
+		}
+		if tw == nil {
+			return enc.Encode(res)
+		}
+		s := res.Stream
+		fmt.Fprintf(tw, "%d\t%s\t%s:%d\t%s:%d\t%s\t%d\t%d\t%s\n",
+			s.ID(), s.Protocol(), s.ClientHostIP(), s.ClientPort, s.ServerHostIP(), s.ServerPort,
+			s.FirstPacket().Local().Format("2006-01-02 15:04:05"), s.ClientBytes, s.ServerBytes, strings.Join(res.Tags, ","))
+		if !opts.data {
+			return nil
+		}
+		// the chunks are not aligned, flush the rows printed so far
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for _, d := range res.Data {
+			direction := "->"
+			if d.Direction == index.DirectionServerToClient {
+				direction = "<-"
+			}
+			if _, err := fmt.Fprintf(out, "  %s %q\n", direction, d.Content); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, manager.Limit(opts.limit, 0), manager.PrefetchAllTags())
+	if err != nil {
+		return err
+	}
+	if tw != nil {
+		return tw.Flush()
+	}
+	return nil
+}
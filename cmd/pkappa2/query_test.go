@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/spq/pkappa2/internal/index/manager"
+)
+
+func TestQuery(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	if err := mgr.AddTag("tag/foo", "red", "cport:1001"); err != nil {
+		mgr.Close()
+		t.Fatalf("AddTag failed with error: %v", err)
+	}
+	events, closer := mgr.Listen()
+	mgr.ImportPcaps([]string{writeTestPcap(t, dirs.pcap, "test.pcap", layers.LinkTypeIPv4, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), 1000)})
+	for e := range events {
+		if e.Type == "pcapProcessed" {
+			break
+		}
+	}
+	closer()
+	mgr.Close()
+
+	v, err := manager.OpenView(dirs.index, dirs.state, "")
+	if err != nil {
+		t.Fatalf("OpenView failed with error: %v", err)
+	}
+	defer v.Release()
+
+	out := bytes.Buffer{}
+	if err := runQuery(context.Background(), v, "sport:4321", queryOptions{format: "jsonl", data: true}, &out); err != nil {
+		t.Fatalf("runQuery failed with error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("runQuery returned %d results, want 4: %q", len(lines), out.String())
+	}
+	tagged := 0
+	for _, l := range lines {
+		res := struct {
+			Stream struct {
+				ID     uint64
+				Client struct {
+					Port uint16
+				}
+			}
+			Tags []string
+			Data []struct {
+				Content []byte
+			}
+		}{}
+		if err := json.Unmarshal([]byte(l), &res); err != nil {
+			t.Fatalf("Unmarshal(%q) failed with error: %v", l, err)
+		}
+		if len(res.Data) != 1 || string(res.Data[0].Content) != "foo" {
+			t.Errorf("stream %d has data %v, want foo", res.Stream.ID, res.Data)
+		}
+		if len(res.Tags) != 0 {
+			tagged++
+			if res.Stream.Client.Port != 1001 || res.Tags[0] != "tag/foo" {
+				t.Errorf("stream %d from port %d has tags %v", res.Stream.ID, res.Stream.Client.Port, res.Tags)
+			}
+		}
+	}
+	if tagged != 1 {
+		t.Errorf("%d streams are tagged, want 1", tagged)
+	}
+
+	out.Reset()
+	if err := runQuery(context.Background(), v, "tag:foo", queryOptions{format: "table"}, &out); err != nil {
+		t.Fatalf("runQuery failed with error: %v", err)
+	}
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "1.2.3.4:1001") {
+		t.Errorf("runQuery returned table %q, want a header and the stream from port 1001", out.String())
+	}
+
+	if err := runQuery(context.Background(), v, "sport:", queryOptions{format: "table"}, &out); err == nil {
+		t.Errorf("runQuery succeeded for an invalid query")
+	}
+}
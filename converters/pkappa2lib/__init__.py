@@ -2,7 +2,7 @@ import base64
 import datetime
 import json
 import sys
-from dataclasses import dataclass
+from dataclasses import dataclass, field
 from enum import Enum
 from typing import List, TypeAlias
 
@@ -29,6 +29,28 @@ class StreamMetadata:
     ServerHost: str
     ServerPort: int
     Protocol: Protocol
+    FirstPacket: datetime.datetime | None = None
+    LastPacket: datetime.datetime | None = None
+    ClientBytes: int = 0
+    ServerBytes: int = 0
+    # names of the tags, services and marks matching the stream
+    Tags: List[str] = field(default_factory=list)
+    Services: List[str] = field(default_factory=list)
+    Marks: List[str] = field(default_factory=list)
+    # pcap files containing the packets of the stream
+    Pcaps: List[str] = field(default_factory=list)
+
+
+def parse_time(value: str) -> datetime.datetime:
+    # Make sure there are 6 digits in the microseconds part
+    if "." in value:
+        time_parts = value.split(".")
+        if len(time_parts) == 2:
+            time_parts[1] = time_parts[1][:6].ljust(6, "0")
+        value = ".".join(time_parts)
+    else:
+        value += ".000000"
+    return datetime.datetime.strptime(value, "%Y-%m-%dT%H:%M:%S.%f")
 
 
 class ConverterDecoder(json.JSONDecoder):
@@ -41,18 +63,13 @@ class ConverterDecoder(json.JSONDecoder):
             obj["Protocol"] = Protocol.from_json(obj["Protocol"])
         if "Direction" in obj:
             obj["Direction"] = Direction.from_json(obj["Direction"])
+        if "Kind" in obj:
+            obj["Kind"] = ChunkKind.from_json(obj["Kind"])
         if "Content" in obj:
             obj["Content"] = base64.b64decode(obj["Content"])
-        if "Time" in obj:
-            # Make sure there are 6 digits in the microseconds part
-            if "." in obj["Time"]:
-                time_parts = obj["Time"].split(".")
-                if len(time_parts) == 2:
-                    time_parts[1] = time_parts[1].ljust(6, "0")
-                obj["Time"] = ".".join(time_parts)
-            obj["Time"] = datetime.datetime.strptime(
-                obj["Time"], "%Y-%m-%dT%H:%M:%S.%f"
-            )
+        for key in ("Time", "FirstPacket", "LastPacket"):
+            if key in obj:
+                obj[key] = parse_time(obj[key])
 
         return obj
 
@@ -67,6 +84,8 @@ class ConverterEncoder(json.JSONEncoder):
             }
             if o.ContentType:
                 json_streamchunk["ContentType"] = o.ContentType
+            if o.Kind != ChunkKind.DATA:
+                json_streamchunk["Kind"] = o.Kind.to_json()
             return json_streamchunk
 
         else:
@@ -98,12 +117,33 @@ class Direction(Enum):
 DirectionType: TypeAlias = Direction
 
 
+class ChunkKind(Enum):
+    # part of the converted traffic
+    DATA = "data"
+    # informative output like a script reproducing the stream
+    INFO = "info"
+    # remarks about the surrounding chunks
+    ANNOTATION = "annotation"
+
+    @staticmethod
+    def from_json(json_value):
+        try:
+            return ChunkKind(json_value)
+        except ValueError:
+            raise ValueError(f"Unknown chunk kind: {json_value}")
+
+    def to_json(self):
+        return self.value
+
+
 @dataclass
 class StreamChunk:
     Direction: DirectionType
     Content: bytes
     Time: datetime.datetime
     ContentType: str = ""
+    # INFO and ANNOTATION chunks are not searched by data queries
+    Kind: ChunkKind = ChunkKind.DATA
 
     def derive(
         self,
@@ -112,6 +152,7 @@ class StreamChunk:
         content: bytes | None = None,
         time: datetime.datetime | None = None,
         content_type: str | None = None,
+        kind: ChunkKind | None = None,
     ) -> "StreamChunk":
         """
         Derive a new StreamChunk with the given parameters.
@@ -122,6 +163,7 @@ class StreamChunk:
             Content=content if content is not None else self.Content,
             Time=time if time is not None else self.Time,
             ContentType=content_type if content_type is not None else self.ContentType,
+            Kind=kind if kind is not None else self.Kind,
         )
 
 
@@ -134,7 +176,7 @@ class Stream:
         """
         Coalesce chunks in the same direction into a single chunk.
         This method yields chunks where consecutive chunks in the same direction
-        are combined into a single chunk.
+        and of the same kind are combined into a single chunk.
 
         There can be multiple chunks in the same direction with differing Time.
         This method will yield a new chunk for each change in direction with the
@@ -144,7 +186,10 @@ class Stream:
             return
         current_chunk = self.Chunks[0]
         for chunk in self.Chunks[1:]:
-            if chunk.Direction == current_chunk.Direction:
+            if (
+                chunk.Direction == current_chunk.Direction
+                and chunk.Kind == current_chunk.Kind
+            ):
                 current_chunk.Content += chunk.Content
             else:
                 yield current_chunk
@@ -156,6 +201,11 @@ class Stream:
 @dataclass
 class Result:
     Chunks: List[StreamChunk]
+    # Names of generated/<name> tags the stream is added to
+    Tags: List[str] = field(default_factory=list)
+    # Refuses the stream, e.g. because it isn't supported, the failure is
+    # cached and the stream isn't converted again
+    Error: str = ""
 
 
 class Pkappa2Converter:
@@ -216,7 +266,13 @@ class Pkappa2Converter:
                     json.dump(chunk, sys.stdout, cls=ConverterEncoder)
                     print("")
                 print("")
-                print("{}", flush=True)
+                result_metadata = {}
+                if result.Tags:
+                    result_metadata["Tags"] = result.Tags
+                if result.Error:
+                    result_metadata["Error"] = result.Error
+                json.dump(result_metadata, sys.stdout)
+                print("", flush=True)
             except KeyboardInterrupt:
                 break
 
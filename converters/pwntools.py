@@ -1,6 +1,7 @@
 #!/usr/bin/env python3
 from datetime import datetime
 from pkappa2lib import (
+    ChunkKind,
     Direction,
     Pkappa2Converter,
     Protocol,
@@ -87,6 +88,7 @@ io = remote(sys.argv[1], {stream.Metadata.ServerPort}{typ})
                     Direction.CLIENTTOSERVER,
                     output.encode(),
                     stream.Chunks[0].Time if stream.Chunks else datetime.now(),
+                    Kind=ChunkKind.INFO,
                 )
             ]
         )
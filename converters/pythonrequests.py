@@ -3,7 +3,7 @@ from datetime import datetime
 from typing import List
 
 from http_gzip import HTTPConverter, HTTPRequest, HTTPResponse
-from pkappa2lib import Direction, Result, Stream, StreamChunk
+from pkappa2lib import ChunkKind, Direction, Result, Stream, StreamChunk
 
 
 class PythonRequestsConverter(HTTPConverter):
@@ -66,6 +66,7 @@ s = requests.Session()
                     Direction.CLIENTTOSERVER,
                     self.requests_output.encode(),
                     stream.Chunks[0].Time if stream.Chunks else datetime.now(),
+                    Kind=ChunkKind.INFO,
                 )
             ]
         )
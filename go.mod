@@ -8,6 +8,8 @@ require (
 	github.com/go-chi/chi/v5 v5.3.0
 	github.com/gopacket/gopacket v1.6.1
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/crypto v0.51.0
 	golang.org/x/sys v0.46.0
 	rsc.io/binaryregexp v0.2.0
 )
@@ -4,8 +4,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gopacket/gopacket"
@@ -22,7 +24,10 @@ import (
 
 type (
 	Builder struct {
-		snapshots        []*snapshot
+		snapshots []*snapshot
+		// guards knownPcaps and packetCount, they are read while pcaps
+		// are imported
+		mutex            sync.RWMutex
 		knownPcaps       []*pcapmetadata.PcapInfo
 		packetCount      uint
 		indexDir         string
@@ -93,6 +98,41 @@ func New(pcapDir, indexDir, snapshotDir string, cachedKnownPcaps []*pcapmetadata
 	return &b, nil
 }
 
+// Rebuild creates new indexes and a new snapshot file from all pcaps in
+// pcapDir, existing indexes and snapshots are ignored.
+func Rebuild(pcapDir, indexDir, snapshotDir string) ([]*index.Reader, error) {
+	b := Builder{
+		indexDir:    indexDir,
+		snapshotDir: snapshotDir,
+	}
+	entries, err := os.ReadDir(pcapDir)
+	if err != nil {
+		return nil, err
+	}
+	pcapFilenames := []string(nil)
+	for _, p := range entries {
+		if p.IsDir() || (!strings.HasSuffix(p.Name(), ".pcap") && !strings.HasSuffix(p.Name(), ".pcapng")) {
+			continue
+		}
+		pcapFilenames = append(pcapFilenames, p.Name())
+	}
+	indexes := []*index.Reader(nil)
+	for len(pcapFilenames) != 0 {
+		processedFiles, _, createdIndexes, _, _, _, err := b.FromPcap(pcapDir, pcapFilenames, indexes)
+		if err != nil && processedFiles == 0 {
+			for _, i := range indexes {
+				i.Close()
+				os.Remove(i.Filename())
+			}
+			return nil, err
+		}
+		// pcaps that can't be read are skipped like during a normal import
+		indexes = append(indexes, createdIndexes...)
+		pcapFilenames = pcapFilenames[processedFiles:]
+	}
+	return indexes, nil
+}
+
 func (b *Builder) FromPcap(pcapDir string, pcapFilenames []string, existingIndexes []*index.Reader) (int, uint64, []*index.Reader, *bitmask.LongBitmask, *bitmask.LongBitmask, *bitmask.LongBitmask, error) {
 	log.Printf("Building indexes from pcaps %q\n", pcapFilenames)
 	// load, find ts of oldest new package
@@ -552,10 +592,12 @@ outer:
 		b.snapshotFilename = filepath.Base(newSnapshotFilename)
 	}
 
+	b.mutex.Lock()
 	b.knownPcaps = append(b.knownPcaps, newPcapInfos...)
 	for _, pi := range newPcapInfos {
 		b.packetCount += pi.PacketCount
 	}
+	b.mutex.Unlock()
 	b.snapshots = newSnapshots
 
 	outputFiles := []string{}
@@ -567,9 +609,62 @@ outer:
 }
 
 func (b *Builder) PacketCount() uint {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	return b.packetCount
 }
 
+// KnownPcaps returns a copy of the list of known pcaps, it may be called
+// while pcaps are imported.
 func (b *Builder) KnownPcaps() []*pcapmetadata.PcapInfo {
-	return b.knownPcaps
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return slices.Clone(b.knownPcaps)
+}
+
+// ForgetPcaps removes the given pcaps from the list of known pcaps. Snapshots
+// that would require packets from them are discarded as well.
+func (b *Builder) ForgetPcaps(pcapFilenames map[string]struct{}) error {
+	b.mutex.Lock()
+	newestForgotten := time.Time{}
+	knownPcaps := []*pcapmetadata.PcapInfo(nil)
+	for _, p := range b.knownPcaps {
+		if _, ok := pcapFilenames[p.Filename]; !ok {
+			knownPcaps = append(knownPcaps, p)
+			continue
+		}
+		b.packetCount -= p.PacketCount
+		if newestForgotten.Before(p.PacketTimestampMax) {
+			newestForgotten = p.PacketTimestampMax
+		}
+	}
+	b.knownPcaps = knownPcaps
+	b.mutex.Unlock()
+
+	snapshots := []*snapshot(nil)
+nextSnapshot:
+	for _, s := range b.snapshots {
+		if !s.timestamp.After(newestForgotten) {
+			continue
+		}
+		for fn := range s.referencedPackets {
+			if _, ok := pcapFilenames[fn]; ok {
+				continue nextSnapshot
+			}
+		}
+		snapshots = append(snapshots, s)
+	}
+	if len(snapshots) == len(b.snapshots) {
+		return nil
+	}
+	b.snapshots = snapshots
+	newSnapshotFilename := tools.MakeFilename(b.snapshotDir, "snap")
+	if err := saveSnapshots(newSnapshotFilename, snapshots); err != nil {
+		return err
+	}
+	if b.snapshotFilename != "" {
+		os.Remove(filepath.Join(b.snapshotDir, b.snapshotFilename))
+	}
+	b.snapshotFilename = filepath.Base(newSnapshotFilename)
+	return nil
 }
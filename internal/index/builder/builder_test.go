@@ -5,6 +5,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	pcapmetadata "github.com/spq/pkappa2/internal/tools/pcapMetadata"
 )
 
 var (
@@ -85,3 +87,54 @@ func TestSnapshots(t *testing.T) {
 		})
 	}
 }
+
+func TestForgetPcaps(t *testing.T) {
+	b := Builder{
+		snapshotDir: t.TempDir(),
+		knownPcaps: []*pcapmetadata.PcapInfo{
+			{Filename: "a", PacketTimestampMin: t1, PacketTimestampMax: t1.Add(time.Minute), PacketCount: 10},
+			{Filename: "b", PacketTimestampMin: t1.Add(time.Minute), PacketTimestampMax: t1.Add(2 * time.Minute), PacketCount: 20},
+		},
+		packetCount: 30,
+		snapshots: []*snapshot{
+			{timestamp: t1.Add(30 * time.Second), referencedPackets: map[string][]uint64{"a": {1}}},
+			{timestamp: t1.Add(90 * time.Second), referencedPackets: map[string][]uint64{"a": {2}, "b": {1}}},
+			{timestamp: t1.Add(100 * time.Second), referencedPackets: map[string][]uint64{"b": {2}}},
+		},
+	}
+	if err := b.ForgetPcaps(map[string]struct{}{"a": {}}); err != nil {
+		t.Fatalf("ForgetPcaps failed: %v", err)
+	}
+	if len(b.knownPcaps) != 1 || b.knownPcaps[0].Filename != "b" || b.packetCount != 20 {
+		t.Errorf("known pcaps = %v with %d packets, want [b] with 20 packets", b.knownPcaps, b.packetCount)
+	}
+	if len(b.snapshots) != 1 || !b.snapshots[0].timestamp.Equal(t1.Add(100*time.Second)) {
+		t.Fatalf("snapshots = %v, want only the last one", b.snapshots)
+	}
+	got, err := loadSnapshots(path.Join(b.snapshotDir, b.snapshotFilename))
+	if err != nil {
+		t.Fatalf("loadSnapshots failed: %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("len(loadSnapshots())=%d, want 1", len(got))
+	}
+}
+
+func TestVerifySnapshots(t *testing.T) {
+	fn := path.Join(t.TempDir(), "test.snap")
+	if err := saveSnapshots(fn, []*snapshot{
+		{timestamp: t1.Add(time.Hour), referencedPackets: map[string][]uint64{"a": {1}}},
+		{timestamp: t1, referencedPackets: map[string][]uint64{"b": {2}}},
+	}); err != nil {
+		t.Fatalf("saveSnapshots failed: %v", err)
+	}
+	if problems := VerifySnapshots(fn, map[string]struct{}{"a": {}, "b": {}}); len(problems) != 1 {
+		t.Errorf("VerifySnapshots() = %v, want the ordering problem", problems)
+	}
+	if problems := VerifySnapshots(fn, map[string]struct{}{"a": {}}); len(problems) != 2 {
+		t.Errorf("VerifySnapshots() = %v, want the ordering and unknown pcap problems", problems)
+	}
+	if problems := VerifySnapshots(path.Join(t.TempDir(), "missing.snap"), nil); len(problems) != 1 {
+		t.Errorf("VerifySnapshots() = %v, want a read error", problems)
+	}
+}
@@ -2,6 +2,7 @@ package builder
 
 import (
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcap"
 	pcapmetadata "github.com/spq/pkappa2/internal/tools/pcapMetadata"
+	pcapoffsets "github.com/spq/pkappa2/internal/tools/pcapOffsets"
 )
 
 type (
@@ -57,6 +59,16 @@ func readPackets(pcapDir, pcapFilename string, info *pcapmetadata.PcapInfo) (*pc
 		return nil, nil, err
 	}
 	defer handle.Close()
+	// remember where the packets are for extracting them later
+	var offsets *pcapoffsets.Collector
+	if updateInfo {
+		offsets, err = pcapoffsets.NewCollector(filepath.Join(pcapDir, pcapFilename))
+		if err != nil {
+			log.Printf("Unable to create offset table for pcap %q: %v", pcapFilename, err)
+		} else {
+			defer offsets.Close()
+		}
+	}
 	packets := []Packet(nil)
 	var decoder gopacket.Decoder
 	switch lt := handle.LinkType(); lt {
@@ -71,6 +83,11 @@ func readPackets(pcapDir, pcapFilename string, info *pcapmetadata.PcapInfo) (*pc
 		data, ci, err := handle.ReadPacketData()
 		switch err {
 		case io.EOF:
+			if offsets != nil {
+				if err := offsets.Save(); err != nil {
+					log.Printf("Unable to create offset table for pcap %q: %v", pcapFilename, err)
+				}
+			}
 			return info, packets, nil
 		case nil:
 		default:
@@ -86,6 +103,9 @@ func readPackets(pcapDir, pcapFilename string, info *pcapmetadata.PcapInfo) (*pc
 			}
 			info.PacketCount++
 		}
+		if offsets != nil {
+			offsets.Add()
+		}
 		pcapmetadata.AddPcapMetadata(&ci, info, packetIndex)
 		packets = append(packets, Packet{
 			decoder: decoder,
@@ -127,3 +127,24 @@ func compactSnapshots(snapshots []*snapshot) []*snapshot {
 	// }
 	// return snapshots
 }
+
+// VerifySnapshots checks that a snapshot file can be loaded and only
+// references the given pcaps, it returns all problems that were found.
+func VerifySnapshots(filename string, pcapFilenames map[string]struct{}) []error {
+	snapshots, err := loadSnapshots(filename)
+	if err != nil {
+		return []error{err}
+	}
+	problems := []error(nil)
+	for i, s := range snapshots {
+		if i != 0 && s.timestamp.Before(snapshots[i-1].timestamp) {
+			problems = append(problems, fmt.Errorf("snapshot %d is older than its predecessor", i))
+		}
+		for fn := range s.referencedPackets {
+			if _, ok := pcapFilenames[fn]; !ok {
+				problems = append(problems, fmt.Errorf("snapshot %d references unknown pcap %q", i, fn))
+			}
+		}
+	}
+	return problems
+}
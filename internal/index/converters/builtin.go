@@ -0,0 +1,255 @@
+package converters
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/spq/pkappa2/internal/index"
+	httpmessages "github.com/spq/pkappa2/internal/tools/httpMessages"
+)
+
+type (
+	// chunkConverter applies a transformation to every chunk on its own.
+	chunkConverter struct {
+		name    string
+		version string
+		convert func([]byte) []byte
+	}
+	httpBodyConverter struct{}
+)
+
+const (
+	// gzip members are not decompressed beyond this size
+	maxGunzipSize = 64 << 20
+
+	// versions of the converters, see Converter
+	base64Version    = "1"
+	urldecodeVersion = "1"
+	gunzipVersion    = "1"
+	httpbodyVersion  = "1"
+)
+
+var (
+	base64Pattern = regexp.MustCompile(`([A-Za-z0-9+/]{4})*([A-Za-z0-9+/]{3}=|[A-Za-z0-9+/]{2}==)?`)
+	gzipMagic     = []byte("\x1f\x8b\x08")
+)
+
+// Builtin returns the converters implemented in Go that are available
+// without a converter executable.
+func Builtin() []Converter {
+	return []Converter{
+		&chunkConverter{name: "base64", version: base64Version, convert: decodeBase64},
+		&chunkConverter{name: "urldecode", version: urldecodeVersion, convert: decodeURL},
+		&chunkConverter{name: "gunzip", version: gunzipVersion, convert: decompressGzip},
+		&httpBodyConverter{},
+	}
+}
+
+func (c *chunkConverter) Name() string {
+	return c.name
+}
+
+func (c *chunkConverter) Version() string {
+	return c.version
+}
+
+func (c *chunkConverter) Convert(stream *index.Stream, data []index.Data) ([]index.Data, error) {
+	res := make([]index.Data, 0, len(data))
+	for _, d := range data {
+		d.Content = c.convert(d.Content)
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+// decodeBase64 replaces everything looking like base64 by its decoded
+// value. Like the b64decode.py converter, it only considers strings
+// containing upper and lower case letters and digits.
+func decodeBase64(data []byte) []byte {
+	res := []byte(nil)
+	pos := 0
+	for _, m := range base64Pattern.FindAllIndex(data, -1) {
+		match := data[m[0]:m[1]]
+		if !bytes.ContainsFunc(match, func(r rune) bool { return 'A' <= r && r <= 'Z' }) ||
+			!bytes.ContainsFunc(match, func(r rune) bool { return 'a' <= r && r <= 'z' }) ||
+			!bytes.ContainsFunc(match, func(r rune) bool { return '0' <= r && r <= '9' }) {
+			continue
+		}
+		decoded, err := base64.StdEncoding.AppendDecode(nil, match)
+		if err != nil {
+			continue
+		}
+		res = append(res, data[pos:m[0]]...)
+		res = append(res, decoded...)
+		pos = m[1]
+	}
+	if pos == 0 {
+		return data
+	}
+	return append(res, data[pos:]...)
+}
+
+// decodeURL replaces all percent encoded bytes, invalid escapes and + are
+// kept as they are.
+func decodeURL(data []byte) []byte {
+	if !bytes.Contains(data, []byte("%")) {
+		return data
+	}
+	res := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] == '%' && i+2 < len(data) {
+			if v, err := strconv.ParseUint(string(data[i+1:i+3]), 16, 8); err == nil {
+				res = append(res, byte(v))
+				i += 2
+				continue
+			}
+		}
+		res = append(res, data[i])
+	}
+	return res
+}
+
+// decompressGzip replaces all complete gzip members by their content.
+func decompressGzip(data []byte) []byte {
+	res := []byte(nil)
+	pos, searchPos := 0, 0
+	for {
+		idx := bytes.Index(data[searchPos:], gzipMagic)
+		if idx < 0 {
+			break
+		}
+		start := searchPos + idx
+		searchPos = start + 1
+		r := bytes.NewReader(data[start:])
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			continue
+		}
+		gr.Multistream(false)
+		decompressed, err := io.ReadAll(io.LimitReader(gr, maxGunzipSize))
+		if err != nil {
+			continue
+		}
+		res = append(res, data[pos:start]...)
+		res = append(res, decompressed...)
+		pos = len(data) - r.Len()
+		searchPos = pos
+	}
+	if pos == 0 {
+		return data
+	}
+	return append(res, data[pos:]...)
+}
+
+func (*httpBodyConverter) Name() string {
+	return "httpbody"
+}
+
+func (*httpBodyConverter) Version() string {
+	return httpbodyVersion
+}
+
+// Convert removes the transfer and content encoding from the bodies of
+// HTTP/1.x requests and responses. Bodies with a Content-Type header are
+// returned as separate chunks of that content type. Streams that don't
+// start with a HTTP request are returned unchanged.
+func (*httpBodyConverter) Convert(stream *index.Stream, data []index.Data) ([]index.Data, error) {
+	raw := [2][]byte{}
+	// the start offset of every chunk in the data of its direction
+	offsets := [2][]int{}
+	dirChunks := [2][]index.Data{}
+	for _, d := range data {
+		offsets[d.Direction] = append(offsets[d.Direction], len(raw[d.Direction]))
+		dirChunks[d.Direction] = append(dirChunks[d.Direction], d)
+		raw[d.Direction] = append(raw[d.Direction], d.Content...)
+	}
+	if !httpmessages.IsRequest(raw[index.DirectionClientToServer]) {
+		return data, nil
+	}
+	requests, responses := httpmessages.ParseWithBodies(raw[index.DirectionClientToServer], raw[index.DirectionServerToClient])
+
+	type message struct {
+		direction index.Direction
+		start     int
+		chunks    []index.Data
+	}
+	messages := []message(nil)
+	// chunkAt returns the index of the chunk containing offset
+	chunkAt := func(dir index.Direction, offset int) int {
+		i, found := slices.BinarySearch(offsets[dir], offset)
+		if !found {
+			i--
+		}
+		return i
+	}
+	add := func(dir index.Direction, m httpmessages.Message) {
+		d := dirChunks[dir][chunkAt(dir, m.Start)]
+		content := raw[dir][m.Start:m.End]
+		header := content
+		if i := bytes.Index(content, []byte("\r\n\r\n")); i >= 0 {
+			header = content[:i+4]
+		} else if i := bytes.Index(content, []byte("\n\n")); i >= 0 {
+			header = content[:i+2]
+		}
+		body := httpmessages.DecodeBody(m.Header, m.Body)
+		chunks := []index.Data{{
+			Direction: dir,
+			Content:   header,
+			Time:      d.Time,
+		}}
+		if contentType := m.Header.Get("Content-Type"); contentType != "" && len(body) != 0 {
+			chunks = append(chunks, index.Data{
+				Direction:   dir,
+				Content:     body,
+				Time:        d.Time,
+				ContentType: contentType,
+			})
+		} else {
+			chunks[0].Content = append(slices.Clip(header), body...)
+		}
+		messages = append(messages, message{dir, m.Start, chunks})
+	}
+	ends := [2]int{}
+	for _, req := range requests {
+		add(index.DirectionClientToServer, req.Message)
+		ends[index.DirectionClientToServer] = req.End
+	}
+	for _, res := range responses {
+		add(index.DirectionServerToClient, res.Message)
+		ends[index.DirectionServerToClient] = res.End
+	}
+	// the data following the last message, e.g. after a protocol switch,
+	// is kept as it is
+	for dir, end := range ends {
+		dir := index.Direction(dir)
+		if end == len(raw[dir]) {
+			continue
+		}
+		for i := chunkAt(dir, end); i < len(dirChunks[dir]); i++ {
+			d := dirChunks[dir][i]
+			if offsets[dir][i] < end {
+				d.Content = d.Content[end-offsets[dir][i]:]
+			}
+			messages = append(messages, message{dir, offsets[dir][i], []index.Data{d}})
+		}
+	}
+	slices.SortStableFunc(messages, func(a, b message) int {
+		if c := a.chunks[0].Time.Compare(b.chunks[0].Time); c != 0 {
+			return c
+		}
+		if a.direction != b.direction {
+			return int(a.direction) - int(b.direction)
+		}
+		return a.start - b.start
+	})
+	res := []index.Data(nil)
+	for _, m := range messages {
+		res = append(res, m.chunks...)
+	}
+	return res, nil
+}
@@ -0,0 +1,91 @@
+package converters
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spq/pkappa2/internal/index"
+)
+
+func gzipString(s string) string {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+func TestChunkConverters(t *testing.T) {
+	for _, tc := range []struct {
+		convert func([]byte) []byte
+		input   string
+		want    string
+	}{
+		{decodeBase64, "flag: RkxBR3t0ZXN0fQ==!", "flag: FLAG{test}!"},
+		{decodeBase64, "hello world", "hello world"},
+		{decodeBase64, "YWJj", "YWJj"},
+		{decodeURL, "a=%41%2f%zz+b%4", "a=A/%zz+b%4"},
+		{decodeURL, "plain", "plain"},
+		{decompressGzip, "x" + gzipString("hello") + "y" + gzipString("world"), "xhelloyworld"},
+		{decompressGzip, "\x1f\x8b\x08 broken", "\x1f\x8b\x08 broken"},
+	} {
+		if got := string(tc.convert([]byte(tc.input))); got != tc.want {
+			t.Errorf("convert(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPBodyConverter(t *testing.T) {
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	gz := gzipString("<b>hi</b>")
+	data := []index.Data{
+		{Direction: index.DirectionClientToServer, Time: t1, Content: []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /b HTTP/1.1\r\n")},
+		{Direction: index.DirectionServerToClient, Time: t1.Add(1 * time.Second), Content: []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", len(gz), gz))},
+		{Direction: index.DirectionClientToServer, Time: t1.Add(2 * time.Second), Content: []byte("Host: a\r\n\r\n")},
+		{Direction: index.DirectionServerToClient, Time: t1.Add(3 * time.Second), Content: []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\ntrailing")},
+	}
+	got, err := (&httpBodyConverter{}).Convert(nil, data)
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	want := []index.Data{
+		{Direction: index.DirectionClientToServer, Time: t1, Content: []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")},
+		{Direction: index.DirectionClientToServer, Time: t1, Content: []byte("GET /b HTTP/1.1\r\nHost: a\r\n\r\n")},
+		{Direction: index.DirectionServerToClient, Time: t1.Add(1 * time.Second), Content: []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n", len(gz)))},
+		{Direction: index.DirectionServerToClient, Time: t1.Add(1 * time.Second), Content: []byte("<b>hi</b>"), ContentType: "text/html"},
+		{Direction: index.DirectionServerToClient, Time: t1.Add(3 * time.Second), Content: []byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nabc")},
+		{Direction: index.DirectionServerToClient, Time: t1.Add(3 * time.Second), Content: []byte("trailing")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Convert returned %d chunks, want %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Direction != want[i].Direction || !got[i].Time.Equal(want[i].Time) || string(got[i].Content) != string(want[i].Content) || got[i].ContentType != want[i].ContentType {
+			t.Errorf("chunk %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	plain := []index.Data{{Direction: index.DirectionClientToServer, Time: t1, Content: []byte("not http")}}
+	if got, err := (&httpBodyConverter{}).Convert(nil, plain); err != nil || len(got) != 1 || string(got[0].Content) != "not http" {
+		t.Errorf("Convert(not http) = %v, %v", got, err)
+	}
+}
+
+func TestNativeConverterFingerprint(t *testing.T) {
+	for _, converter := range append(Builtin(), NewTLSDecryptConverter(nil)) {
+		fingerprint, err := NewNativeConverter(converter).Fingerprint()
+		if err != nil {
+			t.Fatalf("Fingerprint(%s) failed: %v", converter.Name(), err)
+		}
+		if converter.Version() == "" || fingerprint.Equal(Fingerprint{}) {
+			t.Errorf("Fingerprint(%s) = %+v, want a version", converter.Name(), fingerprint)
+		}
+		// an executable declaring the same version must not share the cache
+		if fingerprint.Equal(Fingerprint{Version: converter.Version()}) {
+			t.Errorf("Fingerprint(%s) equals the declared version %q", converter.Name(), converter.Version())
+		}
+	}
+}
@@ -1,37 +1,132 @@
 package converters
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"path/filepath"
+	"sync"
 
 	"github.com/spq/pkappa2/internal/index"
 	"github.com/spq/pkappa2/internal/tools/bitmask"
+	tlskeylog "github.com/spq/pkappa2/internal/tools/tlsKeylog"
 )
 
 type (
+	// backend is implemented by ProcessConverter, NativeConverter and
+	// PipelineConverter.
+	backend interface {
+		Name() string
+		ProcessStats() []ProcessStats
+		Stderr(pid int) *ProcessStderr
+		MaxProcessCount() int
+		// Fingerprint identifies the current version of the converter
+		Fingerprint() (Fingerprint, error)
+		Reset()
+		// Data converts the stream, streamTags are the names of the tags
+		// matching it
+		Data(stream *index.Stream, streamTags []string, moreDetails bool) ([]index.Data, uint64, uint64, []string, error)
+		// convert is like Data, but converts the given chunks instead of
+		// the stream data
+		convert(stream *index.Stream, streamTags []string, packets []index.Data, moreDetails bool) ([]index.Data, uint64, uint64, []string, error)
+		// test converts the input once without using the cache or the
+		// pooled processes
+		test(input *TestInput) (*TestResult, error)
+	}
 	CachedConverter struct {
-		converter *Converter
+		converter backend
 		cacheFile *cacheFile
+		// the version of the converter the cached results were created by
+		fingerprint Fingerprint
+
+		// tags returned by the converter that were not taken by the manager yet
+		pendingTagsMutex sync.Mutex
+		pendingTags      map[uint64][]string
 	}
 	Statistics struct {
 		Name              string
 		CachedStreamCount uint64
+		// FailedStreamCount is the number of cached streams the converter
+		// failed to convert
+		FailedStreamCount uint64
 		Processes         []ProcessStats
+		// Native is set for converters implemented in Go
+		Native bool `json:",omitempty"`
+		// Stages are the converters a pipeline consists of
+		Stages []string `json:",omitempty"`
+		// Address is set for converter services
+		Address string `json:",omitempty"`
 	}
 )
 
 func NewCache(converterName, executablePath, indexCachePath string) (*CachedConverter, error) {
-	filename := fmt.Sprintf("converterindex-%s.cidx", converterName)
+	return newCache(NewProcessConverter(converterName, executablePath), indexCachePath, NewCacheFile)
+}
+
+// NewReadOnlyCache uses the existing cache without modifying it, streams
+// that are not cached yet are converted but their output is not stored.
+func NewReadOnlyCache(converterName, executablePath, indexCachePath string) (*CachedConverter, error) {
+	return newCache(NewProcessConverter(converterName, executablePath), indexCachePath, NewReadOnlyCacheFile)
+}
+
+// NewRemoteCache caches the output of the converter service at the
+// address.
+func NewRemoteCache(converterName, address, indexCachePath string) (*CachedConverter, error) {
+	return newCache(NewRemoteConverter(converterName, address), indexCachePath, NewCacheFile)
+}
+
+func NewReadOnlyRemoteCache(converterName, address, indexCachePath string) (*CachedConverter, error) {
+	return newCache(NewRemoteConverter(converterName, address), indexCachePath, NewReadOnlyCacheFile)
+}
+
+// NewNativeCache caches the output of a converter implemented in Go.
+func NewNativeCache(converter Converter, indexCachePath string) (*CachedConverter, error) {
+	return newCache(NewNativeConverter(converter), indexCachePath, NewCacheFile)
+}
+
+func NewReadOnlyNativeCache(converter Converter, indexCachePath string) (*CachedConverter, error) {
+	return newCache(NewNativeConverter(converter), indexCachePath, NewReadOnlyCacheFile)
+}
+
+// NewPipelineCache caches the output of the stages run one after another.
+func NewPipelineCache(name string, stages []*CachedConverter, indexCachePath string) (*CachedConverter, error) {
+	converter, err := NewPipelineConverter(name, stages)
+	if err != nil {
+		return nil, err
+	}
+	return newCache(converter, indexCachePath, NewCacheFile)
+}
+
+func NewReadOnlyPipelineCache(name string, stages []*CachedConverter, indexCachePath string) (*CachedConverter, error) {
+	converter, err := NewPipelineConverter(name, stages)
+	if err != nil {
+		return nil, err
+	}
+	return newCache(converter, indexCachePath, NewReadOnlyCacheFile)
+}
+
+func newCache(converter backend, indexCachePath string, openCacheFile func(string, Fingerprint) (*cacheFile, error)) (*CachedConverter, error) {
+	filename := fmt.Sprintf("converterindex-%s.cidx", converter.Name())
+	if _, ok := converter.(*NativeConverter); ok {
+		// executables of the same name replace built-in converters, they
+		// must not share the cache
+		filename = fmt.Sprintf("converterindex-builtin-%s.cidx", converter.Name())
+	}
 	cachePath := filepath.Join(indexCachePath, filename)
 
-	cacheFile, err := NewCacheFile(cachePath)
+	fingerprint, err := converter.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	cacheFile, err := openCacheFile(cachePath, fingerprint)
 	if err != nil {
 		return nil, err
 	}
 
 	return &CachedConverter{
-		converter: New(converterName, executablePath),
-		cacheFile: cacheFile,
+		converter:   converter,
+		cacheFile:   cacheFile,
+		fingerprint: fingerprint,
 	}, nil
 }
 
@@ -43,11 +138,65 @@ func (cache *CachedConverter) Name() string {
 	return cache.converter.Name()
 }
 
+// Native returns whether the converter is implemented in Go.
+func (cache *CachedConverter) Native() bool {
+	_, ok := cache.converter.(*NativeConverter)
+	return ok
+}
+
+// Address returns the address of a converter service, or an empty string
+// for other converters.
+func (cache *CachedConverter) Address() string {
+	if converter, ok := cache.converter.(*ProcessConverter); ok {
+		return converter.Address()
+	}
+	return ""
+}
+
+// Stages returns the names of the stages of a pipeline, or nil if the
+// converter is no pipeline.
+func (cache *CachedConverter) Stages() []string {
+	if converter, ok := cache.converter.(*PipelineConverter); ok {
+		return converter.Stages()
+	}
+	return nil
+}
+
+// SetStages replaces the stages of a pipeline, the cache should be reset
+// afterwards.
+func (cache *CachedConverter) SetStages(stages []*CachedConverter) error {
+	converter, ok := cache.converter.(*PipelineConverter)
+	if !ok {
+		return fmt.Errorf("converter %s is no pipeline", cache.Name())
+	}
+	return converter.SetStages(stages)
+}
+
+// Fingerprint returns the version of the converter the cached results were
+// created by.
+func (cache *CachedConverter) Fingerprint() Fingerprint {
+	return cache.fingerprint
+}
+
+// Changed returns whether the converter was modified since the cache was
+// created or reset, its cached results are outdated then.
+func (cache *CachedConverter) Changed() (bool, error) {
+	fingerprint, err := cache.converter.Fingerprint()
+	if err != nil {
+		return false, err
+	}
+	return !fingerprint.Equal(cache.fingerprint), nil
+}
+
 func (cache *CachedConverter) Statistics() *Statistics {
 	return &Statistics{
 		Name:              cache.converter.Name(),
 		CachedStreamCount: cache.cacheFile.StreamCount(),
+		FailedStreamCount: cache.cacheFile.FailedStreamCount(),
 		Processes:         cache.converter.ProcessStats(),
+		Native:            cache.Native(),
+		Stages:            cache.Stages(),
+		Address:           cache.Address(),
 	}
 }
 
@@ -59,19 +208,42 @@ func (cache *CachedConverter) MaxProcessCount() int {
 	return cache.converter.MaxProcessCount()
 }
 
+// SetLimits changes the limits of the converter processes, converters
+// implemented in Go are not limited.
+func (cache *CachedConverter) SetLimits(limits Limits) {
+	switch converter := cache.converter.(type) {
+	case *ProcessConverter:
+		converter.SetLimits(limits)
+	case *PipelineConverter:
+		converter.SetLimits(limits)
+	}
+}
+
 func (cache *CachedConverter) Reset() error {
 	// Stop all converter processes.
 	cache.converter.Reset()
 
-	// Remove the cache file.
-	return cache.cacheFile.Reset()
+	cache.pendingTagsMutex.Lock()
+	cache.pendingTags = nil
+	cache.pendingTagsMutex.Unlock()
+
+	// Remove the cache file, the new results are created by the current
+	// version of the converter. Keep the old version if it can't be
+	// determined, e.g. because the converter was removed.
+	if fingerprint, err := cache.converter.Fingerprint(); err == nil {
+		cache.fingerprint = fingerprint
+	}
+	return cache.cacheFile.ResetFingerprint(cache.fingerprint)
 }
 
 func (cache *CachedConverter) Contains(streamID uint64) bool {
 	return cache.cacheFile.Contains(streamID)
 }
 
-func (cache *CachedConverter) Data(stream *index.Stream, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, wasCached bool, err error) {
+// Data returns the cached output of the converter for the stream or
+// converts it. streamTags are the names of the tags matching the stream,
+// they are passed to the converter.
+func (cache *CachedConverter) Data(stream *index.Stream, streamTags []string, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, wasCached bool, err error) {
 	// See if the stream data is cached already.
 	data, clientBytes, serverBytes, err = cache.cacheFile.Data(stream)
 	if err != nil {
@@ -82,22 +254,85 @@ func (cache *CachedConverter) Data(stream *index.Stream, moreDetails bool) (data
 	}
 
 	// Convert the stream if it's not in the cache.
-	convertedPackets, clientBytes, serverBytes, err := cache.converter.Data(stream, moreDetails)
+	convertedPackets, clientBytes, serverBytes, tags, err := cache.converter.Data(stream, streamTags, moreDetails)
 	if err != nil {
+		// Remember failures caused by the stream, so it isn't converted
+		// over and over. Crashes and killed processes are retried.
+		if !cache.cacheFile.readOnly && errors.As(err, &deterministicError{}) {
+			if err := cache.cacheFile.SetFailed(stream, err); err != nil {
+				log.Printf("Converter (%s): Failed to cache failure of stream %d: %v", cache.Name(), stream.ID(), err)
+			} else {
+				cache.setPendingTags(stream.ID(), []string{})
+			}
+		}
 		return nil, 0, 0, false, err
 	}
 
 	// Save it to the cache.
+	if cache.cacheFile.readOnly {
+		return convertedPackets, clientBytes, serverBytes, false, nil
+	}
 	if err := cache.cacheFile.SetData(stream, convertedPackets); err != nil {
 		return nil, 0, 0, false, err
 	}
+	// An empty list is recorded as well, so the stream is removed from
+	// tags it was added to by an earlier conversion.
+	if tags == nil {
+		tags = []string{}
+	}
+	cache.setPendingTags(stream.ID(), tags)
 	return convertedPackets, clientBytes, serverBytes, false, nil
 }
 
-func (cache *CachedConverter) DataForSearch(streamID uint64) ([2][]byte, [][2]int, uint64, uint64, bool, error) {
-	return cache.cacheFile.DataForSearch(streamID)
+func (cache *CachedConverter) setPendingTags(streamID uint64, tags []string) {
+	cache.pendingTagsMutex.Lock()
+	defer cache.pendingTagsMutex.Unlock()
+	if cache.pendingTags == nil {
+		cache.pendingTags = map[uint64][]string{}
+	}
+	cache.pendingTags[streamID] = tags
+}
+
+// TakeTags returns the tags the converter returned for the streams
+// converted since the last call, indexed by stream id.
+func (cache *CachedConverter) TakeTags() map[uint64][]string {
+	cache.pendingTagsMutex.Lock()
+	defer cache.pendingTagsMutex.Unlock()
+	tags := cache.pendingTags
+	cache.pendingTags = nil
+	return tags
+}
+
+func (cache *CachedConverter) DataForSearch(streamID uint64, informative bool) ([2][]byte, [][2]int, uint64, uint64, bool, error) {
+	return cache.cacheFile.DataForSearch(streamID, informative)
 }
 
 func (cache *CachedConverter) InvalidateChangedStreams(streams *bitmask.LongBitmask) bitmask.LongBitmask {
 	return cache.cacheFile.InvalidateChangedStreams(streams)
 }
+
+// EvictStreams drops the results of the streams from the cache, e.g. when
+// they no longer match any tag the converter is attached to.
+func (cache *CachedConverter) EvictStreams(streams *bitmask.LongBitmask) bitmask.LongBitmask {
+	cache.pendingTagsMutex.Lock()
+	for streamID := uint(0); streams.Next(&streamID); streamID++ {
+		delete(cache.pendingTags, uint64(streamID))
+	}
+	cache.pendingTagsMutex.Unlock()
+	return cache.cacheFile.EvictStreams(streams)
+}
+
+func (cache *CachedConverter) RemoveStreams(streams *bitmask.LongBitmask) (int64, error) {
+	return cache.cacheFile.RemoveStreams(streams)
+}
+
+// RemoveStreamsMissingTLSKeys drops the streams that failed because of
+// the missing secrets from the cache, see
+// cacheFile.RemoveStreamsMissingTLSKeys.
+func (cache *CachedConverter) RemoveStreamsMissingTLSKeys(randoms map[tlskeylog.ClientRandom]struct{}) (bitmask.LongBitmask, error) {
+	return cache.cacheFile.RemoveStreamsMissingTLSKeys(randoms)
+}
+
+func (cache *CachedConverter) CacheSize() int64 {
+	return cache.cacheFile.Size()
+}
@@ -3,26 +3,33 @@ package converters
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"slices"
 	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/spq/pkappa2/internal/index"
 	"github.com/spq/pkappa2/internal/tools/bitmask"
+	tlskeylog "github.com/spq/pkappa2/internal/tools/tlsKeylog"
 )
 
 type (
 	cacheFile struct {
 		file      *os.File
 		cachePath string
+		readOnly  bool
 		rwmutex   sync.RWMutex
 		fileSize  int64
 		freeSize  int64
 		freeStart int64
+		// the sum of the fingerprint of the converter the cached results
+		// were created by
+		fingerprint [32]byte
 
 		streamInfos map[uint64]streamInfo
 	}
@@ -30,17 +37,25 @@ type (
 	streamInfo struct {
 		offset int64
 		size   uint64
+		// the error message if the conversion of the stream failed
+		failure string
+		// the client random of the TLS connection if the conversion
+		// failed because its secrets are missing
+		missingTLSKeys *tlskeylog.ClientRandom
 	}
 
 	// File format:
 	// [u64 stream id] [u8 varint chunk sizes] [client data] [server data]
+	// [varint times] [content types] [chunk kinds] [failure message]
+	// [client random of missing TLS keys]
 	converterStreamSection struct {
 		StreamID uint64
 	}
 
 	converterCacheFileHeader struct {
-		Magic   [4]byte
-		Version uint32
+		Magic       [4]byte
+		Version     uint32
+		Fingerprint [32]byte
 	}
 )
 
@@ -53,7 +68,15 @@ const (
 	cleanupMinFreeFactor = 0.5
 
 	cacheFileMagic   = "P2CC"
-	cacheFileVersion = 1
+	cacheFileVersion = 5
+)
+
+var (
+	errReadOnly = errors.New("cache file is opened read-only")
+
+	// ErrConversionFailed is returned for streams the converter failed to
+	// convert before, they are not converted again until the cache is reset.
+	ErrConversionFailed = errors.New("conversion failed")
 )
 
 func readVarInt(r io.ByteReader) (uint64, int, error) {
@@ -163,14 +186,58 @@ func writeVarBytes(writer io.Writer, data []byte) (int, error) {
 	return bytesWritten, nil
 }
 
-// skipStream skips a single stream in the given buffer, returning how many bytes were skipped.
-func skipStream(buffer *bufio.Reader) (uint64, error) {
+// forEachChunk calls fn with the index of every chunk set in the chunk
+// bitmask.
+func forEachChunk(chunks []byte, chunkCount int, fn func(chunk int)) error {
+	for i, b := range chunks {
+		bit := i * 8
+		for b != 0 {
+			if (b & 1) != 0 {
+				if bit >= chunkCount {
+					return fmt.Errorf("chunk bitmask out of range")
+				}
+				fn(bit)
+			}
+			bit++
+			b >>= 1
+		}
+	}
+	return nil
+}
+
+// readChunkKinds reads the chunk bitmasks of the chunks that aren't of
+// kind data, returning them and how many bytes were read.
+func readChunkKinds(buffer *bufio.Reader) (map[index.ChunkKind][]byte, int, error) {
+	kinds := map[index.ChunkKind][]byte{}
+	size := 0
+	for {
+		chunks, n, err := readVarBytes(buffer)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read chunk kind varbytes: %w", err)
+		}
+		size += n
+		if len(chunks) == 0 {
+			return kinds, size, nil
+		}
+		kind, n, err := readVarInt(buffer)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read chunk kind varint: %w", err)
+		}
+		size += n
+		kinds[index.ChunkKind(kind)] = chunks
+	}
+}
+
+// skipStream skips a single stream in the given buffer, returning how many
+// bytes were skipped, the failure message of the stream and the client
+// random of its missing TLS keys.
+func skipStream(buffer *bufio.Reader) (uint64, string, *tlskeylog.ClientRandom, error) {
 	// Read total data size of the stream by adding all chunk sizes up.
 	streamSize, dataSize, chunkCount := 0, 0, 0
 	for nZeros := 0; nZeros < 2; {
 		sz, n, err := readVarInt(buffer)
 		if err != nil {
-			return 0, fmt.Errorf("failed to read size varint: %w", err)
+			return 0, "", nil, fmt.Errorf("failed to read size varint: %w", err)
 		}
 		streamSize += n
 		dataSize += int(sz)
@@ -184,7 +251,7 @@ func skipStream(buffer *bufio.Reader) (uint64, error) {
 
 	// skip data
 	if _, err := buffer.Discard(int(dataSize)); err != nil {
-		return 0, fmt.Errorf("failed to discard %d bytes: %w", dataSize, err)
+		return 0, "", nil, fmt.Errorf("failed to discard %d bytes: %w", dataSize, err)
 	}
 	streamSize += dataSize
 
@@ -192,7 +259,7 @@ func skipStream(buffer *bufio.Reader) (uint64, error) {
 	for range chunkCount {
 		_, n, err := readVarInt(buffer)
 		if err != nil {
-			return 0, fmt.Errorf("failed to read time varint: %w", err)
+			return 0, "", nil, fmt.Errorf("failed to read time varint: %w", err)
 		}
 		streamSize += n
 	}
@@ -201,7 +268,7 @@ func skipStream(buffer *bufio.Reader) (uint64, error) {
 	for {
 		chunks, n, err := readVarBytes(buffer)
 		if err != nil {
-			return 0, fmt.Errorf("failed to read content type varbytes: %w", err)
+			return 0, "", nil, fmt.Errorf("failed to read content type varbytes: %w", err)
 		}
 		streamSize += n
 		if len(chunks) == 0 {
@@ -210,40 +277,105 @@ func skipStream(buffer *bufio.Reader) (uint64, error) {
 		// read content type string
 		_, n, err = readString(buffer)
 		if err != nil {
-			return 0, fmt.Errorf("failed to read content type string: %w", err)
+			return 0, "", nil, fmt.Errorf("failed to read content type string: %w", err)
 		}
 		streamSize += n
 	}
-	return uint64(streamSize), nil
-}
 
-func NewCacheFile(cachePath string) (*cacheFile, error) {
-	file, err := os.OpenFile(cachePath, os.O_CREATE|os.O_RDWR, 0644)
+	// read chunk kinds
+	_, n, err := readChunkKinds(buffer)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open cache file: %w", err)
+		return 0, "", nil, err
 	}
+	streamSize += n
 
+	// read failure message
+	failure, n, err := readString(buffer)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to read failure message: %w", err)
+	}
+	streamSize += n
+
+	// read client random of missing TLS keys
+	random, n, err := readString(buffer)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to read client random: %w", err)
+	}
+	streamSize += n
+	missingTLSKeys := (*tlskeylog.ClientRandom)(nil)
+	if random != "" {
+		if len(random) != len(tlskeylog.ClientRandom{}) {
+			return 0, "", nil, fmt.Errorf("invalid client random length %d", len(random))
+		}
+		missingTLSKeys = (*tlskeylog.ClientRandom)([]byte(random))
+	}
+	return uint64(streamSize), failure, missingTLSKeys, nil
+}
+
+// NewCacheFile opens the cache file, it is reset if it was created by
+// another version of the converter. A missing file is only created when
+// the first result is stored.
+func NewCacheFile(cachePath string, fingerprint Fingerprint) (*cacheFile, error) {
+	return openCacheFile(cachePath, fingerprint, false)
+}
+
+// NewReadOnlyCacheFile opens an existing cache file without ever modifying
+// it. A missing or invalid file or one created by another version of the
+// converter is treated like an empty one.
+func NewReadOnlyCacheFile(cachePath string, fingerprint Fingerprint) (*cacheFile, error) {
+	return openCacheFile(cachePath, fingerprint, true)
+}
+
+func openCacheFile(cachePath string, fingerprint Fingerprint, readOnly bool) (*cacheFile, error) {
 	res := cacheFile{
-		file:        file,
 		cachePath:   cachePath,
+		readOnly:    readOnly,
+		fingerprint: fingerprint.sum(),
 		streamInfos: map[uint64]streamInfo{},
 		fileSize:    cacheFileHeaderSize,
 		freeStart:   cacheFileHeaderSize,
 	}
+	var file *os.File
+	var err error
+	if readOnly {
+		file, err = os.Open(cachePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return &res, nil
+		}
+	} else {
+		file, err = os.OpenFile(cachePath, os.O_RDWR, 0644)
+		if errors.Is(err, os.ErrNotExist) {
+			res.fileSize, res.freeStart = 0, 0
+			return &res, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache file: %w", err)
+	}
+	res.file = file
 	buffer := bufio.NewReader(file)
 
 	// read the file header
 	fh := converterCacheFileHeader{}
 	if err := binary.Read(buffer, binary.LittleEndian, &fh); err != nil {
 		if err == io.EOF {
+			if readOnly {
+				return &res, nil
+			}
 			if err := res.Reset(); err != nil {
 				return nil, fmt.Errorf("failed to reset cache file: %w", err)
 			}
 			return &res, nil
 		}
+		file.Close()
 		return nil, fmt.Errorf("failed to read stream header: %w", err)
 	}
 	if string(fh.Magic[:]) != cacheFileMagic || fh.Version != cacheFileVersion {
+		if readOnly {
+			log.Printf("Invalid converter cache file(%q) magic or version: %q/%d, expected %q/%d, ignoring file\n",
+				res.cachePath, string(fh.Magic[:]), fh.Version, cacheFileMagic, cacheFileVersion)
+			return &res, nil
+		}
 		log.Printf("Invalid converter cache file(%q) magic or version: %q/%d, expected %q/%d, resetting file\n",
 			res.cachePath, string(fh.Magic[:]), fh.Version, cacheFileMagic, cacheFileVersion)
 		if err := res.Reset(); err != nil {
@@ -251,6 +383,17 @@ func NewCacheFile(cachePath string) (*cacheFile, error) {
 		}
 		return &res, nil
 	}
+	if fh.Fingerprint != res.fingerprint {
+		if readOnly {
+			log.Printf("Converter cache file(%q) was created by another version of the converter, ignoring file\n", res.cachePath)
+			return &res, nil
+		}
+		log.Printf("Converter cache file(%q) was created by another version of the converter, resetting file\n", res.cachePath)
+		if err := res.Reset(); err != nil {
+			return nil, fmt.Errorf("failed to reset cache file: %w", err)
+		}
+		return &res, nil
+	}
 
 	// Read all stream ids
 	for {
@@ -263,7 +406,7 @@ func NewCacheFile(cachePath string) (*cacheFile, error) {
 		}
 		res.fileSize += streamHeaderSize
 
-		streamSize, err := skipStream(buffer)
+		streamSize, failure, missingTLSKeys, err := skipStream(buffer)
 		if err != nil {
 			return nil, fmt.Errorf("failed to skip stream data: %w", err)
 		}
@@ -275,14 +418,16 @@ func NewCacheFile(cachePath string) (*cacheFile, error) {
 			res.freeSize += streamHeaderSize + int64(info.size)
 		}
 		res.streamInfos[streamSection.StreamID] = streamInfo{
-			offset: res.fileSize,
-			size:   uint64(streamSize),
+			offset:         res.fileSize,
+			size:           uint64(streamSize),
+			failure:        failure,
+			missingTLSKeys: missingTLSKeys,
 		}
 		res.fileSize += int64(streamSize)
 	}
 	if res.freeSize == 0 {
 		res.freeStart = res.fileSize
-	} else {
+	} else if !readOnly {
 		if err := res.truncateFile(); err != nil {
 			return nil, fmt.Errorf("failed to truncate file: %w", err)
 		}
@@ -301,6 +446,19 @@ func (cachefile *cacheFile) Close() error {
 	// Don't unlock the mutex here, because we don't want to allow any other
 	// operations on the file after closing it.
 
+	if cachefile.file == nil {
+		return nil
+	}
+	if cachefile.readOnly {
+		return cachefile.file.Close()
+	}
+	// Drop invalidated and evicted streams, they would be loaded again
+	// when the file is opened the next time.
+	if cachefile.freeSize != 0 {
+		if err := cachefile.truncateFile(); err != nil {
+			return err
+		}
+	}
 	if err := cachefile.file.Sync(); err != nil {
 		return err
 	}
@@ -315,10 +473,53 @@ func (cachefile *cacheFile) StreamCount() uint64 {
 	return uint64(len(cachefile.streamInfos))
 }
 
+// FailedStreamCount returns the number of streams the converter failed to
+// convert.
+func (cachefile *cacheFile) FailedStreamCount() uint64 {
+	cachefile.rwmutex.RLock()
+	defer cachefile.rwmutex.RUnlock()
+
+	n := uint64(0)
+	for _, info := range cachefile.streamInfos {
+		if info.failure != "" {
+			n++
+		}
+	}
+	return n
+}
+
 func (cachefile *cacheFile) Reset() error {
 	cachefile.rwmutex.Lock()
 	defer cachefile.rwmutex.Unlock()
 
+	return cachefile.reset()
+}
+
+// ResetFingerprint drops all cached results, the file is marked as
+// created by the given version of the converter.
+func (cachefile *cacheFile) ResetFingerprint(fingerprint Fingerprint) error {
+	cachefile.rwmutex.Lock()
+	defer cachefile.rwmutex.Unlock()
+
+	if cachefile.readOnly {
+		return errReadOnly
+	}
+	cachefile.fingerprint = fingerprint.sum()
+	return cachefile.reset()
+}
+
+func (cachefile *cacheFile) reset() error {
+	if cachefile.readOnly {
+		return errReadOnly
+	}
+	if cachefile.file == nil {
+		// the file is created with the first result
+		cachefile.streamInfos = map[uint64]streamInfo{}
+		cachefile.freeSize = 0
+		cachefile.fileSize = 0
+		cachefile.freeStart = 0
+		return nil
+	}
 	if _, err := cachefile.file.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
@@ -327,8 +528,9 @@ func (cachefile *cacheFile) Reset() error {
 	}
 	// write header
 	fh := converterCacheFileHeader{
-		Magic:   [4]byte([]byte(cacheFileMagic)),
-		Version: cacheFileVersion,
+		Magic:       [4]byte([]byte(cacheFileMagic)),
+		Version:     cacheFileVersion,
+		Fingerprint: cachefile.fingerprint,
 	}
 	if _, err := cachefile.file.Seek(0, io.SeekStart); err != nil {
 		return fmt.Errorf("failed to seek to start of file: %w", err)
@@ -367,6 +569,9 @@ func (cachefile *cacheFile) data(streamID uint64, firstPacketTime time.Time) ([]
 	if !ok {
 		return nil, 0, 0, nil
 	}
+	if info.failure != "" {
+		return nil, 0, 0, fmt.Errorf("%w: %s", ErrConversionFailed, info.failure)
+	}
 
 	buffer := bufio.NewReader(io.NewSectionReader(cachefile.file, info.offset, int64(info.size)))
 	data := []index.Data{}
@@ -445,29 +650,37 @@ func (cachefile *cacheFile) data(streamID uint64, firstPacketTime time.Time) ([]
 		if err != nil {
 			return nil, 0, 0, fmt.Errorf("failed to read content type string: %w", err)
 		}
-		for i, b := range chunks {
-			bit := i * 8
-			for b != 0 {
-				if (b & 1) != 0 {
-					if bit >= len(data) {
-						return nil, 0, 0, fmt.Errorf("content type bitmask out of range")
-					}
-					data[bit].ContentType = ct
-				}
-				bit++
-				b >>= 1
-			}
+		if err := forEachChunk(chunks, len(data), func(chunk int) {
+			data[chunk].ContentType = ct
+		}); err != nil {
+			return nil, 0, 0, fmt.Errorf("content type %w", err)
+		}
+	}
+
+	// Read chunk kinds
+	kinds, _, err := readChunkKinds(buffer)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for kind, chunks := range kinds {
+		if err := forEachChunk(chunks, len(data), func(chunk int) {
+			data[chunk].Kind = kind
+		}); err != nil {
+			return nil, 0, 0, fmt.Errorf("chunk kind %w", err)
 		}
 	}
 	return data, bytes[index.DirectionClientToServer], bytes[index.DirectionServerToClient], nil
 }
 
-func (cachefile *cacheFile) DataForSearch(streamID uint64) ([2][]byte, [][2]int, uint64, uint64, bool, error) {
+// DataForSearch returns the data of both directions and the cumulative
+// chunk sizes of the stream. Informative chunks are left out unless
+// requested.
+func (cachefile *cacheFile) DataForSearch(streamID uint64, informative bool) ([2][]byte, [][2]int, uint64, uint64, bool, error) {
 	cachefile.rwmutex.RLock()
 	defer cachefile.rwmutex.RUnlock()
 
 	info, ok := cachefile.streamInfos[streamID]
-	if !ok {
+	if !ok || info.failure != "" {
 		return [2][]byte{}, [][2]int{}, 0, 0, false, nil
 	}
 	buffer := bufio.NewReader(io.NewSectionReader(cachefile.file, info.offset, int64(info.size)))
@@ -517,7 +730,65 @@ func (cachefile *cacheFile) DataForSearch(streamID uint64) ([2][]byte, [][2]int,
 	if _, err := io.ReadFull(buffer, serverData); err != nil {
 		return [2][]byte{}, [][2]int{}, 0, 0, true, fmt.Errorf("failed to read server data: %w", err)
 	}
-	return [2][]byte{clientData, serverData}, dataSizes, clientBytes, serverBytes, true, nil
+	if informative {
+		return [2][]byte{clientData, serverData}, dataSizes, clientBytes, serverBytes, true, nil
+	}
+
+	// Skip times and content types to find the informative chunks
+	chunkCount := len(dataSizes) - 1
+	for range chunkCount {
+		if _, _, err := readVarInt(buffer); err != nil {
+			return [2][]byte{}, [][2]int{}, 0, 0, true, fmt.Errorf("failed to read time varint: %w", err)
+		}
+	}
+	for {
+		chunks, _, err := readVarBytes(buffer)
+		if err != nil {
+			return [2][]byte{}, [][2]int{}, 0, 0, true, fmt.Errorf("failed to read content type varbytes: %w", err)
+		}
+		if len(chunks) == 0 {
+			break
+		}
+		if _, _, err := readString(buffer); err != nil {
+			return [2][]byte{}, [][2]int{}, 0, 0, true, fmt.Errorf("failed to read content type string: %w", err)
+		}
+	}
+	kinds, _, err := readChunkKinds(buffer)
+	if err != nil {
+		return [2][]byte{}, [][2]int{}, 0, 0, true, err
+	}
+	skip := make([]bool, chunkCount)
+	for kind, chunks := range kinds {
+		if !kind.Informative() {
+			continue
+		}
+		if err := forEachChunk(chunks, chunkCount, func(chunk int) {
+			skip[chunk] = true
+		}); err != nil {
+			return [2][]byte{}, [][2]int{}, 0, 0, true, fmt.Errorf("chunk kind %w", err)
+		}
+	}
+	if !slices.Contains(skip, true) {
+		return [2][]byte{clientData, serverData}, dataSizes, clientBytes, serverBytes, true, nil
+	}
+
+	// Drop the informative chunks
+	data := [2][]byte{clientData, serverData}
+	filteredData := [2][]byte{}
+	filteredSizes := [][2]int{{}}
+	for chunk := range chunkCount {
+		start, end := dataSizes[chunk], dataSizes[chunk+1]
+		if skip[chunk] {
+			continue
+		}
+		last := filteredSizes[len(filteredSizes)-1]
+		for dir := range data {
+			filteredData[dir] = append(filteredData[dir], data[dir][start[dir]:end[dir]]...)
+			last[dir] += end[dir] - start[dir]
+		}
+		filteredSizes = append(filteredSizes, last)
+	}
+	return filteredData, filteredSizes, uint64(len(filteredData[index.DirectionClientToServer])), uint64(len(filteredData[index.DirectionServerToClient])), true, nil
 }
 
 func (cachefile *cacheFile) truncateFile() error {
@@ -554,7 +825,7 @@ func (cachefile *cacheFile) truncateFile() error {
 			continue
 		}
 		// skip the stream
-		n, err := skipStream(reader)
+		n, _, _, err := skipStream(reader)
 		if err != nil {
 			return fmt.Errorf("failed to skip stream: %w", err)
 		}
@@ -580,9 +851,41 @@ func (cachefile *cacheFile) SetData(stream *index.Stream, convertedPackets []ind
 }
 
 func (cachefile *cacheFile) setData(streamID uint64, streamTime time.Time, convertedPackets []index.Data) error {
+	return cachefile.writeStream(streamID, streamTime, convertedPackets, "", nil)
+}
+
+// SetFailed records that the conversion of the stream failed, the stream
+// is not converted again until the cache is reset or, if the error is a
+// MissingTLSKeysError, until the secrets arrive.
+func (cachefile *cacheFile) SetFailed(stream *index.Stream, failure error) error {
+	message := failure.Error()
+	if message == "" {
+		message = "unknown error"
+	}
+	missingTLSKeys := (*tlskeylog.ClientRandom)(nil)
+	if missing := (*MissingTLSKeysError)(nil); errors.As(failure, &missing) {
+		missingTLSKeys = &missing.ClientRandom
+	}
+	return cachefile.writeStream(stream.ID(), stream.FirstPacket(), nil, message, missingTLSKeys)
+}
+
+func (cachefile *cacheFile) writeStream(streamID uint64, streamTime time.Time, convertedPackets []index.Data, failure string, missingTLSKeys *tlskeylog.ClientRandom) error {
 	cachefile.rwmutex.Lock()
 	defer cachefile.rwmutex.Unlock()
 
+	if cachefile.readOnly {
+		return errReadOnly
+	}
+	if cachefile.file == nil {
+		file, err := os.OpenFile(cachefile.cachePath, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to create cache file: %w", err)
+		}
+		cachefile.file = file
+		if err := cachefile.reset(); err != nil {
+			return fmt.Errorf("failed to reset cache file: %w", err)
+		}
+	}
 	if cachefile.freeSize >= cleanupMinFreeSize && cachefile.freeSize >= int64(float64(cachefile.fileSize)*cleanupMinFreeFactor) {
 		if err := cachefile.truncateFile(); err != nil {
 			return fmt.Errorf("failed to truncate file: %w", err)
@@ -639,9 +942,10 @@ func (cachefile *cacheFile) setData(streamID uint64, streamTime time.Time, conve
 		}
 	}
 
-	// Write times and collect content types
+	// Write times and collect content types and chunk kinds
 	lastTime := streamTime
 	contentTypes := map[string][]byte{}
+	kinds := map[index.ChunkKind][]byte{}
 	for i, convertedPacket := range convertedPackets {
 		relTime := convertedPacket.Time.Sub(lastTime)
 		bytesWritten, err := writeVarInt(writer, uint64(relTime.Microseconds()))
@@ -651,6 +955,15 @@ func (cachefile *cacheFile) setData(streamID uint64, streamTime time.Time, conve
 		streamSize += uint64(bytesWritten)
 		lastTime = lastTime.Add(relTime)
 
+		if kind := convertedPacket.Kind; kind != index.ChunkKindData {
+			bm := kinds[kind]
+			for i >= len(bm)*8 {
+				bm = append(bm, 0)
+			}
+			bm[i/8] |= 1 << (i & 7)
+			kinds[kind] = bm
+		}
+
 		ct := convertedPacket.ContentType
 		if ct == "" {
 			continue
@@ -684,14 +997,55 @@ func (cachefile *cacheFile) setData(streamID uint64, streamTime time.Time, conve
 	}
 	streamSize++
 
+	// Write chunk kinds
+	for kind, chunks := range kinds {
+		// Write chunk bitmask
+		bytesWritten, err := writeVarBytes(writer, chunks)
+		if err != nil {
+			return fmt.Errorf("failed to write chunk kind bitmask: %w", err)
+		}
+		streamSize += uint64(bytesWritten)
+		// Write kind
+		bytesWritten, err = writeVarInt(writer, uint64(kind))
+		if err != nil {
+			return fmt.Errorf("failed to write chunk kind: %w", err)
+		}
+		streamSize += uint64(bytesWritten)
+	}
+	// Write ending zero chunk bitmask
+	if err := writer.WriteByte(0); err != nil {
+		return fmt.Errorf("failed to write ending zero chunk kind bitmask: %w", err)
+	}
+	streamSize++
+
+	// Write failure message
+	bytesWritten, err := writeString(writer, failure)
+	if err != nil {
+		return fmt.Errorf("failed to write failure message: %w", err)
+	}
+	streamSize += uint64(bytesWritten)
+
+	// Write client random of missing TLS keys
+	random := []byte(nil)
+	if missingTLSKeys != nil {
+		random = missingTLSKeys[:]
+	}
+	bytesWritten, err = writeString(writer, string(random))
+	if err != nil {
+		return fmt.Errorf("failed to write client random: %w", err)
+	}
+	streamSize += uint64(bytesWritten)
+
 	if err := writer.Flush(); err != nil {
 		return fmt.Errorf("failed to flush writer: %w", err)
 	}
 
 	// Remember where to look for this stream.
 	cachefile.streamInfos[streamID] = streamInfo{
-		offset: cachefile.fileSize + streamHeaderSize,
-		size:   streamSize,
+		offset:         cachefile.fileSize + streamHeaderSize,
+		size:           streamSize,
+		failure:        failure,
+		missingTLSKeys: missingTLSKeys,
 	}
 
 	if cachefile.freeStart == cachefile.fileSize {
@@ -703,26 +1057,99 @@ func (cachefile *cacheFile) setData(streamID uint64, streamTime time.Time, conve
 }
 
 func (cachefile *cacheFile) InvalidateChangedStreams(streams *bitmask.LongBitmask) bitmask.LongBitmask {
-	invalidatedStreams := bitmask.LongBitmask{}
+	// the streams will be re-added when they are converted again
+	return cachefile.forgetStreams(streams)
+}
+
+// EvictStreams drops the given streams from the cache without rewriting
+// the file, the space is reclaimed by the next cleanup. It returns the
+// streams that were cached.
+func (cachefile *cacheFile) EvictStreams(streams *bitmask.LongBitmask) bitmask.LongBitmask {
+	return cachefile.forgetStreams(streams)
+}
+
+// forgetStreams deletes the streams from the in-memory index and marks
+// their space as free.
+func (cachefile *cacheFile) forgetStreams(streams *bitmask.LongBitmask) bitmask.LongBitmask {
+	forgottenStreams := bitmask.LongBitmask{}
 
 	cachefile.rwmutex.Lock()
 	defer cachefile.rwmutex.Unlock()
 
 	// see which of the streams are in the cache
 	for streamID := uint(0); streams.Next(&streamID); streamID++ {
-		// delete the stream from the in-memory index
-		// it will be re-added when the stream is converted again
 		if info, ok := cachefile.streamInfos[uint64(streamID)]; ok {
 			cachefile.freeSize += int64(info.size) + streamHeaderSize
 			if cachefile.freeStart > info.offset-streamHeaderSize {
 				cachefile.freeStart = info.offset - streamHeaderSize
 			}
 			delete(cachefile.streamInfos, uint64(streamID))
-			invalidatedStreams.Set(streamID)
+			forgottenStreams.Set(streamID)
+		}
+	}
+
+	return forgottenStreams
+}
+
+// RemoveStreams drops the given streams from the cache and compacts the
+// file, it returns the number of bytes freed.
+func (cachefile *cacheFile) RemoveStreams(streams *bitmask.LongBitmask) (int64, error) {
+	cachefile.rwmutex.Lock()
+	defer cachefile.rwmutex.Unlock()
+
+	if cachefile.readOnly {
+		return 0, errReadOnly
+	}
+	sizeBefore := cachefile.fileSize
+	removed := false
+	for streamID := uint(0); streams.Next(&streamID); streamID++ {
+		if info, ok := cachefile.streamInfos[uint64(streamID)]; ok {
+			cachefile.freeSize += int64(info.size) + streamHeaderSize
+			if cachefile.freeStart > info.offset-streamHeaderSize {
+				cachefile.freeStart = info.offset - streamHeaderSize
+			}
+			delete(cachefile.streamInfos, uint64(streamID))
+			removed = true
 		}
 	}
+	if !removed {
+		return 0, nil
+	}
+	if err := cachefile.truncateFile(); err != nil {
+		return 0, err
+	}
+	return sizeBefore - cachefile.fileSize, nil
+}
+
+// RemoveStreamsMissingTLSKeys drops the streams that failed because the
+// secrets of one of the client randoms were missing from the cache, so
+// they are converted again. It returns the removed streams.
+func (cachefile *cacheFile) RemoveStreamsMissingTLSKeys(randoms map[tlskeylog.ClientRandom]struct{}) (bitmask.LongBitmask, error) {
+	streams := bitmask.LongBitmask{}
+	cachefile.rwmutex.RLock()
+	for streamID, info := range cachefile.streamInfos {
+		if info.missingTLSKeys == nil {
+			continue
+		}
+		if _, ok := randoms[*info.missingTLSKeys]; ok {
+			streams.Set(uint(streamID))
+		}
+	}
+	cachefile.rwmutex.RUnlock()
+	if streams.IsZero() {
+		return streams, nil
+	}
+	if _, err := cachefile.RemoveStreams(&streams); err != nil {
+		return bitmask.LongBitmask{}, err
+	}
+	return streams, nil
+}
+
+func (cachefile *cacheFile) Size() int64 {
+	cachefile.rwmutex.RLock()
+	defer cachefile.rwmutex.RUnlock()
 
-	return invalidatedStreams
+	return cachefile.fileSize
 }
 
 // func (writer *writer) invalidateStream(stream *index.Stream) error {
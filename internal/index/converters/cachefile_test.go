@@ -3,12 +3,16 @@ package converters
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/spq/pkappa2/internal/index"
+	"github.com/spq/pkappa2/internal/tools/bitmask"
+	tlskeylog "github.com/spq/pkappa2/internal/tools/tlsKeylog"
 )
 
 func TestVarIntRoundtrip(t *testing.T) {
@@ -101,7 +105,7 @@ func TestCachefile(t *testing.T) {
 	// Create a new cache file
 	cacheFilePath := fmt.Sprintf("%s/test.cache", t.TempDir())
 
-	cf, err := NewCacheFile(cacheFilePath)
+	cf, err := NewCacheFile(cacheFilePath, Fingerprint{})
 	if err != nil {
 		t.Fatalf("failed to create cache file: %v", err)
 	}
@@ -167,8 +171,8 @@ func TestCachefile(t *testing.T) {
 	if err := cf.setData(123, t1, packets); err != nil {
 		t.Fatalf("failed to write stream: %v", err)
 	}
-	if cf.streamInfos[123].offset != 16 {
-		t.Fatalf("stream offset = %d, want 16", cf.streamInfos[123].offset)
+	if cf.streamInfos[123].offset != 48 {
+		t.Fatalf("stream offset = %d, want 48", cf.streamInfos[123].offset)
 	}
 
 	check := func() {
@@ -207,7 +211,7 @@ func TestCachefile(t *testing.T) {
 		if bytesDirectionServerToClient != wantBytesDirectionServerToClient {
 			t.Errorf("bytesDirectionServerToClient = %d, want %d", bytesDirectionServerToClient, wantBytesDirectionServerToClient)
 		}
-		data, lengths, clientBytes, serverBytes, present, err := cf.DataForSearch(123)
+		data, lengths, clientBytes, serverBytes, present, err := cf.DataForSearch(123, false)
 		if err != nil {
 			t.Fatalf("DataForSearch failed: %v", err)
 		}
@@ -252,15 +256,15 @@ func TestCachefile(t *testing.T) {
 		t.Fatalf("cache file size = %d, want %d", len(data), wantFileSize)
 	}
 
-	cf, err = NewCacheFile(cacheFilePath)
+	cf, err = NewCacheFile(cacheFilePath, Fingerprint{})
 	if err != nil {
 		t.Fatalf("failed to reopen cache file: %v", err)
 	}
-	if cf.streamInfos[123].offset != 16 {
-		t.Fatalf("after reopen, stream offset = %d, want 16", cf.streamInfos[123].offset)
+	if cf.streamInfos[123].offset != 48 {
+		t.Fatalf("after reopen, stream offset = %d, want 48", cf.streamInfos[123].offset)
 	}
-	if cf.streamInfos[123].size != uint64(wantFileSize-16) {
-		t.Fatalf("after reopen, stream size = %d, want %d", cf.streamInfos[123].size, wantFileSize-16)
+	if cf.streamInfos[123].size != uint64(wantFileSize-48) {
+		t.Fatalf("after reopen, stream size = %d, want %d", cf.streamInfos[123].size, wantFileSize-48)
 	}
 	check()
 
@@ -278,16 +282,465 @@ func TestCachefile(t *testing.T) {
 		t.Fatalf("failed to read cache file: %v", err)
 	}
 	t.Logf("Cache content: %q", string(data2))
-	if int64(len(data2)) != wantFileSize*2-8 {
-		t.Fatalf("cache file size = %d, want %d", len(data2), wantFileSize*2-8)
+	if int64(len(data2)) != wantFileSize*2-40 {
+		t.Fatalf("cache file size = %d, want %d", len(data2), wantFileSize*2-40)
 	}
 
-	cf, err = NewCacheFile(cacheFilePath)
+	cf, err = NewCacheFile(cacheFilePath, Fingerprint{})
 	if err != nil {
 		t.Fatalf("failed to reopen cache file after re-adding stream: %v", err)
 	}
-	if cf.streamInfos[123].offset != 16 {
-		t.Fatalf("after re-adding, stream offset = %d, want %d", cf.streamInfos[123].offset, 16)
+	if cf.streamInfos[123].offset != 48 {
+		t.Fatalf("after re-adding, stream offset = %d, want %d", cf.streamInfos[123].offset, 48)
+	}
+	check()
+}
+
+func TestCachefileRemoveStreams(t *testing.T) {
+	cf, err := NewCacheFile(fmt.Sprintf("%s/test.cache", t.TempDir()), Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to create cache file: %v", err)
+	}
+	t.Cleanup(func() {
+		cf.Close()
+	})
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := uint64(0); i < 3; i++ {
+		packets := []index.Data{{
+			Direction: index.DirectionClientToServer,
+			Content:   []byte(fmt.Sprintf("stream %d", i)),
+			Time:      t1,
+		}}
+		if err := cf.setData(i, t1, packets); err != nil {
+			t.Fatalf("failed to write stream: %v", err)
+		}
+	}
+	sizeBefore := cf.Size()
+	streams := bitmask.LongBitmask{}
+	streams.Set(0)
+	streams.Set(5)
+	freed, err := cf.RemoveStreams(&streams)
+	if err != nil {
+		t.Fatalf("RemoveStreams failed: %v", err)
+	}
+	if freed <= 0 || cf.Size() != sizeBefore-freed {
+		t.Fatalf("RemoveStreams freed %d bytes, size %d -> %d", freed, sizeBefore, cf.Size())
+	}
+	if cf.Contains(0) || !cf.Contains(1) || !cf.Contains(2) {
+		t.Fatalf("cache contains wrong streams after RemoveStreams")
+	}
+	for i := uint64(1); i < 3; i++ {
+		got, _, _, err := cf.data(i, t1)
+		if err != nil {
+			t.Fatalf("failed to read stream: %v", err)
+		}
+		if len(got) != 1 || string(got[0].Content) != fmt.Sprintf("stream %d", i) {
+			t.Errorf("stream %d = %v after RemoveStreams", i, got)
+		}
+	}
+	fi, err := os.Stat(cf.cachePath)
+	if err != nil {
+		t.Fatalf("failed to stat cache file: %v", err)
+	}
+	if fi.Size() != cf.Size() {
+		t.Errorf("cache file size = %d, want %d", fi.Size(), cf.Size())
+	}
+}
+
+func TestCachefileReadOnly(t *testing.T) {
+	cachePath := fmt.Sprintf("%s/test.cache", t.TempDir())
+	cf, err := NewReadOnlyCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to open missing cache file: %v", err)
+	}
+	if cf.StreamCount() != 0 {
+		t.Errorf("missing cache file contains %d streams", cf.StreamCount())
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatalf("failed to close cache file: %v", err)
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Fatalf("read-only cache file was created: %v", err)
+	}
+
+	cf, err = NewCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to create cache file: %v", err)
+	}
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	packets := []index.Data{{
+		Direction: index.DirectionClientToServer,
+		Content:   []byte("stream 1"),
+		Time:      t1,
+	}}
+	if err := cf.setData(1, t1, packets); err != nil {
+		t.Fatalf("failed to write stream: %v", err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatalf("failed to close cache file: %v", err)
+	}
+	before, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatalf("failed to read cache file: %v", err)
+	}
+
+	cf, err = NewReadOnlyCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to open cache file: %v", err)
+	}
+	got, _, _, err := cf.data(1, t1)
+	if err != nil {
+		t.Fatalf("failed to read stream: %v", err)
+	}
+	if len(got) != 1 || string(got[0].Content) != "stream 1" {
+		t.Errorf("stream 1 = %v", got)
+	}
+	if err := cf.setData(2, t1, packets); err != errReadOnly {
+		t.Errorf("setData on read-only cache file returned %v", err)
+	}
+	if err := cf.Reset(); err != errReadOnly {
+		t.Errorf("Reset on read-only cache file returned %v", err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatalf("failed to close cache file: %v", err)
+	}
+	after, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatalf("failed to read cache file: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("read-only cache file was modified")
+	}
+}
+
+func TestCachefileCreatedLazily(t *testing.T) {
+	cachePath := fmt.Sprintf("%s/test.cache", t.TempDir())
+	cf, err := NewCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to open missing cache file: %v", err)
+	}
+	if err := cf.Reset(); err != nil {
+		t.Fatalf("failed to reset cache file: %v", err)
+	}
+	if cf.Size() != 0 {
+		t.Errorf("missing cache file has size %d", cf.Size())
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Fatalf("cache file was created before storing a stream: %v", err)
+	}
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := cf.setData(1, t1, []index.Data{{Content: []byte("stream 1"), Time: t1}}); err != nil {
+		t.Fatalf("failed to write stream: %v", err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatalf("failed to close cache file: %v", err)
+	}
+
+	cf, err = NewCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to open cache file: %v", err)
+	}
+	defer cf.Close()
+	got, _, _, err := cf.data(1, t1)
+	if err != nil {
+		t.Fatalf("failed to read stream: %v", err)
+	}
+	if len(got) != 1 || string(got[0].Content) != "stream 1" {
+		t.Errorf("stream 1 = %v", got)
+	}
+}
+
+func TestCacheFileFailedStreams(t *testing.T) {
+	cachePath := fmt.Sprintf("%s/test.cache", t.TempDir())
+	cf, err := NewCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to create cache file: %v", err)
+	}
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	packets := []index.Data{{
+		Direction: index.DirectionClientToServer,
+		Content:   []byte("stream 1"),
+		Time:      t1,
+	}}
+	if err := cf.setData(1, t1, packets); err != nil {
+		t.Fatalf("failed to write stream: %v", err)
+	}
+	if err := cf.writeStream(2, t1, nil, "timeout exceeded", nil); err != nil {
+		t.Fatalf("failed to write failed stream: %v", err)
+	}
+	random := tlskeylog.ClientRandom{1, 2, 3}
+	missing := &MissingTLSKeysError{ClientRandom: random}
+	if err := cf.writeStream(3, t1, nil, missing.Error(), &missing.ClientRandom); err != nil {
+		t.Fatalf("failed to write failed stream: %v", err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatalf("failed to close cache file: %v", err)
+	}
+
+	cf, err = NewCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to open cache file: %v", err)
+	}
+	defer cf.Close()
+	if got, want := cf.StreamCount(), uint64(3); got != want {
+		t.Errorf("StreamCount() = %d, want %d", got, want)
+	}
+	if got, want := cf.FailedStreamCount(), uint64(2); got != want {
+		t.Errorf("FailedStreamCount() = %d, want %d", got, want)
+	}
+	if got, _, _, err := cf.data(1, t1); err != nil || len(got) != 1 || string(got[0].Content) != "stream 1" {
+		t.Errorf("data(1) = %v, %v", got, err)
+	}
+	if _, _, _, err := cf.data(2, t1); !errors.Is(err, ErrConversionFailed) || !strings.Contains(err.Error(), "timeout exceeded") {
+		t.Errorf("data(2) returned error %v, want %v", err, ErrConversionFailed)
+	}
+	if _, _, _, _, ok, err := cf.DataForSearch(2, false); ok || err != nil {
+		t.Errorf("DataForSearch(2) = %v, %v, want false, nil", ok, err)
+	}
+	// only the stream missing the added keys is removed
+	removed, err := cf.RemoveStreamsMissingTLSKeys(map[tlskeylog.ClientRandom]struct{}{{4}: {}})
+	if err != nil || !removed.IsZero() {
+		t.Errorf("RemoveStreamsMissingTLSKeys(unknown) = %v, %v, want no streams", removed, err)
+	}
+	removed, err = cf.RemoveStreamsMissingTLSKeys(map[tlskeylog.ClientRandom]struct{}{random: {}})
+	if err != nil || removed.OnesCount() != 1 || !removed.IsSet(3) {
+		t.Errorf("RemoveStreamsMissingTLSKeys(random) = %v, %v, want stream 3", removed, err)
+	}
+	if got, want := cf.FailedStreamCount(), uint64(1); got != want {
+		t.Errorf("FailedStreamCount() = %d, want %d", got, want)
+	}
+}
+
+func TestCachefileEvictStreams(t *testing.T) {
+	cachePath := fmt.Sprintf("%s/test.cache", t.TempDir())
+	cf, err := NewCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to create cache file: %v", err)
+	}
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := uint64(0); i < 3; i++ {
+		packets := []index.Data{{
+			Direction: index.DirectionClientToServer,
+			Content:   []byte(fmt.Sprintf("stream %d", i)),
+			Time:      t1,
+		}}
+		if err := cf.setData(i, t1, packets); err != nil {
+			t.Fatalf("failed to write stream: %v", err)
+		}
+	}
+	sizeBefore := cf.Size()
+	streams := bitmask.LongBitmask{}
+	streams.Set(1)
+	streams.Set(5)
+	evicted := cf.EvictStreams(&streams)
+	if evicted.OnesCount() != 1 || !evicted.IsSet(1) {
+		t.Errorf("EvictStreams returned %v, want stream 1", evicted.Mask())
+	}
+	if cf.Contains(1) || !cf.Contains(0) || !cf.Contains(2) {
+		t.Fatalf("cache contains wrong streams after EvictStreams")
+	}
+	// the space is only reclaimed when the file is cleaned up
+	if cf.Size() != sizeBefore {
+		t.Errorf("EvictStreams changed the size from %d to %d", sizeBefore, cf.Size())
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatalf("failed to close cache file: %v", err)
+	}
+
+	cf, err = NewCacheFile(cachePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to open cache file: %v", err)
+	}
+	defer cf.Close()
+	if cf.StreamCount() != 2 || cf.Contains(1) {
+		t.Errorf("evicted stream was loaded again")
+	}
+	if cf.Size() >= sizeBefore {
+		t.Errorf("cache file size = %d, want less than %d", cf.Size(), sizeBefore)
+	}
+	if got, _, _, err := cf.data(2, t1); err != nil || len(got) != 1 || string(got[0].Content) != "stream 2" {
+		t.Errorf("data(2) = %v, %v", got, err)
+	}
+}
+
+func TestCachefileFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	converterPath := fmt.Sprintf("%s/converter.py", dir)
+	write := func(content string) Fingerprint {
+		if err := os.WriteFile(converterPath, []byte(content), 0755); err != nil {
+			t.Fatalf("failed to write converter: %v", err)
+		}
+		fingerprint, err := ReadFingerprint(converterPath)
+		if err != nil {
+			t.Fatalf("ReadFingerprint failed: %v", err)
+		}
+		return fingerprint
+	}
+	v1 := write("#!/usr/bin/env python3\n# pkappa2-version: 1\n")
+	v1Changed := write("#!/usr/bin/env python3\n# pkappa2-version: 1\n# comment\n")
+	v2 := write("#!/usr/bin/env python3\n# pkappa2-version: 2\n")
+	unversioned := write("#!/usr/bin/env python3\n")
+	if v1.Version != "1" || v2.Version != "2" || unversioned.Version != "" {
+		t.Fatalf("ReadFingerprint returned versions %q, %q and %q", v1.Version, v2.Version, unversioned.Version)
+	}
+	if v1.Hash == v1Changed.Hash || !v1.Equal(v1Changed) {
+		t.Errorf("changes keeping the declared version must keep the cache")
+	}
+	if v1.Equal(v2) || v1.Equal(unversioned) {
+		t.Errorf("changing the declared version must drop the cache")
+	}
+
+	cachePath := fmt.Sprintf("%s/test.cache", dir)
+	cf, err := NewCacheFile(cachePath, v1)
+	if err != nil {
+		t.Fatalf("failed to create cache file: %v", err)
+	}
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := cf.setData(1, t1, []index.Data{{Direction: index.DirectionClientToServer, Content: []byte("1"), Time: t1}}); err != nil {
+		t.Fatalf("failed to write stream: %v", err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatalf("failed to close cache file: %v", err)
+	}
+	for _, tc := range []struct {
+		fingerprint Fingerprint
+		readOnly    bool
+		want        uint64
+	}{
+		{v1Changed, false, 1},
+		{v2, true, 0},
+		{v1, true, 1},
+		{v2, false, 0},
+		{v1, false, 0},
+	} {
+		open := NewCacheFile
+		if tc.readOnly {
+			open = NewReadOnlyCacheFile
+		}
+		cf, err := open(cachePath, tc.fingerprint)
+		if err != nil {
+			t.Fatalf("failed to open cache file: %v", err)
+		}
+		if cf.StreamCount() != tc.want {
+			t.Errorf("cache file opened with version %q (read-only: %v) contains %d streams, want %d", tc.fingerprint.Version, tc.readOnly, cf.StreamCount(), tc.want)
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatalf("failed to close cache file: %v", err)
+		}
+	}
+}
+
+func TestCachefileChunkKinds(t *testing.T) {
+	cacheFilePath := fmt.Sprintf("%s/test.cache", t.TempDir())
+	cf, err := NewCacheFile(cacheFilePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to create cache file: %v", err)
+	}
+	t.Cleanup(func() {
+		cf.Close()
+	})
+
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	packets := []index.Data{
+		{
+			Direction: index.DirectionClientToServer,
+			Content:   []byte("GET / HTTP/1.1\r\n\r\n"),
+			Time:      t1,
+		},
+		{
+			Direction: index.DirectionClientToServer,
+			Content:   []byte("requests.get('/')"),
+			Time:      t1,
+			Kind:      index.ChunkKindInfo,
+		},
+		{
+			Direction: index.DirectionServerToClient,
+			Content:   []byte("HTTP/1.1 200 OK\r\n\r\n"),
+			Time:      t1.Add(time.Second),
+		},
+		{
+			Direction:   index.DirectionServerToClient,
+			Content:     []byte("\x89PNG"),
+			Time:        t1.Add(time.Second),
+			ContentType: "image/png",
+		},
+		{
+			Direction: index.DirectionServerToClient,
+			Content:   []byte("truncated image"),
+			Time:      t1.Add(time.Second),
+			Kind:      index.ChunkKindAnnotation,
+		},
+		{
+			Direction: index.DirectionClientToServer,
+			Content:   []byte("bye"),
+			Time:      t1.Add(2 * time.Second),
+		},
+	}
+	if err := cf.setData(1, t1, packets); err != nil {
+		t.Fatalf("failed to write stream: %v", err)
+	}
+
+	check := func() {
+		got, _, _, err := cf.data(1, t1)
+		if err != nil {
+			t.Fatalf("failed to read stream: %v", err)
+		}
+		if len(got) != len(packets) {
+			t.Fatalf("read back %d packets, want %d", len(got), len(packets))
+		}
+		for i := range got {
+			if got[i].Kind != packets[i].Kind {
+				t.Errorf("packet %d: kind = %v, want %v", i, got[i].Kind, packets[i].Kind)
+			}
+			if got[i].ContentType != packets[i].ContentType {
+				t.Errorf("packet %d: content type = %v, want %v", i, got[i].ContentType, packets[i].ContentType)
+			}
+		}
+
+		for _, tc := range []struct {
+			informative bool
+			want        [2]string
+			wantLengths [][2]int
+		}{
+			{
+				informative: false,
+				want:        [2]string{"GET / HTTP/1.1\r\n\r\nbye", "HTTP/1.1 200 OK\r\n\r\n\x89PNG"},
+				wantLengths: [][2]int{{0, 0}, {18, 0}, {18, 19}, {18, 23}, {21, 23}},
+			},
+			{
+				informative: true,
+				want:        [2]string{"GET / HTTP/1.1\r\n\r\nrequests.get('/')bye", "HTTP/1.1 200 OK\r\n\r\n\x89PNGtruncated image"},
+				wantLengths: [][2]int{{0, 0}, {18, 0}, {35, 0}, {35, 19}, {35, 23}, {35, 38}, {38, 38}},
+			},
+		} {
+			data, lengths, clientBytes, serverBytes, present, err := cf.DataForSearch(1, tc.informative)
+			if err != nil || !present {
+				t.Fatalf("DataForSearch(informative: %v) = %v, %v", tc.informative, present, err)
+			}
+			if string(data[0]) != tc.want[0] || string(data[1]) != tc.want[1] {
+				t.Errorf("DataForSearch(informative: %v): data = %q, want %q", tc.informative, data, tc.want)
+			}
+			if clientBytes != uint64(len(tc.want[0])) || serverBytes != uint64(len(tc.want[1])) {
+				t.Errorf("DataForSearch(informative: %v): bytes = %d/%d, want %d/%d", tc.informative, clientBytes, serverBytes, len(tc.want[0]), len(tc.want[1]))
+			}
+			if fmt.Sprint(lengths) != fmt.Sprint(tc.wantLengths) {
+				t.Errorf("DataForSearch(informative: %v): lengths = %v, want %v", tc.informative, lengths, tc.wantLengths)
+			}
+		}
+	}
+	check()
+
+	// Add another stream so the first one has to be skipped when reopening
+	if err := cf.setData(2, t1, packets); err != nil {
+		t.Fatalf("failed to write stream: %v", err)
+	}
+	cf.Close()
+	cf, err = NewCacheFile(cacheFilePath, Fingerprint{})
+	if err != nil {
+		t.Fatalf("failed to reopen cache file: %v", err)
+	}
+	if cf.StreamCount() != 2 {
+		t.Fatalf("after reopen, stream count = %d, want 2", cf.StreamCount())
 	}
 	check()
 }
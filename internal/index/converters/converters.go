@@ -3,11 +3,14 @@ package converters
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spq/pkappa2/internal/index"
@@ -15,12 +18,19 @@ import (
 
 const (
 	MAX_PROCESS_COUNT = 8
+
+	// the format of the times in the JSON protocol
+	chunkTimeFormat = "2006-01-02T15:04:05.999999999"
 )
 
 type (
-	Converter struct {
+	// ProcessConverter runs an executable speaking the JSON protocol, or
+	// connects to a converter service speaking it.
+	ProcessConverter struct {
 		executablePath string
-		name           string
+		// address of the converter service, empty for executables
+		address string
+		name    string
 		// Keep track of when a process was claimed by a stream.
 		// If the epoch changed since the process was claimed, the process is no longer valid.
 		reset_epoch int
@@ -37,35 +47,88 @@ type (
 		available_processes []*Process
 		// Processes that died unexpectedly.
 		failed_processes []*Process
+		// Number of processes started by test runs, they count against
+		// MAX_PROCESS_COUNT but aren't reused.
+		test_processes int
+		// Limits for the processes, guarded by `mutex`.
+		limits Limits
 	}
 	ProcessStats struct {
 		Running  bool
 		ExitCode int
 		Pid      int
 		Errors   int
+		// Converter is the stage of a pipeline the process belongs to
+		Converter string `json:",omitempty"`
+		// State is the protocol step the process is in since StateChanged,
+		// StreamID the stream it converts unless it awaits the metadata
+		// of the next one
+		State        ProcessState
+		StateChanged time.Time
+		StreamID     uint64
+		// LastFailure is the last stream the process failed to convert
+		LastFailure *Conversion `json:",omitempty"`
 	}
 	ProcessStderr struct {
-		Pid    int
+		Pid int
+		// Stderr is the output written while no stream was converted
 		Stderr []string
+		// Conversions are the logs of the last streams that wrote to
+		// stderr or failed and of the current stream
+		Conversions []Conversion
 	}
 	// JSON Protocol
 	converterStreamMetadata struct {
-		StreamID   uint64
-		ClientHost string
-		ClientPort uint16
-		ServerHost string
-		ServerPort uint16
-		Protocol   string
+		StreamID    uint64
+		ClientHost  string
+		ClientPort  uint16
+		ServerHost  string
+		ServerPort  uint16
+		Protocol    string
+		FirstPacket string
+		LastPacket  string
+		ClientBytes uint64
+		ServerBytes uint64
+		// the names of the tags, services and marks matching the stream
+		// when it is converted, without their prefix
+		Tags     []string
+		Services []string
+		Marks    []string
+		// the pcap files containing the packets of the stream
+		Pcaps []string
+	}
+	// converterResultMetadata is sent after the converted chunks
+	converterResultMetadata struct {
+		Tags []string
+		// Error is set by converters refusing the stream, e.g. because
+		// it isn't supported
+		Error string `json:",omitempty"`
 	}
 	converterStreamChunk struct {
 		Direction   string
 		Content     string
 		Time        string
-		ContentType string `json:",omitempty"`
+		ContentType string          `json:",omitempty"`
+		Kind        index.ChunkKind `json:",omitempty"`
+	}
+	// transientError marks errors that are not caused by the converted
+	// stream, the failure is not cached and the stream is converted again.
+	transientError struct {
+		error
+	}
+	// deterministicError marks errors caused by the converted stream, e.g.
+	// unsupported input or output exceeding the limits. The failure is
+	// cached, so the stream isn't converted again. Other failures like
+	// crashing processes are retried.
+	deterministicError struct {
+		error
 	}
 )
 
 var (
+	ErrTimeout     = errors.New("timeout exceeded")
+	ErrOutputLimit = errors.New("output limit exceeded")
+
 	directionsToString = map[index.Direction]string{
 		index.DirectionClientToServer: "client-to-server",
 		index.DirectionServerToClient: "server-to-client",
@@ -76,8 +139,74 @@ var (
 	}
 )
 
-func New(converterName, executablePath string) *Converter {
-	converter := Converter{
+func (err transientError) Unwrap() error {
+	return err.error
+}
+
+func (err deterministicError) Unwrap() error {
+	return err.error
+}
+
+// makeStreamMetadata collects the information about the stream sent to
+// the converter before the chunks. tags are the full names of the tags
+// matching the stream, generated tags are left out as they depend on the
+// output of the converters.
+func makeStreamMetadata(stream *index.Stream, tags []string) (converterStreamMetadata, error) {
+	packets, err := stream.Packets()
+	if err != nil {
+		return converterStreamMetadata{}, err
+	}
+	metadata := converterStreamMetadata{
+		StreamID:    stream.ID(),
+		ClientHost:  stream.ClientHostIP(),
+		ClientPort:  stream.ClientPort,
+		ServerHost:  stream.ServerHostIP(),
+		ServerPort:  stream.ServerPort,
+		Protocol:    stream.Protocol(),
+		FirstPacket: stream.FirstPacket().Format(chunkTimeFormat),
+		LastPacket:  stream.LastPacket().Format(chunkTimeFormat),
+		ClientBytes: stream.ClientBytes,
+		ServerBytes: stream.ServerBytes,
+		Tags:        []string{},
+		Services:    []string{},
+		Marks:       []string{},
+		Pcaps:       []string{},
+	}
+	for _, tag := range tags {
+		prefix, name, _ := strings.Cut(tag, "/")
+		switch prefix {
+		case "tag":
+			metadata.Tags = append(metadata.Tags, name)
+		case "service":
+			metadata.Services = append(metadata.Services, name)
+		case "mark":
+			metadata.Marks = append(metadata.Marks, name)
+		}
+	}
+	for _, p := range packets {
+		if !slices.Contains(metadata.Pcaps, p.PcapFilename) {
+			metadata.Pcaps = append(metadata.Pcaps, p.PcapFilename)
+		}
+	}
+	return metadata, nil
+}
+
+// appendData appends a converted chunk to data. It is merged with the
+// previous chunk if both are in the same direction and of the same kind,
+// discarding the time of the new chunk in the process.
+// We don't support two consecutive packets in the same direction in the cache file format.
+// Would need to inject an empty chunk in the opposite direction to make it work if desired.
+func appendData(data []index.Data, chunk index.Data) []index.Data {
+	if len(data) > 0 && data[len(data)-1].Direction == chunk.Direction && data[len(data)-1].Kind == chunk.Kind && len(data[len(data)-1].ContentType) == 0 && len(chunk.ContentType) == 0 {
+		// Merge with previous packet if both don't have a content type.
+		data[len(data)-1].Content = append(data[len(data)-1].Content, chunk.Content...)
+		return data
+	}
+	return append(data, chunk)
+}
+
+func NewProcessConverter(converterName, executablePath string) *ProcessConverter {
+	converter := ProcessConverter{
 		executablePath:    executablePath,
 		name:              converterName,
 		signal:            make(chan struct{}),
@@ -87,31 +216,29 @@ func New(converterName, executablePath string) *Converter {
 	return &converter
 }
 
-func (converter *Converter) Name() string {
+// NewRemoteConverter talks to the converter service at the address, see
+// NewRemoteProcess. The connections are pooled like processes.
+func NewRemoteConverter(converterName, address string) *ProcessConverter {
+	converter := NewProcessConverter(converterName, "")
+	converter.address = address
+	return converter
+}
+
+func (converter *ProcessConverter) Name() string {
 	return converter.name
 }
 
-func (converter *Converter) ProcessStats() []ProcessStats {
+func (converter *ProcessConverter) ProcessStats() []ProcessStats {
 	converter.mutex.Lock()
 	defer converter.mutex.Unlock()
 
 	output := []ProcessStats{}
 	for process := range converter.started_processes {
-		output = append(output, ProcessStats{
-			Running:  true,
-			ExitCode: process.ExitCode(),
-			Pid:      process.Pid(),
-			Errors:   len(process.Stderr()),
-		})
+		output = append(output, makeProcessStats(process, true))
 	}
 	// Keep stderr and exitcode of processes that have exited.
 	for _, process := range converter.failed_processes {
-		output = append(output, ProcessStats{
-			Running:  false,
-			ExitCode: process.ExitCode(),
-			Pid:      process.Pid(),
-			Errors:   len(process.Stderr()),
-		})
+		output = append(output, makeProcessStats(process, false))
 	}
 	sort.Slice(output, func(i, j int) bool {
 		return output[i].Pid < output[j].Pid
@@ -119,7 +246,30 @@ func (converter *Converter) ProcessStats() []ProcessStats {
 	return output
 }
 
-func (converter *Converter) Stderr(pid int) *ProcessStderr {
+func makeProcessStats(process *Process, running bool) ProcessStats {
+	state, stateChanged, streamID, lastFailure := process.State()
+	return ProcessStats{
+		Running:      running,
+		ExitCode:     process.ExitCode(),
+		Pid:          process.Pid(),
+		Errors:       len(process.Stderr()),
+		State:        state,
+		StateChanged: stateChanged,
+		StreamID:     streamID,
+		LastFailure:  lastFailure,
+	}
+}
+
+func makeProcessStderr(process *Process) *ProcessStderr {
+	stderr, conversions := process.Logs()
+	return &ProcessStderr{
+		Stderr:      stderr,
+		Conversions: conversions,
+		Pid:         process.Pid(),
+	}
+}
+
+func (converter *ProcessConverter) Stderr(pid int) *ProcessStderr {
 	converter.mutex.Lock()
 	defer converter.mutex.Unlock()
 
@@ -127,29 +277,38 @@ func (converter *Converter) Stderr(pid int) *ProcessStderr {
 		if process.Pid() != pid {
 			continue
 		}
-		return &ProcessStderr{
-			Stderr: process.Stderr(),
-			Pid:    process.Pid(),
-		}
+		return makeProcessStderr(process)
 	}
 	for _, process := range converter.failed_processes {
 		if process.Pid() != pid {
 			continue
 		}
-		return &ProcessStderr{
-			Stderr: process.Stderr(),
-			Pid:    process.Pid(),
-		}
+		return makeProcessStderr(process)
 	}
 	return nil
 }
 
-func (converter *Converter) MaxProcessCount() int {
+func (converter *ProcessConverter) MaxProcessCount() int {
 	return MAX_PROCESS_COUNT
 }
 
+// Address returns the address of the converter service, or an empty
+// string for executables.
+func (converter *ProcessConverter) Address() string {
+	return converter.address
+}
+
+// Fingerprint hashes the converter executable. The version of a converter
+// service is unknown, its results are kept until the address changes.
+func (converter *ProcessConverter) Fingerprint() (Fingerprint, error) {
+	if converter.address != "" {
+		return remoteFingerprint(converter.address), nil
+	}
+	return ReadFingerprint(converter.executablePath)
+}
+
 // Stop the converter process.
-func (converter *Converter) Reset() {
+func (converter *ProcessConverter) Reset() {
 	converter.rwmutex.Lock()
 	defer converter.rwmutex.Unlock()
 
@@ -170,7 +329,19 @@ func (converter *Converter) Reset() {
 	converter.available_processes = nil
 }
 
-func (converter *Converter) reserveProcess() (*Process, int) {
+// SetLimits changes the limits of the converter processes. Running
+// processes are restarted to apply them.
+func (converter *ProcessConverter) SetLimits(limits Limits) {
+	converter.mutex.Lock()
+	changed := converter.limits != limits
+	converter.limits = limits
+	converter.mutex.Unlock()
+	if changed {
+		converter.Reset()
+	}
+}
+
+func (converter *ProcessConverter) reserveProcess() (*Process, int) {
 	// See if we want to stop the process and we're in a Reset call. Reset would grab a write lock.
 	converter.rwmutex.RLock()
 	defer converter.rwmutex.RUnlock()
@@ -186,8 +357,13 @@ func (converter *Converter) reserveProcess() (*Process, int) {
 			return process, converter.reset_epoch
 		}
 
-		if len(converter.started_processes) < MAX_PROCESS_COUNT {
-			process := NewProcess(converter.name, converter.executablePath)
+		if len(converter.started_processes)+converter.test_processes < MAX_PROCESS_COUNT {
+			var process *Process
+			if converter.address != "" {
+				process = NewRemoteProcess(converter.name, converter.address, converter.limits)
+			} else {
+				process = NewProcess(converter.name, converter.executablePath, converter.limits)
+			}
 			converter.started_processes[process] = struct{}{}
 			return process, converter.reset_epoch
 		}
@@ -201,7 +377,7 @@ func (converter *Converter) reserveProcess() (*Process, int) {
 	}
 }
 
-func (converter *Converter) releaseProcess(process *Process, reset_epoch int) bool {
+func (converter *ProcessConverter) releaseProcess(process *Process, reset_epoch int) bool {
 	converter.rwmutex.RLock()
 	defer converter.rwmutex.RUnlock()
 
@@ -217,11 +393,15 @@ func (converter *Converter) releaseProcess(process *Process, reset_epoch int) bo
 	if reset_epoch != converter.reset_epoch {
 		// The converter was reset while this process was running.
 		close(process.input)
+		// Don't wait for a process that doesn't respond anymore.
+		process.Kill()
 		// Drain the output until the process exits.
 		for range process.output {
 		}
+		<-process.exited
 		delete(converter.started_processes, process)
-		if process.ExitCode() != 0 || len(process.Stderr()) > 0 {
+		// Keep the logs of processes that failed to convert a stream.
+		if reset_epoch == -1 || process.ExitCode() != 0 || len(process.Stderr()) > 0 {
 			converter.failed_processes = append(converter.failed_processes, process)
 		}
 		return false
@@ -231,41 +411,79 @@ func (converter *Converter) releaseProcess(process *Process, reset_epoch int) bo
 	return true
 }
 
-func (converter *Converter) Data(stream *index.Stream, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, err error) {
-	// TODO: Start a timeout here, so that we don't wait forever for the converter to respond
-
+func (converter *ProcessConverter) Data(stream *index.Stream, streamTags []string, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, tags []string, err error) {
 	// Grab stream data before getting any locks, since this can take a while.
 	packets, err := stream.Data()
 	if err != nil {
-		return nil, 0, 0, fmt.Errorf("converter (%s): Failed to get packets: %w", converter.name, err)
+		return nil, 0, 0, nil, transientError{fmt.Errorf("converter (%s): Failed to get packets: %w", converter.name, err)}
 	}
+	return converter.convert(stream, streamTags, packets, moreDetails)
+}
 
-	metadata := converterStreamMetadata{
-		StreamID:   stream.ID(),
-		ClientHost: stream.ClientHostIP(),
-		ClientPort: stream.ClientPort,
-		ServerHost: stream.ServerHostIP(),
-		ServerPort: stream.ServerPort,
-		Protocol:   stream.Protocol(),
+// convert runs the converter on the given chunks of the stream.
+func (converter *ProcessConverter) convert(stream *index.Stream, streamTags []string, packets []index.Data, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, tags []string, err error) {
+
+	metadata, err := makeStreamMetadata(stream, streamTags)
+	if err != nil {
+		return nil, 0, 0, nil, transientError{fmt.Errorf("converter (%s): Failed to collect stream metadata: %w", converter.name, err)}
 	}
 
 	metadataEncoded, err := json.Marshal(metadata)
 	if err != nil {
-		return nil, 0, 0, fmt.Errorf("converter (%s): Failed to encode metadata: %w", converter.name, err)
+		return nil, 0, 0, nil, fmt.Errorf("converter (%s): Failed to encode metadata: %w", converter.name, err)
 	}
 
 	process, reset_epoch := converter.reserveProcess()
+	return converter.runStream(process, stream.ID(), metadataEncoded, packets, moreDetails, func(keep bool) bool {
+		if !keep {
+			return converter.releaseProcess(process, -1)
+		}
+		return converter.releaseProcess(process, reset_epoch)
+	})
+}
 
-	log.Printf("Converter (%s): Running for stream %d", converter.name, stream.ID())
+// runStream sends the stream to the process and reads the converted chunks.
+// release is called with keep set to false as soon as the process failed,
+// or with keep set to true after the stream was converted successfully.
+// It returns whether the process was kept.
+func (converter *ProcessConverter) runStream(process *Process, streamID uint64, metadataEncoded []byte, packets []index.Data, moreDetails bool, release func(keep bool) bool) (data []index.Data, clientBytes, serverBytes uint64, tags []string, err error) {
+	process.startStream()
+	process.beginConversion(streamID)
+	// Log why the conversion failed, successful conversions and streams
+	// refused by the converter end before the process is released.
+	ended := false
+	defer func() {
+		if err != nil && !ended {
+			process.endConversion(err)
+		}
+	}()
+
+	// Kill the process if it doesn't respond in time, all following reads
+	// and writes fail then.
+	timedOut := atomic.Bool{}
+	if timeout := process.limits.TimeoutSeconds; timeout != 0 {
+		timer := time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+			timedOut.Store(true)
+			process.Kill()
+		})
+		defer timer.Stop()
+		defer func() {
+			if err != nil && timedOut.Load() {
+				err = deterministicError{fmt.Errorf("converter (%s): %w after %d seconds", converter.name, ErrTimeout, timeout)}
+			}
+		}()
+	}
+
+	log.Printf("Converter (%s): Running for stream %d", converter.name, streamID)
 
 	// Initiate converter protocol
 	process.input <- append(metadataEncoded, '\n')
 
 	data = []index.Data{}
-	readOutputLine := func(line []byte) error {
+	parseOutputLine := func(line []byte) error {
 		var convertedPacket converterStreamChunk
 		if err := json.Unmarshal(line, &convertedPacket); err != nil {
-			converter.releaseProcess(process, -1)
+			release(false)
 			if moreDetails {
 				return fmt.Errorf("converter (%s): Failed to read converted packet: %w. Line:\n%s", converter.name, err, line)
 			}
@@ -273,7 +491,7 @@ func (converter *Converter) Data(stream *index.Stream, moreDetails bool) (data [
 		}
 		decodedData, err := base64.StdEncoding.DecodeString(convertedPacket.Content)
 		if err != nil {
-			converter.releaseProcess(process, -1)
+			release(false)
 			if moreDetails {
 				return fmt.Errorf("converter (%s): Failed to decode converted packet data: %w. Line:\n%s", converter.name, err, line)
 			}
@@ -282,31 +500,41 @@ func (converter *Converter) Data(stream *index.Stream, moreDetails bool) (data [
 
 		direction, ok := directionsToInt[convertedPacket.Direction]
 		if !ok {
-			converter.releaseProcess(process, -1)
+			release(false)
 			return fmt.Errorf("converter (%s): Invalid direction: %q", converter.name, convertedPacket.Direction)
 		}
 
-		time, err := time.Parse("2006-01-02T15:04:05.999999999", convertedPacket.Time)
+		time, err := time.Parse(chunkTimeFormat, convertedPacket.Time)
 		if err != nil {
-			converter.releaseProcess(process, -1)
+			release(false)
 			return fmt.Errorf("converter (%s): Failed to parse time: %w. Time:\n%s", converter.name, err, convertedPacket.Time)
 		}
 
-		// Merge with previous packet if both are in the same direction.
-		// Discard the time of this packet in the process.
-		// We don't support two consecutive packets in the same direction in the cache file format.
-		// Would need to inject an empty chunk in the opposite direction to make it work if desired.
-		if len(data) > 0 && data[len(data)-1].Direction == direction && len(data[len(data)-1].ContentType) == 0 && len(convertedPacket.ContentType) == 0 {
-			// Merge with previous packet if both don't have a content type.
-			data[len(data)-1].Content = append(data[len(data)-1].Content, decodedData...)
-		} else {
-			data = append(data, index.Data{Content: decodedData, Direction: direction, Time: time, ContentType: convertedPacket.ContentType})
-		}
+		data = appendData(data, index.Data{Content: decodedData, Direction: direction, Time: time, ContentType: convertedPacket.ContentType, Kind: convertedPacket.Kind})
 		if direction == index.DirectionClientToServer {
 			clientBytes += uint64(len(decodedData))
 		} else {
 			serverBytes += uint64(len(decodedData))
 		}
+		if limit := process.limits.MaxOutputBytes; limit != 0 && clientBytes+serverBytes > uint64(limit) {
+			process.Kill()
+			release(false)
+			return fmt.Errorf("converter (%s): %w of %d bytes", converter.name, ErrOutputLimit, limit)
+		}
+		return nil
+	}
+	// failures talking to a converter service aren't caused by the stream
+	remoteFailure := func() error {
+		if err := process.remoteError(); err != nil {
+			return transientError{fmt.Errorf("converter (%s): %w", converter.name, err)}
+		}
+		return nil
+	}
+	// invalid output is caused by the stream like exceeding the limit
+	readOutputLine := func(line []byte) error {
+		if err := parseOutputLine(line); err != nil {
+			return deterministicError{err}
+		}
 		return nil
 	}
 
@@ -318,61 +546,83 @@ func (converter *Converter) Data(stream *index.Stream, moreDetails bool) (data [
 			// So if we get an empty line before the end of the list, the converter process
 			// exited unexpectedly or didn't follow the protocol.
 			if len(line) == 0 {
-				converter.releaseProcess(process, -1)
-				return nil, 0, 0, fmt.Errorf("converter (%s): Converter process exited unexpectedly. Received empty line before sending all packets", converter.name)
+				release(false)
+				if err := remoteFailure(); err != nil {
+					return nil, 0, 0, nil, err
+				}
+				return nil, 0, 0, nil, fmt.Errorf("converter (%s): Converter process exited unexpectedly. Received empty line before sending all packets", converter.name)
 			}
 			if err := readOutputLine(line); err != nil {
-				return nil, 0, 0, err
+				return nil, 0, 0, nil, err
 			}
 		default:
 		}
 
 		jsonPacket := converterStreamChunk{
-			Direction: directionsToString[packet.Direction],
-			Content:   base64.StdEncoding.EncodeToString(packet.Content),
-			Time:      packet.Time.Format("2006-01-02T15:04:05.999999999"),
+			Direction:   directionsToString[packet.Direction],
+			Content:     base64.StdEncoding.EncodeToString(packet.Content),
+			Time:        packet.Time.Format(chunkTimeFormat),
+			ContentType: packet.ContentType,
+			Kind:        packet.Kind,
 		}
 		// FIXME: Should we notify the converter about this somehow?
 		jsonPacketEncoded, err := json.Marshal(jsonPacket)
 		if err != nil {
-			converter.releaseProcess(process, -1)
-			return nil, 0, 0, fmt.Errorf("converter (%s): Failed to encode packet: %w", converter.name, err)
+			release(false)
+			return nil, 0, 0, nil, fmt.Errorf("converter (%s): Failed to encode packet: %w", converter.name, err)
 		}
 		process.input <- append(jsonPacketEncoded, '\n')
 	}
 
 	process.input <- []byte("\n")
+	process.setState(ProcessStateAwaitingOutput)
 
 	for line := range process.output {
 		if len(line) == 0 {
+			process.setState(ProcessStateAwaitingTrailer)
 			break
 		}
 		if err := readOutputLine(line); err != nil {
-			return nil, 0, 0, err
+			return nil, 0, 0, nil, err
 		}
 	}
-	var convertedMetadata converterStreamMetadata
+	var convertedMetadata converterResultMetadata
 	line, ok := <-process.output
 	if !ok {
-		converter.releaseProcess(process, -1)
+		release(false)
+		if err := remoteFailure(); err != nil {
+			return nil, 0, 0, nil, err
+		}
 		if moreDetails {
-			stderr := process.Stderr()
+			stderr := process.currentStderr()
 			if len(stderr) > 0 {
-				return nil, 0, 0, fmt.Errorf("converter (%s): Converter process exited unexpectedly (exitcode %d). Stderr:\n%s", converter.name, process.ExitCode(), strings.Join(stderr[:], "\n"))
+				return nil, 0, 0, nil, fmt.Errorf("converter (%s): Converter process exited unexpectedly (exitcode %d). Stderr:\n%s", converter.name, process.ExitCode(), strings.Join(stderr[:], "\n"))
 			}
 		}
-		return nil, 0, 0, fmt.Errorf("converter (%s): Converter process exited unexpectedly (exitcode %d)", converter.name, process.ExitCode())
+		return nil, 0, 0, nil, fmt.Errorf("converter (%s): Converter process exited unexpectedly (exitcode %d)", converter.name, process.ExitCode())
 	}
 	if err := json.Unmarshal(line, &convertedMetadata); err != nil {
-		converter.releaseProcess(process, -1)
+		release(false)
 		if moreDetails {
-			return nil, 0, 0, fmt.Errorf("converter (%s): Failed to read converted metadata: %w. Line:\n%s", converter.name, err, line)
+			return nil, 0, 0, nil, deterministicError{fmt.Errorf("converter (%s): Failed to read converted metadata: %w. Line:\n%s", converter.name, err, line)}
 		}
-		return nil, 0, 0, fmt.Errorf("converter (%s): Failed to read converted metadata: %w", converter.name, err)
+		return nil, 0, 0, nil, deterministicError{fmt.Errorf("converter (%s): Failed to read converted metadata: %w", converter.name, err)}
 	}
 
-	if !converter.releaseProcess(process, reset_epoch) {
-		return nil, 0, 0, fmt.Errorf("converter (%s): Converter was reset while running", converter.name)
+	// the converter refused the stream, the process can be used for the
+	// next stream
+	refused := error(nil)
+	if convertedMetadata.Error != "" {
+		refused = deterministicError{fmt.Errorf("converter (%s): Stream refused: %s", converter.name, convertedMetadata.Error)}
+	}
+	process.endConversion(refused)
+	ended = true
+	if !release(true) {
+		return nil, 0, 0, nil, transientError{fmt.Errorf("converter (%s): Converter was reset while running", converter.name)}
+	}
+	if refused != nil {
+		return nil, 0, 0, nil, refused
 	}
+	tags = convertedMetadata.Tags
 	return
 }
@@ -0,0 +1,303 @@
+package converters
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/spq/pkappa2/internal/index"
+)
+
+type (
+	// TestInput is a stream a converter is tested with, see
+	// CachedConverter.Test.
+	TestInput struct {
+		// stream is nil if the chunks were posted instead
+		stream   *index.Stream
+		metadata converterStreamMetadata
+		packets  []index.Data
+	}
+
+	// TestResult is the outcome of a single test run of a converter.
+	TestResult struct {
+		Chunks      []index.Data
+		ClientBytes uint64
+		ServerBytes uint64
+		// Tags are the generated tags returned in the result metadata
+		Tags []string
+		// Error is set if the conversion failed, State is the step of the
+		// protocol it failed at
+		Error string       `json:",omitempty"`
+		State ProcessState `json:",omitempty"`
+		// Stderr is everything the processes wrote to stderr
+		Stderr []string
+		// ExitCode is set if the conversion by a process failed, the
+		// process is stopped after successful conversions
+		ExitCode        *int `json:",omitempty"`
+		Started         time.Time
+		DurationSeconds float64
+	}
+)
+
+// NewTestInput tests a converter with the stream, streamTags are the names
+// of the tags matching it.
+func NewTestInput(stream *index.Stream, streamTags []string) (*TestInput, error) {
+	metadata, err := makeStreamMetadata(stream, streamTags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect stream metadata: %w", err)
+	}
+	packets, err := stream.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get packets: %w", err)
+	}
+	return &TestInput{
+		stream:   stream,
+		metadata: metadata,
+		packets:  packets,
+	}, nil
+}
+
+// ParseTestInput reads a stream a converter is tested with, it is a JSON
+// object containing the `Metadata` and the `Chunks` in the format of the
+// converter protocol. All fields are optional, missing times and byte
+// counts are taken from the chunks.
+func ParseTestInput(r io.Reader) (*TestInput, error) {
+	input := struct {
+		Metadata converterStreamMetadata
+		Chunks   []converterStreamChunk
+	}{}
+	if err := json.NewDecoder(r).Decode(&input); err != nil {
+		return nil, fmt.Errorf("failed to parse test input: %w", err)
+	}
+	res := &TestInput{
+		metadata: input.Metadata,
+		packets:  []index.Data{},
+	}
+	for i, chunk := range input.Chunks {
+		content, err := base64.StdEncoding.DecodeString(chunk.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode content of chunk %d: %w", i, err)
+		}
+		direction, ok := directionsToInt[chunk.Direction]
+		if !ok {
+			return nil, fmt.Errorf("invalid direction of chunk %d: %q", i, chunk.Direction)
+		}
+		t := time.Time{}
+		if chunk.Time != "" {
+			if t, err = time.Parse(chunkTimeFormat, chunk.Time); err != nil {
+				return nil, fmt.Errorf("failed to parse time of chunk %d: %w", i, err)
+			}
+		}
+		res.packets = append(res.packets, index.Data{
+			Content:     content,
+			Direction:   direction,
+			Time:        t,
+			ContentType: chunk.ContentType,
+			Kind:        chunk.Kind,
+		})
+	}
+
+	// converters expect all fields to be present
+	metadata := &res.metadata
+	if metadata.ClientBytes == 0 && metadata.ServerBytes == 0 {
+		for _, p := range res.packets {
+			if p.Direction == index.DirectionClientToServer {
+				metadata.ClientBytes += uint64(len(p.Content))
+			} else {
+				metadata.ServerBytes += uint64(len(p.Content))
+			}
+		}
+	}
+	if metadata.Protocol == "" {
+		metadata.Protocol = "TCP"
+	}
+	if metadata.FirstPacket == "" {
+		t := time.Time{}
+		if len(res.packets) != 0 {
+			t = res.packets[0].Time
+		}
+		metadata.FirstPacket = t.Format(chunkTimeFormat)
+	}
+	if metadata.LastPacket == "" {
+		t := time.Time{}
+		if len(res.packets) != 0 {
+			t = res.packets[len(res.packets)-1].Time
+		}
+		metadata.LastPacket = t.Format(chunkTimeFormat)
+	}
+	for _, l := range []*[]string{&metadata.Tags, &metadata.Services, &metadata.Marks, &metadata.Pcaps} {
+		if *l == nil {
+			*l = []string{}
+		}
+	}
+	return res, nil
+}
+
+// Test runs the converter once on the input, neither the cache nor the
+// pooled processes are used. Executables and converter services are run
+// in a new process, which counts against the processes of the converter.
+func (cache *CachedConverter) Test(input *TestInput) (*TestResult, error) {
+	return cache.converter.test(input)
+}
+
+// reserveTestProcess waits until a process can be started for a test run,
+// idle processes are stopped to make room. It returns the limits of the
+// process, releaseTestProcess has to be called when the process exited.
+func (converter *ProcessConverter) reserveTestProcess() Limits {
+	converter.rwmutex.RLock()
+	defer converter.rwmutex.RUnlock()
+
+	converter.mutex.Lock()
+	defer converter.mutex.Unlock()
+
+	for {
+		if len(converter.started_processes)+converter.test_processes < MAX_PROCESS_COUNT {
+			converter.test_processes++
+			return converter.limits
+		}
+
+		if len(converter.available_processes) > 0 {
+			process := converter.available_processes[len(converter.available_processes)-1]
+			converter.available_processes = converter.available_processes[:len(converter.available_processes)-1]
+			close(process.input)
+			delete(converter.started_processes, process)
+			continue
+		}
+
+		// Wait for signal from process that it's done.
+		converter.mutex.Unlock()
+		converter.rwmutex.RUnlock()
+		<-converter.signal
+		converter.rwmutex.RLock()
+		converter.mutex.Lock()
+	}
+}
+
+func (converter *ProcessConverter) releaseTestProcess() {
+	converter.mutex.Lock()
+	defer converter.mutex.Unlock()
+
+	converter.test_processes--
+	// Signal that a process is available.
+	select {
+	case converter.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (converter *ProcessConverter) test(input *TestInput) (*TestResult, error) {
+	metadataEncoded, err := json.Marshal(input.metadata)
+	if err != nil {
+		return nil, fmt.Errorf("converter (%s): Failed to encode metadata: %w", converter.name, err)
+	}
+
+	limits := converter.reserveTestProcess()
+	defer converter.releaseTestProcess()
+	var process *Process
+	if converter.address != "" {
+		process = NewRemoteProcess(converter.name, converter.address, limits)
+	} else {
+		process = NewProcess(converter.name, converter.executablePath, limits)
+	}
+
+	started := time.Now()
+	finished := time.Time{}
+	// stop the process and wait for its stderr and exit code
+	stop := func(bool) bool {
+		if !finished.IsZero() {
+			return true
+		}
+		finished = time.Now()
+		close(process.input)
+		process.Kill()
+		for range process.output {
+		}
+		<-process.exited
+		return true
+	}
+	data, clientBytes, serverBytes, tags, err := converter.runStream(process, input.metadata.StreamID, metadataEncoded, input.packets, true, stop)
+	stop(false)
+
+	res := &TestResult{
+		Chunks:          data,
+		ClientBytes:     clientBytes,
+		ServerBytes:     serverBytes,
+		Tags:            tags,
+		Stderr:          process.Stderr(),
+		Started:         started,
+		DurationSeconds: finished.Sub(started).Seconds(),
+	}
+	if res.Chunks == nil {
+		res.Chunks = []index.Data{}
+	}
+	if res.Tags == nil {
+		res.Tags = []string{}
+	}
+	if err != nil {
+		res.Error = err.Error()
+		if _, _, _, failure := process.State(); failure != nil {
+			res.State = failure.State
+		}
+		exitCode := process.ExitCode()
+		res.ExitCode = &exitCode
+	}
+	return res, nil
+}
+
+func (converter *NativeConverter) test(input *TestInput) (*TestResult, error) {
+	started := time.Now()
+	data, clientBytes, serverBytes, err := converter.convertChunks(input.stream, input.packets)
+	res := &TestResult{
+		Chunks:          data,
+		ClientBytes:     clientBytes,
+		ServerBytes:     serverBytes,
+		Tags:            []string{},
+		Stderr:          []string{},
+		Started:         started,
+		DurationSeconds: time.Since(started).Seconds(),
+	}
+	if err != nil {
+		res.Chunks = []index.Data{}
+		res.Error = err.Error()
+	}
+	return res, nil
+}
+
+// test feeds the input through all stages like convert, the stderr of all
+// stages is combined.
+func (converter *PipelineConverter) test(input *TestInput) (*TestResult, error) {
+	converter.rwmutex.RLock()
+	stages := converter.stages
+	converter.rwmutex.RUnlock()
+
+	res := &TestResult{
+		Chunks:  []index.Data{},
+		Tags:    []string{},
+		Stderr:  []string{},
+		Started: time.Now(),
+	}
+	stageInput := *input
+	for _, stage := range stages {
+		stageRes, err := stage.test(&stageInput)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline (%s): Stage %s failed: %w", converter.name, stage.Name(), err)
+		}
+		res.Stderr = append(res.Stderr, stageRes.Stderr...)
+		res.DurationSeconds += stageRes.DurationSeconds
+		if stageRes.Error != "" {
+			res.Chunks, res.ClientBytes, res.ServerBytes, res.Tags = []index.Data{}, 0, 0, []string{}
+			res.Error = fmt.Sprintf("pipeline (%s): Stage %s failed: %s", converter.name, stage.Name(), stageRes.Error)
+			res.State, res.ExitCode = stageRes.State, stageRes.ExitCode
+			return res, nil
+		}
+		res.Chunks, res.ClientBytes, res.ServerBytes = stageRes.Chunks, stageRes.ClientBytes, stageRes.ServerBytes
+		res.Tags = append(res.Tags, stageRes.Tags...)
+		stageInput.packets = index.DataChunks(stageRes.Chunks)
+	}
+	slices.Sort(res.Tags)
+	res.Tags = slices.Compact(res.Tags)
+	return res, nil
+}
@@ -0,0 +1,65 @@
+package converters
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTestCountsAgainstProcesses(t *testing.T) {
+	executable := path.Join(t.TempDir(), "echo")
+	script := "#!/bin/sh\nread metadata\nwhile read line && [ -n \"$line\" ]; do echo \"$line\"; done\necho\necho '{}'\n"
+	if err := os.WriteFile(executable, []byte(script), 0775); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	converter := NewProcessConverter("echo", executable)
+	input, err := ParseTestInput(strings.NewReader(`{"Chunks":[{"Direction":"client-to-server","Content":"YmFy"}]}`))
+	if err != nil {
+		t.Fatalf("ParseTestInput failed with error: %v", err)
+	}
+
+	processes := []*Process(nil)
+	epochs := []int(nil)
+	for range MAX_PROCESS_COUNT {
+		process, epoch := converter.reserveProcess()
+		processes = append(processes, process)
+		epochs = append(epochs, epoch)
+	}
+	defer func() {
+		for _, process := range processes[1:] {
+			converter.releaseProcess(process, -1)
+		}
+	}()
+
+	done := make(chan *TestResult)
+	go func() {
+		res, err := converter.test(input)
+		if err != nil {
+			t.Errorf("ProcessConverter.test failed with error: %v", err)
+		}
+		done <- res
+	}()
+	select {
+	case <-done:
+		t.Fatalf("ProcessConverter.test ran while all processes were busy")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the idle process is stopped to make room for the test
+	converter.releaseProcess(processes[0], epochs[0])
+	select {
+	case res := <-done:
+		if res == nil || res.Error != "" || len(res.Chunks) != 1 || string(res.Chunks[0].Content) != "bar" {
+			t.Errorf("ProcessConverter.test = %+v, want chunk bar", res)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("ProcessConverter.test didn't run after a process became idle")
+	}
+	converter.mutex.Lock()
+	defer converter.mutex.Unlock()
+	if n := len(converter.started_processes); n != MAX_PROCESS_COUNT-1 || converter.test_processes != 0 {
+		t.Errorf("converter has %d started and %d test processes after the test, want %d and 0", n, converter.test_processes, MAX_PROCESS_COUNT-1)
+	}
+}
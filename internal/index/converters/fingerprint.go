@@ -0,0 +1,67 @@
+package converters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+type (
+	// Fingerprint identifies the version of a converter, cached results of
+	// another version are discarded.
+	Fingerprint struct {
+		// Hash is the SHA-256 hash of the converter executable
+		Hash string `json:",omitempty"`
+		// Version is declared in the executable using a line containing
+		// `pkappa2-version: <version>`. When set, only changing the version
+		// discards the cached results, so changes that don't affect the
+		// output of the converter keep the cache.
+		Version string `json:",omitempty"`
+	}
+)
+
+var (
+	declaredVersionRegex = regexp.MustCompile(`pkappa2-version:[ \t]*(\S+)`)
+)
+
+// ReadFingerprint hashes the converter executable and looks for a
+// declared version.
+func ReadFingerprint(executablePath string) (Fingerprint, error) {
+	content, err := os.ReadFile(executablePath)
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("failed to read converter: %w", err)
+	}
+	hash := sha256.Sum256(content)
+	fingerprint := Fingerprint{
+		Hash: hex.EncodeToString(hash[:]),
+	}
+	if m := declaredVersionRegex.FindSubmatch(content); m != nil {
+		fingerprint.Version = string(m[1])
+	}
+	return fingerprint, nil
+}
+
+// remoteFingerprint identifies a converter service by its address.
+func remoteFingerprint(address string) Fingerprint {
+	hash := sha256.Sum256([]byte("address:" + address))
+	return Fingerprint{
+		Hash: hex.EncodeToString(hash[:]),
+	}
+}
+
+// sum is stored in the cache file header, it only depends on the version
+// if one was declared.
+func (f Fingerprint) sum() [32]byte {
+	if f.Version != "" {
+		return sha256.Sum256([]byte("version:" + f.Version))
+	}
+	return sha256.Sum256([]byte("hash:" + f.Hash))
+}
+
+// Equal returns whether the cached results of one version are valid for
+// the other one.
+func (f Fingerprint) Equal(other Fingerprint) bool {
+	return f.sum() == other.sum()
+}
@@ -0,0 +1,106 @@
+package converters
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"slices"
+
+	"github.com/spq/pkappa2/internal/index"
+)
+
+type (
+	// Converter is a converter implemented in Go that runs inside of
+	// pkappa2. It receives the chunks of a stream and returns the converted
+	// chunks like a converter executable, but without the JSON encoding.
+	// Convert is called concurrently for different streams, the stream is
+	// nil if the converter is tested with posted chunks. Version has to
+	// be changed whenever the output of the converter changes, so the
+	// cached results are discarded.
+	Converter interface {
+		Name() string
+		Version() string
+		Convert(stream *index.Stream, data []index.Data) ([]index.Data, error)
+	}
+
+	// NativeConverter runs a Converter for the cache.
+	NativeConverter struct {
+		converter Converter
+	}
+)
+
+func NewNativeConverter(converter Converter) *NativeConverter {
+	return &NativeConverter{
+		converter: converter,
+	}
+}
+
+func (converter *NativeConverter) Name() string {
+	return converter.converter.Name()
+}
+
+// ProcessStats returns no processes as the converter runs in the pkappa2
+// process.
+func (converter *NativeConverter) ProcessStats() []ProcessStats {
+	return []ProcessStats{}
+}
+
+func (converter *NativeConverter) Stderr(pid int) *ProcessStderr {
+	return nil
+}
+
+func (converter *NativeConverter) MaxProcessCount() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// Fingerprint is based on the version of the converter, the prefix keeps
+// it apart from the versions declared by converter executables of the
+// same name.
+func (converter *NativeConverter) Fingerprint() (Fingerprint, error) {
+	return Fingerprint{
+		Version: "builtin-" + converter.converter.Version(),
+	}, nil
+}
+
+// Reset does nothing as the converter keeps no state between streams.
+func (converter *NativeConverter) Reset() {}
+
+func (converter *NativeConverter) Data(stream *index.Stream, streamTags []string, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, tags []string, err error) {
+	packets, err := stream.Data()
+	if err != nil {
+		return nil, 0, 0, nil, transientError{fmt.Errorf("converter (%s): Failed to get packets: %w", converter.Name(), err)}
+	}
+	return converter.convert(stream, streamTags, packets, moreDetails)
+}
+
+func (converter *NativeConverter) convert(stream *index.Stream, streamTags []string, packets []index.Data, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, tags []string, err error) {
+	log.Printf("Converter (%s): Running for stream %d", converter.Name(), stream.ID())
+
+	data, clientBytes, serverBytes, err = converter.convertChunks(stream, packets)
+	return data, clientBytes, serverBytes, nil, err
+}
+
+// convertChunks runs the converter on the chunks, stream is nil if the
+// converter is tested with chunks that don't belong to a stream.
+func (converter *NativeConverter) convertChunks(stream *index.Stream, packets []index.Data) (data []index.Data, clientBytes, serverBytes uint64, err error) {
+	converted, err := converter.converter.Convert(stream, packets)
+	if err != nil {
+		return nil, 0, 0, deterministicError{fmt.Errorf("converter (%s): %w", converter.Name(), err)}
+	}
+	data = []index.Data{}
+	for _, chunk := range converted {
+		if chunk.Direction != index.DirectionClientToServer && chunk.Direction != index.DirectionServerToClient {
+			return nil, 0, 0, deterministicError{fmt.Errorf("converter (%s): Invalid direction: %d", converter.Name(), chunk.Direction)}
+		}
+		// the content may share memory with the stream data, so it has to
+		// be copied before chunks are merged
+		chunk.Content = slices.Clone(chunk.Content)
+		data = appendData(data, chunk)
+		if chunk.Direction == index.DirectionClientToServer {
+			clientBytes += uint64(len(chunk.Content))
+		} else {
+			serverBytes += uint64(len(chunk.Content))
+		}
+	}
+	return data, clientBytes, serverBytes, nil
+}
@@ -0,0 +1,204 @@
+package converters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/spq/pkappa2/internal/index"
+)
+
+type (
+	// PipelineConverter runs multiple converters one after another, every
+	// stage converts the output of the previous stage. The stages have
+	// their own processes, so they don't compete with the converters they
+	// are created from.
+	PipelineConverter struct {
+		name string
+		// Synchronizes access to `stages` and `limits`
+		rwmutex sync.RWMutex
+		stages  []backend
+		limits  Limits
+	}
+)
+
+func NewPipelineConverter(name string, stages []*CachedConverter) (*PipelineConverter, error) {
+	converter := &PipelineConverter{
+		name: name,
+	}
+	if err := converter.SetStages(stages); err != nil {
+		return nil, err
+	}
+	return converter, nil
+}
+
+func (converter *PipelineConverter) Name() string {
+	return converter.name
+}
+
+// SetStages replaces the stages of the pipeline and stops the processes
+// of the previous stages.
+func (converter *PipelineConverter) SetStages(stages []*CachedConverter) error {
+	if len(stages) == 0 {
+		return errors.New("pipeline without stages")
+	}
+	newStages := []backend(nil)
+	for _, stage := range stages {
+		switch c := stage.converter.(type) {
+		case *ProcessConverter:
+			if c.address != "" {
+				newStages = append(newStages, NewRemoteConverter(c.name, c.address))
+			} else {
+				newStages = append(newStages, NewProcessConverter(c.name, c.executablePath))
+			}
+		case *NativeConverter:
+			newStages = append(newStages, NewNativeConverter(c.converter))
+		default:
+			return fmt.Errorf("converter %s can't be used in a pipeline", stage.Name())
+		}
+	}
+
+	converter.rwmutex.Lock()
+	oldStages := converter.stages
+	converter.stages = newStages
+	for _, stage := range newStages {
+		if c, ok := stage.(*ProcessConverter); ok {
+			c.SetLimits(converter.limits)
+		}
+	}
+	converter.rwmutex.Unlock()
+
+	for _, stage := range oldStages {
+		stage.Reset()
+	}
+	return nil
+}
+
+// Stages returns the names of the converters the pipeline consists of.
+func (converter *PipelineConverter) Stages() []string {
+	converter.rwmutex.RLock()
+	defer converter.rwmutex.RUnlock()
+
+	names := []string(nil)
+	for _, stage := range converter.stages {
+		names = append(names, stage.Name())
+	}
+	return names
+}
+
+// ProcessStats returns the processes of all stages, they are labeled with
+// the name of their stage.
+func (converter *PipelineConverter) ProcessStats() []ProcessStats {
+	converter.rwmutex.RLock()
+	defer converter.rwmutex.RUnlock()
+
+	output := []ProcessStats{}
+	for _, stage := range converter.stages {
+		for _, stats := range stage.ProcessStats() {
+			stats.Converter = stage.Name()
+			output = append(output, stats)
+		}
+	}
+	return output
+}
+
+func (converter *PipelineConverter) Stderr(pid int) *ProcessStderr {
+	converter.rwmutex.RLock()
+	defer converter.rwmutex.RUnlock()
+
+	for _, stage := range converter.stages {
+		if stderr := stage.Stderr(pid); stderr != nil {
+			return stderr
+		}
+	}
+	return nil
+}
+
+// MaxProcessCount returns the number of streams that can be converted in
+// parallel, which is limited by the stage with the fewest processes.
+func (converter *PipelineConverter) MaxProcessCount() int {
+	converter.rwmutex.RLock()
+	defer converter.rwmutex.RUnlock()
+
+	count := 0
+	for i, stage := range converter.stages {
+		if n := stage.MaxProcessCount(); i == 0 || n < count {
+			count = n
+		}
+	}
+	return count
+}
+
+// SetLimits changes the limits of the processes of all stages.
+func (converter *PipelineConverter) SetLimits(limits Limits) {
+	converter.rwmutex.Lock()
+	defer converter.rwmutex.Unlock()
+
+	converter.limits = limits
+	for _, stage := range converter.stages {
+		if c, ok := stage.(*ProcessConverter); ok {
+			c.SetLimits(limits)
+		}
+	}
+}
+
+// Fingerprint combines the fingerprints of the stages, so the results of
+// the pipeline are discarded when one of them changes.
+func (converter *PipelineConverter) Fingerprint() (Fingerprint, error) {
+	converter.rwmutex.RLock()
+	defer converter.rwmutex.RUnlock()
+
+	hash := sha256.New()
+	for _, stage := range converter.stages {
+		fingerprint, err := stage.Fingerprint()
+		if err != nil {
+			return Fingerprint{}, err
+		}
+		sum := fingerprint.sum()
+		hash.Write([]byte(stage.Name()))
+		hash.Write(sum[:])
+	}
+	return Fingerprint{
+		Hash: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+func (converter *PipelineConverter) Reset() {
+	converter.rwmutex.RLock()
+	defer converter.rwmutex.RUnlock()
+
+	for _, stage := range converter.stages {
+		stage.Reset()
+	}
+}
+
+func (converter *PipelineConverter) Data(stream *index.Stream, streamTags []string, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, tags []string, err error) {
+	packets, err := stream.Data()
+	if err != nil {
+		return nil, 0, 0, nil, transientError{fmt.Errorf("pipeline (%s): Failed to get packets: %w", converter.name, err)}
+	}
+	return converter.convert(stream, streamTags, packets, moreDetails)
+}
+
+// convert feeds the chunks through all stages, the tags of all stages are
+// combined. Every stage only gets the data chunks of its predecessor.
+func (converter *PipelineConverter) convert(stream *index.Stream, streamTags []string, packets []index.Data, moreDetails bool) (data []index.Data, clientBytes, serverBytes uint64, tags []string, err error) {
+	converter.rwmutex.RLock()
+	stages := converter.stages
+	converter.rwmutex.RUnlock()
+
+	data = packets
+	for _, stage := range stages {
+		stageData, stageClientBytes, stageServerBytes, stageTags, err := stage.convert(stream, streamTags, index.DataChunks(data), moreDetails)
+		if err != nil {
+			return nil, 0, 0, nil, fmt.Errorf("pipeline (%s): Stage %s failed: %w", converter.name, stage.Name(), err)
+		}
+		data, clientBytes, serverBytes = stageData, stageClientBytes, stageServerBytes
+		tags = append(tags, stageTags...)
+	}
+	slices.Sort(tags)
+	return data, clientBytes, serverBytes, slices.Compact(tags), nil
+}
@@ -0,0 +1,56 @@
+package converters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spq/pkappa2/internal/index"
+)
+
+// stageStub is a pipeline stage that returns fixed chunks and remembers
+// the chunks it got.
+type stageStub struct {
+	NativeConverter
+	output []index.Data
+	input  []index.Data
+}
+
+func (stage *stageStub) Name() string {
+	return "stub"
+}
+
+func (stage *stageStub) convert(stream *index.Stream, streamTags []string, packets []index.Data, moreDetails bool) ([]index.Data, uint64, uint64, []string, error) {
+	stage.input = packets
+	return stage.output, 0, 0, nil, nil
+}
+
+func TestPipelineStagesOnlyGetDataChunks(t *testing.T) {
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := &stageStub{
+		output: []index.Data{
+			{Direction: index.DirectionClientToServer, Time: t1, Content: []byte("script"), Kind: index.ChunkKindInfo},
+			{Direction: index.DirectionClientToServer, Time: t1, Content: []byte("hello")},
+			{Direction: index.DirectionServerToClient, Time: t1, Content: []byte("note"), Kind: index.ChunkKindAnnotation},
+			{Direction: index.DirectionServerToClient, Time: t1, Content: []byte("world")},
+		},
+	}
+	second := &stageStub{
+		output: []index.Data{
+			{Direction: index.DirectionClientToServer, Time: t1, Content: []byte("result")},
+		},
+	}
+	pipeline := &PipelineConverter{
+		name:   "pipeline",
+		stages: []backend{first, second},
+	}
+	data, _, _, _, err := pipeline.convert(nil, nil, []index.Data{{Content: []byte("input")}}, false)
+	if err != nil {
+		t.Fatalf("PipelineConverter.convert failed: %v", err)
+	}
+	if len(data) != 1 || string(data[0].Content) != "result" {
+		t.Errorf("PipelineConverter.convert = %q, want output of the last stage", data)
+	}
+	if len(second.input) != 2 || string(second.input[0].Content) != "hello" || string(second.input[1].Content) != "world" {
+		t.Errorf("second stage got %q, want only the data chunks of the first stage", second.input)
+	}
+}
@@ -2,10 +2,11 @@ package converters
 
 import (
 	"bufio"
-	"container/ring"
 	"log"
 	"os/exec"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/spq/pkappa2/internal/tools"
 )
@@ -14,57 +15,301 @@ type (
 	Process struct {
 		converterName  string
 		executablePath string
-		cmd            *exec.Cmd
-		input          chan []byte
-		output         chan []byte
-		stderrRing     *ring.Ring
-		stderrLock     sync.RWMutex
-		exitCode       int
+		// address of a converter service, see NewRemoteProcess
+		address string
+		// id identifies processes of converter services, they have no pid
+		id     int
+		limits Limits
+		cmd    *exec.Cmd
+		// number of streams the process started converting
+		streamCount int
+		input       chan []byte
+		output      chan []byte
+		// guards the protocol state and the stderr logs
+		stderrLock sync.RWMutex
+		// stderr written while no stream was converted
+		stderr       []string
+		state        ProcessState
+		stateChanged time.Time
+		// the stream currently converted, nil while awaiting metadata
+		current *Conversion
+		// the last conversions that wrote to stderr or failed
+		conversions []*Conversion
+		// closed once stderr was read completely
+		stderrDone chan struct{}
+		exitCode   int
+		// why talking to the converter service failed, set before the
+		// output channel is closed
+		remoteErr error
+		// closed once the process exited and the exit code is known
+		exited chan struct{}
+		// closed once the process was started or failed to start
+		started  chan struct{}
+		kill     chan struct{}
+		killOnce sync.Once
+	}
+
+	// ProcessState is the step of the JSON protocol a converter process is
+	// in.
+	ProcessState string
+
+	// Conversion is the log of a stream converted by a process.
+	Conversion struct {
+		StreamID uint64
+		Started  time.Time
+		// State is the step the conversion is in or was in when it ended
+		State        ProcessState
+		StateChanged time.Time
+		// Error is set if the conversion failed
+		Error  string   `json:",omitempty"`
+		Stderr []string `json:",omitempty"`
+	}
+
+	// Limits restricts the resources a converter process may use, a limit
+	// of 0 is disabled.
+	Limits struct {
+		// Seconds to wait for the converted stream.
+		TimeoutSeconds int64
+		// Maximum size of the converted stream.
+		MaxOutputBytes int64
+		// Maximum size of the address space of the process (RLIMIT_AS).
+		MaxMemoryBytes int64
+		// Maximum CPU time the process may spend on a single stream.
+		MaxCPUSeconds int64
 	}
 )
 
 const (
-	// Number of lines to keep in the stderr buffer.
-	STDERR_RING_SIZE = 512
+	// Number of stderr lines to keep per stream conversion.
+	STDERR_LINES_PER_CONVERSION = 512
+	// Number of conversions with stderr output or errors to keep per process.
+	CONVERSION_LOG_SIZE = 32
+
+	// the process waits for the metadata of the next stream
+	ProcessStateAwaitingMetadata ProcessState = "awaiting-metadata"
+	// the metadata and chunks of the stream are sent to the process
+	ProcessStateSendingChunks ProcessState = "sending-chunks"
+	// all chunks were sent, the converted chunks are read
+	ProcessStateAwaitingOutput ProcessState = "awaiting-output"
+	// the converted chunks were read, the result metadata is expected
+	ProcessStateAwaitingTrailer ProcessState = "awaiting-trailer"
+)
+
+var (
+	// DefaultLimits stop converters that hang or produce huge outputs.
+	DefaultLimits = Limits{
+		TimeoutSeconds: 60,
+		MaxOutputBytes: 256 << 20,
+	}
 )
 
 // To stop the process, close the input channel.
 // The output channel will be closed when the process exits.
-func NewProcess(converterName string, executablePath string) *Process {
+func NewProcess(converterName string, executablePath string, limits Limits) *Process {
 	process := Process{
 		converterName:  converterName,
 		executablePath: executablePath,
+		limits:         limits,
 		cmd:            nil,
 		input:          make(chan []byte),
 		output:         make(chan []byte),
-		stderrRing:     ring.New(STDERR_RING_SIZE),
 		stderrLock:     sync.RWMutex{},
+		state:          ProcessStateAwaitingMetadata,
+		stateChanged:   time.Now(),
+		stderrDone:     make(chan struct{}),
+		exited:         make(chan struct{}),
+		started:        make(chan struct{}),
+		kill:           make(chan struct{}),
 	}
 
 	go process.run()
 	return &process
 }
 
+// Stderr returns all stderr lines the process logs contain.
 func (process *Process) Stderr() []string {
 	process.stderrLock.RLock()
 	defer process.stderrLock.RUnlock()
 
-	// TODO: Return []byte to avoid copying when constructing the string?
-	//       Would require base64 encoding in the JSON response.
-	output := []string{}
-	process.stderrRing.Do(func(value any) {
-		if value != nil {
-			output = append(output, string(value.([]byte)))
-		}
-	})
+	output := append([]string{}, process.stderr...)
+	for _, c := range process.conversions {
+		output = append(output, c.Stderr...)
+	}
+	if process.current != nil {
+		output = append(output, process.current.Stderr...)
+	}
 	return output
 }
 
+// Logs returns the stderr written while no stream was converted and the
+// logs of the last conversions, including the current one.
+func (process *Process) Logs() ([]string, []Conversion) {
+	process.stderrLock.RLock()
+	defer process.stderrLock.RUnlock()
+
+	conversions := []Conversion{}
+	for _, c := range process.conversions {
+		conversions = append(conversions, *c)
+	}
+	if process.current != nil {
+		conversions = append(conversions, *process.current)
+	}
+	for i := range conversions {
+		conversions[i].Stderr = slices.Clone(conversions[i].Stderr)
+	}
+	return append([]string{}, process.stderr...), conversions
+}
+
+// State returns the protocol step the process is in, the stream it
+// converts unless it awaits the metadata of the next one and the last
+// failed conversion.
+func (process *Process) State() (ProcessState, time.Time, uint64, *Conversion) {
+	process.stderrLock.RLock()
+	defer process.stderrLock.RUnlock()
+
+	streamID := uint64(0)
+	if process.current != nil {
+		streamID = process.current.StreamID
+	}
+	var lastFailure *Conversion
+	for _, c := range slices.Backward(process.conversions) {
+		if c.Error != "" {
+			failure := *c
+			failure.Stderr = nil
+			lastFailure = &failure
+			break
+		}
+	}
+	return process.state, process.stateChanged, streamID, lastFailure
+}
+
+// beginConversion starts the log of the given stream.
+func (process *Process) beginConversion(streamID uint64) {
+	process.stderrLock.Lock()
+	defer process.stderrLock.Unlock()
+
+	now := time.Now()
+	process.state = ProcessStateSendingChunks
+	process.stateChanged = now
+	process.current = &Conversion{
+		StreamID:     streamID,
+		Started:      now,
+		State:        ProcessStateSendingChunks,
+		StateChanged: now,
+		Stderr:       []string{},
+	}
+}
+
+// setState records the protocol step of the current conversion.
+func (process *Process) setState(state ProcessState) {
+	process.stderrLock.Lock()
+	defer process.stderrLock.Unlock()
+
+	process.state = state
+	process.stateChanged = time.Now()
+	if process.current != nil {
+		process.current.State = state
+		process.current.StateChanged = process.stateChanged
+	}
+}
+
+// endConversion finishes the log of the current conversion, it is kept if
+// the conversion failed or wrote to stderr.
+func (process *Process) endConversion(err error) {
+	process.stderrLock.Lock()
+	defer process.stderrLock.Unlock()
+
+	process.state = ProcessStateAwaitingMetadata
+	process.stateChanged = time.Now()
+	c := process.current
+	if c == nil {
+		return
+	}
+	process.current = nil
+	if err != nil {
+		c.Error = err.Error()
+	}
+	if c.Error == "" && len(c.Stderr) == 0 {
+		return
+	}
+	process.conversions = append(process.conversions, c)
+	if len(process.conversions) > CONVERSION_LOG_SIZE {
+		process.conversions = slices.Delete(process.conversions, 0, len(process.conversions)-CONVERSION_LOG_SIZE)
+	}
+}
+
+// currentStderr returns the stderr written during the current conversion.
+func (process *Process) currentStderr() []string {
+	process.stderrLock.RLock()
+	defer process.stderrLock.RUnlock()
+
+	if process.current == nil {
+		return nil
+	}
+	return slices.Clone(process.current.Stderr)
+}
+
+// logStderr adds the line to the stderr of the current conversion, or of
+// the process if no stream is converted.
+func (process *Process) logStderr(line string) {
+	process.stderrLock.Lock()
+	defer process.stderrLock.Unlock()
+
+	lines := &process.stderr
+	if process.current != nil {
+		lines = &process.current.Stderr
+	}
+	*lines = append(*lines, line)
+	if len(*lines) > STDERR_LINES_PER_CONVERSION {
+		*lines = slices.Delete(*lines, 0, len(*lines)-STDERR_LINES_PER_CONVERSION)
+	}
+}
+
+// waitStderr waits a moment for the stderr of a process that was killed or
+// exited to be read completely.
+func (process *Process) waitStderr() {
+	select {
+	case <-process.stderrDone:
+	case <-time.After(time.Second):
+	}
+}
+
 func (process *Process) ExitCode() int {
 	return process.exitCode
 }
 
+// remoteError returns why talking to the converter service failed, it is
+// known once the output channel was closed.
+func (process *Process) remoteError() error {
+	return process.remoteErr
+}
+
+// Kill stops the process immediately, e.g. when it doesn't respond anymore.
+// The output channel is closed once the process exited, the input channel
+// still has to be closed.
+func (process *Process) Kill() {
+	process.killOnce.Do(func() {
+		close(process.kill)
+	})
+}
+
+// startStream prepares the process for converting the next stream.
+func (process *Process) startStream() {
+	<-process.started
+	process.streamCount++
+	// the limit of the first stream was set when starting the process
+	if process.streamCount == 1 || process.limits.MaxCPUSeconds == 0 || process.cmd == nil || process.cmd.Process == nil {
+		return
+	}
+	if err := limitCPUTime(process.cmd.Process.Pid, process.limits.MaxCPUSeconds); err != nil {
+		log.Printf("Converter (%s): Failed to limit cpu time: %q", process.converterName, err)
+	}
+}
+
 func (process *Process) Pid() int {
+	if process.address != "" {
+		return process.id
+	}
 	if process.cmd == nil || process.cmd.Process == nil {
 		return -1
 	}
@@ -73,11 +318,27 @@ func (process *Process) Pid() int {
 
 // Run until input channel is closed
 func (process *Process) run() {
-	process.cmd = exec.Command(process.executablePath)
+	if process.address != "" {
+		process.runRemote()
+		return
+	}
+	startedClosed := false
+	defer func() {
+		if !startedClosed {
+			close(process.started)
+		}
+		close(process.exited)
+	}()
+	cmd, err := limitedCommand(process.executablePath, process.limits)
+	process.cmd = cmd
+	if err != nil {
+		log.Printf("Converter (%s): Failed to limit resources: %q", process.converterName, err)
+	}
 	stdout, err := process.cmd.StdoutPipe()
 	if err != nil {
 		log.Printf("Converter (%s): Failed to create stdout pipe: %q", process.converterName, err)
 		close(process.output)
+		close(process.stderrDone)
 
 		// drain input channel to unblock caller
 		for range process.input {
@@ -102,6 +363,7 @@ func (process *Process) run() {
 	if err != nil {
 		log.Printf("Converter (%s): Failed to create stderr pipe: %q", process.converterName, err)
 		stdout.Close()
+		close(process.stderrDone)
 
 		// drain input channel to unblock caller
 		for range process.input {
@@ -109,8 +371,9 @@ func (process *Process) run() {
 		return
 	}
 
-	// Dump stderr directly
+	// Dump stderr directly and log it for the current stream
 	go func() {
+		defer close(process.stderrDone)
 		reader := bufio.NewReaderSize(stderr, 65536)
 		for {
 			line, err := tools.ReadLine(reader)
@@ -118,11 +381,7 @@ func (process *Process) run() {
 				break
 			}
 			log.Printf("Converter (%s) stderr: %s", process.converterName, line)
-
-			process.stderrLock.Lock()
-			process.stderrRing.Value = line
-			process.stderrRing = process.stderrRing.Next()
-			process.stderrLock.Unlock()
+			process.logStderr(string(line))
 		}
 	}()
 
@@ -150,11 +409,25 @@ func (process *Process) run() {
 		}
 		return
 	}
+	close(process.started)
+	startedClosed = true
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-process.kill:
+			// errors are ignored as the process might have exited already
+			_ = process.cmd.Process.Kill()
+		case <-exited:
+		}
+	}()
 
 	for line := range process.input {
 		if _, err := stdin.Write(line); err != nil {
 			log.Printf("Converter (%s): Failed to write to stdin: %q", process.converterName, err)
 			// wait for process to exit and close std pipes.
+			process.waitStderr()
 			if err := process.cmd.Wait(); err != nil {
 				if _, ok := err.(*exec.ExitError); !ok {
 					log.Printf("Converter (%s): Failed to wait for process: %q", process.converterName, err)
@@ -175,6 +448,8 @@ func (process *Process) run() {
 	if err := process.cmd.Process.Kill(); err != nil {
 		log.Printf("Converter (%s): Failed to kill process: %q", process.converterName, err)
 	}
+	// Wait closes stderr, so read the remaining lines first.
+	process.waitStderr()
 	if err := process.cmd.Wait(); err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
 			log.Printf("Converter (%s): Failed to wait for process: %q", process.converterName, err)
@@ -0,0 +1,73 @@
+//go:build linux
+
+package converters
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The unit of the cpu times in /proc/<pid>/stat, it is fixed to 100 for
+// userspace on all architectures.
+const userHZ = 100
+
+// limitedCommand returns the command running the executable. The memory
+// and cpu time limits are applied by a shell before the executable replaces
+// it, so the process is never running without them.
+func limitedCommand(executablePath string, limits Limits) (*exec.Cmd, error) {
+	script := ""
+	if limits.MaxMemoryBytes != 0 {
+		// ulimit counts kilobytes
+		script += fmt.Sprintf("ulimit -v %d && ", max(limits.MaxMemoryBytes/1024, 1))
+	}
+	if limits.MaxCPUSeconds != 0 {
+		// only the soft limit is set, it is raised for every further stream
+		script += fmt.Sprintf("ulimit -S -t %d && ", limits.MaxCPUSeconds)
+	}
+	if script == "" {
+		return exec.Command(executablePath), nil
+	}
+	return exec.Command("/bin/sh", "-c", script+`exec "$0"`, executablePath), nil
+}
+
+// limitCPUTime allows the process to use up to seconds of cpu time from now
+// on, it is called before every stream but the first one. Only the soft limit is changed as the hard limit can't be raised
+// again, the process receives SIGXCPU once it is exceeded.
+func limitCPUTime(pid int, seconds int64) error {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return err
+	}
+	// the process name in the second field might contain spaces
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return fmt.Errorf("invalid stat file %q", stat)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	// utime and stime are the 14th and 15th field
+	if len(fields) < 13 {
+		return fmt.Errorf("invalid stat file %q", stat)
+	}
+	used := uint64(0)
+	for _, f := range fields[11:13] {
+		ticks, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return err
+		}
+		used += ticks
+	}
+	old := unix.Rlimit{}
+	if err := unix.Prlimit(pid, unix.RLIMIT_CPU, nil, &old); err != nil {
+		return err
+	}
+	limit := unix.Rlimit{
+		Cur: min(used/userHZ+1+uint64(seconds), old.Max),
+		Max: old.Max,
+	}
+	return unix.Prlimit(pid, unix.RLIMIT_CPU, &limit, nil)
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package converters
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errLimitsUnsupported = errors.New("resource limits are only supported on linux")
+
+func limitedCommand(executablePath string, limits Limits) (*exec.Cmd, error) {
+	cmd := exec.Command(executablePath)
+	if limits.MaxMemoryBytes != 0 || limits.MaxCPUSeconds != 0 {
+		return cmd, errLimitsUnsupported
+	}
+	return cmd, nil
+}
+
+func limitCPUTime(pid int, seconds int64) error {
+	return errLimitsUnsupported
+}
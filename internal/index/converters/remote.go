@@ -0,0 +1,287 @@
+package converters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spq/pkappa2/internal/tools"
+)
+
+const (
+	// Prefix of the addresses of converter services listening on a unix
+	// socket, e.g. `unix:/run/deserializer.sock`.
+	unixAddressPrefix = "unix:"
+)
+
+var (
+	// ids of the connections to converter services, shown instead of a pid
+	remoteProcessIDs atomic.Int64
+
+	// stream conversions posted to converter services over http
+	remoteHTTPClient = &http.Client{}
+)
+
+// CheckRemoteAddress returns an error if the address is no valid address
+// of a converter service: `unix:/path/to/socket` or an http(s) url of a
+// loopback host. Streams are only sent to services on the same machine.
+func CheckRemoteAddress(address string) error {
+	if path, ok := strings.CutPrefix(address, unixAddressPrefix); ok {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("socket path %q is not absolute", path)
+		}
+		return nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", address, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("address %q is neither unix:/path nor an http(s) url", address)
+	}
+	if host := u.Hostname(); host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("host %q of address %q is not a loopback host", host, address)
+		}
+	}
+	return nil
+}
+
+// NewRemoteProcess connects to a converter service speaking the JSON
+// protocol instead of starting an executable. The service either listens
+// on a unix socket, the connection is used like the stdin and stdout of a
+// process then, or on an http url, which every stream is posted to. The
+// request body contains the metadata and chunks, the response the
+// converted chunks and the result metadata, both one JSON object per line.
+// It is stopped like a process.
+func NewRemoteProcess(converterName string, address string, limits Limits) *Process {
+	process := Process{
+		converterName: converterName,
+		address:       address,
+		id:            int(remoteProcessIDs.Add(1)),
+		limits:        limits,
+		input:         make(chan []byte),
+		output:        make(chan []byte),
+		stderrLock:    sync.RWMutex{},
+		state:         ProcessStateAwaitingMetadata,
+		stateChanged:  time.Now(),
+		stderrDone:    make(chan struct{}),
+		exited:        make(chan struct{}),
+		started:       make(chan struct{}),
+		kill:          make(chan struct{}),
+	}
+
+	go process.run()
+	return &process
+}
+
+// runRemote talks to the converter service until the input channel is
+// closed. Services don't write to stderr, errors talking to them are
+// logged as stderr of the conversion instead.
+func (process *Process) runRemote() {
+	close(process.stderrDone)
+	defer close(process.exited)
+
+	if path, ok := strings.CutPrefix(process.address, unixAddressPrefix); ok {
+		process.runSocket(path)
+	} else {
+		process.runHTTP()
+	}
+}
+
+// remoteFailed logs why talking to the converter service failed. The
+// failure isn't caused by the stream, so it is retried.
+func (process *Process) remoteFailed(err error) {
+	log.Printf("Converter (%s): %v", process.converterName, err)
+	process.logStderr(err.Error())
+	process.remoteErr = err
+}
+
+func (process *Process) runSocket(path string) {
+	conn, err := net.Dial("unix", path)
+	close(process.started)
+	if err != nil {
+		process.remoteFailed(fmt.Errorf("failed to connect to %s: %w", process.address, err))
+		process.exitCode = -1
+		close(process.output)
+
+		// drain input channel to unblock caller
+		for range process.input {
+		}
+		return
+	}
+
+	// Pipe the connection to the output channel
+	closing := atomic.Bool{}
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		reader := bufio.NewReaderSize(conn, 65536)
+		for {
+			line, err := tools.ReadLine(reader)
+			if err != nil {
+				// the service closed the connection or it was killed
+				if !closing.Load() {
+					process.remoteFailed(fmt.Errorf("connection to %s closed: %w", process.address, err))
+					process.exitCode = -1
+				}
+				break
+			}
+			process.output <- line
+		}
+		close(process.output)
+	}()
+
+	go func() {
+		select {
+		case <-process.kill:
+			conn.Close()
+		case <-readerDone:
+		}
+	}()
+
+	for line := range process.input {
+		if _, err := conn.Write(line); err != nil {
+			// the reader notices the closed connection as well
+			conn.Close()
+
+			// drain input channel to unblock caller
+			for range process.input {
+			}
+			<-readerDone
+			return
+		}
+	}
+	closing.Store(true)
+	conn.Close()
+	<-readerDone
+}
+
+func (process *Process) runHTTP() {
+	close(process.started)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-process.kill:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// body of the request of the current stream, nil once all its chunks
+	// were sent
+	var body *io.PipeWriter
+	// receives the result of the request of the current stream
+	var done chan error
+	failed := func(err error) {
+		if body != nil {
+			body.CloseWithError(err)
+		}
+		process.remoteFailed(err)
+		process.exitCode = -1
+		close(process.output)
+
+		// drain input channel to unblock caller
+		for range process.input {
+		}
+	}
+	for {
+		select {
+		case line, ok := <-process.input:
+			if !ok {
+				if body != nil {
+					body.CloseWithError(errors.New("converter stopped"))
+				}
+				if done != nil {
+					<-done
+				}
+				close(process.output)
+				return
+			}
+			if body == nil {
+				// the metadata of the next stream, the response of the
+				// previous stream was read completely already
+				if done != nil {
+					if err := <-done; err != nil {
+						failed(err)
+						return
+					}
+				}
+				reader, writer := io.Pipe()
+				body = writer
+				done = make(chan error, 1)
+				go func() {
+					err := process.postStream(ctx, reader)
+					reader.CloseWithError(err)
+					done <- err
+				}()
+			}
+			if _, err := body.Write(line); err != nil {
+				err = <-done
+				done = nil
+				if err == nil {
+					err = fmt.Errorf("converter service %s answered before receiving all chunks", process.address)
+				}
+				failed(err)
+				return
+			}
+			if bytes.Equal(line, []byte("\n")) {
+				// the empty line terminates the chunks
+				body.Close()
+				body = nil
+			}
+		case err := <-done:
+			done = nil
+			if err != nil {
+				failed(err)
+				return
+			}
+		}
+	}
+}
+
+// postStream sends the request body to the converter service and passes
+// the lines of the response to the output channel, up to the result
+// metadata following the empty line.
+func (process *Process) postStream(ctx context.Context, body io.Reader) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, process.address, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request to %s: %w", process.address, err)
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	response, err := remoteHTTPClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", process.address, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("request to %s failed: %s: %s", process.address, response.Status, bytes.TrimSpace(message))
+	}
+
+	reader := bufio.NewReaderSize(response.Body, 65536)
+	chunksDone := false
+	for {
+		line, err := tools.ReadLine(reader)
+		if err != nil {
+			return fmt.Errorf("response of %s ended unexpectedly: %w", process.address, err)
+		}
+		process.output <- line
+		if chunksDone {
+			return nil
+		}
+		chunksDone = len(line) == 0
+	}
+}
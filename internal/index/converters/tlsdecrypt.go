@@ -0,0 +1,731 @@
+package converters
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+
+	"github.com/spq/pkappa2/internal/index"
+	tlskeylog "github.com/spq/pkappa2/internal/tools/tlsKeylog"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type (
+	// tlsDecryptConverter decrypts TLS 1.2 and 1.3 streams using the
+	// secrets of the key store. Only the application data is returned.
+	tlsDecryptConverter struct {
+		keys *tlskeylog.Store
+	}
+
+	tlsCipherSuite struct {
+		keyLength int
+		// hash of the PRF of TLS 1.2 and HKDF of TLS 1.3
+		hash func() hash.Hash
+		// aead creates the cipher of AEAD suites, it is nil for CBC suites
+		aead func(key []byte) (cipher.AEAD, error)
+		// ivLength is the length of the implicit part of the nonce of AEAD
+		// suites and the block size of CBC suites
+		ivLength int
+		// macHash is the hash of the HMAC of CBC suites
+		macHash func() hash.Hash
+	}
+
+	tlsRecord struct {
+		header  []byte
+		payload []byte
+		// index of the chunk containing the end of the record
+		chunk int
+	}
+
+	// tls12Cipher and tls13Cipher decrypt the records of one direction
+	tls12Cipher struct {
+		// aead and iv are used by AEAD suites, GCM records start with
+		// the explicit part of the nonce, ChaCha20-Poly1305 uses the iv
+		// like TLS 1.3
+		aead          cipher.AEAD
+		iv            []byte
+		explicitNonce bool
+		// block and mac are used by CBC suites
+		block          cipher.Block
+		mac            hash.Hash
+		encryptThenMAC bool
+		sequence       uint64
+	}
+	tls13Cipher struct {
+		aead     cipher.AEAD
+		iv       []byte
+		sequence uint64
+	}
+
+	tlsHello struct {
+		random      tlskeylog.ClientRandom
+		version     uint16
+		cipherSuite uint16
+		// the server agreed to the encrypt_then_mac extension
+		encryptThenMAC bool
+	}
+
+	tlsDecryptedRecord struct {
+		data  index.Data
+		chunk int
+	}
+)
+
+const (
+	tlsRecordTypeChangeCipherSpec = 20
+	tlsRecordTypeAlert            = 21
+	tlsRecordTypeHandshake        = 22
+	tlsRecordTypeApplicationData  = 23
+	tlsRecordTypeHeartbeat        = 24
+
+	tlsHandshakeTypeClientHello     = 1
+	tlsHandshakeTypeServerHello     = 2
+	tlsHandshakeTypeEndOfEarlyData  = 5
+	tlsHandshakeTypeFinished        = 20
+	tlsHandshakeTypeKeyUpdate       = 24
+	tlsExtensionEncryptThenMAC      = 0x0016
+	tlsExtensionSupportedVersions   = 0x002b
+	tlsRecordHeaderSize             = 5
+	tlsMaxRecordSize                = 1<<14 + 2048
+	tls12ExplicitNonceSize          = 8
+	tls12GCMFixedIVSize             = 4
+	tlsChaChaIVSize                 = 12
+	tls13IVSize                     = 12
+	tlsHandshakeMessageHeaderLength = 4
+
+	// the version of the converter, see Converter
+	tlsDecryptVersion = "1"
+
+	// cipher suites missing in crypto/tls
+	tlsDHERSAWithAES128CBCSHA           = 0x0033
+	tlsDHERSAWithAES256CBCSHA           = 0x0039
+	tlsRSAWithAES256CBCSHA256           = 0x003d
+	tlsDHERSAWithAES128CBCSHA256        = 0x0067
+	tlsDHERSAWithAES256CBCSHA256        = 0x006b
+	tlsDHERSAWithAES128GCMSHA256        = 0x009e
+	tlsDHERSAWithAES256GCMSHA384        = 0x009f
+	tlsECDHEECDSAWithAES256CBCSHA384    = 0xc024
+	tlsECDHERSAWithAES256CBCSHA384      = 0xc028
+	tlsDHERSAWithChaCha20Poly1305SHA256 = 0xccaa
+)
+
+type (
+	// MissingTLSKeysError is returned by the tlsdecrypt converter for
+	// streams whose secrets are not known yet, it matches
+	// ErrMissingTLSKeys.
+	MissingTLSKeysError struct {
+		ClientRandom tlskeylog.ClientRandom
+	}
+)
+
+var (
+	// ErrMissingTLSKeys is matched by MissingTLSKeysError.
+	ErrMissingTLSKeys = errors.New("missing TLS keys")
+
+	// the random of a ServerHello that is a HelloRetryRequest
+	tlsHelloRetryRequestRandom = tlskeylog.ClientRandom(sha256.Sum256([]byte("HelloRetryRequest")))
+
+	tlsCipherSuites = map[uint16]tlsCipherSuite{
+		// TLS 1.3
+		tls.TLS_AES_128_GCM_SHA256:       {keyLength: 16, hash: sha256.New, aead: newGCM},
+		tls.TLS_AES_256_GCM_SHA384:       {keyLength: 32, hash: sha512.New384, aead: newGCM},
+		tls.TLS_CHACHA20_POLY1305_SHA256: {keyLength: 32, hash: sha256.New, aead: chacha20poly1305.New},
+
+		// TLS 1.2 AEAD
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               {keyLength: 16, hash: sha256.New, aead: newGCM, ivLength: tls12GCMFixedIVSize},
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               {keyLength: 32, hash: sha512.New384, aead: newGCM, ivLength: tls12GCMFixedIVSize},
+		tlsDHERSAWithAES128GCMSHA256:                      {keyLength: 16, hash: sha256.New, aead: newGCM, ivLength: tls12GCMFixedIVSize},
+		tlsDHERSAWithAES256GCMSHA384:                      {keyLength: 32, hash: sha512.New384, aead: newGCM, ivLength: tls12GCMFixedIVSize},
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       {keyLength: 16, hash: sha256.New, aead: newGCM, ivLength: tls12GCMFixedIVSize},
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       {keyLength: 32, hash: sha512.New384, aead: newGCM, ivLength: tls12GCMFixedIVSize},
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         {keyLength: 16, hash: sha256.New, aead: newGCM, ivLength: tls12GCMFixedIVSize},
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         {keyLength: 32, hash: sha512.New384, aead: newGCM, ivLength: tls12GCMFixedIVSize},
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   {keyLength: 32, hash: sha256.New, aead: chacha20poly1305.New, ivLength: tlsChaChaIVSize},
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: {keyLength: 32, hash: sha256.New, aead: chacha20poly1305.New, ivLength: tlsChaChaIVSize},
+		tlsDHERSAWithChaCha20Poly1305SHA256:               {keyLength: 32, hash: sha256.New, aead: chacha20poly1305.New, ivLength: tlsChaChaIVSize},
+
+		// TLS 1.2 CBC
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA:            {keyLength: 16, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha1.New},
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA:            {keyLength: 32, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha1.New},
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         {keyLength: 16, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha256.New},
+		tlsRSAWithAES256CBCSHA256:                   {keyLength: 32, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha256.New},
+		tlsDHERSAWithAES128CBCSHA:                   {keyLength: 16, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha1.New},
+		tlsDHERSAWithAES256CBCSHA:                   {keyLength: 32, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha1.New},
+		tlsDHERSAWithAES128CBCSHA256:                {keyLength: 16, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha256.New},
+		tlsDHERSAWithAES256CBCSHA256:                {keyLength: 32, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha256.New},
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    {keyLength: 16, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha1.New},
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    {keyLength: 32, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha1.New},
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      {keyLength: 16, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha1.New},
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      {keyLength: 32, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha1.New},
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: {keyLength: 16, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha256.New},
+		tlsECDHEECDSAWithAES256CBCSHA384:            {keyLength: 32, hash: sha512.New384, ivLength: aes.BlockSize, macHash: sha512.New384},
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   {keyLength: 16, hash: sha256.New, ivLength: aes.BlockSize, macHash: sha256.New},
+		tlsECDHERSAWithAES256CBCSHA384:              {keyLength: 32, hash: sha512.New384, ivLength: aes.BlockSize, macHash: sha512.New384},
+	}
+)
+
+// NewTLSDecryptConverter returns a converter decrypting TLS streams with
+// the secrets of the store. Streams whose secrets are missing fail with
+// ErrMissingTLSKeys.
+func NewTLSDecryptConverter(keys *tlskeylog.Store) Converter {
+	return &tlsDecryptConverter{
+		keys: keys,
+	}
+}
+
+func (err *MissingTLSKeysError) Error() string {
+	return fmt.Sprintf("%v for client random %s", ErrMissingTLSKeys, err.ClientRandom)
+}
+
+func (err *MissingTLSKeysError) Is(target error) bool {
+	return target == ErrMissingTLSKeys
+}
+
+func (c *tlsDecryptConverter) Name() string {
+	return "tlsdecrypt"
+}
+
+func (c *tlsDecryptConverter) Version() string {
+	return tlsDecryptVersion
+}
+
+func (c *tlsDecryptConverter) Convert(stream *index.Stream, data []index.Data) ([]index.Data, error) {
+	records := [2][]tlsRecord{}
+	for _, direction := range []index.Direction{index.DirectionClientToServer, index.DirectionServerToClient} {
+		r, err := splitTLSRecords(data, direction)
+		if err != nil {
+			return nil, err
+		}
+		records[direction] = r
+	}
+	clientHello, err := findTLSHello(records[index.DirectionClientToServer], tlsHandshakeTypeClientHello)
+	if err != nil {
+		return nil, err
+	}
+	if clientHello == nil {
+		return nil, errors.New("no ClientHello found")
+	}
+	serverHello, err := findTLSHello(records[index.DirectionServerToClient], tlsHandshakeTypeServerHello)
+	if err != nil {
+		return nil, err
+	}
+	if serverHello == nil {
+		// the handshake didn't complete, there is nothing to decrypt
+		return []index.Data{}, nil
+	}
+	suite, ok := tlsCipherSuites[serverHello.cipherSuite]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher suite %#04x", serverHello.cipherSuite)
+	}
+	secrets := c.keys.Lookup(clientHello.random)
+
+	decrypted := []tlsDecryptedRecord(nil)
+	for _, direction := range []index.Direction{index.DirectionClientToServer, index.DirectionServerToClient} {
+		var (
+			res []tlsDecryptedRecord
+			err error
+		)
+		switch serverHello.version {
+		case tls.VersionTLS12:
+			res, err = decryptTLS12(records[direction], direction, data, suite, clientHello.random, serverHello.random, serverHello.encryptThenMAC, secrets)
+		case tls.VersionTLS13:
+			res, err = decryptTLS13(records[direction], direction, data, suite, clientHello.random, secrets)
+		default:
+			return nil, fmt.Errorf("unsupported TLS version %#04x", serverHello.version)
+		}
+		if err != nil {
+			return nil, err
+		}
+		decrypted = append(decrypted, res...)
+	}
+	slices.SortStableFunc(decrypted, func(a, b tlsDecryptedRecord) int {
+		return a.chunk - b.chunk
+	})
+	res := make([]index.Data, 0, len(decrypted))
+	for _, d := range decrypted {
+		res = append(res, d.data)
+	}
+	return res, nil
+}
+
+// splitTLSRecords returns the complete records sent in the direction, an
+// incomplete record at the end is ignored.
+func splitTLSRecords(data []index.Data, direction index.Direction) ([]tlsRecord, error) {
+	buffer := []byte(nil)
+	chunkEnds := []int(nil)
+	chunkIndexes := []int(nil)
+	for i, chunk := range data {
+		if chunk.Direction != direction {
+			continue
+		}
+		buffer = append(buffer, chunk.Content...)
+		chunkEnds = append(chunkEnds, len(buffer))
+		chunkIndexes = append(chunkIndexes, i)
+	}
+	records := []tlsRecord(nil)
+	for pos := 0; len(buffer)-pos >= tlsRecordHeaderSize; {
+		header := buffer[pos : pos+tlsRecordHeaderSize]
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if header[0] < tlsRecordTypeChangeCipherSpec || header[0] > tlsRecordTypeHeartbeat || header[1] != 3 || length > tlsMaxRecordSize {
+			return nil, fmt.Errorf("invalid TLS record header %x at offset %d", header, pos)
+		}
+		end := pos + tlsRecordHeaderSize + length
+		if end > len(buffer) {
+			break
+		}
+		chunk, _ := slices.BinarySearch(chunkEnds, end)
+		records = append(records, tlsRecord{
+			header:  header,
+			payload: buffer[pos+tlsRecordHeaderSize : end],
+			chunk:   chunkIndexes[chunk],
+		})
+		pos = end
+	}
+	return records, nil
+}
+
+// findTLSHello parses the first ClientHello or ServerHello of the
+// unencrypted handshake records, HelloRetryRequests are skipped.
+func findTLSHello(records []tlsRecord, handshakeType byte) (*tlsHello, error) {
+	messages := []byte(nil)
+	for _, record := range records {
+		if record.header[0] == tlsRecordTypeApplicationData {
+			break
+		}
+		// a HelloRetryRequest might be followed by a ChangeCipherSpec
+		// before the ServerHello
+		if record.header[0] != tlsRecordTypeHandshake {
+			continue
+		}
+		messages = append(messages, record.payload...)
+		for len(messages) >= tlsHandshakeMessageHeaderLength {
+			length := int(messages[1])<<16 | int(binary.BigEndian.Uint16(messages[2:]))
+			if len(messages) < tlsHandshakeMessageHeaderLength+length {
+				break
+			}
+			message := messages[:tlsHandshakeMessageHeaderLength+length]
+			messages = messages[len(message):]
+			if message[0] != handshakeType {
+				continue
+			}
+			hello, err := parseTLSHello(message[tlsHandshakeMessageHeaderLength:], handshakeType == tlsHandshakeTypeServerHello)
+			if err != nil {
+				return nil, err
+			}
+			if hello.random == tlsHelloRetryRequestRandom {
+				continue
+			}
+			return hello, nil
+		}
+	}
+	return nil, nil
+}
+
+func parseTLSHello(body []byte, server bool) (*tlsHello, error) {
+	hello := tlsHello{}
+	if len(body) < 2+len(hello.random)+1 {
+		return nil, errors.New("truncated hello message")
+	}
+	hello.version = binary.BigEndian.Uint16(body)
+	copy(hello.random[:], body[2:])
+	rest := body[2+len(hello.random):]
+	if len(rest) < 1+int(rest[0]) {
+		return nil, errors.New("truncated hello message")
+	}
+	rest = rest[1+int(rest[0]):]
+	if !server {
+		return &hello, nil
+	}
+	if len(rest) < 3 {
+		return nil, errors.New("truncated ServerHello")
+	}
+	hello.cipherSuite = binary.BigEndian.Uint16(rest)
+	rest = rest[3:]
+	if len(rest) < 2 {
+		return &hello, nil
+	}
+	extensions := rest[2:]
+	if l := int(binary.BigEndian.Uint16(rest)); l < len(extensions) {
+		extensions = extensions[:l]
+	}
+	for len(extensions) >= 4 {
+		extensionType := binary.BigEndian.Uint16(extensions)
+		length := int(binary.BigEndian.Uint16(extensions[2:]))
+		if len(extensions) < 4+length {
+			return nil, errors.New("truncated ServerHello extension")
+		}
+		switch {
+		case extensionType == tlsExtensionSupportedVersions && length == 2:
+			hello.version = binary.BigEndian.Uint16(extensions[4:])
+		case extensionType == tlsExtensionEncryptThenMAC:
+			hello.encryptThenMAC = true
+		}
+		extensions = extensions[4+length:]
+	}
+	return &hello, nil
+}
+
+// prf12 is the pseudorandom function of TLS 1.2 defined in RFC 5246.
+func prf12(hash func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelAndSeed := append([]byte(label), seed...)
+	mac := hmac.New(hash, secret)
+	mac.Write(labelAndSeed)
+	a := mac.Sum(nil)
+	res := []byte(nil)
+	for len(res) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelAndSeed)
+		res = mac.Sum(res)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return res[:length]
+}
+
+// expandLabel13 is HKDF-Expand-Label of TLS 1.3 defined in RFC 8446
+// with an empty context.
+func expandLabel13(hash func() hash.Hash, secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(hash, secret, string(info), length)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// macLength returns the length of the MAC keys of CBC suites.
+func (suite tlsCipherSuite) macLength() int {
+	if suite.macHash == nil {
+		return 0
+	}
+	return suite.macHash().Size()
+}
+
+// sequenceNonce returns the iv xored with the sequence number as used by
+// TLS 1.3 and ChaCha20-Poly1305 in TLS 1.2.
+func sequenceNonce(iv []byte, sequence uint64) []byte {
+	nonce := slices.Clone(iv)
+	for i := range 8 {
+		nonce[len(nonce)-1-i] ^= byte(sequence >> (8 * i))
+	}
+	return nonce
+}
+
+// additionalData returns the data authenticated with the content of a
+// TLS 1.2 record of the given length.
+func (c *tls12Cipher) additionalData(header []byte, length int) []byte {
+	additionalData := binary.BigEndian.AppendUint64(nil, c.sequence)
+	additionalData = append(additionalData, header[:3]...)
+	return binary.BigEndian.AppendUint16(additionalData, uint16(length))
+}
+
+func (c *tls12Cipher) decrypt(record tlsRecord) (byte, []byte, error) {
+	var (
+		plaintext []byte
+		err       error
+	)
+	if c.aead != nil {
+		plaintext, err = c.decryptAEAD(record)
+	} else {
+		plaintext, err = c.decryptCBC(record)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	c.sequence++
+	return record.header[0], plaintext, nil
+}
+
+func (c *tls12Cipher) decryptAEAD(record tlsRecord) ([]byte, error) {
+	nonce, ciphertext := []byte(nil), record.payload
+	if c.explicitNonce {
+		if len(ciphertext) < tls12ExplicitNonceSize {
+			return nil, errors.New("encrypted record too short")
+		}
+		nonce = append(slices.Clone(c.iv), ciphertext[:tls12ExplicitNonceSize]...)
+		ciphertext = ciphertext[tls12ExplicitNonceSize:]
+	} else {
+		nonce = sequenceNonce(c.iv, c.sequence)
+	}
+	if len(ciphertext) < c.aead.Overhead() {
+		return nil, errors.New("encrypted record too short")
+	}
+	return c.aead.Open(nil, nonce, ciphertext, c.additionalData(record.header, len(ciphertext)-c.aead.Overhead()))
+}
+
+// decryptCBC decrypts a record consisting of the explicit iv and the
+// ciphertext. The MAC is part of the plaintext, or follows the ciphertext
+// when encrypt_then_mac was negotiated.
+func (c *tls12Cipher) decryptCBC(record tlsRecord) ([]byte, error) {
+	payload := record.payload
+	blockSize, macSize := c.block.BlockSize(), c.mac.Size()
+	checkMAC := func(content, mac []byte) error {
+		c.mac.Reset()
+		c.mac.Write(c.additionalData(record.header, len(content)))
+		c.mac.Write(content)
+		if !hmac.Equal(c.mac.Sum(nil), mac) {
+			return errors.New("invalid MAC")
+		}
+		return nil
+	}
+	if c.encryptThenMAC {
+		if len(payload) < macSize {
+			return nil, errors.New("encrypted record too short")
+		}
+		mac := payload[len(payload)-macSize:]
+		payload = payload[:len(payload)-macSize]
+		if err := checkMAC(payload, mac); err != nil {
+			return nil, err
+		}
+	}
+	if len(payload) < 2*blockSize || len(payload)%blockSize != 0 {
+		return nil, errors.New("invalid encrypted record length")
+	}
+	plaintext := make([]byte, len(payload)-blockSize)
+	cipher.NewCBCDecrypter(c.block, payload[:blockSize]).CryptBlocks(plaintext, payload[blockSize:])
+	padding := int(plaintext[len(plaintext)-1])
+	if padding >= len(plaintext) {
+		return nil, errors.New("invalid padding")
+	}
+	for _, b := range plaintext[len(plaintext)-1-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	plaintext = plaintext[:len(plaintext)-1-padding]
+	if c.encryptThenMAC {
+		return plaintext, nil
+	}
+	if len(plaintext) < macSize {
+		return nil, errors.New("encrypted record too short")
+	}
+	content, mac := plaintext[:len(plaintext)-macSize], plaintext[len(plaintext)-macSize:]
+	if err := checkMAC(content, mac); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// newTLS12Cipher creates the cipher of a direction from the key block
+// consisting of the client and server MAC keys, keys and ivs.
+func newTLS12Cipher(suite tlsCipherSuite, keyBlock []byte, direction index.Direction, encryptThenMAC bool) (*tls12Cipher, error) {
+	macLength := suite.macLength()
+	part := func(offset, length int) []byte {
+		if direction == index.DirectionServerToClient {
+			offset += length
+		}
+		return keyBlock[offset : offset+length]
+	}
+	macKey := part(0, macLength)
+	key := part(2*macLength, suite.keyLength)
+	iv := part(2*macLength+2*suite.keyLength, suite.ivLength)
+	if suite.aead != nil {
+		aead, err := suite.aead(key)
+		if err != nil {
+			return nil, err
+		}
+		return &tls12Cipher{
+			aead:          aead,
+			iv:            iv,
+			explicitNonce: suite.ivLength == tls12GCMFixedIVSize,
+		}, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls12Cipher{
+		block:          block,
+		mac:            hmac.New(suite.macHash, macKey),
+		encryptThenMAC: encryptThenMAC,
+	}, nil
+}
+
+func newTLS13Cipher(suite tlsCipherSuite, secret []byte) (*tls13Cipher, error) {
+	key, err := expandLabel13(suite.hash, secret, "key", suite.keyLength)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := expandLabel13(suite.hash, secret, "iv", tls13IVSize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := suite.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls13Cipher{
+		aead: aead,
+		iv:   iv,
+	}, nil
+}
+
+func (c *tls13Cipher) decrypt(record tlsRecord) (byte, []byte, error) {
+	plaintext, err := c.aead.Open(nil, sequenceNonce(c.iv, c.sequence), record.payload, record.header)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.sequence++
+	// the content type follows the content, it is padded with zeros
+	for len(plaintext) > 0 && plaintext[len(plaintext)-1] == 0 {
+		plaintext = plaintext[:len(plaintext)-1]
+	}
+	if len(plaintext) == 0 {
+		return 0, nil, errors.New("record without content type")
+	}
+	return plaintext[len(plaintext)-1], plaintext[:len(plaintext)-1], nil
+}
+
+func decryptTLS12(records []tlsRecord, direction index.Direction, data []index.Data, suite tlsCipherSuite, clientRandom, serverRandom tlskeylog.ClientRandom, encryptThenMAC bool, secrets tlskeylog.Secrets) ([]tlsDecryptedRecord, error) {
+	res := []tlsDecryptedRecord(nil)
+	recordCipher := (*tls12Cipher)(nil)
+	for _, record := range records {
+		if record.header[0] == tlsRecordTypeChangeCipherSpec {
+			if recordCipher != nil {
+				return nil, errors.New("renegotiation is not supported")
+			}
+			masterSecret, ok := secrets[tlskeylog.LabelClientRandom]
+			if !ok {
+				return nil, &MissingTLSKeysError{ClientRandom: clientRandom}
+			}
+			seed := append(serverRandom[:], clientRandom[:]...)
+			keyBlock := prf12(suite.hash, masterSecret, "key expansion", seed, 2*(suite.macLength()+suite.keyLength+suite.ivLength))
+			c, err := newTLS12Cipher(suite, keyBlock, direction, encryptThenMAC)
+			if err != nil {
+				return nil, err
+			}
+			recordCipher = c
+			continue
+		}
+		if recordCipher == nil {
+			continue
+		}
+		contentType, plaintext, err := recordCipher.decrypt(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt record: %w", err)
+		}
+		if contentType == tlsRecordTypeApplicationData {
+			res = append(res, tlsDecryptedRecord{
+				data: index.Data{
+					Direction: direction,
+					Content:   plaintext,
+					Time:      data[record.chunk].Time,
+				},
+				chunk: record.chunk,
+			})
+		}
+	}
+	return res, nil
+}
+
+func decryptTLS13(records []tlsRecord, direction index.Direction, data []index.Data, suite tlsCipherSuite, clientRandom tlskeylog.ClientRandom, secrets tlskeylog.Secrets) ([]tlsDecryptedRecord, error) {
+	// the labels of the secrets used one after another
+	labels := []string{tlskeylog.LabelServerHandshakeTrafficSecret, tlskeylog.LabelServerTrafficSecret0}
+	if direction == index.DirectionClientToServer {
+		labels = []string{tlskeylog.LabelClientHandshakeTrafficSecret, tlskeylog.LabelClientTrafficSecret0}
+		if _, ok := secrets[tlskeylog.LabelClientEarlyTrafficSecret]; ok {
+			labels = append([]string{tlskeylog.LabelClientEarlyTrafficSecret}, labels...)
+		}
+	}
+	for _, label := range labels {
+		if _, ok := secrets[label]; !ok {
+			return nil, &MissingTLSKeysError{ClientRandom: clientRandom}
+		}
+	}
+	secret := []byte(nil)
+	recordCipher := (*tls13Cipher)(nil)
+	nextSecret := func(updated []byte) error {
+		if updated == nil {
+			secret, labels = secrets[labels[0]], labels[1:]
+		} else {
+			secret = updated
+		}
+		c, err := newTLS13Cipher(suite, secret)
+		recordCipher = c
+		return err
+	}
+	if err := nextSecret(nil); err != nil {
+		return nil, err
+	}
+
+	res := []tlsDecryptedRecord(nil)
+	handshakeMessages := []byte(nil)
+	for _, record := range records {
+		if record.header[0] != tlsRecordTypeApplicationData {
+			// unencrypted handshake messages and the compatibility
+			// ChangeCipherSpec
+			continue
+		}
+		contentType, plaintext, err := recordCipher.decrypt(record)
+		if err != nil && len(labels) == 2 && direction == index.DirectionClientToServer {
+			// the server might have rejected the early data and the
+			// client continued with the handshake
+			if err := nextSecret(nil); err != nil {
+				return nil, err
+			}
+			contentType, plaintext, err = recordCipher.decrypt(record)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt record: %w", err)
+		}
+		switch contentType {
+		case tlsRecordTypeApplicationData:
+			res = append(res, tlsDecryptedRecord{
+				data: index.Data{
+					Direction: direction,
+					Content:   plaintext,
+					Time:      data[record.chunk].Time,
+				},
+				chunk: record.chunk,
+			})
+		case tlsRecordTypeHandshake:
+			handshakeMessages = append(handshakeMessages, plaintext...)
+			for len(handshakeMessages) >= tlsHandshakeMessageHeaderLength {
+				length := int(handshakeMessages[1])<<16 | int(binary.BigEndian.Uint16(handshakeMessages[2:]))
+				if len(handshakeMessages) < tlsHandshakeMessageHeaderLength+length {
+					break
+				}
+				messageType := handshakeMessages[0]
+				handshakeMessages = handshakeMessages[tlsHandshakeMessageHeaderLength+length:]
+				// labels contains the secrets that are not used yet, the
+				// early data ends with EndOfEarlyData and the handshake
+				// with Finished
+				switch {
+				case messageType == tlsHandshakeTypeEndOfEarlyData && len(labels) == 2,
+					messageType == tlsHandshakeTypeFinished && len(labels) == 1:
+					if err := nextSecret(nil); err != nil {
+						return nil, err
+					}
+				case messageType == tlsHandshakeTypeKeyUpdate && len(labels) == 0:
+					updated, err := expandLabel13(suite.hash, secret, "traffic upd", suite.hash().Size())
+					if err != nil {
+						return nil, err
+					}
+					if err := nextSecret(updated); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,332 @@
+package converters
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spq/pkappa2/internal/index"
+	tlskeylog "github.com/spq/pkappa2/internal/tools/tlsKeylog"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type (
+	// recordingConn records the data written by both ends of a connection
+	recordingConn struct {
+		net.Conn
+		direction index.Direction
+		mutex     *sync.Mutex
+		data      *[]index.Data
+	}
+)
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	*c.data = append(*c.data, index.Data{
+		Direction: c.direction,
+		Content:   bytes.Clone(b),
+		Time:      time.Unix(int64(len(*c.data)), 0),
+	})
+	c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+func makeCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey failed: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %v", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{cert},
+		PrivateKey:  key,
+	}
+}
+
+// recordTLSSession runs a TLS connection exchanging a request and a
+// response, it returns the recorded data and the keylog. The cipher suite
+// is only used by TLS 1.2.
+func recordTLSSession(t *testing.T, version uint16, cipherSuite uint16) ([]index.Data, []byte) {
+	cert := makeCertificate(t)
+	keylog := bytes.Buffer{}
+	data := []index.Data(nil)
+	mutex := sync.Mutex{}
+	// net.Pipe is unbuffered, which deadlocks when both ends write
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial failed: %v", err)
+	}
+	defer clientConn.Close()
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer serverConn.Close()
+	client := tls.Client(&recordingConn{clientConn, index.DirectionClientToServer, &mutex, &data}, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+		CipherSuites:       []uint16{cipherSuite},
+		KeyLogWriter:       &keylog,
+	})
+	server := tls.Server(&recordingConn{serverConn, index.DirectionServerToClient, &mutex, &data}, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		MaxVersion:   version,
+		CipherSuites: []uint16{cipherSuite},
+	})
+	errs := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			errs <- err
+			return
+		}
+		_, err := server.Write([]byte("pong!"))
+		errs <- err
+	}()
+	if _, err := client.Write([]byte("ping!")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("server failed: %v", err)
+	}
+	if version == tls.VersionTLS12 && client.ConnectionState().CipherSuite != cipherSuite {
+		t.Fatalf("negotiated cipher suite %s, want %s", tls.CipherSuiteName(client.ConnectionState().CipherSuite), tls.CipherSuiteName(cipherSuite))
+	}
+	return data, keylog.Bytes()
+}
+
+func TestTLSDecryptConverter(t *testing.T) {
+	for _, tc := range []struct {
+		version     uint16
+		cipherSuite uint16
+	}{
+		{tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		{tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		{tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+		{tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256},
+		{tls.VersionTLS13, 0},
+	} {
+		name := tls.VersionName(tc.version)
+		if tc.version == tls.VersionTLS12 {
+			name += "/" + tls.CipherSuiteName(tc.cipherSuite)
+		}
+		t.Run(name, func(t *testing.T) {
+			data, keylog := recordTLSSession(t, tc.version, tc.cipherSuite)
+			keys := tlskeylog.NewStore()
+			converter := NewTLSDecryptConverter(keys)
+
+			_, err := converter.Convert(nil, data)
+			missing := (*MissingTLSKeysError)(nil)
+			if !errors.Is(err, ErrMissingTLSKeys) || !errors.As(errors.Join(errors.New("pipeline"), err), &missing) {
+				t.Fatalf("Convert without keys returned %v, want %v", err, ErrMissingTLSKeys)
+			}
+			random := missing.ClientRandom
+
+			entries, err := tlskeylog.Parse(bytes.NewReader(keylog))
+			if err != nil {
+				t.Fatalf("tlskeylog.Parse failed: %v", err)
+			}
+			keys.Add(entries)
+			if keys.Lookup(random) == nil {
+				t.Fatalf("MissingTLSKeysError contains unknown client random %s", random)
+			}
+			got, err := converter.Convert(nil, data)
+			if err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			if len(got) != 2 ||
+				got[0].Direction != index.DirectionClientToServer || string(got[0].Content) != "ping!" ||
+				got[1].Direction != index.DirectionServerToClient || string(got[1].Content) != "pong!" {
+				t.Fatalf("Convert returned %+v, want ping! and pong!", got)
+			}
+		})
+	}
+}
+
+func tlsTestRecord(contentType byte, payload []byte) []byte {
+	return append([]byte{contentType, 3, 3, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+}
+
+// tlsTestHello returns a record containing a minimal ClientHello or
+// ServerHello.
+func tlsTestHello(handshakeType byte, random tlskeylog.ClientRandom, cipherSuite uint16, extensions []byte) []byte {
+	body := append([]byte{3, 3}, random[:]...)
+	// empty session id
+	body = append(body, 0)
+	if handshakeType == tlsHandshakeTypeClientHello {
+		body = binary.BigEndian.AppendUint16(body, 2)
+		body = binary.BigEndian.AppendUint16(body, cipherSuite)
+		body = append(body, 1, 0)
+	} else {
+		body = binary.BigEndian.AppendUint16(body, cipherSuite)
+		body = append(body, 0)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extensions)))
+	body = append(body, extensions...)
+	return tlsTestRecord(tlsRecordTypeHandshake, append([]byte{handshakeType, 0, byte(len(body) >> 8), byte(len(body))}, body...))
+}
+
+// tlsTestFinished returns a Finished message with an empty verify_data,
+// it is not checked by the converter.
+func tlsTestFinished() []byte {
+	return append([]byte{tlsHandshakeTypeFinished, 0, 0, 12}, make([]byte, 12)...)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("rand.Read failed: %v", err)
+	}
+	return b
+}
+
+// TestTLSDecryptConverterSynthetic decrypts handcrafted sessions using
+// cipher suites crypto/tls doesn't negotiate on demand.
+func TestTLSDecryptConverterSynthetic(t *testing.T) {
+	clientRandom := tlskeylog.ClientRandom(randomBytes(t, 32))
+	serverRandom := tlskeylog.ClientRandom(randomBytes(t, 32))
+	check := func(t *testing.T, data []index.Data, entries []tlskeylog.Entry) {
+		keys := tlskeylog.NewStore()
+		keys.Add(entries)
+		got, err := NewTLSDecryptConverter(keys).Convert(nil, data)
+		if err != nil {
+			t.Fatalf("Convert failed: %v", err)
+		}
+		if len(got) != 2 ||
+			got[0].Direction != index.DirectionClientToServer || string(got[0].Content) != "ping!" ||
+			got[1].Direction != index.DirectionServerToClient || string(got[1].Content) != "pong!" {
+			t.Fatalf("Convert returned %+v, want ping! and pong!", got)
+		}
+	}
+
+	t.Run("TLS_CHACHA20_POLY1305_SHA256", func(t *testing.T) {
+		entries := []tlskeylog.Entry(nil)
+		// encrypt returns an encrypted TLS 1.3 record using the secret
+		encrypt := func(label string, sequence uint64, contentType byte, content []byte) []byte {
+			secret := randomBytes(t, 32)
+			if sequence == 0 {
+				entries = append(entries, tlskeylog.Entry{Label: label, ClientRandom: clientRandom, Secret: secret})
+			}
+			for _, e := range entries {
+				if e.Label == label {
+					secret = e.Secret
+				}
+			}
+			key, err := expandLabel13(sha256.New, secret, "key", chacha20poly1305.KeySize)
+			if err != nil {
+				t.Fatalf("expandLabel13 failed: %v", err)
+			}
+			iv, err := expandLabel13(sha256.New, secret, "iv", tls13IVSize)
+			if err != nil {
+				t.Fatalf("expandLabel13 failed: %v", err)
+			}
+			aead, err := chacha20poly1305.New(key)
+			if err != nil {
+				t.Fatalf("chacha20poly1305.New failed: %v", err)
+			}
+			plaintext := append(slices.Clone(content), contentType)
+			header := []byte{tlsRecordTypeApplicationData, 3, 3, 0, byte(len(plaintext) + aead.Overhead())}
+			return append(header, aead.Seal(nil, sequenceNonce(iv, sequence), plaintext, header)...)
+		}
+		supportedVersions := []byte{0, tlsExtensionSupportedVersions, 0, 2, 3, 4}
+		data := []index.Data{
+			{Direction: index.DirectionClientToServer, Content: tlsTestHello(tlsHandshakeTypeClientHello, clientRandom, tls.TLS_CHACHA20_POLY1305_SHA256, nil)},
+			{Direction: index.DirectionServerToClient, Content: tlsTestHello(tlsHandshakeTypeServerHello, serverRandom, tls.TLS_CHACHA20_POLY1305_SHA256, supportedVersions)},
+			{Direction: index.DirectionServerToClient, Content: encrypt(tlskeylog.LabelServerHandshakeTrafficSecret, 0, tlsRecordTypeHandshake, tlsTestFinished())},
+			{Direction: index.DirectionClientToServer, Content: encrypt(tlskeylog.LabelClientHandshakeTrafficSecret, 0, tlsRecordTypeHandshake, tlsTestFinished())},
+			{Direction: index.DirectionClientToServer, Content: encrypt(tlskeylog.LabelClientTrafficSecret0, 0, tlsRecordTypeApplicationData, []byte("ping!"))},
+			{Direction: index.DirectionServerToClient, Content: encrypt(tlskeylog.LabelServerTrafficSecret0, 0, tlsRecordTypeApplicationData, []byte("pong!"))},
+		}
+		check(t, data, entries)
+	})
+
+	t.Run("TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256 encrypt_then_mac", func(t *testing.T) {
+		masterSecret := randomBytes(t, 48)
+		keyBlock := prf12(sha256.New, masterSecret, "key expansion", append(serverRandom[:], clientRandom[:]...), 2*(sha256.Size+16+aes.BlockSize))
+		// encrypt returns an encrypted record of the direction, the MAC
+		// is computed over the iv and ciphertext
+		encrypt := func(direction index.Direction, sequence uint64, contentType byte, content []byte) []byte {
+			macKey, key := keyBlock[:sha256.Size], keyBlock[2*sha256.Size:2*sha256.Size+16]
+			if direction == index.DirectionServerToClient {
+				macKey, key = keyBlock[sha256.Size:2*sha256.Size], keyBlock[2*sha256.Size+16:2*sha256.Size+32]
+			}
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				t.Fatalf("aes.NewCipher failed: %v", err)
+			}
+			padding := aes.BlockSize - 1 - len(content)%aes.BlockSize
+			plaintext := append(slices.Clone(content), bytes.Repeat([]byte{byte(padding)}, padding+1)...)
+			payload := randomBytes(t, aes.BlockSize)
+			ciphertext := make([]byte, len(plaintext))
+			cipher.NewCBCEncrypter(block, payload).CryptBlocks(ciphertext, plaintext)
+			payload = append(payload, ciphertext...)
+			mac := hmac.New(sha256.New, macKey)
+			mac.Write(binary.BigEndian.AppendUint64(nil, sequence))
+			mac.Write([]byte{contentType, 3, 3, byte(len(payload) >> 8), byte(len(payload))})
+			mac.Write(payload)
+			return tlsTestRecord(contentType, mac.Sum(payload))
+		}
+		cipherSuite := uint16(tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256)
+		encryptThenMAC := []byte{0, tlsExtensionEncryptThenMAC, 0, 0}
+		changeCipherSpec := tlsTestRecord(tlsRecordTypeChangeCipherSpec, []byte{1})
+		data := []index.Data{
+			{Direction: index.DirectionClientToServer, Content: tlsTestHello(tlsHandshakeTypeClientHello, clientRandom, cipherSuite, encryptThenMAC)},
+			{Direction: index.DirectionServerToClient, Content: tlsTestHello(tlsHandshakeTypeServerHello, serverRandom, cipherSuite, encryptThenMAC)},
+			{Direction: index.DirectionClientToServer, Content: append(changeCipherSpec, encrypt(index.DirectionClientToServer, 0, tlsRecordTypeHandshake, tlsTestFinished())...)},
+			{Direction: index.DirectionServerToClient, Content: append(changeCipherSpec, encrypt(index.DirectionServerToClient, 0, tlsRecordTypeHandshake, tlsTestFinished())...)},
+			{Direction: index.DirectionClientToServer, Content: encrypt(index.DirectionClientToServer, 1, tlsRecordTypeApplicationData, []byte("ping!"))},
+			{Direction: index.DirectionServerToClient, Content: encrypt(index.DirectionServerToClient, 1, tlsRecordTypeApplicationData, []byte("pong!"))},
+		}
+		check(t, data, []tlskeylog.Entry{{Label: tlskeylog.LabelClientRandom, ClientRandom: clientRandom, Secret: masterSecret}})
+	})
+}
+
+func TestTLSDecryptConverterInvalidStreams(t *testing.T) {
+	converter := NewTLSDecryptConverter(tlskeylog.NewStore())
+	for _, content := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"\x16\x03\x01\x00\x01",
+	} {
+		data := []index.Data{{Direction: index.DirectionClientToServer, Content: []byte(content)}}
+		if _, err := converter.Convert(nil, data); err == nil || errors.Is(err, ErrMissingTLSKeys) {
+			t.Errorf("Convert(%q) returned %v, want an error", content, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package index
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type (
+	// dataBlockWriter writes the stream data into zstd compressed blocks
+	// of dataBlockSize bytes, the last block might be smaller.
+	dataBlockWriter struct {
+		w              *Writer
+		blocks         []dataBlockEntry
+		pending        []byte
+		compressedSize uint64
+		flushedSize    uint64
+	}
+	// dataBlockReader provides random access to the uncompressed stream
+	// data, it caches the last decompressed block and is not safe for
+	// concurrent use.
+	dataBlockReader struct {
+		r          *Reader
+		block      int
+		data       []byte
+		compressed []byte
+	}
+)
+
+var (
+	dataBlockEncoder, _ = zstd.NewWriter(nil)
+	dataBlockDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+func (dw *dataBlockWriter) Write(p []byte) (int, error) {
+	dw.pending = append(dw.pending, p...)
+	if len(dw.pending) < dataBlockSize {
+		return len(p), nil
+	}
+	pos := 0
+	for ; len(dw.pending)-pos >= dataBlockSize; pos += dataBlockSize {
+		if err := dw.flushBlock(dw.pending[pos:][:dataBlockSize]); err != nil {
+			return 0, err
+		}
+	}
+	dw.pending = dw.pending[:copy(dw.pending, dw.pending[pos:])]
+	return len(p), nil
+}
+
+func (dw *dataBlockWriter) flushBlock(block []byte) error {
+	compressed := dataBlockEncoder.EncodeAll(block, nil)
+	if err := dw.w.write(compressed); err != nil {
+		return err
+	}
+	dw.blocks = append(dw.blocks, dataBlockEntry{
+		Offset:     dw.compressedSize,
+		DataOffset: dw.flushedSize,
+	})
+	dw.compressedSize += uint64(len(compressed))
+	dw.flushedSize += uint64(len(block))
+	return nil
+}
+
+// pos returns the position in the uncompressed stream data.
+func (dw *dataBlockWriter) pos() uint64 {
+	return dw.flushedSize + uint64(len(dw.pending))
+}
+
+// truncate drops all data written after pos, already written
+// blocks are read back from the file if necessary.
+func (dw *dataBlockWriter) truncate(pos uint64) error {
+	if pos >= dw.flushedSize {
+		dw.pending = dw.pending[:pos-dw.flushedSize]
+		return nil
+	}
+	i := sort.Search(len(dw.blocks), func(i int) bool {
+		return dw.blocks[i].DataOffset > pos
+	}) - 1
+	b := dw.blocks[i]
+	if err := dw.w.buffer.Flush(); err != nil {
+		return err
+	}
+	compressed := make([]byte, dw.compressedSize-b.Offset)
+	begin := int64(dw.w.header.Sections[sectionData].Begin + b.Offset)
+	if _, err := dw.w.file.ReadAt(compressed, begin); err != nil {
+		return err
+	}
+	if len(dw.blocks) > i+1 {
+		compressed = compressed[:dw.blocks[i+1].Offset-b.Offset]
+	}
+	data, err := dataBlockDecoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := dw.w.file.Seek(begin, io.SeekStart); err != nil {
+		return err
+	}
+	dw.blocks = dw.blocks[:i]
+	dw.compressedSize = b.Offset
+	dw.flushedSize = b.DataOffset
+	dw.pending = data[:pos-b.DataOffset]
+	return nil
+}
+
+// finish writes the remaining data and returns the block table, the
+// last entry marks the end of the data.
+func (dw *dataBlockWriter) finish() ([]dataBlockEntry, error) {
+	if len(dw.pending) != 0 {
+		if err := dw.flushBlock(dw.pending); err != nil {
+			return nil, err
+		}
+		dw.pending = nil
+	}
+	return append(dw.blocks, dataBlockEntry{
+		Offset:     dw.compressedSize,
+		DataOffset: dw.flushedSize,
+	}), nil
+}
+
+func (br *dataBlockReader) ReadAt(p []byte, off int64) (int, error) {
+	blocks := br.r.dataBlocks
+	n := 0
+	for n < len(p) {
+		pos := uint64(off) + uint64(n)
+		if pos >= blocks[len(blocks)-1].DataOffset {
+			return n, io.EOF
+		}
+		i := sort.Search(len(blocks)-1, func(i int) bool {
+			return blocks[i].DataOffset > pos
+		}) - 1
+		if i != br.block {
+			if err := br.load(i); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], br.data[pos-blocks[i].DataOffset:])
+	}
+	return n, nil
+}
+
+func (br *dataBlockReader) load(i int) error {
+	b, next := br.r.dataBlocks[i], br.r.dataBlocks[i+1]
+	size := int(next.Offset - b.Offset)
+	begin := int64(br.r.header.Sections[sectionData].Begin + b.Offset)
+	compressed := []byte(nil)
+	if br.r.mapped != nil && begin+int64(size) <= int64(len(br.r.mapped)) {
+		compressed = br.r.mapped[begin:][:size]
+	} else {
+		if cap(br.compressed) < size {
+			br.compressed = make([]byte, size)
+		}
+		br.compressed = br.compressed[:size]
+		if _, err := br.r.file.ReadAt(br.compressed, begin); err != nil {
+			return err
+		}
+		compressed = br.compressed
+	}
+	data, err := dataBlockDecoder.DecodeAll(compressed, br.data[:0])
+	if err != nil {
+		br.block = -1
+		return err
+	}
+	if uint64(len(data)) != next.DataOffset-b.DataOffset {
+		br.block = -1
+		return fmt.Errorf("data block %d has size %d, expected %d", i, len(data), next.DataOffset-b.DataOffset)
+	}
+	br.data = data
+	br.block = i
+	return nil
+}
+
+// dataSize returns the size of the uncompressed stream data.
+func (r *Reader) dataSize() int64 {
+	if r.dataBlocks == nil {
+		return r.header.Sections[sectionData].size()
+	}
+	return int64(r.dataBlocks[len(r.dataBlocks)-1].DataOffset)
+}
+
+// dataReader returns a reader for the uncompressed stream data.
+func (r *Reader) dataReader() *io.SectionReader {
+	if r.dataBlocks == nil {
+		return r.sectionReader(sectionData)
+	}
+	return io.NewSectionReader(&dataBlockReader{r: r, block: -1}, 0, r.dataSize())
+}
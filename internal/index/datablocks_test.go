@@ -0,0 +1,198 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/spq/pkappa2/internal/query"
+)
+
+func makeLargeStreams() map[uint64]streamInfo {
+	streams := map[uint64]streamInfo{}
+	for i := 0; i < 8; i++ {
+		chunks := []string(nil)
+		for j := 0; j < 5; j++ {
+			b := bytes.Buffer{}
+			for b.Len() < 30_000 {
+				fmt.Fprintf(&b, "stream %d chunk %d line %d\n", i, j, b.Len())
+			}
+			chunks = append(chunks, b.String())
+		}
+		streams[uint64(i)] = makeStream("1.2.3.4:1234", fmt.Sprintf("4.3.2.1:%d", 1000+i), t1.Add(time.Minute*time.Duration(i)), chunks)
+	}
+	return streams
+}
+
+func checkStreamData(t *testing.T, r *Reader, streams map[uint64]streamInfo) {
+	t.Helper()
+	for id, si := range streams {
+		s, err := r.StreamByID(id)
+		if err != nil || s == nil {
+			t.Fatalf("Reader.StreamByID(%d) = %v, %v", id, s, err)
+		}
+		data, err := s.Data()
+		if err != nil {
+			t.Fatalf("Stream.Data() failed with error: %v", err)
+		}
+		got := [2][]byte{}
+		for _, d := range data {
+			got[d.Direction] = append(got[d.Direction], d.Content...)
+		}
+		want := [2][]byte{}
+		for i, d := range si.s.Data {
+			want[i%2] = append(want[i%2], d.Bytes...)
+		}
+		if !bytes.Equal(got[0], want[0]) || !bytes.Equal(got[1], want[1]) {
+			t.Errorf("Stream(%d).Data() returned %d/%d bytes, want %d/%d bytes", id, len(got[0]), len(got[1]), len(want[0]), len(want[1]))
+		}
+	}
+}
+
+func TestDataBlocks(t *testing.T) {
+	tmpDir := t.TempDir()
+	streams := makeLargeStreams()
+	r, err := makeIndex(tmpDir, streams, nil)
+	if err != nil {
+		t.Fatalf("makeIndex failed with error: %v", err)
+	}
+	if len(r.dataBlocks) < 3 {
+		t.Fatalf("len(Reader.dataBlocks) = %d, want at least 3", len(r.dataBlocks))
+	}
+	if got, max := r.header.Sections[sectionData].size(), r.dataSize()/2; got > max {
+		t.Errorf("compressed data section size = %d, want at most %d", got, max)
+	}
+	checkStreamData(t, r, streams)
+
+	q, err := query.Parse("sdata:\"stream 5 chunk 3 line\"")
+	if err != nil {
+		t.Fatalf("query.Parse failed with error: %v", err)
+	}
+	results, _, _, err := SearchStreams(context.Background(), []*Reader{r}, nil, q.ReferenceTime, q.Conditions, nil, nil, 0, 0, nil, nil, false)
+	if err != nil {
+		t.Fatalf("SearchStreams failed with error: %v", err)
+	}
+	if len(results) != 1 || results[0].ID() != 5 {
+		t.Errorf("SearchStreams returned %d results, want stream 5", len(results))
+	}
+
+	merged, err := Merge(tmpDir, []*Reader{r})
+	if err != nil {
+		t.Fatalf("Merge failed with error: %v", err)
+	}
+	if len(merged) != 1 {
+		t.Fatalf("len(Merge()) = %d, want 1", len(merged))
+	}
+	checkStreamData(t, merged[0], streams)
+}
+
+func TestDataBlockWriterTruncate(t *testing.T) {
+	w, err := NewWriter(filepath.Join(t.TempDir(), "test.idx"))
+	if err != nil {
+		t.Fatalf("NewWriter failed with error: %v", err)
+	}
+	defer w.Close()
+	want := []byte(nil)
+	for i := 0; len(want) < dataBlockSize*3; i++ {
+		want = fmt.Appendf(want, "line %d\n", i)
+	}
+	if _, err := w.data.Write(want); err != nil {
+		t.Fatalf("dataBlockWriter.Write failed with error: %v", err)
+	}
+	// truncate into the first block and overwrite the rest
+	pos := uint64(dataBlockSize / 2)
+	if err := w.data.truncate(pos); err != nil {
+		t.Fatalf("dataBlockWriter.truncate failed with error: %v", err)
+	}
+	want = append(want[:pos], bytes.Repeat([]byte("x"), dataBlockSize*2)...)
+	if _, err := w.data.Write(want[pos:]); err != nil {
+		t.Fatalf("dataBlockWriter.Write failed with error: %v", err)
+	}
+	blocks, err := w.data.finish()
+	if err != nil {
+		t.Fatalf("dataBlockWriter.finish failed with error: %v", err)
+	}
+	if err := w.buffer.Flush(); err != nil {
+		t.Fatalf("Flush failed with error: %v", err)
+	}
+	r := &Reader{
+		file:       w.file,
+		header:     w.header,
+		dataBlocks: blocks,
+	}
+	if got := r.dataSize(); got != int64(len(want)) {
+		t.Fatalf("Reader.dataSize() = %d, want %d", got, len(want))
+	}
+	got, err := io.ReadAll(r.dataReader())
+	if err != nil {
+		t.Fatalf("ReadAll failed with error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read data does not match written data")
+	}
+}
+
+// writeV2Index rewrites an index with an uncompressed data section and without the data blocks section.
+func writeV2Index(r *Reader, filename string) error {
+	data, err := io.ReadAll(r.dataReader())
+	if err != nil {
+		return err
+	}
+	header := fileHeaderV2{
+		FirstPacketTime: r.header.FirstPacketTime,
+	}
+	copy(header.Magic[:], fileMagicV2)
+	out := make([]byte, unsafe.Sizeof(header))
+	header.Sections[sectionData] = fileHeaderSection{Begin: uint64(len(out)), End: uint64(len(out) + len(data))}
+	out = append(out, data...)
+	for s := sectionData + 1; int(s) < sectionsCountV2; s++ {
+		for len(out)%8 != 0 {
+			out = append(out, 0)
+		}
+		sec := make([]byte, r.header.Sections[s].size())
+		if err := r.readObjects(s, sec); err != nil {
+			return err
+		}
+		header.Sections[s] = fileHeaderSection{Begin: uint64(len(out)), End: uint64(len(out) + len(sec))}
+		out = append(out, sec...)
+	}
+	copy(out, unsafe.Slice((*byte)(unsafe.Pointer(&header)), unsafe.Sizeof(header)))
+	return os.WriteFile(filename, out, 0644)
+}
+
+func TestReaderV2(t *testing.T) {
+	tmpDir := t.TempDir()
+	streams := makeLargeStreams()
+	r, err := makeIndex(tmpDir, streams, nil)
+	if err != nil {
+		t.Fatalf("makeIndex failed with error: %v", err)
+	}
+	fn := filepath.Join(tmpDir, "v2.idx")
+	if err := writeV2Index(r, fn); err != nil {
+		t.Fatalf("writeV2Index failed with error: %v", err)
+	}
+	r2, err := NewReader(fn)
+	if err != nil {
+		t.Fatalf("NewReader failed with error: %v", err)
+	}
+	if r2.dataBlocks != nil {
+		t.Fatalf("Reader.dataBlocks = %v, want nil", r2.dataBlocks)
+	}
+	checkStreamData(t, r2, streams)
+
+	// merging a v2 index creates a compressed index
+	merged, err := Merge(tmpDir, []*Reader{r2})
+	if err != nil {
+		t.Fatalf("Merge failed with error: %v", err)
+	}
+	if len(merged) != 1 || merged[0].dataBlocks == nil {
+		t.Fatalf("Merge() did not create a compressed index")
+	}
+	checkStreamData(t, merged[0], streams)
+}
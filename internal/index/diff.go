@@ -0,0 +1,133 @@
+package index
+
+import (
+	"bytes"
+
+	"github.com/spq/pkappa2/internal/tools/diff"
+)
+
+type (
+	// DiffChunk describes how a chunk of the first stream relates to a
+	// chunk of the second one. A and B are the indexes of the chunks in
+	// the data of the streams, they are -1 for inserted and deleted chunks.
+	// Replaced chunks have the same direction and their differences are
+	// described by byte level runs, all other chunks consist of a single
+	// run containing the whole chunk.
+	DiffChunk struct {
+		Kind      diff.Kind
+		Direction Direction
+		A, B      int
+		Runs      []DiffRun
+	}
+	DiffRun struct {
+		Kind diff.Kind
+		Data []byte
+	}
+)
+
+const (
+	// limits on the edits of a single diff, the work is quadratic in them
+	diffMaxChunkEdits = 1000
+	diffMaxByteEdits  = 1000
+	// larger chunks aren't compared byte by byte, the work is linear in
+	// their size as well
+	diffMaxChunkSize = 16 * 1024
+)
+
+// DiffData aligns the chunks of two streams by their direction and order
+// and computes the differences between them.
+func DiffData(a, b []Data) []DiffChunk {
+	res := []DiffChunk(nil)
+	runs := diff.Diff(len(a), len(b), func(i, j int) bool {
+		return a[i].Direction == b[j].Direction && bytes.Equal(a[i].Content, b[j].Content)
+	}, diffMaxChunkEdits)
+	for i := 0; i < len(runs); i++ {
+		r := runs[i]
+		if r.Kind == diff.Equal {
+			for k := 0; k < r.AEnd-r.AStart; k++ {
+				res = append(res, DiffChunk{
+					Kind:      diff.Equal,
+					Direction: a[r.AStart+k].Direction,
+					A:         r.AStart + k,
+					B:         r.BStart + k,
+					Runs:      []DiffRun{{diff.Equal, a[r.AStart+k].Content}},
+				})
+			}
+			continue
+		}
+		// merge all deletions and insertions up to the next equal run
+		aStart, aEnd, bStart, bEnd := r.AStart, r.AEnd, r.BStart, r.BEnd
+		for i+1 < len(runs) && runs[i+1].Kind != diff.Equal {
+			aEnd, bEnd = runs[i+1].AEnd, runs[i+1].BEnd
+			i++
+		}
+		// chunks with the same direction are compared byte by byte,
+		// keeping the order of the chunks
+		pairs := diff.Diff(aEnd-aStart, bEnd-bStart, func(i, j int) bool {
+			return a[aStart+i].Direction == b[bStart+j].Direction
+		}, diffMaxChunkEdits)
+		for _, p := range pairs {
+			switch p.Kind {
+			case diff.Equal:
+				for k := 0; k < p.AEnd-p.AStart; k++ {
+					ia, ib := aStart+p.AStart+k, bStart+p.BStart+k
+					res = append(res, DiffChunk{
+						Kind:      diff.Replace,
+						Direction: a[ia].Direction,
+						A:         ia,
+						B:         ib,
+						Runs:      diffBytes(a[ia].Content, b[ib].Content),
+					})
+				}
+			case diff.Delete:
+				for ia := aStart + p.AStart; ia < aStart+p.AEnd; ia++ {
+					res = append(res, DiffChunk{
+						Kind:      diff.Delete,
+						Direction: a[ia].Direction,
+						A:         ia,
+						B:         -1,
+						Runs:      []DiffRun{{diff.Delete, a[ia].Content}},
+					})
+				}
+			case diff.Insert:
+				for ib := bStart + p.BStart; ib < bStart+p.BEnd; ib++ {
+					res = append(res, DiffChunk{
+						Kind:      diff.Insert,
+						Direction: b[ib].Direction,
+						A:         -1,
+						B:         ib,
+						Runs:      []DiffRun{{diff.Insert, b[ib].Content}},
+					})
+				}
+			}
+		}
+	}
+	return res
+}
+
+// diffBytes computes the byte level differences of two chunks, chunks
+// larger than diffMaxChunkSize are replaced as a whole.
+func diffBytes(a, b []byte) []DiffRun {
+	if len(a) > diffMaxChunkSize || len(b) > diffMaxChunkSize {
+		res := []DiffRun(nil)
+		if len(a) != 0 {
+			res = append(res, DiffRun{diff.Delete, a})
+		}
+		if len(b) != 0 {
+			res = append(res, DiffRun{diff.Insert, b})
+		}
+		return res
+	}
+	runs := diff.Diff(len(a), len(b), func(i, j int) bool {
+		return a[i] == b[j]
+	}, diffMaxByteEdits)
+	res := make([]DiffRun, 0, len(runs))
+	for _, r := range runs {
+		data := a[r.AStart:r.AEnd]
+		if r.Kind == diff.Insert {
+			data = b[r.BStart:r.BEnd]
+		}
+		res = append(res, DiffRun{r.Kind, data})
+	}
+	return res
+}
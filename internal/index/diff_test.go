@@ -0,0 +1,86 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiffData(t *testing.T) {
+	chunks := func(s ...string) []Data {
+		res := []Data(nil)
+		for i, c := range s {
+			res = append(res, Data{
+				Direction: Direction(i % 2),
+				Content:   []byte(c),
+			})
+		}
+		return res
+	}
+	// describe formats the result as <kind><a>/<b>:<runs>
+	describe := func(chunks []DiffChunk) string {
+		res := []string(nil)
+		for _, c := range chunks {
+			runs := []string(nil)
+			for _, r := range c.Runs {
+				runs = append(runs, fmt.Sprintf("%c%q", r.Kind.String()[0], r.Data))
+			}
+			res = append(res, fmt.Sprintf("%c%d/%d:%s", c.Kind.String()[0], c.A, c.B, strings.Join(runs, ",")))
+		}
+		return strings.Join(res, " ")
+	}
+	for _, tc := range []struct {
+		name string
+		a, b []Data
+		want string
+	}{
+		{
+			name: "equal",
+			a:    chunks("GET /", "200 OK"),
+			b:    chunks("GET /", "200 OK"),
+			want: `e0/0:e"GET /" e1/1:e"200 OK"`,
+		},
+		{
+			name: "changed response",
+			a:    chunks("GET /flag", "403 Forbidden"),
+			b:    chunks("GET /flag", "200 FLAG"),
+			want: `e0/0:e"GET /flag" r1/1:d"4",i"2",e"0",d"3",i"0",e" F",d"orbidden",i"LAG"`,
+		},
+		{
+			name: "changed bytes",
+			a:    chunks("login admin", "ok", "get flag", "no"),
+			b:    chunks("login admin'--", "ok", "get flag", "FLAG{x}"),
+			want: `r0/0:e"login admin",i"'--" e1/1:e"ok" e2/2:e"get flag" r3/3:d"no",i"FLAG{x}"`,
+		},
+		{
+			name: "additional chunks",
+			a:    chunks("a", "b"),
+			b:    chunks("a", "b", "c", "d"),
+			want: `e0/0:e"a" e1/1:e"b" i-1/2:i"c" i-1/3:i"d"`,
+		},
+		{
+			name: "missing chunks",
+			a:    chunks("a", "b", "c", "d"),
+			b:    chunks("a", "b"),
+			want: `e0/0:e"a" e1/1:e"b" d2/-1:d"c" d3/-1:d"d"`,
+		},
+		{
+			name: "large chunks",
+			a:    chunks("x", strings.Repeat("a", diffMaxChunkSize+1)),
+			b:    chunks("x", strings.Repeat("a", diffMaxChunkSize)+"b"),
+			want: fmt.Sprintf(`e0/0:e"x" r1/1:d"%s",i"%s"`, strings.Repeat("a", diffMaxChunkSize+1), strings.Repeat("a", diffMaxChunkSize)+"b"),
+		},
+		{
+			name: "direction",
+			a:    chunks("x", "y"),
+			b:    append(chunks("x"), Data{Direction: DirectionClientToServer, Content: []byte("y")}),
+			want: `e0/0:e"x" d1/-1:d"y" i-1/1:i"y"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := describe(DiffData(tc.a, tc.b)); got != tc.want {
+				t.Errorf("DiffData() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
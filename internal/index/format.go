@@ -17,7 +17,11 @@ const (
 	sectionStreamsByFirstPacketSource
 	sectionStreamsByFirstPacketTime
 	sectionStreamsByLastPacketTime
+	sectionDataBlocks
 	sectionsCount int = iota
+
+	// v2 files don't have the data blocks section
+	sectionsCountV2 = int(sectionDataBlocks)
 )
 
 type (
@@ -30,6 +34,15 @@ type (
 		FirstPacketTime uint64
 		Sections        [sectionsCount]fileHeaderSection
 	}
+	fileHeaderV2 struct {
+		Magic           [16]byte
+		FirstPacketTime uint64
+		Sections        [sectionsCountV2]fileHeaderSection
+	}
+	dataBlockEntry struct {
+		Offset     uint64 // offset of the compressed block in the data section
+		DataOffset uint64 // offset of the uncompressed block in the stream data
+	}
 	hostGroupEntry struct {
 		Start uint32
 		Count uint16 // add 1: 0 means 1, 0xffff means 0x10000
@@ -63,7 +76,21 @@ type (
 )
 
 const (
-	fileMagic = "pkappa2index\x00\x00\x00\x02"
+	fileMagic = "pkappa2index\x00\x00\x00\x06"
+	// v5 files only contain the MIME types of the carved files instead of
+	// their positions
+	fileMagicV5 = "pkappa2index\x00\x00\x00\x05"
+	// v4 files don't contain the MIME types of the carved files
+	fileMagicV4 = "pkappa2index\x00\x00\x00\x04"
+	// v3 files don't contain the positions of the HTTP messages either
+	fileMagicV3 = "pkappa2index\x00\x00\x00\x03"
+	fileMagicV2 = "pkappa2index\x00\x00\x00\x02"
+
+	// uncompressed size of the zstd compressed blocks of the data section
+	dataBlockSize = 64 * 1024
+
+	// how much client data is checked for a HTTP request line
+	httpRequestLineMaxSize = 8 * 1024
 
 	flagsHostGroupIPVersion = 0b1
 	flagsHostGroupIP4       = 0b0
@@ -82,6 +109,7 @@ const (
 	flagsStreamSegmentation     = 0b100
 	flagsStreamSegmentationNone = 0b000
 	flagsStreamSegmentationHTTP = 0b100
+	flagsStreamFiles            = 0b1000
 )
 
 func (fhs fileHeaderSection) size() int64 {
@@ -34,6 +34,8 @@ import (
 	"github.com/spq/pkappa2/internal/tools"
 	"github.com/spq/pkappa2/internal/tools/bitmask"
 	pcapmetadata "github.com/spq/pkappa2/internal/tools/pcapMetadata"
+	pcapoffsets "github.com/spq/pkappa2/internal/tools/pcapOffsets"
+	tlskeylog "github.com/spq/pkappa2/internal/tools/tlsKeylog"
 )
 
 const (
@@ -46,6 +48,27 @@ const (
 	// Interval for sending aggregated tag update events to the frontend, to avoid sending
 	// too many events when processing a lot of packets in a short time.
 	tagUpdateEventInterval = time.Second * 1
+
+	// Interval for checking whether pcaps exceeded the maximum age of the retention policy.
+	retentionCheckInterval = time.Minute
+
+	// Color of generated tags created for tags returned by converters.
+	generatedTagColor = "#9e9e9e"
+
+	// Files with this extension in the converter directory define pipelines.
+	pipelineExtension = ".pipeline"
+
+	// File in the state directory storing the known TLS secrets.
+	tlsKeysFilename = "tlskeys.log"
+
+	// File in the state directory storing the addresses of the converter
+	// services by name.
+	remoteConvertersFilename = "remoteconverters.json"
+)
+
+var (
+	// Names of tags returned by converters, without the generated/ prefix.
+	generatedTagNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
 )
 
 type (
@@ -99,6 +122,8 @@ type (
 		color        string
 		converters   []*converters.CachedConverter
 		referencedBy map[string]struct{}
+		// the streams of a generated tag that were added by each converter
+		converterMatches map[string]bitmask.LongBitmask
 	}
 	TagInfo struct {
 		Name           string
@@ -117,10 +142,15 @@ type (
 		ConverterDir string
 		WatchDir     string
 
+		// a read-only manager never modifies any file, see OpenView
+		readOnly bool
+
 		jobs                chan func()
 		mergeJobRunning     bool
 		taggingJobRunning   bool
 		converterJobRunning bool
+		retentionJobRunning bool
+		importJobRunning    bool
 		importJobs          []string
 
 		builder             *builder.Builder
@@ -135,6 +165,9 @@ type (
 		updatedStreamsDuringTaggingJob bitmask.LongBitmask
 		resetStreamsDuringTaggingJob   bitmask.LongBitmask
 		addedStreamsDuringTaggingJob   bitmask.LongBitmask
+		// streams whose tags changed while they might have been converted,
+		// by tag name
+		tagsChangedDuringConverterJob map[string]bitmask.LongBitmask
 
 		streamsToConvert         map[string]*bitmask.LongBitmask
 		pcapProcessorWebhookUrls []string
@@ -145,16 +178,24 @@ type (
 
 		tags       map[string]*tag
 		converters map[string]*converters.CachedConverter
+		// converters that were modified while pkappa2 was not running, the
+		// streams they added to generated tags are removed on startup
+		changedConverters []string
 
 		usedIndexes       map[*index.Reader]uint
 		convertersWatcher *fsnotify.Watcher
 		pcapsWatcher      *fsnotify.Watcher
+		tlsKeyLogWatcher  *fsnotify.Watcher
+
+		// secrets used by the tlsdecrypt converter
+		tlsKeys *tlskeylog.Store
 
 		listeners           map[chan Event]listener
 		updatedTagsToSignal map[string]struct{}
 		updatedTagsDone     chan struct{}
 
-		config Config
+		config    Config
+		retention RetentionStatistics
 	}
 
 	Statistics struct {
@@ -169,28 +210,61 @@ type (
 		MergeJobRunning     bool
 		TaggingJobRunning   bool
 		ConverterJobRunning bool
+		RetentionJobRunning bool
+		DiskUsage           int64
+		Retention           RetentionStatistics
+	}
+
+	RetentionStatistics struct {
+		DroppedPcapCount   int
+		DroppedStreamCount int
+		FreedBytes         int64
+		LastRun            time.Time
 	}
 
 	Config struct {
 		AutoInsertLimitToQuery bool
+		// Pcaps whose newest packet is older than RetentionMaxAge seconds
+		// are dropped, 0 disables the limit.
+		RetentionMaxAge int64
+		// The oldest pcaps are dropped while the combined size of the pcaps,
+		// indexes and converter caches exceeds RetentionMaxBytes, 0 disables
+		// the limit.
+		RetentionMaxBytes int64
+		// Limits of the converter processes, ConverterLimitOverrides replaces
+		// them for single converters.
+		ConverterLimits         converters.Limits
+		ConverterLimitOverrides map[string]converters.Limits `json:",omitempty"`
+		// ConverterTags lists the tags whose names are sent to a converter
+		// with the streams matching them, converters that are not listed
+		// receive no tags. Entries ending in / select all tags with the
+		// prefix, e.g. service/.
+		ConverterTags map[string][]string `json:",omitempty"`
 	}
 
 	indexReleaser []*index.Reader
 
-	// TODO: Maybe save md5 of converters to detect changes
 	stateFile struct {
 		Saved time.Time
 		Tags  []struct {
 			Name       string
 			Definition string
 			Matches    []uint64
+			Evaluated  [][2]uint64
 			Color      string
 			Converters []string
+			// ConverterMatches holds the streams added to a generated tag by converters
+			ConverterMatches map[string][]uint64 `json:",omitempty"`
 		}
+		Indexes                  []string
 		Pcaps                    []*pcapmetadata.PcapInfo
 		PcapProcessorWebhookUrls []string
 		PcapOverIPEndpoints      []string
 		Config                   Config
+		Retention                RetentionStatistics
+		// ConverterFingerprints identify the versions of the converters the
+		// cached results were created by
+		ConverterFingerprints map[string]converters.Fingerprint `json:",omitempty"`
 	}
 
 	updateTagOperationInfo struct {
@@ -211,6 +285,11 @@ type (
 		tagDetails    map[string]query.TagDetails
 		tagConverters map[string][]string
 		converters    map[string]index.ConverterAccess
+		// converterTags is Config.ConverterTags
+		converterTags map[string][]string
+
+		// files owned by a view that was opened without a manager
+		files []io.Closer
 	}
 
 	StreamContext struct {
@@ -244,8 +323,9 @@ func New(pcapDir, indexDir, snapshotDir, stateDir, converterDir, watchDir string
 		listeners:           make(map[chan Event]listener),
 		updatedTagsToSignal: make(map[string]struct{}),
 		updatedTagsDone:     make(chan struct{}),
+		tlsKeys:             tlskeylog.NewStore(),
 
-		config: Config{AutoInsertLimitToQuery: false},
+		config: defaultConfig(),
 	}
 
 	convertersWatcher, err := fsnotify.NewWatcher()
@@ -264,18 +344,19 @@ func New(pcapDir, indexDir, snapshotDir, stateDir, converterDir, watchDir string
 		mgr.startMonitoringPcaps(pcapsWatcher)
 	}
 
-	// Lookup all available converter binaries
-	entries, err := os.ReadDir(mgr.ConverterDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read converter directory: %w", err)
+	if err := mgr.loadTLSKeys(); err != nil {
+		return nil, err
 	}
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		if err := mgr.addConverter(filepath.Join(mgr.ConverterDir, entry.Name())); err != nil {
-			log.Printf("failed to add converter %q: %v", entry.Name(), err)
-		}
+	if err := mgr.addNativeConverters(); err != nil {
+		return nil, err
+	}
+	if err := mgr.loadRemoteConverters(); err != nil {
+		return nil, err
+	}
+
+	// Lookup all available converter binaries
+	if err := mgr.addConvertersFromDir(mgr.ConverterDir); err != nil {
+		return nil, err
 	}
 
 	tools.AssertFolderRWXPermissions("pcap_dir", pcapDir)
@@ -283,11 +364,55 @@ func New(pcapDir, indexDir, snapshotDir, stateDir, converterDir, watchDir string
 	tools.AssertFolderRWXPermissions("snapshot_dir", snapshotDir)
 	tools.AssertFolderRWXPermissions("state_dir", stateDir)
 
-	// read all existing indexes and load them
-	indexFileNames, err := tools.ListFiles(indexDir, "idx")
+	cachedKnownPcapData, pcapOverIPEndpoints, err := mgr.loadIndexesAndState()
 	if err != nil {
 		return nil, err
 	}
+
+	mgr.builder, err = builder.New(pcapDir, indexDir, snapshotDir, cachedKnownPcapData)
+	if err != nil {
+		return nil, err
+	}
+	if len(mgr.builder.KnownPcaps()) != len(cachedKnownPcapData) {
+		if err := mgr.saveState(); err != nil {
+			return nil, fmt.Errorf("unable to save state: %w", err)
+		}
+	}
+	mgr.pcapOverIPPackets = make(chan pcapOverIPPacket, 100)
+	mgr.pcapOverIPCmd = make(chan pcapOverIPCmd, 1)
+
+	go func() {
+		for f := range mgr.jobs {
+			f()
+		}
+	}()
+	mgr.jobs <- func() {
+		go mgr.pcapOverIPPacketHandler()
+		go mgr.tagUpdateEventWorker()
+		go mgr.retentionWorker()
+		for _, name := range mgr.changedConverters {
+			mgr.resetConverterTags(name)
+		}
+		mgr.changedConverters = nil
+		mgr.startTaggingJobIfNeeded()
+		mgr.startConverterJobIfNeeded()
+		mgr.startMergeJobIfNeeded()
+		mgr.startRetentionJobIfNeeded()
+		for a := range pcapOverIPEndpoints {
+			mgr.pcapOverIPEndpoints = append(mgr.pcapOverIPEndpoints, mgr.newPcapOverIPEndpoint(ctx, a))
+		}
+	}
+	return &mgr, nil
+}
+
+// loadIndexesAndState loads all indexes and the newest valid state file,
+// it returns the pcaps and pcap-over-ip endpoints stored in the state.
+func (mgr *Manager) loadIndexesAndState() ([]*pcapmetadata.PcapInfo, map[string]struct{}, error) {
+	// read all existing indexes and load them
+	indexFileNames, err := tools.ListFiles(mgr.IndexDir, "idx")
+	if err != nil {
+		return nil, nil, err
+	}
 	for _, fn := range indexFileNames {
 		idx, err := index.NewReader(fn)
 		if err != nil {
@@ -302,28 +427,28 @@ func New(pcapDir, indexDir, snapshotDir, stateDir, converterDir, watchDir string
 		}
 	}
 	mgr.lock(mgr.indexes)
+	// streams dropped by the retention policy are missing in the indexes
+	for _, idx := range mgr.indexes {
+		for id := range idx.StreamIDs() {
+			mgr.allStreams.Set(uint(id))
+		}
+	}
 
-	stateFilenames, err := tools.ListFiles(stateDir, "state.json")
+	stateFilenames, err := tools.ListFiles(mgr.StateDir, "state.json")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	stateTimestamp := time.Time{}
 	cachedKnownPcapData := []*pcapmetadata.PcapInfo(nil)
-	if mgr.nextStreamID != 0 {
-		mgr.allStreams.Set(uint(mgr.nextStreamID - 1))
-		for i := uint64(0); i != mgr.nextStreamID; i++ {
-			mgr.allStreams.Set(uint(i))
-		}
-	}
 	var pcapOverIPEndpoints map[string]struct{}
-nextStateFile:
 	for _, fn := range stateFilenames {
 		f, err := os.Open(fn)
 		if err != nil {
 			log.Printf("Unable to load state file %q: %v", fn, err)
 			continue
 		}
-		s := stateFile{}
+		// settings missing in older state files keep their default
+		s := stateFile{Config: defaultConfig()}
 		if err := json.NewDecoder(f).Decode(&s); err != nil {
 			log.Printf("Unable to parse state file %q: %v", fn, err)
 			continue
@@ -331,38 +456,40 @@ nextStateFile:
 		if s.Saved.Before(stateTimestamp) {
 			continue
 		}
-		newTags := make(map[string]*tag, len(s.Tags))
+		// the evaluated stream ranges of the tags are only valid for
+		// the set of indexes that existed when the state was saved
+		indexesUnchanged := len(s.Indexes) == len(mgr.indexes)
+		for _, idx := range mgr.indexes {
+			if !slices.Contains(s.Indexes, filepath.Base(idx.Filename())) {
+				indexesUnchanged = false
+				break
+			}
+		}
+		newTags, pcapOverIPEndpointsTemp, problems := parseState(&s, mgr.nextStreamID)
+		if len(problems) != 0 {
+			for _, p := range problems {
+				log.Printf("Invalid statefile %q: %v", fn, p)
+			}
+			continue
+		}
 		for _, t := range s.Tags {
-			q, err := query.Parse(t.Definition)
-			if err != nil {
-				log.Printf("Invalid tag %q in statefile %q: %v", t.Name, fn, err)
-				continue nextStateFile
-			}
-			if _, ok := newTags[t.Name]; ok {
-				log.Printf("Invalid tag %q in statefile %q: duplicate name", t.Name, fn)
-				continue nextStateFile
-			}
-			matches := bitmask.WrapAsLongBitmask(t.Matches)
-			matches.Shrink()
-			nt := &tag{
-				TagDetails: query.TagDetails{
-					Matches:    matches,
-					Uncertain:  mgr.allStreams,
-					Conditions: q.Conditions,
-				},
-				definition:   t.Definition,
-				features:     q.Conditions.Features(),
-				color:        t.Color,
-				referencedBy: make(map[string]struct{}),
+			nt := newTags[t.Name]
+			if !isStreamIDTag(t.Name) {
+				nt.Uncertain = mgr.allStreams
+				if indexesUnchanged {
+					nt.Uncertain = mgr.allStreams.SubCopy(streamRangesBitmask(t.Evaluated))
+				}
 			}
-			if strings.HasPrefix(t.Name, "mark/") || strings.HasPrefix(t.Name, "generated/") {
-				ids, ok := q.Conditions.StreamIDs(mgr.nextStreamID)
-				if !ok {
-					log.Printf("Invalid tag %q in statefile %q: 'mark' or 'generated' tag is malformed", t.Name, fn)
-					continue nextStateFile
+			for converterName, m := range t.ConverterMatches {
+				// the streams stay in the tag, but they are no longer
+				// removed when the converter doesn't return the tag anymore
+				if _, ok := mgr.converters[converterName]; !ok {
+					continue
 				}
-				nt.Matches = ids
-				nt.Uncertain = bitmask.LongBitmask{}
+				if nt.converterMatches == nil {
+					nt.converterMatches = map[string]bitmask.LongBitmask{}
+				}
+				nt.converterMatches[converterName] = bitmask.WrapAsLongBitmask(m)
 			}
 			for _, converterName := range t.Converters {
 				converter, ok := mgr.converters[converterName]
@@ -375,91 +502,65 @@ nextStateFile:
 					log.Printf("Invalid tag %q in statefile %q: Failed to attach converter %q: %v", t.Name, fn, converterName, err)
 				}
 			}
-			newTags[t.Name] = nt
 		}
-		cyclingTags := map[string]struct{}{}
-		for n, t := range newTags {
-			for _, tn := range t.referencedTags() {
-				if n == tn {
-					log.Printf("Invalid tag %q in statefile %q: references itself", n, fn)
-					continue nextStateFile
-				}
-				if _, ok := newTags[tn]; !ok {
-					log.Printf("Invalid tag %q in statefile %q: references non-existing tag %q", n, fn, tn)
-					continue nextStateFile
-				}
-				newTags[tn].referencedBy[n] = struct{}{}
+		// the cache files of converters that were modified since are reset
+		// when they are opened, the generated tags have to be reset too
+		changedConverters := []string(nil)
+		for name, fingerprint := range s.ConverterFingerprints {
+			if converter, ok := mgr.converters[name]; ok && !converter.Fingerprint().Equal(fingerprint) {
+				log.Printf("Converter %q was modified, converting all streams again", name)
+				changedConverters = append(changedConverters, name)
 			}
-			cyclingTags[n] = struct{}{}
-		}
-	checkCyclingTags:
-		for {
-		nextCyclingTag:
-			for n := range cyclingTags {
-				for _, rt := range newTags[n].referencedTags() {
-					if _, ok := cyclingTags[rt]; ok {
-						continue nextCyclingTag
-					}
-				}
-				delete(cyclingTags, n)
-				continue checkCyclingTags
-			}
-			for n := range cyclingTags {
-				log.Printf("Invalid tag %q in statefile %q: contains cycle", n, fn)
-				continue nextStateFile
-			}
-			break
-		}
-		pcapOverIPEndpointsTemp := map[string]struct{}{}
-		for _, v := range s.PcapOverIPEndpoints {
-			_, _, err := net.SplitHostPort(v)
-			if err != nil {
-				log.Printf("Invalid pcap-over-ip host %q in statefile %q: %v", v, fn, err)
-				continue nextStateFile
-			}
-			if _, ok := pcapOverIPEndpointsTemp[v]; ok {
-				log.Printf("Invalid pcap-over-ip host %q in statefile %q: duplicate", v, fn)
-				continue nextStateFile
-			}
-			pcapOverIPEndpointsTemp[v] = struct{}{}
 		}
 		mgr.tags = newTags
+		mgr.changedConverters = changedConverters
 		mgr.pcapProcessorWebhookUrls = s.PcapProcessorWebhookUrls
 		mgr.stateFilename = fn
 		mgr.config = s.Config
+		mgr.retention = s.Retention
 		pcapOverIPEndpoints = pcapOverIPEndpointsTemp
 		stateTimestamp = s.Saved
 		cachedKnownPcapData = s.Pcaps
 	}
+	mgr.inheritTagUncertainty()
+	mgr.applyConverterLimits()
+	return cachedKnownPcapData, pcapOverIPEndpoints, nil
+}
 
-	mgr.builder, err = builder.New(pcapDir, indexDir, snapshotDir, cachedKnownPcapData)
-	if err != nil {
-		return nil, err
+func defaultConfig() Config {
+	return Config{
+		AutoInsertLimitToQuery: false,
+		ConverterLimits:        converters.DefaultLimits,
 	}
-	if len(mgr.builder.KnownPcaps()) != len(cachedKnownPcapData) {
-		if err := mgr.saveState(); err != nil {
-			return nil, fmt.Errorf("unable to save state: %w", err)
-		}
+}
+
+// applyConverterLimits sets the limits of all converters from the config.
+func (mgr *Manager) applyConverterLimits() {
+	for name, converter := range mgr.converters {
+		converter.SetLimits(mgr.converterLimits(name))
 	}
-	mgr.pcapOverIPPackets = make(chan pcapOverIPPacket, 100)
-	mgr.pcapOverIPCmd = make(chan pcapOverIPCmd, 1)
+}
 
-	go func() {
-		for f := range mgr.jobs {
-			f()
-		}
-	}()
-	mgr.jobs <- func() {
-		go mgr.pcapOverIPPacketHandler()
-		go mgr.tagUpdateEventWorker()
-		mgr.startTaggingJobIfNeeded()
-		mgr.startConverterJobIfNeeded()
-		mgr.startMergeJobIfNeeded()
-		for a := range pcapOverIPEndpoints {
-			mgr.pcapOverIPEndpoints = append(mgr.pcapOverIPEndpoints, mgr.newPcapOverIPEndpoint(ctx, a))
+func (mgr *Manager) converterLimits(name string) converters.Limits {
+	if limits, ok := mgr.config.ConverterLimitOverrides[name]; ok {
+		return limits
+	}
+	return mgr.config.ConverterLimits
+}
+
+// receivesTag returns whether the name of the tag is sent to a converter
+// with the given entries of Config.ConverterTags. Generated tags are never
+// sent as they depend on the output of the converters.
+func receivesTag(converterTags []string, tagName string) bool {
+	if strings.HasPrefix(tagName, "generated/") {
+		return false
+	}
+	for _, t := range converterTags {
+		if t == tagName || (strings.HasSuffix(t, "/") && strings.HasPrefix(tagName, t)) {
+			return true
 		}
 	}
-	return &mgr, nil
+	return false
 }
 
 func (t tag) referencedTags() []string {
@@ -494,6 +595,12 @@ func (mgr *Manager) Close() {
 	close(mgr.updatedTagsDone)
 	c := make(chan struct{})
 	mgr.jobs <- func() {
+		// the watcher is replaced within a job
+		if mgr.tlsKeyLogWatcher != nil {
+			if err := mgr.tlsKeyLogWatcher.Close(); err != nil {
+				log.Printf("Failed to close TLS keylog watcher: %v", err)
+			}
+		}
 		for _, converter := range mgr.converters {
 			if err := converter.Close(); err != nil {
 				log.Printf("Failed to close converter %q: %v", converter.Name(), err)
@@ -504,7 +611,13 @@ func (mgr *Manager) Close() {
 				delete(mgr.listeners, ch)
 				close(ch)
 			}
-			close(l.close)
+			// listeners with pending events stay registered after being
+			// closed until the events are dropped
+			select {
+			case <-l.close:
+			default:
+				close(l.close)
+			}
 		}
 		for _, e := range mgr.pcapOverIPEndpoints {
 			e.cancel()
@@ -522,23 +635,43 @@ func (mgr *Manager) saveState() error {
 		PcapProcessorWebhookUrls: mgr.pcapProcessorWebhookUrls,
 		PcapOverIPEndpoints:      make([]string, 0, len(mgr.pcapOverIPEndpoints)),
 		Config:                   mgr.config,
+		Retention:                mgr.retention,
+		ConverterFingerprints:    make(map[string]converters.Fingerprint, len(mgr.converters)),
+	}
+	for name, converter := range mgr.converters {
+		j.ConverterFingerprints[name] = converter.Fingerprint()
+	}
+	for _, idx := range mgr.indexes {
+		j.Indexes = append(j.Indexes, filepath.Base(idx.Filename()))
 	}
 	for _, e := range mgr.pcapOverIPEndpoints {
 		j.PcapOverIPEndpoints = append(j.PcapOverIPEndpoints, e.Address)
 	}
 	for n, t := range mgr.tags {
+		converterMatches := map[string][]uint64(nil)
+		for c, m := range t.converterMatches {
+			if converterMatches == nil {
+				converterMatches = map[string][]uint64{}
+			}
+			converterMatches[c] = m.Mask()
+		}
 		j.Tags = append(j.Tags, struct {
 			Name       string
 			Definition string
 			Matches    []uint64
+			Evaluated  [][2]uint64
 			Color      string
 			Converters []string
+			// ConverterMatches holds the streams added to a generated tag by converters
+			ConverterMatches map[string][]uint64 `json:",omitempty"`
 		}{
-			Name:       n,
-			Definition: t.definition,
-			Matches:    t.Matches.Mask(),
-			Color:      t.color,
-			Converters: t.converterNames(),
+			Name:             n,
+			Definition:       t.definition,
+			Matches:          t.Matches.Mask(),
+			Evaluated:        streamRanges(mgr.allStreams.SubCopy(t.Uncertain)),
+			Color:            t.color,
+			Converters:       t.converterNames(),
+			ConverterMatches: converterMatches,
 		})
 	}
 	fn := tools.MakeFilename(mgr.StateDir, "state.json")
@@ -562,6 +695,187 @@ func (mgr *Manager) saveState() error {
 	return nil
 }
 
+// VerifyState checks that a state file would be accepted by New, it returns
+// all problems that were found.
+func VerifyState(filename string) []error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return []error{err}
+	}
+	defer f.Close()
+	s := stateFile{}
+	if err := json.NewDecoder(f).Decode(&s); err != nil {
+		return []error{err}
+	}
+	_, _, problems := parseState(&s, 0)
+	return problems
+}
+
+// ForgetStreamIDs removes all stream ids from a state file, it is used
+// after the indexes were rebuilt and the streams got new ids. Marks and
+// generated tags are emptied, all other tags are evaluated again.
+func ForgetStreamIDs(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	s := stateFile{Config: defaultConfig()}
+	err = json.NewDecoder(f).Decode(&s)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	s.Indexes = nil
+	for i := range s.Tags {
+		t := &s.Tags[i]
+		if isStreamIDTag(t.Name) {
+			t.Definition = "id:-1"
+		}
+		t.Matches = nil
+		t.Evaluated = nil
+		t.ConverterMatches = nil
+	}
+	tmpFilename := filename + ".tmp"
+	f, err = os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(&s); err != nil {
+		f.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// isStreamIDTag returns whether the tag is a list of stream ids instead of
+// a query, which is the case for marks and generated tags.
+func isStreamIDTag(name string) bool {
+	return strings.HasPrefix(name, "mark/") || strings.HasPrefix(name, "generated/")
+}
+
+// parseState parses the tags and pcap-over-ip endpoints of a state file
+// and returns all problems that were found, the state file is only usable
+// if there are none. The uncertain streams and converters of the tags are
+// left to the caller.
+func parseState(s *stateFile, nextStreamID uint64) (map[string]*tag, map[string]struct{}, []error) {
+	problems := []error(nil)
+	tags := make(map[string]*tag, len(s.Tags))
+	// tags that are invalid, references to them are no separate problem
+	invalidTags := map[string]struct{}{}
+	for _, t := range s.Tags {
+		if _, ok := tags[t.Name]; ok {
+			problems = append(problems, fmt.Errorf("tag %q: duplicate name", t.Name))
+			continue
+		}
+		q, err := query.Parse(t.Definition)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("tag %q: %w", t.Name, err))
+			invalidTags[t.Name] = struct{}{}
+			continue
+		}
+		matches := bitmask.WrapAsLongBitmask(t.Matches)
+		matches.Shrink()
+		nt := &tag{
+			TagDetails: query.TagDetails{
+				Matches:    matches,
+				Conditions: q.Conditions,
+			},
+			definition:   t.Definition,
+			features:     q.Conditions.Features(),
+			color:        t.Color,
+			referencedBy: make(map[string]struct{}),
+		}
+		if isStreamIDTag(t.Name) {
+			ids, ok := q.Conditions.StreamIDs(nextStreamID)
+			if !ok {
+				problems = append(problems, fmt.Errorf("tag %q: 'mark' or 'generated' tag is malformed", t.Name))
+				invalidTags[t.Name] = struct{}{}
+				continue
+			}
+			nt.Matches = ids
+		}
+		tags[t.Name] = nt
+	}
+	cyclingTags := map[string]struct{}{}
+	for _, n := range slices.Sorted(maps.Keys(tags)) {
+		cyclingTags[n] = struct{}{}
+		for _, tn := range tags[n].referencedTags() {
+			if n == tn {
+				problems = append(problems, fmt.Errorf("tag %q: references itself", n))
+				delete(cyclingTags, n)
+				continue
+			}
+			rt, ok := tags[tn]
+			if !ok {
+				if _, ok := invalidTags[tn]; !ok {
+					problems = append(problems, fmt.Errorf("tag %q: references non-existing tag %q", n, tn))
+				}
+				continue
+			}
+			rt.referencedBy[n] = struct{}{}
+		}
+	}
+checkCyclingTags:
+	for {
+	nextCyclingTag:
+		for n := range cyclingTags {
+			for _, rt := range tags[n].referencedTags() {
+				if _, ok := cyclingTags[rt]; ok {
+					continue nextCyclingTag
+				}
+			}
+			delete(cyclingTags, n)
+			continue checkCyclingTags
+		}
+		break
+	}
+	for _, n := range slices.Sorted(maps.Keys(cyclingTags)) {
+		problems = append(problems, fmt.Errorf("tag %q: contains cycle", n))
+	}
+	pcapOverIPEndpoints := map[string]struct{}{}
+	for _, v := range s.PcapOverIPEndpoints {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			problems = append(problems, fmt.Errorf("pcap-over-ip host %q: %w", v, err))
+			continue
+		}
+		if _, ok := pcapOverIPEndpoints[v]; ok {
+			problems = append(problems, fmt.Errorf("pcap-over-ip host %q: duplicate", v))
+			continue
+		}
+		pcapOverIPEndpoints[v] = struct{}{}
+	}
+	return tags, pcapOverIPEndpoints, problems
+}
+
+// streamRanges converts a set of stream ids into a list of inclusive ranges.
+func streamRanges(streams bitmask.LongBitmask) [][2]uint64 {
+	ranges := [][2]uint64(nil)
+	for i := uint(0); streams.Next(&i); i++ {
+		if l := len(ranges); l != 0 && ranges[l-1][1]+1 == uint64(i) {
+			ranges[l-1][1]++
+			continue
+		}
+		ranges = append(ranges, [2]uint64{uint64(i), uint64(i)})
+	}
+	return ranges
+}
+
+// streamRangesBitmask is the inverse of streamRanges.
+func streamRangesBitmask(ranges [][2]uint64) bitmask.LongBitmask {
+	streams := bitmask.LongBitmask{}
+	for _, r := range ranges {
+		for i := r[0]; i <= r[1]; i++ {
+			streams.Set(uint(i))
+		}
+	}
+	return streams
+}
+
 func (mgr *Manager) inheritTagUncertainty() {
 	resolvedTags := map[string]struct{}{}
 	for len(resolvedTags) != len(mgr.tags) {
@@ -611,7 +925,7 @@ func (mgr *Manager) invalidateTags(updatedStreams, resetStreams, addedStreams bi
 			tin.Uncertain = ti.Uncertain.Copy()
 			tin.Uncertain.Or(addedStreams)
 			tin.Uncertain.Or(resetStreams)
-			if ti.features.MainFeatures&(query.FeatureFilterData|query.FeatureFilterTimeAbsolute|query.FeatureFilterTimeRelative) != 0 {
+			if ti.features.MainFeatures&(query.FeatureFilterData|query.FeatureFilterDataMetadata|query.FeatureFilterTimeAbsolute|query.FeatureFilterTimeRelative) != 0 {
 				tin.Uncertain.Or(updatedStreams)
 			}
 		}
@@ -625,14 +939,15 @@ func (mgr *Manager) importPcapJob(filenames []string, nextStreamID uint64, exist
 	if err != nil {
 		log.Printf("importPcapJob(%q) failed: %s", filenames, err)
 	}
-	allStreams := bitmask.LongBitmask{}
-	nextStreamID += usedNewStreamIDs
-	if nextStreamID != 0 {
-		allStreams.Set(uint(nextStreamID - 1))
-		for i := uint64(0); i < nextStreamID; i++ {
-			allStreams.Set(uint(i))
+	// the ids of the new streams, older streams might have been dropped
+	newStreams := bitmask.LongBitmask{}
+	if usedNewStreamIDs != 0 {
+		newStreams.Set(uint(nextStreamID + usedNewStreamIDs - 1))
+		for i := nextStreamID; i < nextStreamID+usedNewStreamIDs; i++ {
+			newStreams.Set(uint(i))
 		}
 	}
+	nextStreamID += usedNewStreamIDs
 	newStreamCount := 0
 	newPacketCount := 0
 	for _, idx := range createdIndexes {
@@ -640,7 +955,7 @@ func (mgr *Manager) importPcapJob(filenames []string, nextStreamID uint64, exist
 		newPacketCount += idx.PacketCount()
 	}
 	mgr.jobs <- func() {
-		mgr.allStreams = allStreams
+		mgr.allStreams.Or(newStreams)
 		existingIndexesReleaser.release(mgr)
 		// add new indexes if some were created
 		if len(createdIndexes) > 0 {
@@ -653,20 +968,21 @@ func (mgr *Manager) importPcapJob(filenames []string, nextStreamID uint64, exist
 			mgr.resetStreamsDuringTaggingJob.Or(*resetStreams)
 			mgr.addedStreamsDuringTaggingJob.Or(*addedStreams)
 			mgr.invalidateTags(*updatedStreams, *resetStreams, *addedStreams)
-			mgr.invalidateConverters(updatedStreams)
+			changedStreams := updatedStreams.OrCopy(*resetStreams)
+			mgr.invalidateConverters(&changedStreams)
 		}
 		// remove finished job from queue
 		mgr.importJobs = mgr.importJobs[processedFiles:]
+		mgr.importJobRunning = false
 		// start new import job if there are more queued
-		if len(mgr.importJobs) >= 1 {
-			idxs, rel := mgr.getIndexesCopy(0)
-			go mgr.importPcapJob(mgr.importJobs[:], mgr.nextStreamID, idxs, rel)
-		} else {
+		if len(mgr.importJobs) == 0 {
 			mgr.pcapOverIPCmd <- pcapOverIPCmdFlush
 		}
+		mgr.startImportJobIfNeeded()
 		mgr.startTaggingJobIfNeeded()
 		mgr.startConverterJobIfNeeded()
 		mgr.startMergeJobIfNeeded()
+		mgr.startRetentionJobIfNeeded()
 		if err := mgr.saveState(); err != nil {
 			log.Printf("importPcapJob(%q) failed to save state file: %s", filenames, err)
 		}
@@ -686,8 +1002,19 @@ func (mgr *Manager) importPcapJob(filenames []string, nextStreamID uint64, exist
 	}
 }
 
+// startImportJobIfNeeded imports the queued pcaps, imports don't run
+// while the retention job drops pcaps and indexes.
+func (mgr *Manager) startImportJobIfNeeded() {
+	if mgr.importJobRunning || mgr.retentionJobRunning || len(mgr.importJobs) == 0 {
+		return
+	}
+	mgr.importJobRunning = true
+	indexes, releaser := mgr.getIndexesCopy(0)
+	go mgr.importPcapJob(mgr.importJobs[:], mgr.nextStreamID, indexes, releaser)
+}
+
 func (mgr *Manager) startMergeJobIfNeeded() {
-	if mgr.mergeJobRunning || mgr.taggingJobRunning || mgr.converterJobRunning {
+	if mgr.mergeJobRunning || mgr.taggingJobRunning || mgr.converterJobRunning || mgr.retentionJobRunning {
 		return
 	}
 	// only merge if all tags are on the newest version, prioritize updating tags
@@ -710,7 +1037,7 @@ func (mgr *Manager) startMergeJobIfNeeded() {
 }
 
 func (mgr *Manager) startTaggingJobIfNeeded() {
-	if mgr.taggingJobRunning {
+	if mgr.taggingJobRunning || mgr.retentionJobRunning {
 		return
 	}
 outer:
@@ -771,9 +1098,14 @@ func (mgr *Manager) mergeIndexesJob(offset int, indexes []*index.Reader, release
 			mgr.nUnmergeableIndexes += len(mergedIndexes) - 1
 			mgr.nStreamRecords += streamsDiff
 			mgr.nPacketRecords += packetsDiff
+			// the state references the current set of indexes
+			if err := mgr.saveState(); err != nil {
+				log.Printf("mergeIndexesJob failed to save state file: %s", err)
+			}
 		}
 		mgr.mergeJobRunning = false
 		mgr.startMergeJobIfNeeded()
+		mgr.startRetentionJobIfNeeded()
 		releaser.release(mgr)
 		mgr.event(Event{
 			Type: "indexesMerged",
@@ -790,6 +1122,220 @@ func (mgr *Manager) mergeIndexesJob(offset int, indexes []*index.Reader, release
 	}
 }
 
+// diskUsage returns the size of all known pcaps and the combined size of
+// the pcaps, their offset tables, indexes and converter caches.
+func (mgr *Manager) diskUsage() (int64, int64) {
+	pcapBytes, offsetsBytes := int64(0), int64(0)
+	for _, p := range mgr.builder.KnownPcaps() {
+		pcapBytes += int64(p.Filesize)
+		if fi, err := os.Stat(pcapoffsets.Filename(filepath.Join(mgr.PcapDir, p.Filename))); err == nil {
+			offsetsBytes += fi.Size()
+		}
+	}
+	totalBytes := pcapBytes + offsetsBytes
+	for _, idx := range mgr.indexes {
+		totalBytes += idx.Size()
+	}
+	for _, converter := range mgr.converters {
+		totalBytes += converter.CacheSize()
+	}
+	return pcapBytes, totalBytes
+}
+
+// expiredPcaps returns the oldest pcaps that have to be dropped to satisfy
+// the retention policy.
+func (mgr *Manager) expiredPcaps() []*pcapmetadata.PcapInfo {
+	if mgr.config.RetentionMaxAge <= 0 && mgr.config.RetentionMaxBytes <= 0 {
+		return nil
+	}
+	pcaps := mgr.builder.KnownPcaps()
+	slices.SortFunc(pcaps, func(a, b *pcapmetadata.PcapInfo) int {
+		return a.PacketTimestampMax.Compare(b.PacketTimestampMax)
+	})
+	minTimestamp := time.Time{}
+	if mgr.config.RetentionMaxAge > 0 {
+		minTimestamp = time.Now().Add(-time.Duration(mgr.config.RetentionMaxAge) * time.Second)
+	}
+	// assume that the indexes and caches shrink proportionally to the pcaps
+	pcapBytes, totalBytes := mgr.diskUsage()
+	ratio := 1.0
+	if pcapBytes != 0 {
+		ratio = float64(totalBytes) / float64(pcapBytes)
+	}
+	n := 0
+	for _, p := range pcaps {
+		expired := p.PacketTimestampMax.Before(minTimestamp)
+		overQuota := mgr.config.RetentionMaxBytes > 0 && totalBytes > mgr.config.RetentionMaxBytes
+		if !(expired || overQuota) {
+			break
+		}
+		totalBytes -= int64(float64(p.Filesize) * ratio)
+		n++
+	}
+	return pcaps[:n]
+}
+
+func (mgr *Manager) startRetentionJobIfNeeded() {
+	if mgr.retentionJobRunning || mgr.mergeJobRunning || mgr.taggingJobRunning || mgr.converterJobRunning || mgr.importJobRunning || len(mgr.importJobs) != 0 {
+		return
+	}
+	pcaps := mgr.expiredPcaps()
+	if len(pcaps) == 0 {
+		return
+	}
+	mgr.retentionJobRunning = true
+	indexes, releaser := mgr.getIndexesCopy(0)
+	go mgr.retentionJob(pcaps, indexes, releaser)
+}
+
+// retentionJob drops the pcaps and all streams containing their packets.
+// Streams continuing in a kept pcap are dropped completely as well, their
+// packets can't be removed partially.
+func (mgr *Manager) retentionJob(pcaps []*pcapmetadata.PcapInfo, indexes []*index.Reader, releaser indexReleaser) {
+	pcapFilenames := make(map[string]struct{}, len(pcaps))
+	for _, p := range pcaps {
+		pcapFilenames[p.Filename] = struct{}{}
+	}
+	// find all streams that contain packets from the dropped pcaps and
+	// rewrite the range of indexes containing them
+	droppedStreams := bitmask.LongBitmask{}
+	first, last := -1, -1
+	prunedIndexes := []*index.Reader(nil)
+	err := func() error {
+		for i, idx := range indexes {
+			streams, err := idx.StreamsFromPcaps(pcapFilenames)
+			if err != nil {
+				return err
+			}
+			if streams.IsZero() {
+				continue
+			}
+			droppedStreams.Or(streams)
+			if first == -1 {
+				first = i
+			}
+			last = i
+		}
+		if first == -1 {
+			return nil
+		}
+		var err error
+		prunedIndexes, err = index.Prune(mgr.IndexDir, indexes[first:last+1], &droppedStreams)
+		return err
+	}()
+	streamsDiff, packetsDiff, freedBytes := 0, 0, int64(0)
+	if err == nil && first != -1 {
+		for _, idx := range prunedIndexes {
+			streamsDiff += idx.StreamCount()
+			packetsDiff += idx.PacketCount()
+			freedBytes -= idx.Size()
+		}
+		for _, idx := range indexes[first : last+1] {
+			streamsDiff -= idx.StreamCount()
+			packetsDiff -= idx.PacketCount()
+			freedBytes += idx.Size()
+		}
+	}
+	mgr.jobs <- func() {
+		if err != nil {
+			log.Printf("retentionJob failed: %s", err)
+		} else {
+			if first != -1 {
+				rel := indexReleaser(mgr.indexes[first : last+1])
+				rel.release(mgr)
+				mgr.lock(prunedIndexes)
+				mgr.indexes = append(mgr.indexes[:first], append(prunedIndexes, mgr.indexes[last+1:]...)...)
+				mgr.nUnmergeableIndexes = min(mgr.nUnmergeableIndexes, first)
+				mgr.nStreamRecords += streamsDiff
+				mgr.nPacketRecords += packetsDiff
+			}
+			for tn, ti := range mgr.tags {
+				tin := *ti
+				tin.Matches = ti.Matches.SubCopy(droppedStreams)
+				tin.Uncertain = ti.Uncertain.SubCopy(droppedStreams)
+				if ti.converterMatches != nil {
+					tin.converterMatches = make(map[string]bitmask.LongBitmask, len(ti.converterMatches))
+					for c, m := range ti.converterMatches {
+						tin.converterMatches[c] = m.SubCopy(droppedStreams)
+					}
+				}
+				if ti.features.SubQueryFeatures != 0 {
+					// the dropped streams might have been matched by the sub query
+					tin.Uncertain = mgr.allStreams.SubCopy(droppedStreams)
+				}
+				mgr.tags[tn] = &tin
+			}
+			mgr.inheritTagUncertainty()
+			for _, converter := range mgr.converters {
+				mgr.streamsToConvert[converter.Name()].Sub(droppedStreams)
+				n, err := converter.RemoveStreams(&droppedStreams)
+				if err != nil {
+					log.Printf("retentionJob failed to prune cache of converter %q: %s", converter.Name(), err)
+				}
+				freedBytes += n
+			}
+			mgr.allStreams.Sub(droppedStreams)
+			deletedPcaps := make(map[string]struct{}, len(pcaps))
+			for _, p := range pcaps {
+				if err := os.Remove(filepath.Join(mgr.PcapDir, p.Filename)); err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Printf("retentionJob failed to delete pcap %q: %s", p.Filename, err)
+					continue
+				}
+				deletedPcaps[p.Filename] = struct{}{}
+				freedBytes += int64(p.Filesize)
+				if err := os.Remove(pcapoffsets.Filename(filepath.Join(mgr.PcapDir, p.Filename))); err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Printf("retentionJob failed to delete offset table of pcap %q: %s", p.Filename, err)
+				}
+			}
+			// pcaps that couldn't be deleted stay known and are dropped
+			// again by the next run, no import job is running, so we can
+			// safely modify the builder
+			if err := mgr.builder.ForgetPcaps(deletedPcaps); err != nil {
+				log.Printf("retentionJob failed to update snapshots: %s", err)
+			}
+			mgr.retention.DroppedPcapCount += len(deletedPcaps)
+			mgr.retention.DroppedStreamCount += droppedStreams.OnesCount()
+			mgr.retention.FreedBytes += freedBytes
+			mgr.retention.LastRun = time.Now()
+			log.Printf("Retention dropped %d pcaps and %d streams, freeing %d bytes", len(deletedPcaps), droppedStreams.OnesCount(), freedBytes)
+			if err := mgr.saveState(); err != nil {
+				log.Printf("retentionJob failed to save state file: %s", err)
+			}
+		}
+		mgr.retentionJobRunning = false
+		mgr.startImportJobIfNeeded()
+		mgr.startTaggingJobIfNeeded()
+		mgr.startConverterJobIfNeeded()
+		mgr.startMergeJobIfNeeded()
+		releaser.release(mgr)
+		mgr.event(Event{
+			Type: "pcapsDropped",
+			PcapStats: &PcapStatistics{
+				PcapCount:         len(mgr.builder.KnownPcaps()),
+				ImportJobCount:    len(mgr.importJobs),
+				StreamCount:       int(mgr.nextStreamID),
+				PacketCount:       int(mgr.builder.PacketCount()),
+				IndexCount:        len(mgr.indexes),
+				StreamRecordCount: mgr.nStreamRecords,
+				PacketRecordCount: mgr.nPacketRecords,
+			},
+		})
+	}
+}
+
+func (mgr *Manager) retentionWorker() {
+	ticker := time.NewTicker(retentionCheckInterval)
+	for {
+		select {
+		case <-mgr.updatedTagsDone:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			mgr.jobs <- mgr.startRetentionJobIfNeeded
+		}
+	}
+}
+
 func (mgr *Manager) updateTagJob(name string, t tag, tagDetails map[string]query.TagDetails, converters map[string]index.ConverterAccess, indexes []*index.Reader, releaser indexReleaser) {
 	err := func() error {
 		q, err := query.Parse(t.definition)
@@ -818,10 +1364,20 @@ func (mgr *Manager) updateTagJob(name string, t tag, tagDetails map[string]query
 			t.color = ot.color
 			t.converters = ot.converters
 			t.referencedBy = ot.referencedBy
+			t.converterMatches = ot.converterMatches
+			// only queue streams that started matching, streams with
+			// changed data were already queued by invalidateConverters
+			newMatches := t.Matches.SubCopy(ot.Matches)
 			for _, converter := range t.converters {
-				mgr.streamsToConvert[converter.Name()].Or(t.Matches)
+				mgr.streamsToConvert[converter.Name()].Or(newMatches)
 			}
 			mgr.tags[name] = &t
+			if err == nil {
+				mgr.evictConverterResults(&t, ot.Matches.SubCopy(t.Matches))
+			}
+			changedStreams := ot.Matches.SubCopy(t.Matches)
+			changedStreams.Or(newMatches)
+			mgr.tagMatchesChanged(name, changedStreams)
 			if !(mgr.updatedStreamsDuringTaggingJob.IsZero() && mgr.resetStreamsDuringTaggingJob.IsZero() && mgr.addedStreamsDuringTaggingJob.IsZero()) {
 				mgr.invalidateTags(mgr.updatedStreamsDuringTaggingJob, mgr.resetStreamsDuringTaggingJob, mgr.addedStreamsDuringTaggingJob)
 			}
@@ -833,6 +1389,7 @@ func (mgr *Manager) updateTagJob(name string, t tag, tagDetails map[string]query
 		mgr.startTaggingJobIfNeeded()
 		mgr.startConverterJobIfNeeded()
 		mgr.startMergeJobIfNeeded()
+		mgr.startRetentionJobIfNeeded()
 		releaser.release(mgr)
 		mgr.updatedTagsToSignal[name] = struct{}{}
 	}
@@ -846,10 +1403,7 @@ func (mgr *Manager) ImportPcaps(filenames []string) {
 		//add job to be processed by importer goroutine
 		mgr.importJobs = append(mgr.importJobs, filenames...)
 		//start import job when none running
-		if len(mgr.importJobs) == len(filenames) {
-			indexes, releaser := mgr.getIndexesCopy(0)
-			go mgr.importPcapJob(mgr.importJobs[:len(filenames)], mgr.nextStreamID, indexes, releaser)
-		}
+		mgr.startImportJobIfNeeded()
 		mgr.event(Event{
 			Type: "pcapArrived",
 		})
@@ -864,7 +1418,18 @@ func (mgr *Manager) getIndexesCopy(start int) ([]*index.Reader, indexReleaser) {
 func (mgr *Manager) SetConfig(config Config) error {
 	c := make(chan error)
 	mgr.jobs <- func() {
+		oldConfig := mgr.config
 		mgr.config = config
+		mgr.applyConverterLimits()
+		for name := range mgr.converters {
+			if slices.Equal(oldConfig.ConverterTags[name], config.ConverterTags[name]) {
+				continue
+			}
+			// the cached results were created with other tags
+			if err := mgr.restartConverterProcess(name); err != nil {
+				log.Printf("error while resetting converter %s after its tags changed: %v", name, err)
+			}
+		}
 
 		mgr.event(Event{
 			Type:   "configUpdated",
@@ -872,6 +1437,7 @@ func (mgr *Manager) SetConfig(config Config) error {
 		})
 		c <- mgr.saveState()
 		close(c)
+		mgr.startRetentionJobIfNeeded()
 	}
 	return <-c
 }
@@ -892,6 +1458,7 @@ func (mgr *Manager) Status() Statistics {
 		for _, n := range mgr.usedIndexes {
 			locks += n
 		}
+		_, diskUsage := mgr.diskUsage()
 		c <- Statistics{
 			IndexCount:          len(mgr.indexes),
 			IndexLockCount:      locks,
@@ -904,6 +1471,9 @@ func (mgr *Manager) Status() Statistics {
 			MergeJobRunning:     mgr.mergeJobRunning,
 			TaggingJobRunning:   mgr.taggingJobRunning,
 			ConverterJobRunning: mgr.converterJobRunning,
+			RetentionJobRunning: mgr.retentionJobRunning,
+			DiskUsage:           diskUsage,
+			Retention:           mgr.retention,
 		}
 		close(c)
 	}
@@ -959,6 +1529,27 @@ func (mgr *Manager) ListTags() []TagInfo {
 	return <-c
 }
 
+// setStreamIDsDefinition replaces the definition of a mark or generated tag
+// by the list of its matching streams.
+func (t *tag) setStreamIDsDefinition() {
+	b := strings.Builder{}
+	b.WriteString("id:")
+	for i := uint(0); t.Matches.Next(&i); i++ {
+		fmt.Fprintf(&b, "%d,", i)
+	}
+	if b.Len() == len("id:") {
+		t.definition = "id:-1"
+		t.Conditions = nil
+		return
+	}
+	markQuery := b.String()
+	markQuery = markQuery[:len(markQuery)-1]
+	if q, err := query.Parse(markQuery); err == nil {
+		t.Conditions = q.Conditions
+		t.definition = markQuery
+	}
+}
+
 func parseTagName(fullName string) (typ, name string, isMark bool) {
 	ok := false
 	typ, name, ok = strings.Cut(fullName, "/")
@@ -1068,6 +1659,7 @@ func (mgr *Manager) DelTag(name string) error {
 				}
 			}
 			delete(mgr.tags, name)
+			mgr.tagMatchesChanged(name, tag.Matches)
 			mgr.event(Event{
 				Type: "tagDeleted",
 				Tag: &TagInfo{
@@ -1197,10 +1789,12 @@ func (mgr *Manager) UpdateTag(name string, operation UpdateTagOperation) error {
 			if info.color != "" {
 				tag.color = info.color
 			}
-			if newTag != nil {
+			// keep the evaluated streams if the query didn't change
+			if newTag != nil && newTag.definition != tag.definition {
 				newTag.color = tag.color
 				newTag.converters = tag.converters
 				newTag.referencedBy = tag.referencedBy
+				newTag.converterMatches = tag.converterMatches
 				newTag.Uncertain = mgr.allStreams
 				onlyBefore := map[string]struct{}{}
 				onlyAfter := map[string]struct{}{}
@@ -1269,6 +1863,7 @@ func (mgr *Manager) UpdateTag(name string, operation UpdateTagOperation) error {
 				newTag.Uncertain = tag.Uncertain.Copy()
 				// update mark streamid tag matches without parsing the definition again
 				// this is a bit hacky but it is much faster than parsing the definition of long mark tags again
+				addedStreams := bitmask.LongBitmask{}
 				if len(info.markTagAddStreams) != 0 {
 					b := strings.Builder{}
 					b.WriteString("id:")
@@ -1277,6 +1872,7 @@ func (mgr *Manager) UpdateTag(name string, operation UpdateTagOperation) error {
 							continue
 						}
 						newTag.Matches.Set(uint(s))
+						addedStreams.Set(uint(s))
 						newTag.Uncertain.Set(uint(s))
 						fmt.Fprintf(&b, "%d,", s)
 
@@ -1297,6 +1893,7 @@ func (mgr *Manager) UpdateTag(name string, operation UpdateTagOperation) error {
 						}
 					}
 				}
+				removedStreams := bitmask.LongBitmask{}
 				if len(info.markTagDelStreams) != 0 {
 					for _, s := range info.markTagDelStreams {
 						if !newTag.Matches.IsSet(uint(s)) {
@@ -1304,27 +1901,15 @@ func (mgr *Manager) UpdateTag(name string, operation UpdateTagOperation) error {
 						}
 						newTag.Matches.Unset(uint(s))
 						newTag.Uncertain.Set(uint(s))
-						// TODO: invalidate converter cache for this stream
-					}
-					b := strings.Builder{}
-					b.WriteString("id:")
-					for i := uint(0); newTag.Matches.Next(&i); i++ {
-						fmt.Fprintf(&b, "%d,", i)
-					}
-					if b.Len() == len("id:") {
-						newTag.definition = "id:-1"
-						newTag.Conditions = nil
-					} else {
-						markQuery := b.String()
-						markQuery = markQuery[:len(markQuery)-1]
-						if q, err := query.Parse(markQuery); err == nil {
-							newTag.Conditions = q.Conditions
-							newTag.definition = markQuery
-						}
+						removedStreams.Set(uint(s))
 					}
+					newTag.setStreamIDsDefinition()
 				}
 				tag = &newTag
 				mgr.tags[name] = tag
+				mgr.evictConverterResults(tag, removedStreams)
+				addedStreams.Or(removedStreams)
+				mgr.tagMatchesChanged(name, addedStreams)
 				mgr.inheritTagUncertainty()
 				mgr.tags[name].Uncertain = bitmask.LongBitmask{}
 				mgr.startTaggingJobIfNeeded()
@@ -1347,6 +1932,7 @@ func (mgr *Manager) UpdateTag(name string, operation UpdateTagOperation) error {
 				}
 				delete(mgr.tags, name)
 				mgr.tags[info.name] = tag
+				mgr.tagMatchesChanged(info.name, tag.Matches)
 				for _, rtn := range tag.referencedTags() {
 					rt := mgr.tags[rtn]
 					delete(rt.referencedBy, name)
@@ -1396,32 +1982,48 @@ func (r *indexReleaser) release(mgr *Manager) {
 }
 
 func (mgr *Manager) startConverterJobIfNeeded() {
-	if mgr.converterJobRunning {
+	if mgr.converterJobRunning || mgr.retentionJobRunning {
 		return
 	}
 	activeConverters := []*converters.CachedConverter(nil)
 	streamsToConvert := []*bitmask.LongBitmask(nil)
 
+	// the converters receive the names of the tags matching the streams,
+	// so streams are only converted once all tags were evaluated for them
+	converterTags := [][]string(nil)
+
 	// TODO: split this into smaller chunks so that we can abort long running jobs
 	//       when a converter gets detached from a tag while it is running
 	for converterName, converter := range mgr.converters {
-		streams := mgr.streamsToConvert[converterName]
+		// the tags sent to the converter have to be evaluated first
+		uncertainStreams := bitmask.LongBitmask{}
+		for tn, t := range mgr.tags {
+			if receivesTag(mgr.config.ConverterTags[converterName], tn) {
+				uncertainStreams.Or(t.Uncertain)
+			}
+		}
+		streams := mgr.streamsToConvert[converterName].SubCopy(uncertainStreams)
 		if streams.IsZero() {
 			continue
 		}
-		mgr.streamsToConvert[converterName] = &bitmask.LongBitmask{}
-		streamsToConvert = append(streamsToConvert, streams)
+		mgr.streamsToConvert[converterName].Sub(streams)
+		streamsToConvert = append(streamsToConvert, &streams)
 		activeConverters = append(activeConverters, converter)
+		converterTags = append(converterTags, mgr.config.ConverterTags[converterName])
 	}
 	if len(activeConverters) == 0 {
 		return
 	}
+	tagDetails := make(map[string]query.TagDetails, len(mgr.tags))
+	for tn, t := range mgr.tags {
+		tagDetails[tn] = t.TagDetails
+	}
 	indexes, releaser := mgr.getIndexesCopy(0)
-	go mgr.convertStreamJob(activeConverters, streamsToConvert, indexes, releaser)
+	go mgr.convertStreamJob(activeConverters, streamsToConvert, converterTags, tagDetails, indexes, releaser)
 	mgr.converterJobRunning = true
 }
 
-func (mgr *Manager) convertStreamJob(allConverters []*converters.CachedConverter, allStreamIDs []*bitmask.LongBitmask, indexes []*index.Reader, releaser indexReleaser) {
+func (mgr *Manager) convertStreamJob(allConverters []*converters.CachedConverter, allStreamIDs []*bitmask.LongBitmask, allConverterTags [][]string, tagDetails map[string]query.TagDetails, indexes []*index.Reader, releaser indexReleaser) {
 	type job struct {
 		streamID  uint64
 		converter int
@@ -1499,7 +2101,7 @@ func (mgr *Manager) convertStreamJob(allConverters []*converters.CachedConverter
 					if stream == nil {
 						continue
 					}
-					_, _, _, _, err = converter.Data(stream, false)
+					_, _, _, _, err = converter.Data(stream, streamTags(tagDetails, allConverterTags[job.converter], job.streamID), false)
 					results <- result{job, err}
 					return
 				}
@@ -1539,6 +2141,10 @@ func (mgr *Manager) convertStreamJob(allConverters []*converters.CachedConverter
 
 	mgr.jobs <- func() {
 		mgr.converterJobRunning = false
+		for tagName, streams := range mgr.tagsChangedDuringConverterJob {
+			mgr.dropConverterResults(tagName, streams)
+		}
+		mgr.tagsChangedDuringConverterJob = nil
 
 		for i, converter := range allConverters {
 			// The converter was removed while we were running.
@@ -1549,6 +2155,7 @@ func (mgr *Manager) convertStreamJob(allConverters []*converters.CachedConverter
 				}
 				continue
 			}
+			mgr.applyConverterTags(converter)
 
 			// Mark the converted streams as uncertain on all tags using a data: filter
 			// The tag could match on the converted data now.
@@ -1568,10 +2175,249 @@ func (mgr *Manager) convertStreamJob(allConverters []*converters.CachedConverter
 		mgr.inheritTagUncertainty()
 		mgr.startTaggingJobIfNeeded()
 		mgr.startConverterJobIfNeeded()
+		mgr.startMergeJobIfNeeded()
+		mgr.startRetentionJobIfNeeded()
 		releaser.release(mgr)
 	}
 }
 
+// applyConverterTags updates the generated tags with the tags the converter
+// returned for the streams it converted since the last call.
+func (mgr *Manager) applyConverterTags(converter *converters.CachedConverter) {
+	name := converter.Name()
+	added := map[string][]uint64{}
+	removed := map[string][]uint64{}
+	for streamID, tags := range converter.TakeTags() {
+		current := map[string]struct{}{}
+		for _, t := range tags {
+			if !generatedTagNameRegex.MatchString(t) {
+				log.Printf("Converter %q returned invalid tag %q for stream %d", name, t, streamID)
+				continue
+			}
+			current["generated/"+t] = struct{}{}
+		}
+		for tn := range current {
+			added[tn] = append(added[tn], streamID)
+		}
+		for tn, t := range mgr.tags {
+			if _, ok := current[tn]; ok {
+				continue
+			}
+			if m, ok := t.converterMatches[name]; ok && m.IsSet(uint(streamID)) {
+				removed[tn] = append(removed[tn], streamID)
+			}
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	updated := []string(nil)
+	for tn, streams := range added {
+		updated = append(updated, tn)
+		if _, ok := mgr.tags[tn]; !ok {
+			mgr.tags[tn] = &tag{
+				definition:   "id:-1",
+				color:        generatedTagColor,
+				referencedBy: make(map[string]struct{}),
+			}
+			mgr.updateGeneratedTag(tn, name, streams, nil)
+			mgr.event(Event{
+				Type: "tagAdded",
+				Tag:  makeTagInfo(tn, mgr.tags[tn]),
+			})
+			continue
+		}
+		mgr.updateGeneratedTag(tn, name, streams, removed[tn])
+		delete(removed, tn)
+	}
+	for tn, streams := range removed {
+		updated = append(updated, tn)
+		mgr.updateGeneratedTag(tn, name, nil, streams)
+	}
+	mgr.finishGeneratedTagUpdate(updated)
+}
+
+// resetConverterTags removes the streams the converter added to generated
+// tags, it is used when the results of the converter are discarded.
+func (mgr *Manager) resetConverterTags(converterName string) {
+	mgr.removeConverterTags(converterName, nil)
+}
+
+// removeConverterTags removes the streams from the generated tags the
+// converter added them to, nil removes all streams.
+func (mgr *Manager) removeConverterTags(converterName string, removedStreams *bitmask.LongBitmask) {
+	updated := []string(nil)
+	for tn, t := range mgr.tags {
+		m, ok := t.converterMatches[converterName]
+		if !ok {
+			continue
+		}
+		if removedStreams != nil {
+			m = m.AndCopy(*removedStreams)
+			if m.IsZero() {
+				continue
+			}
+		}
+		streams := []uint64(nil)
+		for i := uint(0); m.Next(&i); i++ {
+			streams = append(streams, uint64(i))
+		}
+		mgr.updateGeneratedTag(tn, converterName, nil, streams)
+		updated = append(updated, tn)
+	}
+	if len(updated) != 0 {
+		mgr.finishGeneratedTagUpdate(updated)
+	}
+}
+
+// updateGeneratedTag adds and removes streams the converter returned the
+// generated tag for. Streams are only removed from the tag if no other
+// converter returned the tag for them. The tag is updated in place as
+// callers might hold a pointer to it, the bitmasks are copied as they are
+// shared with views.
+func (mgr *Manager) updateGeneratedTag(tagName, converterName string, add, del []uint64) {
+	t := mgr.tags[tagName]
+	t.Matches = t.Matches.Copy()
+	t.Uncertain = t.Uncertain.Copy()
+	if t.converterMatches == nil {
+		t.converterMatches = map[string]bitmask.LongBitmask{}
+	}
+	converterMatches := t.converterMatches[converterName].Copy()
+	for _, s := range add {
+		converterMatches.Set(uint(s))
+		if t.Matches.IsSet(uint(s)) {
+			continue
+		}
+		t.Matches.Set(uint(s))
+		t.Uncertain.Set(uint(s))
+		for _, converter := range t.converters {
+			mgr.streamsToConvert[converter.Name()].Set(uint(s))
+		}
+	}
+	removedStreams := bitmask.LongBitmask{}
+nextStream:
+	for _, s := range del {
+		converterMatches.Unset(uint(s))
+		for c, m := range t.converterMatches {
+			if c != converterName && m.IsSet(uint(s)) {
+				continue nextStream
+			}
+		}
+		if !t.Matches.IsSet(uint(s)) {
+			continue
+		}
+		t.Matches.Unset(uint(s))
+		t.Uncertain.Set(uint(s))
+		removedStreams.Set(uint(s))
+	}
+	converterMatches.Shrink()
+	if converterMatches.IsZero() {
+		delete(t.converterMatches, converterName)
+	} else {
+		t.converterMatches[converterName] = converterMatches
+	}
+	t.setStreamIDsDefinition()
+	mgr.updatedTagsToSignal[tagName] = struct{}{}
+	mgr.evictConverterResults(t, removedStreams)
+}
+
+// finishGeneratedTagUpdate propagates the changes of the updated generated
+// tags to the tags referencing them.
+func (mgr *Manager) finishGeneratedTagUpdate(tagNames []string) {
+	mgr.inheritTagUncertainty()
+	for _, tn := range tagNames {
+		mgr.tags[tn].Uncertain = bitmask.LongBitmask{}
+	}
+	mgr.startTaggingJobIfNeeded()
+	mgr.startConverterJobIfNeeded()
+	if err := mgr.saveState(); err != nil {
+		log.Printf("Unable to save state: %v", err)
+	}
+}
+
+// evictConverterResults drops the cached results of the converters
+// attached to the tag for the streams that stopped matching it.
+func (mgr *Manager) evictConverterResults(t *tag, removedStreams bitmask.LongBitmask) {
+	if removedStreams.IsZero() {
+		return
+	}
+	for _, converter := range t.converters {
+		mgr.evictConverterStreams(converter, removedStreams)
+	}
+}
+
+// evictConverterStreams drops the cached results of the converter for the
+// streams that don't match any tag the converter is attached to. Streams
+// converted on demand without matching such a tag have to be passed
+// explicitly, so their results are kept otherwise.
+func (mgr *Manager) evictConverterStreams(converter *converters.CachedConverter, streams bitmask.LongBitmask) {
+	streams = streams.Copy()
+	for _, t := range mgr.tags {
+		if slices.Contains(t.converters, converter) {
+			streams.Sub(t.Matches)
+		}
+	}
+	if streams.IsZero() {
+		return
+	}
+	mgr.streamsToConvert[converter.Name()].Sub(streams)
+	evicted := converter.EvictStreams(&streams)
+	if evicted.IsZero() {
+		return
+	}
+	// the streams must not match generated tags and data filters because
+	// of the evicted results anymore
+	mgr.removeConverterTags(converter.Name(), &evicted)
+	for _, tag := range mgr.tags {
+		if tag.features.MainFeatures&query.FeatureFilterData == 0 && tag.features.SubQueryFeatures&query.FeatureFilterData == 0 {
+			continue
+		}
+		tag.Uncertain = tag.Uncertain.OrCopy(evicted)
+	}
+	mgr.updatedStreamsDuringTaggingJob.Or(evicted)
+	mgr.inheritTagUncertainty()
+}
+
+// tagMatchesChanged drops the cached results of the converters receiving
+// the name of the tag for the streams that started or stopped matching it.
+// Streams matching a tag the converter is attached to are converted again,
+// the results of the other streams are evicted. The results of converters
+// not receiving the tag are kept.
+func (mgr *Manager) tagMatchesChanged(tagName string, streams bitmask.LongBitmask) {
+	if streams.IsZero() || strings.HasPrefix(tagName, "generated/") {
+		return
+	}
+	if mgr.converterJobRunning {
+		// the running job might store results using the old tags
+		if mgr.tagsChangedDuringConverterJob == nil {
+			mgr.tagsChangedDuringConverterJob = map[string]bitmask.LongBitmask{}
+		}
+		changed := mgr.tagsChangedDuringConverterJob[tagName]
+		changed.Or(streams)
+		mgr.tagsChangedDuringConverterJob[tagName] = changed
+	}
+	mgr.dropConverterResults(tagName, streams)
+}
+
+// dropConverterResults drops the cached results of the converters
+// receiving the tag for the streams, see tagMatchesChanged.
+func (mgr *Manager) dropConverterResults(tagName string, streams bitmask.LongBitmask) {
+	for name, converter := range mgr.converters {
+		if !receivesTag(mgr.config.ConverterTags[name], tagName) {
+			continue
+		}
+		attached := bitmask.LongBitmask{}
+		for _, t := range mgr.tags {
+			if slices.Contains(t.converters, converter) {
+				attached.Or(t.Matches)
+			}
+		}
+		convertAgain := streams.AndCopy(attached)
+		mgr.streamsToConvert[name].Or(converter.InvalidateChangedStreams(&convertAgain))
+		mgr.evictConverterStreams(converter, streams)
+	}
+}
+
 func (mgr *Manager) invalidateConverters(updatedStreams *bitmask.LongBitmask) {
 	for _, converter := range mgr.converters {
 		invalidatedStreams := converter.InvalidateChangedStreams(updatedStreams)
@@ -1605,10 +2451,15 @@ func (mgr *Manager) startMonitoringConverters(watcher *fsnotify.Watcher) {
 
 				if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
 					mgr.jobs <- func() {
-						if err := mgr.removeConverter(event.Name); err != nil {
-							log.Printf("error while removing converter: %v", err)
-						}
 						name := strings.TrimSuffix(filepath.Base(event.Name), filepath.Ext(event.Name))
+						if converter, ok := mgr.converters[name]; ok && (converter.Native() || converter.Address() != "") {
+							// the file was ignored when it was added
+							return
+						}
+						removeErr := mgr.removeConverter(event.Name)
+						if removeErr != nil {
+							log.Printf("error while removing converter: %v", removeErr)
+						}
 						mgr.event(Event{
 							Type: "converterDeleted",
 							Converter: &converters.Statistics{
@@ -1616,6 +2467,18 @@ func (mgr *Manager) startMonitoringConverters(watcher *fsnotify.Watcher) {
 								Processes: []converters.ProcessStats{},
 							},
 						})
+						if removeErr != nil {
+							return
+						}
+						// the built-in converter of the same name is used again
+						if restored, err := mgr.restoreNativeConverter(name); err != nil {
+							log.Printf("error while restoring built-in converter: %v", err)
+						} else if restored {
+							mgr.event(Event{
+								Type:      "converterAdded",
+								Converter: mgr.converters[name].Statistics(),
+							})
+						}
 					}
 				}
 
@@ -1650,23 +2513,20 @@ func (mgr *Manager) startMonitoringConverters(watcher *fsnotify.Watcher) {
 									Type:      "converterAdded",
 									Converter: converter.Statistics(),
 								})
+								mgr.restartDependentPipelines(name)
+								mgr.addDependentPipelines(name)
 							}
-							if event.Has(fsnotify.Chmod) {
+							if event.Has(fsnotify.Chmod) || event.Has(fsnotify.Write) {
 								fileInfo, err := os.Stat(event.Name)
 								if err != nil || fileInfo.IsDir() {
 									return
 								}
-								if err := mgr.restartConverterProcess(event.Name); err != nil {
+								changed, err := mgr.updateConverter(event.Name)
+								if err != nil {
 									log.Printf("error while restarting converter: %v", err)
 								}
-							}
-							if event.Has(fsnotify.Write) {
-								fileInfo, err := os.Stat(event.Name)
-								if err != nil || fileInfo.IsDir() {
-									return
-								}
-								if err := mgr.restartConverterProcess(event.Name); err != nil {
-									log.Printf("error while restarting converter: %v", err)
+								if changed {
+									mgr.restartDependentPipelines(strings.TrimSuffix(filepath.Base(event.Name), filepath.Ext(event.Name)))
 								}
 							}
 						}
@@ -1769,48 +2629,571 @@ func (mgr *Manager) startMonitoringPcaps(watcher *fsnotify.Watcher) {
 					timers[event.Name] = timer
 					mu.Unlock()
 				}
-				timer.Reset(waitFor)
+				timer.Reset(waitFor)
+			}
+		}
+	}()
+	err := watcher.Add(mgr.WatchDir)
+	if err != nil {
+		log.Fatal(fmt.Errorf("error while adding pcaps dir to watcher %v: %w", mgr.WatchDir, err))
+	}
+}
+
+func (mgr *Manager) checkConverterName(name string) error {
+	if converter, ok := mgr.converters[name]; ok {
+		if converter.Native() {
+			return fmt.Errorf("error: converter %s is built in", name)
+		}
+		return fmt.Errorf("error: converter %s already exists", name)
+	}
+	if name == "none" {
+		return fmt.Errorf("error: converter %s is reserved", name)
+	}
+	// Converter names have to be plain ascii so we can use them in the query language easily.
+	if !regexp.MustCompile(`^[a-zA-Z0-9_]+$`).MatchString(name) {
+		return fmt.Errorf("error: converter %s has to be alphanumeric", name)
+	}
+	return nil
+}
+
+// nativeConverters returns the converters implemented in Go.
+func (mgr *Manager) nativeConverters() []converters.Converter {
+	return append(converters.Builtin(), converters.NewTLSDecryptConverter(mgr.tlsKeys))
+}
+
+// addNativeConverters registers the converters implemented in Go,
+// converters of the same name in the converter directory replace them.
+func (mgr *Manager) addNativeConverters() error {
+	for _, c := range mgr.nativeConverters() {
+		if err := mgr.addNativeConverter(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mgr *Manager) addNativeConverter(c converters.Converter) error {
+	name := c.Name()
+	if err := mgr.checkConverterName(name); err != nil {
+		return err
+	}
+	newCache := converters.NewNativeCache
+	if mgr.readOnly {
+		newCache = converters.NewReadOnlyNativeCache
+	}
+	converter, err := newCache(c, mgr.IndexDir)
+	if err != nil {
+		return fmt.Errorf("error: failed to create converter %s: %w", name, err)
+	}
+	mgr.converters[name] = converter
+	mgr.streamsToConvert[name] = &bitmask.LongBitmask{}
+	return nil
+}
+
+// removeNativeConverter unregisters the built-in converter of the same name
+// as a converter of the converter directory, so the latter can be added.
+// It returns the built-in converter, nil if there is none.
+func (mgr *Manager) removeNativeConverter(name string) *converters.CachedConverter {
+	native, ok := mgr.converters[name]
+	if !ok || !native.Native() {
+		return nil
+	}
+	log.Printf("Warning: converter %s in the converter directory replaces the built-in converter of the same name", name)
+	delete(mgr.converters, name)
+	delete(mgr.streamsToConvert, name)
+	return native
+}
+
+// replaceNativeConverter finishes replacing the built-in converter returned
+// by removeNativeConverter. The tags it was attached to use the new
+// converter, which converts their streams again. If the new converter
+// couldn't be added, the built-in converter is registered again.
+func (mgr *Manager) replaceNativeConverter(native *converters.CachedConverter, err error) error {
+	if native == nil {
+		return err
+	}
+	name := native.Name()
+	converter, ok := mgr.converters[name]
+	if err != nil || !ok {
+		mgr.converters[name] = native
+		mgr.streamsToConvert[name] = &bitmask.LongBitmask{}
+		return err
+	}
+	if err := native.Reset(); err != nil {
+		return err
+	}
+	mgr.resetConverterTags(name)
+	attached := false
+	for tagName, tag := range mgr.tags {
+		if i := slices.Index(tag.converters, native); i >= 0 {
+			tag.converters[i] = converter
+			mgr.updatedTagsToSignal[tagName] = struct{}{}
+			mgr.streamsToConvert[name].Or(tag.Matches)
+			attached = true
+		}
+	}
+	if attached {
+		mgr.startConverterJobIfNeeded()
+	}
+	return nil
+}
+
+// restoreNativeConverter registers the built-in converter replaced by the
+// removed converter of the same name again.
+func (mgr *Manager) restoreNativeConverter(name string) (bool, error) {
+	for _, c := range mgr.nativeConverters() {
+		if c.Name() == name {
+			return true, mgr.addNativeConverter(c)
+		}
+	}
+	return false, nil
+}
+
+// loadTLSKeys reads the TLS secrets stored in the state directory.
+func (mgr *Manager) loadTLSKeys() error {
+	f, err := os.Open(filepath.Join(mgr.StateDir, tlsKeysFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to open TLS keys: %w", err)
+	}
+	defer f.Close()
+	entries, err := tlskeylog.Parse(f)
+	if err != nil {
+		log.Printf("Failed to load some TLS keys: %v", err)
+	}
+	mgr.tlsKeys.Add(entries)
+	return nil
+}
+
+// AddTLSKeys adds the secrets of a keylog file to the secrets used by the
+// tlsdecrypt converter. Streams that failed to convert because their
+// secrets were missing are converted again. It returns the number of new
+// secrets, invalid lines are reported in the error but don't prevent the
+// valid ones from being added.
+func (mgr *Manager) AddTLSKeys(r io.Reader) (int, error) {
+	entries, parseErr := tlskeylog.Parse(r)
+	c := make(chan error)
+	added := []tlskeylog.Entry(nil)
+	mgr.jobs <- func() {
+		added = mgr.tlsKeys.Add(entries)
+		c <- mgr.tlsKeysAdded(added)
+	}
+	if err := <-c; err != nil {
+		return len(added), err
+	}
+	return len(added), parseErr
+}
+
+// tlsKeysAdded stores the new secrets and requeues the streams that can
+// be decrypted now.
+func (mgr *Manager) tlsKeysAdded(added []tlskeylog.Entry) error {
+	if len(added) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(mgr.StateDir, tlsKeysFilename), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to store TLS keys: %w", err)
+	}
+	for _, e := range added {
+		if _, err := fmt.Fprintln(f, e); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to store TLS keys: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to store TLS keys: %w", err)
+	}
+
+	randoms := map[tlskeylog.ClientRandom]struct{}{}
+	for _, e := range added {
+		randoms[e.ClientRandom] = struct{}{}
+	}
+	for name, converter := range mgr.converters {
+		streams, err := converter.RemoveStreamsMissingTLSKeys(randoms)
+		if err != nil {
+			log.Printf("Failed to remove failed streams of converter %s: %v", name, err)
+			continue
+		}
+		if streams.IsZero() {
+			continue
+		}
+		for _, tag := range mgr.tags {
+			if slices.Contains(tag.converters, converter) {
+				mgr.streamsToConvert[name].Or(streams.AndCopy(tag.Matches))
+			}
+		}
+	}
+	mgr.startConverterJobIfNeeded()
+	return nil
+}
+
+// WriteTLSKeys writes all known TLS secrets in the keylog format.
+func (mgr *Manager) WriteTLSKeys(w io.Writer) error {
+	_, err := mgr.tlsKeys.WriteTo(w)
+	return err
+}
+
+// WatchTLSKeyLogFile reads the secrets of the keylog file and adds the
+// lines appended to it later, like the SSLKEYLOGFILE of a service.
+func (mgr *Manager) WatchTLSKeyLogFile(path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create fsnotify watcher for the TLS keylog: %w", err)
+	}
+	// watch the directory, the file might not exist yet or be replaced
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("error while adding TLS keylog dir to watcher: %w", err)
+	}
+	c := make(chan struct{})
+	mgr.jobs <- func() {
+		if mgr.tlsKeyLogWatcher != nil {
+			// stop watching the previous keylog file
+			if err := mgr.tlsKeyLogWatcher.Close(); err != nil {
+				log.Printf("Failed to close TLS keylog watcher: %v", err)
+			}
+		}
+		mgr.tlsKeyLogWatcher = watcher
+		close(c)
+	}
+	<-c
+
+	offset := int64(0)
+	readKeys := func() {
+		f, err := os.Open(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Failed to open TLS keylog: %v", err)
+			}
+			return
+		}
+		defer f.Close()
+		fileInfo, err := f.Stat()
+		if err != nil {
+			log.Printf("Failed to stat TLS keylog: %v", err)
+			return
+		}
+		if fileInfo.Size() < offset {
+			// the file was truncated
+			offset = 0
+		}
+		content := make([]byte, fileInfo.Size()-offset)
+		n, err := f.ReadAt(content, offset)
+		if err != nil && err != io.EOF {
+			log.Printf("Failed to read TLS keylog: %v", err)
+			return
+		}
+		// the last line might not be written completely
+		content = content[:bytes.LastIndexByte(content[:n], '\n')+1]
+		offset += int64(len(content))
+		if n, err := mgr.AddTLSKeys(bytes.NewReader(content)); err != nil {
+			log.Printf("Error while adding TLS keys from %s: %v", path, err)
+		} else if n != 0 {
+			log.Printf("Added %d TLS keys from %s", n, path)
+		}
+	}
+	readKeys()
+	go func() {
+		for {
+			select {
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("error:", err)
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(path) {
+					continue
+				}
+				if event.Has(fsnotify.Create) {
+					offset = 0
+				}
+				if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+					readKeys()
+				}
 			}
 		}
 	}()
-	err := watcher.Add(mgr.WatchDir)
+	return nil
+}
+
+// addConvertersFromDir adds all converters in the directory, pipelines are
+// added last as they reference the other converters.
+func (mgr *Manager) addConvertersFromDir(dir string) error {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		log.Fatal(fmt.Errorf("error while adding pcaps dir to watcher %v: %w", mgr.WatchDir, err))
+		return fmt.Errorf("failed to read converter directory: %w", err)
 	}
+	for _, pipelines := range []bool{false, true} {
+		for _, entry := range entries {
+			if entry.IsDir() || (filepath.Ext(entry.Name()) == pipelineExtension) != pipelines {
+				continue
+			}
+			if err := mgr.addConverter(filepath.Join(dir, entry.Name())); err != nil {
+				log.Printf("failed to add converter %q: %v", entry.Name(), err)
+			}
+		}
+	}
+	return nil
 }
 
 func (mgr *Manager) addConverter(path string) error {
+	if filepath.Ext(path) == pipelineExtension {
+		return mgr.addPipeline(path)
+	}
 	// TODO: Do we want to check this now or when we start the converter?
 	if !tools.IsFileExecutable(path) {
 		return fmt.Errorf("error: converter %s is not executable", path)
 	}
 	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
-	if _, ok := mgr.converters[name]; ok {
-		return fmt.Errorf("error: converter %s already exists", name)
+	native := mgr.removeNativeConverter(name)
+	return mgr.replaceNativeConverter(native, func() error {
+		if err := mgr.checkConverterName(name); err != nil {
+			return err
+		}
+
+		newCache := converters.NewCache
+		if mgr.readOnly {
+			newCache = converters.NewReadOnlyCache
+		}
+		converter, err := newCache(name, path, mgr.IndexDir)
+		if err != nil {
+			return fmt.Errorf("error: failed to create converter %s: %w", name, err)
+		}
+		converter.SetLimits(mgr.converterLimits(name))
+		mgr.converters[name] = converter
+		mgr.streamsToConvert[name] = &bitmask.LongBitmask{}
+		return nil
+	}())
+}
+
+// addPipeline adds the pipeline defined in the file, it contains the names
+// of the converters to run one after another.
+func (mgr *Manager) addPipeline(path string) error {
+	name := strings.TrimSuffix(filepath.Base(path), pipelineExtension)
+	native := mgr.removeNativeConverter(name)
+	return mgr.replaceNativeConverter(native, func() error {
+		if err := mgr.checkConverterName(name); err != nil {
+			return err
+		}
+		stages, err := mgr.readPipelineStages(path)
+		if err != nil {
+			return err
+		}
+		newCache := converters.NewPipelineCache
+		if mgr.readOnly {
+			newCache = converters.NewReadOnlyPipelineCache
+		}
+		converter, err := newCache(name, stages, mgr.IndexDir)
+		if err != nil {
+			return fmt.Errorf("error: failed to create pipeline %s: %w", name, err)
+		}
+		converter.SetLimits(mgr.converterLimits(name))
+		mgr.converters[name] = converter
+		mgr.streamsToConvert[name] = &bitmask.LongBitmask{}
+		return nil
+	}())
+}
+
+// addRemoteConverter adds the converter service listening at the address.
+func (mgr *Manager) addRemoteConverter(name, address string) error {
+	if err := mgr.checkConverterName(name); err != nil {
+		return err
 	}
-	if name == "none" {
-		return fmt.Errorf("error: converter %s is reserved", name)
+	if err := converters.CheckRemoteAddress(address); err != nil {
+		return fmt.Errorf("error: converter %s: %w", name, err)
 	}
-	// Converter names have to be plain ascii so we can use them in the query language easily.
-	if !regexp.MustCompile(`^[a-zA-Z0-9_]+$`).MatchString(name) {
-		return fmt.Errorf("error: converter %s has to be alphanumeric", name)
+	newCache := converters.NewRemoteCache
+	if mgr.readOnly {
+		newCache = converters.NewReadOnlyRemoteCache
 	}
-
-	converter, err := converters.NewCache(name, path, mgr.IndexDir)
+	converter, err := newCache(name, address, mgr.IndexDir)
 	if err != nil {
 		return fmt.Errorf("error: failed to create converter %s: %w", name, err)
 	}
+	converter.SetLimits(mgr.converterLimits(name))
 	mgr.converters[name] = converter
 	mgr.streamsToConvert[name] = &bitmask.LongBitmask{}
 	return nil
 }
 
+// loadRemoteConverters adds the converter services stored in the state
+// directory.
+func (mgr *Manager) loadRemoteConverters() error {
+	content, err := os.ReadFile(filepath.Join(mgr.StateDir, remoteConvertersFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read converter services: %w", err)
+	}
+	addresses := map[string]string{}
+	if err := json.Unmarshal(content, &addresses); err != nil {
+		return fmt.Errorf("failed to parse converter services: %w", err)
+	}
+	for name, address := range addresses {
+		if err := mgr.addRemoteConverter(name, address); err != nil {
+			log.Printf("failed to add converter service %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// saveRemoteConverters stores the addresses of the converter services.
+func (mgr *Manager) saveRemoteConverters() error {
+	content, err := json.Marshal(mgr.remoteConverterAddresses())
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(mgr.StateDir, remoteConvertersFilename)
+	if err := os.WriteFile(fn+".tmp", content, 0600); err != nil {
+		return fmt.Errorf("failed to store converter services: %w", err)
+	}
+	if err := os.Rename(fn+".tmp", fn); err != nil {
+		return fmt.Errorf("failed to store converter services: %w", err)
+	}
+	return nil
+}
+
+func (mgr *Manager) remoteConverterAddresses() map[string]string {
+	addresses := map[string]string{}
+	for name, converter := range mgr.converters {
+		if address := converter.Address(); address != "" {
+			addresses[name] = address
+		}
+	}
+	return addresses
+}
+
+// readPipelineStageNames returns the names of the converters listed in a
+// pipeline file, separated by whitespace. Everything following a # is a
+// comment.
+func readPipelineStageNames(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	names := []string(nil)
+	for _, line := range strings.Split(string(content), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		names = append(names, strings.Fields(line)...)
+	}
+	return names, nil
+}
+
+// readPipelineStages returns the converters listed in a pipeline file.
+func (mgr *Manager) readPipelineStages(path string) ([]*converters.CachedConverter, error) {
+	names, err := readPipelineStageNames(path)
+	if err != nil {
+		return nil, err
+	}
+	stages := []*converters.CachedConverter(nil)
+	for _, stageName := range names {
+		stage, ok := mgr.converters[stageName]
+		if !ok {
+			return nil, fmt.Errorf("error: pipeline %s uses unknown converter %s", path, stageName)
+		}
+		if stage.Stages() != nil {
+			return nil, fmt.Errorf("error: pipeline %s uses pipeline %s", path, stageName)
+		}
+		stages = append(stages, stage)
+	}
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("error: pipeline %s has no stages", path)
+	}
+	return stages, nil
+}
+
+// addDependentPipelines adds the pipelines using the converter which were
+// missing as it didn't exist.
+func (mgr *Manager) addDependentPipelines(name string) {
+	paths, err := filepath.Glob(filepath.Join(mgr.ConverterDir, "*"+pipelineExtension))
+	if err != nil {
+		log.Printf("error while looking for pipelines using converter %s: %v", name, err)
+		return
+	}
+	for _, path := range paths {
+		pipelineName := strings.TrimSuffix(filepath.Base(path), pipelineExtension)
+		if _, ok := mgr.converters[pipelineName]; ok {
+			continue
+		}
+		if names, err := readPipelineStageNames(path); err != nil || !slices.Contains(names, name) {
+			continue
+		}
+		if err := mgr.addPipeline(path); err != nil {
+			log.Printf("error while adding pipeline %s: %v", pipelineName, err)
+			continue
+		}
+		mgr.event(Event{
+			Type:      "converterAdded",
+			Converter: mgr.converters[pipelineName].Statistics(),
+		})
+	}
+}
+
+// removeDependentPipelines removes the pipelines using the converter, they
+// are added again once the converter exists again.
+func (mgr *Manager) removeDependentPipelines(name string) error {
+	for _, converter := range mgr.converters {
+		if !slices.Contains(converter.Stages(), name) {
+			continue
+		}
+		log.Printf("removing pipeline %s as it uses the removed converter %s", converter.Name(), name)
+		if err := mgr.deleteConverter(converter); err != nil {
+			return err
+		}
+		mgr.event(Event{
+			Type: "converterDeleted",
+			Converter: &converters.Statistics{
+				Name:      converter.Name(),
+				Processes: []converters.ProcessStats{},
+			},
+		})
+	}
+	return nil
+}
+
+// restartDependentPipelines restarts the pipelines using the converter, so
+// they use the current version of it.
+func (mgr *Manager) restartDependentPipelines(name string) {
+	for _, converter := range mgr.converters {
+		if !slices.Contains(converter.Stages(), name) {
+			continue
+		}
+		path := filepath.Join(mgr.ConverterDir, converter.Name()+pipelineExtension)
+		if err := mgr.restartConverterProcess(path); err != nil {
+			log.Printf("error while restarting pipeline %s: %v", converter.Name(), err)
+		}
+	}
+}
+
 func (mgr *Manager) removeConverter(path string) error {
 	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
 	converter, ok := mgr.converters[name]
 	if !ok {
 		return fmt.Errorf("error: converter %s does not exist", name)
 	}
+	if converter.Native() {
+		return fmt.Errorf("error: converter %s is built in", name)
+	}
+	if converter.Address() != "" {
+		return fmt.Errorf("error: converter %s is a converter service", name)
+	}
+	if err := mgr.removeDependentPipelines(name); err != nil {
+		return err
+	}
+	return mgr.deleteConverter(converter)
+}
+
+// deleteConverter detaches the converter from all tags and drops its
+// results.
+func (mgr *Manager) deleteConverter(converter *converters.CachedConverter) error {
+	name := converter.Name()
 
 	// remove converter from all tags
 	for tagName, tag := range mgr.tags {
@@ -1823,12 +3206,47 @@ func (mgr *Manager) removeConverter(path string) error {
 	if err := converter.Reset(); err != nil {
 		return err
 	}
+	mgr.resetConverterTags(name)
 
 	delete(mgr.converters, name)
 	delete(mgr.streamsToConvert, name)
 	return mgr.saveState()
 }
 
+// updateConverter restarts the converter if it was modified, its cached
+// results are dropped and all streams are converted again. Events that
+// don't change the converter, e.g. touching it, keep the cache.
+func (mgr *Manager) updateConverter(path string) (bool, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if converter, ok := mgr.converters[name]; ok && converter.Address() != "" {
+		// the file is ignored
+		return false, mgr.checkConverterName(name)
+	} else if ok && converter.Native() {
+		// the file replaces the built-in converter, e.g. after it was
+		// made executable
+		if err := mgr.addConverter(path); err != nil {
+			return false, err
+		}
+		mgr.event(Event{
+			Type:      "converterAdded",
+			Converter: mgr.converters[name].Statistics(),
+		})
+		return true, nil
+	} else if ok && converter.Stages() == nil {
+		changed, err := converter.Changed()
+		if err != nil {
+			return false, err
+		}
+		if !changed {
+			return false, nil
+		}
+	}
+	if err := mgr.restartConverterProcess(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (mgr *Manager) restartConverterProcess(path string) error {
 	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
 	converter, ok := mgr.converters[name]
@@ -1841,11 +3259,21 @@ func (mgr *Manager) restartConverterProcess(path string) error {
 			Type:      "converterAdded",
 			Converter: converter.Statistics(),
 		})
+	} else if converter.Stages() != nil {
+		// the definition of the pipeline might have changed
+		stages, err := mgr.readPipelineStages(filepath.Join(mgr.ConverterDir, name+pipelineExtension))
+		if err != nil {
+			return err
+		}
+		if err := converter.SetStages(stages); err != nil {
+			return err
+		}
 	}
 	// Stop the process if it is running and restart it
 	if err := converter.Reset(); err != nil {
 		return err
 	}
+	mgr.resetConverterTags(name)
 
 	// run the converter on all streams that match the tags it is attached to again
 	for _, tag := range mgr.tags {
@@ -1905,13 +3333,15 @@ func (mgr *Manager) detachConverterFromTag(tag *tag, tagName string, converter *
 	onlyThisTag := tag.Matches.Copy()
 	onlyThisTag.Sub(matchingStreams)
 	mgr.streamsToConvert[converter.Name()].Sub(onlyThisTag)
-	// TODO: invalidate all streams in the cache that are only matched by this tag.
 
 	if matchingStreams.IsZero() {
 		// no other tags use this converter, delete all results
 		if err := converter.Reset(); err != nil {
 			return err
 		}
+		mgr.resetConverterTags(converter.Name())
+	} else {
+		mgr.evictConverterStreams(converter, onlyThisTag)
 	}
 	return nil
 }
@@ -1960,6 +3390,85 @@ func (mgr *Manager) ConverterStderr(converterName string, pid int) (*converters.
 	return stderr, nil
 }
 
+// TestConverter runs the converter once on the input, the cache of the
+// converter and the generated tags are not modified.
+func (mgr *Manager) TestConverter(converterName string, input *converters.TestInput) (*converters.TestResult, error) {
+	c := make(chan *converters.CachedConverter)
+	mgr.jobs <- func() {
+		c <- mgr.converters[converterName]
+		close(c)
+	}
+	converter := <-c
+	if converter == nil {
+		return nil, fmt.Errorf("error: converter %s does not exist", converterName)
+	}
+	return converter.Test(input)
+}
+
+// ListRemoteConverters returns the addresses of the converter services
+// by name.
+func (mgr *Manager) ListRemoteConverters() map[string]string {
+	c := make(chan map[string]string)
+	mgr.jobs <- func() {
+		c <- mgr.remoteConverterAddresses()
+		close(c)
+	}
+	return <-c
+}
+
+// AddRemoteConverter registers a converter service speaking the JSON
+// protocol of converters, listening on `unix:/path/to/socket` or an http
+// url. It can be attached to tags like other converters.
+func (mgr *Manager) AddRemoteConverter(name, address string) error {
+	c := make(chan error)
+	mgr.jobs <- func() {
+		defer close(c)
+		if err := mgr.addRemoteConverter(name, address); err != nil {
+			c <- err
+			return
+		}
+		mgr.event(Event{
+			Type:      "converterAdded",
+			Converter: mgr.converters[name].Statistics(),
+		})
+		c <- mgr.saveRemoteConverters()
+	}
+	return <-c
+}
+
+// DelRemoteConverter detaches the converter service from all tags and
+// removes it.
+func (mgr *Manager) DelRemoteConverter(name string) error {
+	c := make(chan error)
+	mgr.jobs <- func() {
+		defer close(c)
+		converter, ok := mgr.converters[name]
+		if !ok || converter.Address() == "" {
+			c <- fmt.Errorf("error: converter service %s does not exist", name)
+			return
+		}
+		for _, other := range mgr.converters {
+			if slices.Contains(other.Stages(), name) {
+				c <- fmt.Errorf("error: converter service %s is used by pipeline %s", name, other.Name())
+				return
+			}
+		}
+		if err := mgr.deleteConverter(converter); err != nil {
+			c <- err
+			return
+		}
+		mgr.event(Event{
+			Type: "converterDeleted",
+			Converter: &converters.Statistics{
+				Name:      name,
+				Processes: []converters.ProcessStats{},
+			},
+		})
+		c <- mgr.saveRemoteConverters()
+	}
+	return <-c
+}
+
 func (mgr *Manager) ListPcapProcessorWebhooks() []string {
 	c := make(chan []string)
 	mgr.jobs <- func() {
@@ -2300,8 +3809,66 @@ func (mgr *Manager) GetView() View {
 	return View{mgr: mgr}
 }
 
+// OpenView loads the indexes, tags and converter caches from the given
+// directories without starting a Manager and without modifying any file.
+// Release closes all files.
+func OpenView(indexDir, stateDir, converterDir string) (*View, error) {
+	mgr := Manager{
+		IndexDir:     indexDir,
+		StateDir:     stateDir,
+		ConverterDir: converterDir,
+		readOnly:     true,
+
+		usedIndexes:         make(map[*index.Reader]uint),
+		tags:                make(map[string]*tag),
+		converters:          make(map[string]*converters.CachedConverter),
+		streamsToConvert:    make(map[string]*bitmask.LongBitmask),
+		updatedTagsToSignal: make(map[string]struct{}),
+		tlsKeys:             tlskeylog.NewStore(),
+	}
+	v := &View{
+		tagDetails:    make(map[string]query.TagDetails),
+		tagConverters: make(map[string][]string),
+		converters:    make(map[string]index.ConverterAccess),
+	}
+	if err := mgr.loadTLSKeys(); err != nil {
+		return nil, err
+	}
+	if err := mgr.addNativeConverters(); err != nil {
+		return nil, err
+	}
+	if err := mgr.loadRemoteConverters(); err != nil {
+		return nil, err
+	}
+	if converterDir != "" {
+		if err := mgr.addConvertersFromDir(converterDir); err != nil {
+			return nil, err
+		}
+	}
+	for name, converter := range mgr.converters {
+		v.converters[name] = converter
+		v.files = append(v.files, converter)
+	}
+	if _, _, err := mgr.loadIndexesAndState(); err != nil {
+		v.Release()
+		return nil, err
+	}
+	v.indexes = mgr.indexes
+	for _, idx := range mgr.indexes {
+		v.files = append(v.files, idx)
+	}
+	v.converterTags = mgr.config.ConverterTags
+	for tn, ti := range mgr.tags {
+		v.tagDetails[tn] = ti.TagDetails
+		for _, c := range ti.converters {
+			v.tagConverters[tn] = append(v.tagConverters[tn], c.Name())
+		}
+	}
+	return v, nil
+}
+
 func (v *View) fetch() error {
-	if len(v.indexes) != 0 {
+	if v.mgr == nil || len(v.indexes) != 0 {
 		return nil
 	}
 	v.tagDetails = make(map[string]query.TagDetails)
@@ -2319,6 +3886,7 @@ func (v *View) fetch() error {
 		for converterName, converter := range v.mgr.converters {
 			v.converters[converterName] = converter
 		}
+		v.converterTags = v.mgr.config.ConverterTags
 		c <- nil
 		close(c)
 	}
@@ -2326,6 +3894,12 @@ func (v *View) fetch() error {
 }
 
 func (v *View) Release() {
+	for _, f := range v.files {
+		if err := f.Close(); err != nil {
+			log.Printf("Failed to close view: %v", err)
+		}
+	}
+	v.files = nil
 	if len(v.releaser) != 0 {
 		v.mgr.jobs <- func() {
 			v.releaser.release(v.mgr)
@@ -2560,12 +4134,17 @@ func (c StreamContext) Data(converterName string) ([]index.Data, error) {
 	if !ok {
 		return nil, fmt.Errorf("invalid converter %q", converterName)
 	}
-	data, _, _, wasCached, err := converter.Data(c.Stream(), true)
+	streamTags, err := c.ConverterTags(converterName)
+	if err != nil {
+		return nil, err
+	}
+	data, _, _, wasCached, err := converter.Data(c.Stream(), streamTags, true)
 	// only send event if the data wasn't cached before
-	if err == nil && !wasCached {
+	if err == nil && !wasCached && c.v.mgr != nil {
 		c.v.mgr.jobs <- func() {
 			converter, ok := c.v.mgr.converters[converterName]
 			if ok {
+				c.v.mgr.applyConverterTags(converter)
 				c.v.mgr.event(Event{
 					Type:      "converterCompleted",
 					Converter: converter.Statistics(),
@@ -2588,14 +4167,17 @@ func (c StreamContext) HasTag(name string) (bool, error) {
 	return false, nil
 }
 
-func (c StreamContext) AllTags() ([]string, error) {
-	if c.v == nil {
-		return nil, fmt.Errorf("no view")
-	}
+// streamTags returns the names of the tags certainly matching the stream.
+// If converterTags is not nil, only the tags sent to a converter with
+// these entries of Config.ConverterTags are returned.
+func streamTags(tagDetails map[string]query.TagDetails, converterTags []string, streamID uint64) []string {
 	tags := []string{}
-	for tn, td := range c.v.tagDetails {
-		if !td.Uncertain.IsSet(uint(c.s.ID())) {
-			if td.Matches.IsSet(uint(c.s.ID())) {
+	for tn, td := range tagDetails {
+		if converterTags != nil && !receivesTag(converterTags, tn) {
+			continue
+		}
+		if !td.Uncertain.IsSet(uint(streamID)) {
+			if td.Matches.IsSet(uint(streamID)) {
 				tags = append(tags, tn)
 			}
 			continue
@@ -2603,7 +4185,39 @@ func (c StreamContext) AllTags() ([]string, error) {
 		//TODO: figure out if the uncertain tag matches
 	}
 	sort.Strings(tags)
-	return tags, nil
+	return tags
+}
+
+func (c StreamContext) AllTags() ([]string, error) {
+	if c.v == nil {
+		return nil, fmt.Errorf("no view")
+	}
+	return streamTags(c.v.tagDetails, nil, c.s.ID()), nil
+}
+
+// ConverterTags returns the names of the tags matching the stream that are
+// sent to the converter, see Config.ConverterTags. Uncertain tags are
+// evaluated first.
+func (c StreamContext) ConverterTags(converterName string) ([]string, error) {
+	if c.v == nil {
+		return nil, fmt.Errorf("no view")
+	}
+	converterTags, ok := c.v.converterTags[converterName]
+	if !ok {
+		return []string{}, nil
+	}
+	tagNames := []string(nil)
+	for tn := range c.v.tagDetails {
+		if receivesTag(converterTags, tn) {
+			tagNames = append(tagNames, tn)
+		}
+	}
+	stream := bitmask.LongBitmask{}
+	stream.Set(uint(c.s.ID()))
+	if err := c.v.prefetchTags(context.Background(), tagNames, stream); err != nil {
+		return nil, err
+	}
+	return streamTags(c.v.tagDetails, converterTags, c.s.ID()), nil
 }
 
 func (c StreamContext) AllConverters() ([]string, error) {
@@ -2689,7 +4303,11 @@ func (mgr *Manager) Listen() (chan Event, func()) {
 				delete(mgr.listeners, ch)
 				close(ch)
 			}
-			close(l.close)
+			select {
+			case <-l.close:
+			default:
+				close(l.close)
+			}
 		}
 		<-c
 	}
@@ -1,20 +1,33 @@
 package manager
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	_ "embed"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,6 +36,8 @@ import (
 	"github.com/gopacket/gopacket/pcapgo"
 	"github.com/spq/pkappa2/internal/index/converters"
 	"github.com/spq/pkappa2/internal/query"
+	"github.com/spq/pkappa2/internal/tools/bitmask"
+	pcapoffsets "github.com/spq/pkappa2/internal/tools/pcapOffsets"
 )
 
 type (
@@ -36,6 +51,8 @@ var (
 
 	//go:embed testdata/test_converter.py
 	converterScript []byte
+	//go:embed testdata/tag_converter.py
+	tagConverterScript []byte
 )
 
 func init() {
@@ -312,6 +329,41 @@ func TestManagerRestartKeepsState(t *testing.T) {
 	defer mgr.Close()
 }
 
+func TestManagerRestartKeepsEvaluatedStreams(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	if err := mgr.AddTag("service/foo", "red", "cport:2,3"); err != nil {
+		mgr.Close()
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	importSomePackets(t, mgr, t1, "tagUpdated")
+	mgr.Close()
+	mgr = makeManager(t, dirs)
+	defer mgr.Close()
+	if got := mgr.ListTags()[0]; got.MatchingCount != 2 || got.UncertainCount != 0 {
+		t.Fatalf("Manager.ListTags()[0] = %+v, want {MatchingCount: 2, UncertainCount: 0}", got)
+	}
+}
+
+func TestStreamRanges(t *testing.T) {
+	for _, ids := range [][]uint{{}, {0}, {1, 2, 3}, {0, 2, 3, 4, 7, 100, 101}} {
+		streams := bitmask.LongBitmask{}
+		for _, id := range ids {
+			streams.Set(id)
+		}
+		if got := streamRangesBitmask(streamRanges(streams)); !got.Equal(streams) {
+			t.Fatalf("streamRangesBitmask(streamRanges(%v)) = %v, want %v", ids, got, streams)
+		}
+	}
+	streams := bitmask.LongBitmask{}
+	for _, id := range []uint{0, 2, 3, 4, 7} {
+		streams.Set(id)
+	}
+	if got, want := streamRanges(streams), [][2]uint64{{0, 0}, {2, 4}, {7, 7}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("streamRanges() = %v, want %v", got, want)
+	}
+}
+
 func TestManagerPcapOverIP(t *testing.T) {
 	dirs := makeTempdirs(t)
 	mgr := makeManager(t, dirs)
@@ -539,12 +591,36 @@ func waitForEvent(t *testing.T, listener <-chan Event, listenerCloser func(), ev
 	}
 }
 
+// waitForIdle waits until the tagging and converter jobs finished, e.g.
+// after converting streams again because their tags changed.
+func waitForIdle(t *testing.T, mgr *Manager) {
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status := mgr.Status()
+		if !status.TaggingJobRunning && !status.ConverterJobRunning {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("manager didn't become idle")
+		}
+	}
+}
+
 func TestConverters(t *testing.T) {
 	dirs := makeTempdirs(t)
 	addConverter(dirs, "foo")
 	mgr := makeManager(t, dirs)
 	defer mgr.Close()
-	if got := mgr.ListConverters(); len(got) != 1 || got[0].Name != "foo" {
+	// the native converters are always available
+	listConverters := func() []*converters.Statistics {
+		res := []*converters.Statistics(nil)
+		for _, s := range mgr.ListConverters() {
+			if !s.Native {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	if got := listConverters(); len(got) != 1 || got[0].Name != "foo" {
 		gotReadable := []converters.Statistics(nil)
 		for _, s := range got {
 			gotReadable = append(gotReadable, *s)
@@ -554,7 +630,7 @@ func TestConverters(t *testing.T) {
 	listener, listenerCloser := mgr.Listen()
 	addConverter(dirs, "bar")
 	waitForEvent(t, listener, listenerCloser, "converterAdded")
-	if got := mgr.ListConverters(); len(got) != 2 || got[0].Name != "bar" || got[1].Name != "foo" {
+	if got := listConverters(); len(got) != 2 || got[0].Name != "bar" || got[1].Name != "foo" {
 		gotReadable := []converters.Statistics(nil)
 		for _, s := range got {
 			gotReadable = append(gotReadable, *s)
@@ -573,7 +649,7 @@ func TestConverters(t *testing.T) {
 		t.Fatalf("os.Remove failed with error: %v", err)
 	}
 	waitForEvent(t, listener, nil, "converterDeleted")
-	if got := mgr.ListConverters(); len(got) != 1 || got[0].Name != "foo" {
+	if got := listConverters(); len(got) != 1 || got[0].Name != "foo" {
 		gotReadable := []converters.Statistics(nil)
 		for _, s := range got {
 			gotReadable = append(gotReadable, *s)
@@ -614,16 +690,1183 @@ func TestConverters(t *testing.T) {
 	}
 }
 
-func TestWatchDir(t *testing.T) {
+func TestNativeConverters(t *testing.T) {
 	dirs := makeTempdirs(t)
+	// executables replace native converters
+	addConverter(dirs, "base64")
 	mgr := makeManager(t, dirs)
 	defer mgr.Close()
+	nativeConverters := func() map[string]bool {
+		res := map[string]bool{}
+		for _, s := range mgr.ListConverters() {
+			res[s.Name] = s.Native
+		}
+		return res
+	}
+	if got := nativeConverters(); got["base64"] || !got["urldecode"] {
+		t.Fatalf("Manager.ListConverters() = %v, want executable base64 and native urldecode", got)
+	}
+	if err := mgr.AddRemoteConverter("urldecode", "unix:/nonexistent.sock"); err == nil || !strings.Contains(err.Error(), "built in") {
+		t.Fatalf("Manager.AddRemoteConverter(\"urldecode\") = %v, want built in error", err)
+	}
 	listener, listenerCloser := mgr.Listen()
-	_, err := writePcaps(mgr.WatchDir, []pcapOverIPPacket{
-		makeUDPPacket("1.2.3.4:1", "4.3.2.1:4321", t1.Add(time.Second*0), "foo"),
-	})
+	defer listenerCloser()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", ""); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"urldecode"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	view := mgr.GetView()
+	defer view.Release()
+	if err := view.AllStreams(context.Background(), func(sc StreamContext) error {
+		raw, err := sc.Data("")
+		if err != nil {
+			return err
+		}
+		data, err := sc.Data("urldecode")
+		if err != nil {
+			return err
+		}
+		if len(data) != 1 || !bytes.Equal(data[0].Content, raw[0].Content) {
+			return fmt.Errorf("StreamContext.Data(\"urldecode\") = %v, want %v", data, raw)
+		}
+		return nil
+	}, PrefetchTags([]string{"tag/foo"})); err != nil {
+		t.Fatalf("View.AllStreams failed with error: %v", err)
+	}
+	if err := mgr.ResetConverter("urldecode"); err != nil {
+		t.Fatalf("Manager.ResetConverter failed with error: %v", err)
+	}
+	if err := os.Remove(path.Join(dirs.converter, "base64")); err != nil {
+		t.Fatalf("os.Remove failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterAdded")
+	if got := nativeConverters(); !got["base64"] {
+		t.Fatalf("Manager.ListConverters() = %v, want native base64 after removing the executable", got)
+	}
+
+	// a new executable replaces the native converter in the tags
+	addConverter(dirs, "urldecode")
+	waitForEvent(t, listener, nil, "converterAdded")
+	if got := nativeConverters(); got["urldecode"] {
+		t.Fatalf("Manager.ListConverters() = %v, want executable urldecode", got)
+	}
+	if got := mgr.ListTags(); len(got) != 1 || !slices.Equal(got[0].Converters, []string{"urldecode"}) {
+		t.Fatalf("Manager.ListTags() = %v, want tag/foo with converter urldecode", got)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	newView := mgr.GetView()
+	defer newView.Release()
+	if err := newView.AllStreams(context.Background(), func(sc StreamContext) error {
+		data, err := sc.Data("urldecode")
+		if err != nil {
+			return err
+		}
+		if len(data) != 1 || !strings.Contains(string(data[0].Content), fmt.Sprintf("\"StreamID\": %d", sc.Stream().ID())) {
+			return fmt.Errorf("StreamContext.Data(\"urldecode\") = %v, want output of the executable", data)
+		}
+		return nil
+	}, PrefetchTags([]string{"tag/foo"})); err != nil {
+		t.Fatalf("View.AllStreams failed with error: %v", err)
+	}
+}
+
+func TestConverterTags(t *testing.T) {
+	dirs := makeTempdirs(t)
+	if err := os.WriteFile(path.Join(dirs.converter, "tagger"), tagConverterScript, 0775); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	listener, listenerCloser := mgr.Listen()
+	defer listenerCloser()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", ""); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"tagger"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	generatedTag := func() *TagInfo {
+		for _, ti := range mgr.ListTags() {
+			if ti.Name == "generated/ba" {
+				return &ti
+			}
+		}
+		return nil
+	}
+	if ti := generatedTag(); ti == nil || ti.MatchingCount != 2 {
+		t.Fatalf("generated/ba = %+v, want MatchingCount 2", ti)
+	}
+	q, err := query.Parse("generated:ba")
 	if err != nil {
-		t.Fatalf("writePcaps failed with error: %v", err)
+		t.Fatalf("query.Parse failed: %v", err)
+	}
+	view := mgr.GetView()
+	contents := []string(nil)
+	if _, _, _, err := view.SearchStreams(context.Background(), q, func(sc StreamContext) error {
+		data, err := sc.Data("")
+		if err != nil {
+			return err
+		}
+		contents = append(contents, string(data[0].Content))
+		return nil
+	}); err != nil {
+		t.Fatalf("View.SearchStreams failed with error: %v", err)
+	}
+	view.Release()
+	slices.Sort(contents)
+	if !slices.Equal(contents, []string{"bar", "baz"}) {
+		t.Fatalf("View.SearchStreams(generated:ba) returned %v, want [bar baz]", contents)
+	}
+	// detaching the converter discards its results
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter(nil)); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	if ti := generatedTag(); ti == nil || ti.MatchingCount != 0 {
+		t.Fatalf("generated/ba = %+v, want no matches", ti)
+	}
+}
+
+func TestConverterFingerprints(t *testing.T) {
+	dirs := makeTempdirs(t)
+	taggerPath := path.Join(dirs.converter, "tagger")
+	if err := os.WriteFile(taggerPath, tagConverterScript, 0775); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr := makeManager(t, dirs)
+	listener, _ := mgr.Listen()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", ""); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"tagger"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	generatedTagMatches := func() uint {
+		for _, ti := range mgr.ListTags() {
+			if ti.Name == "generated/ba" {
+				return ti.MatchingCount
+			}
+		}
+		return 0
+	}
+	if n := generatedTagMatches(); n != 2 {
+		t.Fatalf("generated/ba has %d matches, want 2", n)
+	}
+	mgr.Close()
+
+	// modify the converter while pkappa2 is not running, the streams
+	// containing "qu" are tagged now
+	modified := bytes.Replace(tagConverterScript, []byte(`b"ba" in data`), []byte(`b"qu" in data`), 1)
+	if err := os.WriteFile(taggerPath, modified, 0775); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr = makeManager(t, dirs)
+	defer mgr.Close()
+	for deadline := time.Now().Add(10 * time.Second); generatedTagMatches() != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("generated/ba has %d matches, want 1", generatedTagMatches())
+		}
+	}
+	for _, s := range mgr.ListConverters() {
+		if s.Name == "tagger" && s.CachedStreamCount != 4 {
+			t.Fatalf("converter cached %d streams, want 4", s.CachedStreamCount)
+		}
+	}
+}
+
+func TestConverterStreamMetadata(t *testing.T) {
+	dirs := makeTempdirs(t)
+	addConverter(dirs, "test")
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	for _, tc := range []struct{ name, query string }{
+		{"tag/foo", "id:0,1"},
+		{"service/web", "id:0"},
+		{"mark/bar", "id:0"},
+		{"generated/baz", "id:0"},
+	} {
+		if err := mgr.AddTag(tc.name, "red", tc.query); err != nil {
+			t.Fatalf("Manager.AddTag failed with error: %v", err)
+		}
+	}
+	type streamInfo struct {
+		StreamID                uint64
+		FirstPacket, LastPacket string
+		ClientBytes             uint64
+		ServerBytes             uint64
+		Tags, Services, Marks   []string
+		Pcaps                   []string
+	}
+	// the tags are evaluated for the stream before converting it
+	convert := func() streamInfo {
+		view := mgr.GetView()
+		defer view.Release()
+		sc, err := view.Stream(0)
+		if err != nil {
+			t.Fatalf("View.Stream failed with error: %v", err)
+		}
+		data, err := sc.Data("test")
+		if err != nil || len(data) != 1 {
+			t.Fatalf("StreamContext.Data(\"test\") = %v, %v, want 1 chunk", data, err)
+		}
+		output := struct {
+			Info streamInfo
+		}{}
+		if err := json.Unmarshal(data[0].Content, &output); err != nil {
+			t.Fatalf("json.Unmarshal failed with error: %v", err)
+		}
+		return output.Info
+	}
+	// converters only receive the tags they opted in to
+	info := convert()
+	if len(info.Tags) != 0 || len(info.Services) != 0 || len(info.Marks) != 0 {
+		t.Errorf("converter received tags %v, services %v and marks %v without opting in, want none", info.Tags, info.Services, info.Marks)
+	}
+	waitForIdle(t, mgr)
+	config := mgr.Config()
+	config.ConverterTags = map[string][]string{"test": {"tag/foo", "service/", "mark/bar", "generated/"}}
+	if err := mgr.SetConfig(config); err != nil {
+		t.Fatalf("Manager.SetConfig failed with error: %v", err)
+	}
+	info = convert()
+	if info.StreamID != 0 || info.ClientBytes != 3 || info.ServerBytes != 0 {
+		t.Errorf("converter received stream %d with %d/%d bytes, want stream 0 with 3/0 bytes", info.StreamID, info.ClientBytes, info.ServerBytes)
+	}
+	// the times are in the same format as the times of the chunks
+	if want := t1.Local().Format("2006-01-02T15:04:05"); info.FirstPacket != want || info.LastPacket != want {
+		t.Errorf("converter received packet times %q and %q, want %q", info.FirstPacket, info.LastPacket, want)
+	}
+	if !slices.Equal(info.Tags, []string{"foo"}) || !slices.Equal(info.Services, []string{"web"}) || !slices.Equal(info.Marks, []string{"bar"}) {
+		t.Errorf("converter received tags %v, services %v and marks %v, want [foo], [web] and [bar]", info.Tags, info.Services, info.Marks)
+	}
+	if len(info.Pcaps) != 1 {
+		t.Errorf("converter received pcaps %v, want one pcap", info.Pcaps)
+	}
+
+	// the cached result is dropped when the tags of the stream change
+	waitForIdle(t, mgr)
+	if err := mgr.DelTag("mark/bar"); err != nil {
+		t.Fatalf("Manager.DelTag failed with error: %v", err)
+	}
+	if info := convert(); len(info.Marks) != 0 || !slices.Equal(info.Tags, []string{"foo"}) {
+		t.Errorf("converter received tags %v and marks %v after deleting the mark, want [foo] and []", info.Tags, info.Marks)
+	}
+
+	// changes of tags the converter doesn't receive keep the cached result
+	waitForIdle(t, mgr)
+	if err := mgr.AddTag("tag/other", "red", "id:0"); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	waitForIdle(t, mgr)
+	for _, s := range mgr.ListConverters() {
+		if s.Name == "test" && s.CachedStreamCount != 1 {
+			t.Errorf("converter test has %d cached streams after adding an unrelated tag, want 1", s.CachedStreamCount)
+		}
+	}
+}
+
+func TestConverterPipelines(t *testing.T) {
+	dirs := makeTempdirs(t)
+	addConverter(dirs, "test")
+	addConverter(dirs, "test2")
+	if err := os.WriteFile(path.Join(dirs.converter, "chain.pipeline"), []byte("# decode first\nurldecode test\ntest2\n"), 0664); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	// pipelines can only consist of existing converters
+	if err := os.WriteFile(path.Join(dirs.converter, "broken.pipeline"), []byte("test missing\n"), 0664); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	stats := map[string]*converters.Statistics{}
+	for _, s := range mgr.ListConverters() {
+		stats[s.Name] = s
+	}
+	if s, ok := stats["chain"]; !ok || !slices.Equal(s.Stages, []string{"urldecode", "test", "test2"}) {
+		t.Fatalf("Manager.ListConverters() = %v, want pipeline chain with stages [urldecode test test2]", stats)
+	}
+	if _, ok := stats["broken"]; ok {
+		t.Fatalf("Manager.ListConverters() contains pipeline with unknown stage")
+	}
+	listener, listenerCloser := mgr.Listen()
+	defer listenerCloser()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", ""); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"chain"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	for _, s := range mgr.ListConverters() {
+		switch s.Name {
+		case "chain":
+			if s.CachedStreamCount != 4 {
+				t.Fatalf("Manager.ListConverters() = %+v, want 4 cached streams", *s)
+			}
+			for _, p := range s.Processes {
+				if p.Converter != "test" && p.Converter != "test2" {
+					t.Fatalf("process %+v of pipeline isn't labeled with its stage", p)
+				}
+			}
+		case "test", "test2", "urldecode":
+			// the stages don't share the cache of the pipeline
+			if s.CachedStreamCount != 0 {
+				t.Fatalf("Manager.ListConverters() = %+v, want no cached streams", *s)
+			}
+		}
+	}
+	view := mgr.GetView()
+	defer view.Release()
+	if err := view.AllStreams(context.Background(), func(sc StreamContext) error {
+		data, err := sc.Data("chain")
+		if err != nil {
+			return err
+		}
+		if len(data) != 1 {
+			return fmt.Errorf("StreamContext.Data(\"chain\") returned %d chunks, want 1", len(data))
+		}
+		type testOutput struct {
+			Converter string
+			Data      []struct {
+				Content string
+			}
+		}
+		output := testOutput{}
+		if err := json.Unmarshal(data[0].Content, &output); err != nil {
+			return err
+		}
+		if !strings.HasSuffix(output.Converter, "/test2") {
+			return fmt.Errorf("StreamContext.Data(\"chain\") was converted by %q, want test2", output.Converter)
+		}
+		// the input of every stage is the output of the previous one
+		if len(output.Data) != 1 {
+			return fmt.Errorf("stage test2 received %d chunks, want 1", len(output.Data))
+		}
+		content, err := base64.StdEncoding.DecodeString(output.Data[0].Content)
+		if err != nil {
+			return err
+		}
+		stageOutput := testOutput{}
+		if err := json.Unmarshal(content, &stageOutput); err != nil {
+			return err
+		}
+		if !strings.HasSuffix(stageOutput.Converter, "/test") {
+			return fmt.Errorf("stage test2 received the output of %q, want test", stageOutput.Converter)
+		}
+		decoded, err := sc.Data("urldecode")
+		if err != nil {
+			return err
+		}
+		if len(stageOutput.Data) != len(decoded) {
+			return fmt.Errorf("stage test received %d chunks, want the %d chunks of urldecode", len(stageOutput.Data), len(decoded))
+		}
+		for i, d := range decoded {
+			if got, want := stageOutput.Data[i].Content, base64.StdEncoding.EncodeToString(d.Content); got != want {
+				return fmt.Errorf("stage test received chunk %q, want %q", got, want)
+			}
+		}
+		return nil
+	}, PrefetchTags([]string{"tag/foo"})); err != nil {
+		t.Fatalf("View.AllStreams failed with error: %v", err)
+	}
+
+	// removing a stage removes the pipeline until the stage is back
+	if err := os.Remove(path.Join(dirs.converter, "test")); err != nil {
+		t.Fatalf("os.Remove failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterDeleted")
+	waitForEvent(t, listener, nil, "converterDeleted")
+	for _, s := range mgr.ListConverters() {
+		if s.Name == "chain" || s.Name == "test" {
+			t.Fatalf("Manager.ListConverters() contains %s after removing test", s.Name)
+		}
+	}
+	addConverter(dirs, "test")
+	waitForEvent(t, listener, nil, "converterAdded")
+	waitForEvent(t, listener, nil, "converterAdded")
+	found := false
+	for _, s := range mgr.ListConverters() {
+		found = found || s.Name == "chain"
+	}
+	if !found {
+		t.Fatalf("Manager.ListConverters() doesn't contain chain after adding test again")
+	}
+}
+
+type recordingConn struct {
+	net.Conn
+	client  bool
+	mutex   *sync.Mutex
+	packets *[]pcapOverIPPacket
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	ts := t1.Add(time.Duration(len(*c.packets)) * time.Second)
+	if c.client {
+		*c.packets = append(*c.packets, makeUDPPacket("1.2.3.4:1", "4.3.2.1:443", ts, string(b)))
+	} else {
+		*c.packets = append(*c.packets, makeUDPPacket("4.3.2.1:443", "1.2.3.4:1", ts, string(b)))
+	}
+	c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+// recordTLSSession returns the packets of a TLS connection sending ping!
+// and receiving pong! and the keylog of the connection.
+func recordTLSSession(t *testing.T) ([]pcapOverIPPacket, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey failed: %v", err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial failed: %v", err)
+	}
+	defer clientConn.Close()
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer serverConn.Close()
+
+	packets := []pcapOverIPPacket(nil)
+	mutex := sync.Mutex{}
+	keylog := bytes.Buffer{}
+	client := tls.Client(&recordingConn{clientConn, true, &mutex, &packets}, &tls.Config{
+		InsecureSkipVerify: true,
+		KeyLogWriter:       &keylog,
+	})
+	server := tls.Server(&recordingConn{serverConn, false, &mutex, &packets}, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+	})
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := io.ReadFull(server, make([]byte, 5)); err != nil {
+			errs <- err
+			return
+		}
+		_, err := server.Write([]byte("pong!"))
+		errs <- err
+	}()
+	if _, err := client.Write([]byte("ping!")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 5)); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("server failed: %v", err)
+	}
+	if client.ConnectionState().CipherSuite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		t.Skip("ChaCha20-Poly1305 was negotiated")
+	}
+	return packets, keylog.Bytes()
+}
+
+func TestTLSDecryption(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	packets, keylog := recordTLSSession(t)
+	pcaps, err := writePcaps(mgr.PcapDir, packets)
+	if err != nil {
+		t.Fatalf("writePcaps failed with error: %v", err)
+	}
+	events, eventCloser := mgr.Listen()
+	mgr.ImportPcaps(pcaps)
+	waitForEvent(t, events, eventCloser, "pcapProcessed")
+	listener, listenerCloser := mgr.Listen()
+	defer listenerCloser()
+	if err := mgr.AddTag("service/tls", "red", "sport:443"); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("service/tls", UpdateTagOperationSetConverter([]string{"tlsdecrypt"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	failedStreams := func() uint64 {
+		for _, s := range mgr.ListConverters() {
+			if s.Name == "tlsdecrypt" {
+				return s.FailedStreamCount
+			}
+		}
+		return 0
+	}
+	if n := failedStreams(); n != 1 {
+		t.Fatalf("tlsdecrypt failed for %d streams without keys, want 1", n)
+	}
+
+	// the keys are read from the keylog file once it is written
+	keylogFile := path.Join(dirs.base, "keylog.txt")
+	if err := mgr.WatchTLSKeyLogFile(keylogFile); err != nil {
+		t.Fatalf("Manager.WatchTLSKeyLogFile failed with error: %v", err)
+	}
+	if err := os.WriteFile(keylogFile, keylog, 0600); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	if n := failedStreams(); n != 0 {
+		t.Fatalf("tlsdecrypt failed for %d streams with keys, want 0", n)
+	}
+	view := mgr.GetView()
+	defer view.Release()
+	if err := view.AllStreams(context.Background(), func(sc StreamContext) error {
+		data, err := sc.Data("tlsdecrypt")
+		if err != nil {
+			return err
+		}
+		if len(data) != 2 || string(data[0].Content) != "ping!" || string(data[1].Content) != "pong!" {
+			return fmt.Errorf("StreamContext.Data(\"tlsdecrypt\") = %v, want ping! and pong!", data)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("View.AllStreams failed with error: %v", err)
+	}
+
+	// the keys are stored in the state directory
+	stored, err := os.ReadFile(path.Join(dirs.state, tlsKeysFilename))
+	if err != nil {
+		t.Fatalf("os.ReadFile failed with error: %v", err)
+	}
+	if n, err := mgr.AddTLSKeys(bytes.NewReader(stored)); err != nil || n != 0 {
+		t.Fatalf("Manager.AddTLSKeys(stored keys) = %d, %v, want no new keys", n, err)
+	}
+}
+
+func TestWatchTLSKeyLogFileConcurrently(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := mgr.WatchTLSKeyLogFile(path.Join(dirs.base, fmt.Sprintf("keylog%d.txt", i))); err != nil {
+				t.Errorf("Manager.WatchTLSKeyLogFile failed with error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	mgr.Close()
+}
+
+func TestConverterAttachToMetadataTags(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	for _, tc := range []struct {
+		name, query string
+		wantError   bool
+	}{
+		// http messages and file types are stored in the index, they
+		// don't depend on converters
+		{"tag/http", "HTTP.method:GET", false},
+		{"tag/file", "file.type:image/png", false},
+		{"tag/data", "data:GET", true},
+	} {
+		if err := mgr.AddTag(tc.name, "red", tc.query); err != nil {
+			t.Fatalf("Manager.AddTag(%q) failed with error: %v", tc.query, err)
+		}
+		err := mgr.UpdateTag(tc.name, UpdateTagOperationSetConverter([]string{"base64"}))
+		if (err != nil) != tc.wantError {
+			t.Errorf("Manager.UpdateTag(%q, SetConverter) failed with error %v, want error: %v", tc.query, err, tc.wantError)
+		}
+	}
+}
+
+func TestConverterCacheEviction(t *testing.T) {
+	dirs := makeTempdirs(t)
+	addConverter(dirs, "test")
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	listener, listenerCloser := mgr.Listen()
+	defer listenerCloser()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	for _, tc := range []struct{ name, query string }{
+		{"mark/foo", "id:0,1"},
+		{"tag/bar", "id:1"},
+	} {
+		if err := mgr.AddTag(tc.name, "red", tc.query); err != nil {
+			t.Fatalf("Manager.AddTag failed with error: %v", err)
+		}
+		if err := mgr.UpdateTag(tc.name, UpdateTagOperationSetConverter([]string{"test"})); err != nil {
+			t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+		}
+		waitForEvent(t, listener, nil, "converterCompleted")
+	}
+	cachedStreams := func() uint64 {
+		for _, s := range mgr.ListConverters() {
+			if s.Name == "test" {
+				return s.CachedStreamCount
+			}
+		}
+		return 0
+	}
+	// the content of the first stream is foo, the test converter outputs it base64 encoded
+	searchFoo := func() int {
+		q, err := query.Parse("data.test:Zm9v")
+		if err != nil {
+			t.Fatalf("query.Parse failed: %v", err)
+		}
+		view := mgr.GetView()
+		defer view.Release()
+		n := 0
+		if _, _, _, err := view.SearchStreams(context.Background(), q, func(sc StreamContext) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatalf("View.SearchStreams failed with error: %v", err)
+		}
+		return n
+	}
+	waitForIdle(t, mgr)
+	if n := cachedStreams(); n != 2 {
+		t.Fatalf("converter cached %d streams, want 2", n)
+	}
+	if n := searchFoo(); n != 1 {
+		t.Fatalf("data.test:Zm9v matched %d streams, want 1", n)
+	}
+	// stream 1 still matches tag/bar, so only the result of stream 0 is
+	// evicted, stream 1 is converted again as its tags changed
+	if err := mgr.UpdateTag("mark/foo", UpdateTagOperationMarkDelStream([]uint64{0, 1})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForIdle(t, mgr)
+	if n := cachedStreams(); n != 1 {
+		t.Fatalf("converter cached %d streams after removing them from the mark, want 1", n)
+	}
+	if n := searchFoo(); n != 0 {
+		t.Fatalf("data.test:Zm9v matched %d streams after eviction, want 0", n)
+	}
+	// detaching the converter from one of the tags evicts its streams
+	if err := mgr.UpdateTag("mark/foo", UpdateTagOperationMarkAddStream([]uint64{2})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForIdle(t, mgr)
+	if n := cachedStreams(); n != 2 {
+		t.Fatalf("converter cached %d streams, want 2", n)
+	}
+	if err := mgr.UpdateTag("mark/foo", UpdateTagOperationSetConverter(nil)); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	if n := cachedStreams(); n != 1 {
+		t.Fatalf("converter cached %d streams after detaching it, want 1", n)
+	}
+}
+
+func TestConverterLimits(t *testing.T) {
+	dirs := makeTempdirs(t)
+	// the converter never responds
+	if err := os.WriteFile(path.Join(dirs.converter, "hang"), []byte("#!/bin/sh\nexec sleep 600\n"), 0775); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	config := mgr.Config()
+	if config.ConverterLimits != converters.DefaultLimits {
+		t.Fatalf("Manager.Config().ConverterLimits = %+v, want %+v", config.ConverterLimits, converters.DefaultLimits)
+	}
+	config.ConverterLimitOverrides = map[string]converters.Limits{
+		"hang": {TimeoutSeconds: 1},
+	}
+	if err := mgr.SetConfig(config); err != nil {
+		t.Fatalf("Manager.SetConfig failed with error: %v", err)
+	}
+	listener, listenerCloser := mgr.Listen()
+	defer listenerCloser()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", ""); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"hang"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	for _, s := range mgr.ListConverters() {
+		if s.Name == "hang" && (s.CachedStreamCount != 4 || s.FailedStreamCount != 4) {
+			t.Fatalf("Manager.ListConverters() = %+v, want 4 failed streams", *s)
+		}
+	}
+	// failed streams are not converted again
+	view := mgr.GetView()
+	defer view.Release()
+	if err := view.AllStreams(context.Background(), func(sc StreamContext) error {
+		if _, err := sc.Data("hang"); !errors.Is(err, converters.ErrConversionFailed) {
+			return fmt.Errorf("StreamContext.Data(\"hang\") returned %v, want %v", err, converters.ErrConversionFailed)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("View.AllStreams failed with error: %v", err)
+	}
+}
+
+func TestConverterRefusingStreams(t *testing.T) {
+	dirs := makeTempdirs(t)
+	script := "#!/bin/sh\nwhile read metadata; do\nwhile read line && [ -n \"$line\" ]; do :; done\necho\necho '{\"Error\": \"unsupported\"}'\ndone\n"
+	if err := os.WriteFile(path.Join(dirs.converter, "refuse"), []byte(script), 0775); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	listener, listenerCloser := mgr.Listen()
+	defer listenerCloser()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", ""); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"refuse"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	for _, s := range mgr.ListConverters() {
+		if s.Name != "refuse" {
+			continue
+		}
+		if s.FailedStreamCount != 4 {
+			t.Errorf("Manager.ListConverters() = %+v, want 4 failed streams", *s)
+		}
+		// refusing a stream doesn't stop the process
+		for _, p := range s.Processes {
+			if p.LastFailure == nil || !strings.Contains(p.LastFailure.Error, "unsupported") {
+				t.Errorf("last failure = %+v, want unsupported", p.LastFailure)
+			}
+		}
+	}
+}
+
+func TestConverterRlimits(t *testing.T) {
+	dirs := makeTempdirs(t)
+	// the converter outputs the limits it was started with
+	script := "#!/bin/sh\nwhile read metadata; do\nwhile read line && [ -n \"$line\" ]; do :; done\n" +
+		"c=$(printf '%s %s' \"$(ulimit -v)\" \"$(ulimit -S -t)\" | base64 | tr -d '\\n')\n" +
+		"echo \"{\\\"Direction\\\":\\\"client-to-server\\\",\\\"Content\\\":\\\"$c\\\",\\\"Time\\\":\\\"2020-01-01T00:00:00\\\"}\"\necho\necho '{}'\ndone\n"
+	if err := os.WriteFile(path.Join(dirs.converter, "limits"), []byte(script), 0775); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	config := mgr.Config()
+	config.ConverterLimitOverrides = map[string]converters.Limits{
+		"limits": {TimeoutSeconds: 60, MaxMemoryBytes: 1 << 30, MaxCPUSeconds: 30},
+	}
+	if err := mgr.SetConfig(config); err != nil {
+		t.Fatalf("Manager.SetConfig failed with error: %v", err)
+	}
+	listener, listenerCloser := mgr.Listen()
+	defer listenerCloser()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", "id:2"); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"limits"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	view := mgr.GetView()
+	defer view.Release()
+	if err := view.AllStreams(context.Background(), func(sc StreamContext) error {
+		// the cpu time limit is raised for the following streams
+		if sc.Stream().ID() != 2 {
+			return nil
+		}
+		data, err := sc.Data("limits")
+		if err != nil {
+			return err
+		}
+		if len(data) != 1 || string(data[0].Content) != "1048576 30" {
+			return fmt.Errorf("StreamContext.Data(\"limits\") = %v, want [{Content:1048576 30}]", data)
+		}
+		return nil
+	}, PrefetchTags([]string{"tag/foo"})); err != nil {
+		t.Fatalf("View.AllStreams failed with error: %v", err)
+	}
+}
+
+func TestConverterProtocolState(t *testing.T) {
+	dirs := makeTempdirs(t)
+	// the converter reads the whole stream and exits instead of answering
+	script := "#!/bin/sh\nread metadata\nwhile read line && [ -n \"$line\" ]; do :; done\necho \"failed on $metadata\" >&2\nexit 1\n"
+	if err := os.WriteFile(path.Join(dirs.converter, "fail"), []byte(script), 0775); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	listener, listenerCloser := mgr.Listen()
+	defer listenerCloser()
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", "id:2"); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"fail"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, nil, "converterCompleted")
+	var failure *converters.Conversion
+	pid := 0
+	for _, s := range mgr.ListConverters() {
+		if s.Name != "fail" {
+			continue
+		}
+		for _, p := range s.Processes {
+			if p.LastFailure != nil {
+				failure, pid = p.LastFailure, p.Pid
+			}
+		}
+	}
+	if failure == nil {
+		t.Fatalf("Manager.ListConverters() contains no failed process")
+	}
+	if failure.StreamID != 2 || failure.State != converters.ProcessStateAwaitingOutput || !strings.Contains(failure.Error, "exited unexpectedly") {
+		t.Errorf("last failure = %+v, want stream 2 failing while awaiting output", *failure)
+	}
+	// crashes are not cached
+	for _, s := range mgr.ListConverters() {
+		if s.Name == "fail" && s.FailedStreamCount != 0 {
+			t.Errorf("Manager.ListConverters() = %+v, want no failed streams", *s)
+		}
+	}
+	stderr, err := mgr.ConverterStderr("fail", pid)
+	if err != nil {
+		t.Fatalf("Manager.ConverterStderr failed with error: %v", err)
+	}
+	if len(stderr.Conversions) != 1 {
+		t.Fatalf("Manager.ConverterStderr() = %+v, want 1 conversion", *stderr)
+	}
+	if c := stderr.Conversions[0]; c.StreamID != 2 || len(c.Stderr) != 1 || !strings.Contains(c.Stderr[0], `"StreamID":2`) {
+		t.Errorf("Manager.ConverterStderr() conversion = %+v, want stderr of stream 2", c)
+	}
+}
+
+// serveConverter is a stand-in for a converter service, it echoes the
+// chunks of the streams and appends a chunk naming the stream.
+func serveConverter(r *bufio.Reader, w io.Writer) error {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		metadata := struct{ StreamID uint64 }{}
+		if err := json.Unmarshal(line, &metadata); err != nil {
+			return err
+		}
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return err
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				break
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+		content := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("converted %d", metadata.StreamID)))
+		if _, err := fmt.Fprintf(w, "{\"Direction\":\"server-to-client\",\"Content\":%q,\"Time\":\"2020-01-01T00:00:00\"}\n\n{}\n", content); err != nil {
+			return err
+		}
+		// drain the body of http requests
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func TestRemoteConverters(t *testing.T) {
+	dirs := makeTempdirs(t)
+	// unix socket paths are limited to about 100 bytes
+	socketDir, err := os.MkdirTemp("", "pkappa2")
+	if err != nil {
+		t.Fatalf("os.MkdirTemp failed with error: %v", err)
+	}
+	defer os.RemoveAll(socketDir)
+	socketPath := path.Join(socketDir, "converter.sock")
+	socketListener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("net.Listen failed with error: %v", err)
+	}
+	defer socketListener.Close()
+	serve := func(listener net.Listener) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = serveConverter(bufio.NewReader(conn), conn)
+			}()
+		}
+	}
+	go serve(socketListener)
+	broken := atomic.Bool{}
+	broken.Store(true)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" && broken.Load() {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		response := bytes.Buffer{}
+		if err := serveConverter(bufio.NewReader(r.Body), &response); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(response.Bytes())
+	}))
+	defer httpServer.Close()
+
+	mgr := makeManager(t, dirs)
+	listener, listenerCloser := mgr.Listen()
+	if err := mgr.AddRemoteConverter("sock", "unix:"+socketPath); err != nil {
+		t.Fatalf("Manager.AddRemoteConverter failed with error: %v", err)
+	}
+	if err := mgr.AddRemoteConverter("web", httpServer.URL); err != nil {
+		t.Fatalf("Manager.AddRemoteConverter failed with error: %v", err)
+	}
+	if err := mgr.AddRemoteConverter("web", httpServer.URL); err == nil {
+		t.Errorf("Manager.AddRemoteConverter succeeded for an existing name, want error")
+	}
+	if err := mgr.AddRemoteConverter("ftp", "ftp://localhost"); err == nil {
+		t.Errorf("Manager.AddRemoteConverter succeeded for an ftp url, want error")
+	}
+	if err := mgr.AddRemoteConverter("public", "http://192.0.2.1:8080/"); err == nil {
+		t.Errorf("Manager.AddRemoteConverter succeeded for a host that isn't loopback, want error")
+	}
+	want := map[string]string{"sock": "unix:" + socketPath, "web": httpServer.URL}
+	if got := mgr.ListRemoteConverters(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Manager.ListRemoteConverters() = %v, want %v", got, want)
+	}
+	importSomePackets(t, mgr, t1, "pcapProcessed")
+	if err := mgr.AddTag("tag/foo", "red", ""); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	if err := mgr.UpdateTag("tag/foo", UpdateTagOperationSetConverter([]string{"sock", "web"})); err != nil {
+		t.Fatalf("Manager.UpdateTag failed with error: %v", err)
+	}
+	waitForEvent(t, listener, listenerCloser, "converterCompleted")
+	checkConverted := func(mgr *Manager, converterNames ...string) {
+		view := mgr.GetView()
+		defer view.Release()
+		if err := view.AllStreams(context.Background(), func(sc StreamContext) error {
+			for _, name := range converterNames {
+				data, err := sc.Data(name)
+				if err != nil {
+					return err
+				}
+				want := fmt.Sprintf("converted %d", sc.Stream().ID())
+				if len(data) == 0 || !strings.HasSuffix(string(data[len(data)-1].Content), want) {
+					return fmt.Errorf("StreamContext.Data(%q) = %v, want chunks ending with %q", name, data, want)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("View.AllStreams failed with error: %v", err)
+		}
+	}
+	checkConverted(mgr, "sock", "web")
+
+	// failing to talk to a service fails the conversion, it is retried
+	// once the service is back
+	missingSocketPath := path.Join(socketDir, "missing.sock")
+	if err := mgr.AddRemoteConverter("down", "unix:"+missingSocketPath); err != nil {
+		t.Fatalf("Manager.AddRemoteConverter failed with error: %v", err)
+	}
+	if err := mgr.AddRemoteConverter("broken", httpServer.URL+"/broken"); err != nil {
+		t.Fatalf("Manager.AddRemoteConverter failed with error: %v", err)
+	}
+	view := mgr.GetView()
+	stream, err := view.Stream(0)
+	if err != nil {
+		t.Fatalf("View.Stream failed with error: %v", err)
+	}
+	for name, want := range map[string]string{"down": "failed to connect", "broken": "500 Internal Server Error"} {
+		if _, err := stream.Data(name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("StreamContext.Data(%q) failed with error %v, want %s", name, err, want)
+		}
+	}
+	missingSocketListener, err := net.Listen("unix", missingSocketPath)
+	if err != nil {
+		t.Fatalf("net.Listen failed with error: %v", err)
+	}
+	defer missingSocketListener.Close()
+	go serve(missingSocketListener)
+	broken.Store(false)
+	for _, name := range []string{"down", "broken"} {
+		if data, err := stream.Data(name); err != nil || len(data) == 0 || !strings.HasSuffix(string(data[len(data)-1].Content), "converted 0") {
+			t.Errorf("StreamContext.Data(%q) = %v, %v after the service is back, want converted stream", name, data, err)
+		}
+	}
+	view.Release()
+	for _, name := range []string{"down", "broken"} {
+		if err := mgr.DelRemoteConverter(name); err != nil {
+			t.Fatalf("Manager.DelRemoteConverter failed with error: %v", err)
+		}
+	}
+	for _, s := range mgr.ListConverters() {
+		if s.Address != want[s.Name] {
+			t.Errorf("Manager.ListConverters() address of %s = %q, want %q", s.Name, s.Address, want[s.Name])
+		}
+	}
+
+	if err := mgr.DelRemoteConverter("sock"); err != nil {
+		t.Fatalf("Manager.DelRemoteConverter failed with error: %v", err)
+	}
+	if err := mgr.DelRemoteConverter("base64"); err == nil {
+		t.Errorf("Manager.DelRemoteConverter succeeded for a native converter, want error")
+	}
+	if got := mgr.ListTags(); len(got) != 1 || !reflect.DeepEqual(got[0].Converters, []string{"web"}) {
+		t.Fatalf("Manager.ListTags() = %v, want [{Converters: [web]}]", got)
+	}
+	mgr.Close()
+
+	// the converter services are registered again after a restart and
+	// can be used in pipelines
+	if err := os.WriteFile(path.Join(dirs.converter, "remote.pipeline"), []byte("web\n"), 0664); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	mgr = makeManager(t, dirs)
+	defer mgr.Close()
+	delete(want, "sock")
+	if got := mgr.ListRemoteConverters(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Manager.ListRemoteConverters() = %v, want %v", got, want)
+	}
+	checkConverted(mgr, "web", "remote")
+}
+
+func TestWatchDir(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	listener, listenerCloser := mgr.Listen()
+	_, err := writePcaps(mgr.WatchDir, []pcapOverIPPacket{
+		makeUDPPacket("1.2.3.4:1", "4.3.2.1:4321", t1.Add(time.Second*0), "foo"),
+	})
+	if err != nil {
+		t.Fatalf("writePcaps failed with error: %v", err)
+	}
+	waitForEvent(t, listener, listenerCloser, "pcapArrived")
+}
+
+func TestRetention(t *testing.T) {
+	dirs := makeTempdirs(t)
+	mgr := makeManager(t, dirs)
+	defer mgr.Close()
+	if err := mgr.AddTag("tag/foo", "red", "cport:1,2,3,4"); err != nil {
+		t.Fatalf("Manager.AddTag failed with error: %v", err)
+	}
+	now := time.Now()
+	oldPcaps, err := writePcaps(mgr.PcapDir, []pcapOverIPPacket{
+		makeUDPPacket("1.2.3.4:1", "4.3.2.1:4321", now.Add(-2*time.Hour), "foo"),
+		makeUDPPacket("1.2.3.4:2", "4.3.2.1:4321", now.Add(-2*time.Hour+time.Second), "bar"),
+	})
+	if err != nil {
+		t.Fatalf("writePcaps failed with error: %v", err)
+	}
+	newPcaps, err := writePcaps(mgr.PcapDir, []pcapOverIPPacket{
+		// continues the stream of the old pcap, it is dropped with it
+		makeUDPPacket("1.2.3.4:2", "4.3.2.1:4321", now.Add(-2*time.Hour+2*time.Second), "continued"),
+		makeUDPPacket("1.2.3.4:3", "4.3.2.1:4321", now.Add(-time.Minute), "baz"),
+		makeUDPPacket("1.2.3.4:4", "4.3.2.1:4321", now.Add(-time.Minute+time.Second), "qux"),
+	})
+	if err != nil {
+		t.Fatalf("writePcaps failed with error: %v", err)
+	}
+	events, eventsCloser := mgr.Listen()
+	mgr.ImportPcaps(oldPcaps)
+	waitForEvent(t, events, nil, "pcapProcessed")
+	mgr.ImportPcaps(newPcaps)
+	waitForEvent(t, events, nil, "pcapProcessed")
+	if _, err := os.Stat(pcapoffsets.Filename(path.Join(mgr.PcapDir, oldPcaps[0]))); err != nil {
+		t.Errorf("offset table of pcap %q was not created: %v", oldPcaps[0], err)
+	}
+
+	if err := mgr.SetConfig(Config{RetentionMaxAge: 3600}); err != nil {
+		t.Fatalf("Manager.SetConfig failed with error: %v", err)
+	}
+	waitForEvent(t, events, eventsCloser, "pcapsDropped")
+
+	status := mgr.Status()
+	if status.PcapCount != 1 || status.StreamRecordCount != 2 {
+		t.Errorf("Status() = %+v, want 1 pcap and 2 stream records", status)
+	}
+	if status.Retention.DroppedPcapCount != 1 || status.Retention.DroppedStreamCount != 2 || status.Retention.FreedBytes <= 0 {
+		t.Errorf("Status().Retention = %+v, want 1 dropped pcap and 2 dropped streams", status.Retention)
+	}
+	if _, err := os.Stat(path.Join(mgr.PcapDir, oldPcaps[0])); !os.IsNotExist(err) {
+		t.Errorf("pcap %q was not deleted: %v", oldPcaps[0], err)
+	}
+	if _, err := os.Stat(pcapoffsets.Filename(path.Join(mgr.PcapDir, oldPcaps[0]))); !os.IsNotExist(err) {
+		t.Errorf("offset table of pcap %q was not deleted: %v", oldPcaps[0], err)
+	}
+	if got := mgr.ListTags()[0]; got.MatchingCount != 2 {
+		t.Errorf("Manager.ListTags()[0] = %+v, want {MatchingCount: 2}", got)
+	}
+	v := mgr.GetView()
+	defer v.Release()
+	ids := []uint64(nil)
+	if err := v.AllStreams(context.Background(), func(c StreamContext) error {
+		ids = append(ids, c.Stream().ID())
+		return nil
+	}); err != nil {
+		t.Fatalf("View.AllStreams failed with error: %v", err)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []uint64{2, 3}) {
+		t.Errorf("View.AllStreams() = %v, want [2 3]", ids)
+	}
+	// new tags are only evaluated on the remaining streams
+	c := make(chan bitmask.LongBitmask)
+	mgr.jobs <- func() {
+		c <- mgr.allStreams.Copy()
+	}
+	if got := <-c; got.OnesCount() != 2 || !got.IsSet(2) || !got.IsSet(3) {
+		t.Errorf("Manager.allStreams = %v, want [2 3]", got)
+	}
+}
+
+func TestVerifyState(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.state.json")
+	if err := os.WriteFile(fn, []byte(`{"Tags": [
+		{"Name": "tag/a", "Definition": "tag:b"},
+		{"Name": "tag/b", "Definition": "tag:a"},
+		{"Name": "tag/c", "Definition": "tag:d"},
+		{"Name": "mark/e", "Definition": "port:80"},
+		{"Name": "tag/f", "Definition": "mark:e"}
+	], "PcapOverIPEndpoints": ["localhost"]}`), 0644); err != nil {
+		t.Fatalf("WriteFile failed with error: %v", err)
+	}
+	got := []string{}
+	for _, p := range VerifyState(fn) {
+		got = append(got, p.Error())
+	}
+	want := []string{
+		`tag "mark/e": 'mark' or 'generated' tag is malformed`,
+		`tag "tag/c": references non-existing tag "tag/d"`,
+		`tag "tag/a": contains cycle`,
+		`tag "tag/b": contains cycle`,
+		`pcap-over-ip host "localhost": address localhost: missing port in address`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VerifyState() = %q, want %q", got, want)
 	}
-	waitForEvent(t, listener, listenerCloser, "pcapArrived")
 }
@@ -0,0 +1,16 @@
+#!/usr/bin/python3
+import base64
+import json
+import sys
+
+# returns the tag "ba" for all streams containing "ba"
+lines = []
+while 1:
+    line = sys.stdin.readline().strip()
+    if line != "":
+        lines.append(json.loads(line))
+        continue
+    data = b"".join(base64.b64decode(l["Content"]) for l in lines[1:])
+    print()
+    print(json.dumps({"Tags": ["ba"]} if b"ba" in data else {}), flush=True)
+    lines = []
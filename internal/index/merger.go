@@ -5,9 +5,21 @@ import (
 	"os"
 
 	"github.com/spq/pkappa2/internal/tools"
+	"github.com/spq/pkappa2/internal/tools/bitmask"
 )
 
 func Merge(indexDir string, indexes []*Reader) ([]*Reader, error) {
+	return merge(indexDir, indexes, nil)
+}
+
+// Prune rewrites the indexes without the given streams. The result might
+// contain fewer indexes than the input or none at all if all streams were
+// removed.
+func Prune(indexDir string, indexes []*Reader, streams *bitmask.LongBitmask) ([]*Reader, error) {
+	return merge(indexDir, indexes, streams)
+}
+
+func merge(indexDir string, indexes []*Reader, excludedStreams *bitmask.LongBitmask) ([]*Reader, error) {
 	ws := []*Writer{}
 	rs := []*Reader{}
 	err := func() error {
@@ -24,7 +36,7 @@ func Merge(indexDir string, indexes []*Reader) ([]*Reader, error) {
 				}
 				w := ws[wIdx]
 
-				added, err := w.AddIndex(idx)
+				added, err := w.addIndex(idx, excludedStreams)
 				if err != nil {
 					return err
 				}
@@ -33,7 +45,18 @@ func Merge(indexDir string, indexes []*Reader) ([]*Reader, error) {
 				}
 			}
 		}
-		for _, w := range ws {
+		for wIdx := 0; wIdx < len(ws); wIdx++ {
+			w := ws[wIdx]
+			if len(w.streams) == 0 {
+				// all streams were excluded
+				if err := w.Close(); err != nil {
+					return err
+				}
+				os.Remove(w.filename)
+				ws = append(ws[:wIdx], ws[wIdx+1:]...)
+				wIdx--
+				continue
+			}
 			r, err := w.Finalize()
 			if err != nil {
 				return err
@@ -5,6 +5,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/spq/pkappa2/internal/tools/bitmask"
 )
 
 func TestMerge(t *testing.T) {
@@ -122,3 +124,67 @@ func TestMerge(t *testing.T) {
 		t.Errorf("Close failed with error: %v", err)
 	}
 }
+
+func TestPrune(t *testing.T) {
+	tmpDir := t.TempDir()
+	t1, err := time.Parse(time.RFC3339, "2020-01-01T12:00:00Z")
+	if err != nil {
+		t.Fatalf("time.Parse failed with error: %v", err)
+	}
+	idx, err := makeIndex(tmpDir, map[uint64]streamInfo{
+		0: makeStream("1.2.3.4:1", "5.6.7.8:9", t1.Add(time.Hour*1), []string{"Lorem", "ipsum"}),
+		1: makeStream("1.2.3.4:2", "5.6.7.8:8", t1.Add(time.Hour*2), []string{"dolor", "sit"}),
+		2: makeStream("1.2.3.4:3", "5.6.7.8:7", t1.Add(time.Hour*3), []string{"amet", "consectetur"}),
+	}, nil)
+	if err != nil {
+		t.Fatalf("makeIndex failed with error: %v", err)
+	}
+	pcaps := map[string]struct{}{}
+	for _, id := range []uint64{0, 2} {
+		s, err := idx.StreamByID(id)
+		if err != nil {
+			t.Fatalf("StreamByID failed with error: %v", err)
+		}
+		packets, err := s.Packets()
+		if err != nil {
+			t.Fatalf("Packets failed with error: %v", err)
+		}
+		pcaps[packets[0].PcapFilename] = struct{}{}
+	}
+	streams, err := idx.StreamsFromPcaps(pcaps)
+	if err != nil {
+		t.Fatalf("StreamsFromPcaps failed with error: %v", err)
+	}
+	if streams.OnesCount() != 2 || !streams.IsSet(0) || !streams.IsSet(2) {
+		t.Fatalf("StreamsFromPcaps() = %v, want streams 0 and 2", streams.Mask())
+	}
+
+	pruned, err := Prune(tmpDir, []*Reader{idx}, &streams)
+	if err != nil {
+		t.Fatalf("Prune failed with error: %v", err)
+	}
+	if len(pruned) != 1 {
+		t.Fatalf("Expected 1 pruned index, but got %d", len(pruned))
+	}
+	if got := pruned[0].StreamCount(); got != 1 {
+		t.Errorf("StreamCount() = %d, want 1", got)
+	}
+	if s, err := pruned[0].StreamByID(1); err != nil || s == nil {
+		t.Errorf("StreamByID(1) = %v, %v", s, err)
+	}
+	if len(pruned[0].imports) != 1 {
+		t.Errorf("len(imports) = %d, want 1", len(pruned[0].imports))
+	}
+
+	all := bitmask.LongBitmask{}
+	for i := uint(0); i < 3; i++ {
+		all.Set(i)
+	}
+	pruned, err = Prune(tmpDir, pruned, &all)
+	if err != nil {
+		t.Fatalf("Prune failed with error: %v", err)
+	}
+	if len(pruned) != 0 {
+		t.Errorf("Expected no pruned index, but got %d", len(pruned))
+	}
+}
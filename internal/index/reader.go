@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -14,6 +15,8 @@ import (
 	"sort"
 	"time"
 	"unsafe"
+
+	"github.com/spq/pkappa2/internal/tools/bitmask"
 )
 
 type (
@@ -33,6 +36,18 @@ type (
 		header     fileHeader
 		imports    []readerImportEntry
 		hostGroups []readerHostGroup
+		dataBlocks []dataBlockEntry
+		// httpMessages is set if the data of HTTP streams is followed by
+		// the positions of their requests and responses
+		httpMessages bool
+		// fileTypes is set if the data of streams containing files is
+		// followed by the MIME types of the files
+		fileTypes bool
+		// filePositions is set if the MIME types are part of the positions
+		// of the files
+		filePositions bool
+		// mapped contains the whole file if it could be mapped into memory
+		mapped []byte
 
 		ReferenceTime time.Time
 		packetID,
@@ -50,6 +65,9 @@ type (
 		index uint32
 	}
 	Direction int
+	// ChunkKind tells whether a chunk of converter output is part of the
+	// converted traffic or only informative.
+	ChunkKind uint8
 	Packet    struct {
 		Timestamp    time.Time
 		PcapFilename string
@@ -60,7 +78,8 @@ type (
 		Direction   Direction
 		Content     []byte
 		Time        time.Time
-		ContentType string `json:",omitempty"`
+		ContentType string    `json:",omitempty"`
+		Kind        ChunkKind `json:",omitempty"`
 	}
 )
 
@@ -69,12 +88,72 @@ const (
 	DirectionServerToClient Direction = 1
 
 	ChunkSplitThreshold = 50 * time.Millisecond
+
+	// ChunkKindData chunks contain the converted traffic.
+	ChunkKindData ChunkKind = 0
+	// ChunkKindInfo chunks contain informative output like a script
+	// reproducing the stream, they are not searched by `data` queries.
+	ChunkKindInfo ChunkKind = 1
+	// ChunkKindAnnotation chunks contain remarks about the surrounding
+	// chunks, they are not searched by `data` queries.
+	ChunkKindAnnotation ChunkKind = 2
+)
+
+var (
+	chunkKindNames = map[ChunkKind]string{
+		ChunkKindData:       "data",
+		ChunkKindInfo:       "info",
+		ChunkKindAnnotation: "annotation",
+	}
 )
 
 func (dir Direction) Reverse() Direction {
 	return dir ^ DirectionClientToServer ^ DirectionServerToClient
 }
 
+// Informative returns whether chunks of this kind are not part of the
+// converted traffic.
+func (kind ChunkKind) Informative() bool {
+	return kind != ChunkKindData
+}
+
+// DataChunks returns the chunks of data that are part of the converted
+// traffic, dropping informative chunks.
+func DataChunks(data []Data) []Data {
+	res := make([]Data, 0, len(data))
+	for _, d := range data {
+		if !d.Kind.Informative() {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+func (kind ChunkKind) String() string {
+	if name, ok := chunkKindNames[kind]; ok {
+		return name
+	}
+	return fmt.Sprintf("ChunkKind(%d)", kind)
+}
+
+func (kind ChunkKind) MarshalText() ([]byte, error) {
+	name, ok := chunkKindNames[kind]
+	if !ok {
+		return nil, fmt.Errorf("invalid chunk kind %d", kind)
+	}
+	return []byte(name), nil
+}
+
+func (kind *ChunkKind) UnmarshalText(text []byte) error {
+	for k, name := range chunkKindNames {
+		if name == string(text) {
+			*kind = k
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid chunk kind %q", text)
+}
+
 func (hg *readerHostGroup) get(id uint16) net.IP {
 	return net.IP(hg.hosts[hg.hostSize*int(id):][:hg.hostSize])
 }
@@ -83,12 +162,25 @@ func (r *Reader) Filename() string {
 	return r.filename
 }
 
+// Size returns the size of the index file in bytes.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
 func (r *Reader) calculateOffset(section section, objectSize, index int) int64 {
 	return int64(r.header.Sections[section].Begin) + int64(objectSize*index)
 }
 
+// readerAt returns the mapped file if available, the file otherwise.
+func (r *Reader) readerAt() io.ReaderAt {
+	if r.mapped != nil {
+		return bytes.NewReader(r.mapped)
+	}
+	return r.file
+}
+
 func (r *Reader) readAt(offset int64, d interface{}) error {
-	s := io.NewSectionReader(r.file, offset, r.size-offset)
+	s := io.NewSectionReader(r.readerAt(), offset, r.size-offset)
 	err := binary.Read(s, binary.LittleEndian, d)
 	if err != nil {
 		debug.PrintStack()
@@ -96,14 +188,34 @@ func (r *Reader) readAt(offset int64, d interface{}) error {
 	return err
 }
 
-var isLittleEndian bool
+var (
+	isLittleEndian bool
+	// useMmap enables mapping index files into memory where supported
+	useMmap = true
+)
 
 func init() {
 	isLittleEndian = binary.NativeEndian.Uint16([]byte("AB")) == binary.LittleEndian.Uint16([]byte("AB"))
 }
 
+// readMapped copies the record at the offset out of the mapped file, it
+// returns false if the file isn't mapped. Records are copied as they
+// might not be aligned and have to stay valid after Close.
+func readMapped[T stream | packet](r *Reader, offset int64, obj *T) bool {
+	size := int64(unsafe.Sizeof(*obj))
+	if r.mapped == nil || !isLittleEndian || offset < 0 || offset+size > int64(len(r.mapped)) {
+		return false
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(obj)), size), r.mapped[offset:])
+	return true
+}
+
 func (r *Reader) streamByIndex(index uint32) (*stream, error) {
 	obj := stream{}
+	offset := r.calculateOffset(sectionStreams, int(unsafe.Sizeof(obj)), int(index))
+	if readMapped(r, offset, &obj) {
+		return &obj, nil
+	}
 	var err error
 	var d interface{}
 	if isLittleEndian {
@@ -111,12 +223,16 @@ func (r *Reader) streamByIndex(index uint32) (*stream, error) {
 	} else {
 		d = obj
 	}
-	err = r.readAt(r.calculateOffset(sectionStreams, int(unsafe.Sizeof(obj)), int(index)), d)
+	err = r.readAt(offset, d)
 	return &obj, err
 }
 
 func (r *Reader) packetByIndex(index uint64) (*packet, error) {
 	obj := packet{}
+	offset := r.calculateOffset(sectionPackets, int(unsafe.Sizeof(obj)), int(index))
+	if readMapped(r, offset, &obj) {
+		return &obj, nil
+	}
 	var err error
 	var d interface{}
 	if isLittleEndian {
@@ -124,11 +240,14 @@ func (r *Reader) packetByIndex(index uint64) (*packet, error) {
 	} else {
 		d = obj
 	}
-	err = r.readAt(r.calculateOffset(sectionPackets, int(unsafe.Sizeof(obj)), int(index)), d)
+	err = r.readAt(offset, d)
 	return &obj, err
 }
 
 func (r *Reader) readLookup(lookup section, index int) (uint32, error) {
+	if offset := r.calculateOffset(lookup, 4, index); r.mapped != nil && offset+4 <= int64(len(r.mapped)) {
+		return binary.LittleEndian.Uint32(r.mapped[offset:]), nil
+	}
 	streamIndex := uint32(0)
 	err := r.readAt(r.calculateOffset(lookup, 4, index), &streamIndex)
 	return streamIndex, err
@@ -143,6 +262,14 @@ func (r *Reader) objectCount(section section, objectSize int) int {
 }
 
 func (r *Reader) Close() error {
+	if r.mapped != nil {
+		mapped := r.mapped
+		r.mapped = nil
+		if err := munmapFile(mapped); err != nil {
+			r.file.Close()
+			return err
+		}
+	}
 	return r.file.Close()
 }
 
@@ -157,14 +284,40 @@ func NewReader(filename string) (*Reader, error) {
 		size:               int64(unsafe.Sizeof(fileHeader{})),
 		containedStreamIds: make(map[uint64]uint32),
 	}
+	// map the whole file if possible, fall back to reading the file otherwise
+	if useMmap {
+		if fi, err := file.Stat(); err == nil && fi.Size() > 0 && fi.Size() == int64(int(fi.Size())) {
+			if mapped, err := mmapFile(file, fi.Size()); err == nil {
+				r.mapped = mapped
+			}
+		}
+	}
 
 	if err := func() error {
 		// read header
-		if err := r.readAt(0, &r.header); err != nil {
+		magic := [len(fileMagic)]byte{}
+		if err := r.readAt(0, &magic); err != nil {
 			return err
 		}
-		if string(r.header.Magic[:]) != fileMagic {
-			return fmt.Errorf("wrong magic: %q, expected %q", string(r.header.Magic[:]), fileMagic)
+		switch string(magic[:]) {
+		case fileMagic, fileMagicV5, fileMagicV4, fileMagicV3:
+			if err := r.readAt(0, &r.header); err != nil {
+				return err
+			}
+			r.httpMessages = string(magic[:]) != fileMagicV3
+			r.fileTypes = string(magic[:]) == fileMagic || string(magic[:]) == fileMagicV5
+			r.filePositions = string(magic[:]) == fileMagic
+		case fileMagicV2:
+			// v2 files store the data section uncompressed
+			header := fileHeaderV2{}
+			if err := r.readAt(0, &header); err != nil {
+				return err
+			}
+			r.header.Magic = header.Magic
+			r.header.FirstPacketTime = header.FirstPacketTime
+			copy(r.header.Sections[:], header.Sections[:])
+		default:
+			return fmt.Errorf("wrong magic: %q, expected %q", string(magic[:]), fileMagic)
 		}
 		for _, s := range r.header.Sections {
 			if uint64(r.size) < s.End {
@@ -172,6 +325,17 @@ func NewReader(filename string) (*Reader, error) {
 			}
 		}
 
+		// read data blocks
+		if string(magic[:]) != fileMagicV2 {
+			r.dataBlocks = make([]dataBlockEntry, r.header.Sections[sectionDataBlocks].size()/int64(unsafe.Sizeof(dataBlockEntry{})))
+			if len(r.dataBlocks) == 0 {
+				return errors.New("data block section is empty")
+			}
+			if err := r.readObjects(sectionDataBlocks, r.dataBlocks); err != nil {
+				return err
+			}
+		}
+
 		// read imports
 		importFilenames := make([]byte, r.header.Sections[sectionImportFilenames].size())
 		if err := r.readObjects(sectionImportFilenames, importFilenames); err != nil {
@@ -406,6 +570,41 @@ func (r *Reader) StreamByFirstPacketSource(pcapFilename string, packetIndex uint
 	return s.wrap(r, streamIndex)
 }
 
+// StreamsFromPcaps returns the ids of all streams that contain at least
+// one packet from one of the given pcap files.
+func (r *Reader) StreamsFromPcaps(pcapFilenames map[string]struct{}) (bitmask.LongBitmask, error) {
+	streams := bitmask.LongBitmask{}
+	importIDs := map[uint32]struct{}{}
+	for i, imp := range r.imports {
+		if _, ok := pcapFilenames[imp.filename]; ok {
+			importIDs[uint32(i)] = struct{}{}
+		}
+	}
+	if len(importIDs) == 0 {
+		return streams, nil
+	}
+	for sIdx, sCount := 0, r.StreamCount(); sIdx < sCount; sIdx++ {
+		s, err := r.streamByIndex(uint32(sIdx))
+		if err != nil {
+			return bitmask.LongBitmask{}, err
+		}
+		for pIdx := uint64(s.PacketInfoStart); ; pIdx++ {
+			p, err := r.packetByIndex(pIdx)
+			if err != nil {
+				return bitmask.LongBitmask{}, err
+			}
+			if _, ok := importIDs[p.ImportID]; ok {
+				streams.Set(uint(s.StreamID))
+				break
+			}
+			if p.Flags&flagsPacketHasNext == 0 {
+				break
+			}
+		}
+	}
+	return streams, nil
+}
+
 func (s *Stream) ID() uint64 {
 	return s.StreamID
 }
@@ -470,7 +669,7 @@ func (s *Stream) Packets() ([]Packet, error) {
 
 func (s *Stream) Data() ([]Data, error) {
 	off := int64(s.PacketInfoStart) * int64(unsafe.Sizeof(packet{}))
-	sr := io.NewSectionReader(s.r.file, int64(s.r.header.Sections[sectionPackets].Begin)+off, s.r.header.Sections[sectionPackets].size()-off)
+	sr := io.NewSectionReader(s.r.readerAt(), int64(s.r.header.Sections[sectionPackets].Begin)+off, s.r.header.Sections[sectionPackets].size()-off)
 	br := bufio.NewReader(sr)
 	p := packet{}
 	refTime := s.FirstPacket()
@@ -516,7 +715,7 @@ func (s *Stream) Data() ([]Data, error) {
 		}
 	}
 	data := []Data{}
-	sr = io.NewSectionReader(s.r.file, int64(s.r.header.Sections[sectionData].Begin+s.DataStart), s.r.header.Sections[sectionData].size()-int64(s.DataStart))
+	sr = io.NewSectionReader(s.r.dataReader(), int64(s.DataStart), s.r.dataSize()-int64(s.DataStart))
 	br = bufio.NewReader(sr)
 
 	content := [2][]byte{}
@@ -640,7 +839,7 @@ func (r *Reader) AllStreams(handler func(*Stream) error) error {
 
 func (r *Reader) sectionReader(section section) *io.SectionReader {
 	s := r.header.Sections[section]
-	return io.NewSectionReader(r.file, int64(s.Begin), s.size())
+	return io.NewSectionReader(r.readerAt(), int64(s.Begin), s.size())
 }
 
 func (d *Data) MarshalJSON() ([]byte, error) {
@@ -648,14 +847,16 @@ func (d *Data) MarshalJSON() ([]byte, error) {
 		return json.Marshal(struct {
 			Direction   Direction
 			Content     []byte
-			ContentType string `json:",omitempty"`
-		}{Direction: d.Direction, Content: d.Content, ContentType: d.ContentType})
+			ContentType string    `json:",omitempty"`
+			Kind        ChunkKind `json:",omitempty"`
+		}{Direction: d.Direction, Content: d.Content, ContentType: d.ContentType, Kind: d.Kind})
 	} else {
 		return json.Marshal(struct {
 			Direction   Direction
 			Content     []byte
 			Time        time.Time
-			ContentType string `json:",omitempty"`
-		}{Direction: d.Direction, Content: d.Content, Time: d.Time, ContentType: d.ContentType})
+			ContentType string    `json:",omitempty"`
+			Kind        ChunkKind `json:",omitempty"`
+		}{Direction: d.Direction, Content: d.Content, Time: d.Time, ContentType: d.ContentType, Kind: d.Kind})
 	}
 }
@@ -3,6 +3,7 @@ package index
 import (
 	"bytes"
 	"fmt"
+	"runtime"
 	"testing"
 	"time"
 
@@ -191,3 +192,35 @@ func TestLongPackets(t *testing.T) {
 		}
 	}
 }
+
+func TestReaderWithoutMmap(t *testing.T) {
+	idx, err := makeIndex(t.TempDir(), map[uint64]streamInfo{
+		0: makeStream("1.2.3.4:1234", "4.3.2.1:4321", t1, []string{"foo"}),
+	}, nil)
+	if err != nil {
+		t.Fatalf("makeIndex failed: %v", err)
+	}
+	if runtime.GOOS == "linux" && idx.mapped == nil {
+		t.Errorf("Reader.mapped = nil, want mapped file")
+	}
+	// records are copied out of the mapped file, so they stay valid after
+	// it was unmapped
+	stream, err := idx.StreamByID(0)
+	if err != nil {
+		t.Fatalf("Reader.StreamByID failed: %v", err)
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatalf("Reader.Close failed: %v", err)
+	}
+	if stream.ClientPort != 1234 || stream.ServerPort != 4321 {
+		t.Errorf("Stream ports after Close = %d, %d, want 1234, 4321", stream.ClientPort, stream.ServerPort)
+	}
+
+	useMmap = false
+	defer func() {
+		useMmap = true
+	}()
+	t.Run("Reader", TestReader)
+	t.Run("LongPackets", TestLongPackets)
+	t.Run("DataBlocks", TestDataBlocks)
+}
@@ -7,8 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"runtime"
 	"slices"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/spq/pkappa2/internal/query"
@@ -17,8 +19,8 @@ import (
 
 type (
 	ConverterAccess interface {
-		Data(stream *Stream, moreDetails bool) (data []Data, clientBytes, serverBytes uint64, wasCached bool, err error)
-		DataForSearch(streamID uint64) ([2][]byte, [][2]int, uint64, uint64, bool, error)
+		Data(stream *Stream, streamTags []string, moreDetails bool) (data []Data, clientBytes, serverBytes uint64, wasCached bool, err error)
+		DataForSearch(streamID uint64, informative bool) ([2][]byte, [][2]int, uint64, uint64, bool, error)
 	}
 	subQuerySelection struct {
 		remaining []map[string]bitmask.ConnectedBitmask
@@ -93,6 +95,9 @@ func (sqs *subQuerySelection) empty() bool {
 }
 
 var (
+	// maxParallelIndexSearches limits the number of indexes searched concurrently
+	maxParallelIndexSearches = runtime.NumCPU()
+
 	alwaysSuccess = ([]func(sc *searchContext, s *stream) (bool, error))(nil)
 	alwaysFail    = []func(sc *searchContext, s *stream) (bool, error){
 		func(sc *searchContext, s *stream) (bool, error) {
@@ -134,6 +139,8 @@ func (r *Reader) buildSearchObjects(subQuery string, queryPartIndex int, previou
 	minIDFilter, maxIDFilter := uint64(0), uint64(math.MaxUint64)
 	hostConditionBitmaps := [][]uint64(nil)
 	dcc := dataConditionsContainer{}
+	httpConditions := []*query.HTTPCondition(nil)
+	fileConditions := []*query.FileCondition(nil)
 conditions:
 	for _, c := range *q {
 		c := c
@@ -738,7 +745,29 @@ conditions:
 			if err := dcc.add(cc, subQuery, previousResults); err != nil {
 				return queryPart{}, err
 			}
+		case *query.HTTPCondition:
+			if cc.SubQuery == subQuery {
+				httpConditions = append(httpConditions, cc)
+			}
+		case *query.FileCondition:
+			if cc.SubQuery == subQuery {
+				fileConditions = append(fileConditions, cc)
+			}
+		}
+	}
+	if len(httpConditions) != 0 {
+		filter, err := r.makeHTTPConditionFilter(httpConditions)
+		if err != nil {
+			return queryPart{}, err
 		}
+		filters = append(filters, filter)
+	}
+	if len(fileConditions) != 0 {
+		filter, err := r.makeFileConditionFilter(fileConditions)
+		if err != nil {
+			return queryPart{}, err
+		}
+		filters = append(filters, filter)
 	}
 	if minIDFilter == maxIDFilter {
 		idx, ok := r.containedStreamIds[minIDFilter]
@@ -1069,7 +1098,7 @@ func SearchStreams(ctx context.Context, indexes []*Reader, limitIDs *bitmask.Lon
 			limitIDs = nil
 		}
 
-		for idxIdx := len(indexes) - 1; idxIdx >= 0; idxIdx-- {
+		searchIndex := func(ctx context.Context, idxIdx int, result *resultData) error {
 			idx := indexes[idxIdx]
 
 			sortingLookup := (func() ([]uint32, error))(nil)
@@ -1101,14 +1130,55 @@ func SearchStreams(ctx context.Context, indexes []*Reader, limitIDs *bitmask.Lon
 				//build search structures
 				queryPart, err := idx.buildSearchObjects(subQuery, qID, allResults, refTime, &qs[qID], indexes[idxIdx+1:], limitIDs, tagDetails, converters)
 				if err != nil {
-					return nil, false, nil, err
+					return err
 				}
 				queryParts = append(queryParts, queryPart)
 			}
-			err := idx.searchStreams(ctx, &results, allResults, queryParts, groupingData, sorter, resultLimit, sortingLookup)
-			if err != nil {
+			return idx.searchStreams(ctx, result, allResults, queryParts, groupingData, sorter, resultLimit, sortingLookup)
+		}
+
+		if len(indexes) == 1 {
+			if err := searchIndex(ctx, 0, &results); err != nil {
 				return nil, false, nil, err
 			}
+		} else {
+			// search the indexes in parallel, each one into its own result,
+			// the newest indexes are started first as they are merged first
+			indexResults := make([]resultData, len(indexes))
+			indexErrors := make([]error, len(indexes))
+			workerCtx, cancel := context.WithCancel(ctx)
+			work := make(chan int, len(indexes))
+			for idxIdx := len(indexes) - 1; idxIdx >= 0; idxIdx-- {
+				indexResults[idxIdx].matchingQueryPart = make([]bitmask.ConnectedBitmask, len(qs))
+				work <- idxIdx
+			}
+			close(work)
+			wg := sync.WaitGroup{}
+			for range min(maxParallelIndexSearches, len(indexes)) {
+				wg.Go(func() {
+					for idxIdx := range work {
+						if err := searchIndex(workerCtx, idxIdx, &indexResults[idxIdx]); err != nil {
+							indexErrors[idxIdx] = err
+							cancel()
+						}
+					}
+				})
+			}
+			wg.Wait()
+			cancel()
+			if err := ctx.Err(); err != nil {
+				return nil, false, nil, err
+			}
+			for _, err := range indexErrors {
+				if err != nil && !errors.Is(err, context.Canceled) {
+					return nil, false, nil, err
+				}
+			}
+			// merge deterministically from the newest to the oldest index,
+			// this results in the same order as a sequential search
+			for idxIdx := len(indexes) - 1; idxIdx >= 0; idxIdx-- {
+				results.merge(&indexResults[idxIdx], groupingData, sorter, resultLimit)
+			}
 		}
 		if len(results.streams) == 0 {
 			return nil, false, nil, nil
@@ -1126,6 +1196,164 @@ func SearchStreams(ctx context.Context, indexes []*Reader, limitIDs *bitmask.Lon
 	return results.streams[skip:], results.resultDropped != 0, dataRegexes, nil
 }
 
+// add inserts a stream into the result, replacing either the entry of its
+// group at groupPos or the last entry if the limit is reached. It returns
+// true if the stream was dropped because the limit was reached.
+func (result *resultData) add(ss *Stream, groupKey []byte, groupPos int, matchingQueryParts bitmask.ShortBitmask, vdv []variableDataValue, grouper *grouper, sortingLess func(a, b *Stream) bool, limit uint) bool {
+	replacePos := groupPos
+	if groupPos == -1 {
+		if limit == 0 || uint(len(result.streams)) < limit {
+			// we have no limit or the limit is not yet reached
+			replacePos = len(result.streams)
+			result.streams = append(result.streams, nil)
+		} else if sortingLess != nil && sortingLess(ss, result.streams[limit-1]) {
+			// we have a limit but we are better than the last
+			replacePos = len(result.streams) - 1
+		} else {
+			// we have a limit and are worse than the last
+			result.resultDropped++
+			return true
+		}
+	}
+
+	if r := &result.streams[replacePos]; *r != nil {
+		if groupPos != -1 {
+			// we should replace the group slot
+			delete(result.groups, string(groupKey))
+		} else if grouper != nil {
+			// we should replace the last slot
+			delete(result.groups, string(grouper.key(*r)))
+		}
+		if d, ok := result.variableAssociation[(*r).StreamID]; ok {
+			result.variableData[d].uses--
+			delete(result.variableAssociation, (*r).StreamID)
+		}
+		for i := range result.matchingQueryPart {
+			result.matchingQueryPart[i].Extract(uint(replacePos))
+		}
+		*r = nil
+		if groupPos == -1 {
+			result.resultDropped++
+		}
+	}
+	// replacePos now points to the position of a nil slot that we can use
+
+	// insert the result at the right place
+	insertPos := replacePos
+	if sortingLess != nil {
+		insertPos = sort.Search(len(result.streams)-1, func(i int) bool {
+			if i >= replacePos {
+				i++
+			}
+			return sortingLess(ss, result.streams[i])
+		})
+		if replacePos < insertPos {
+			insertPos++
+			for ; replacePos < insertPos; replacePos++ {
+				result.streams[replacePos] = result.streams[replacePos+1]
+			}
+		} else if replacePos > insertPos {
+			for ; replacePos > insertPos; replacePos-- {
+				result.streams[replacePos] = result.streams[replacePos-1]
+			}
+		}
+	}
+	result.streams[insertPos] = ss
+
+	if grouper != nil {
+		if result.groups == nil {
+			result.groups = make(map[string]int)
+		}
+		result.groups[string(groupKey)] = insertPos
+	}
+
+	for qpIdx := range result.matchingQueryPart {
+		result.matchingQueryPart[qpIdx].Inject(uint(insertPos), matchingQueryParts.IsSet(uint(qpIdx)))
+	}
+
+	if len(vdv) == 0 {
+		return false
+	}
+	if result.variableAssociation == nil {
+		result.variableAssociation = make(map[uint64]int)
+	}
+	freeSlot := len(result.variableData)
+varData:
+	for i := range result.variableData {
+		d := &result.variableData[i]
+		if d.uses == 0 {
+			freeSlot = i
+		}
+		if len(d.data) != len(vdv) {
+			continue
+		}
+		for j := range vdv {
+			if vdv[j].name != d.data[j].name {
+				continue varData
+			}
+			if vdv[j].value != d.data[j].value {
+				continue varData
+			}
+			if !vdv[j].queryParts.Equal(d.data[j].queryParts) {
+				continue varData
+			}
+		}
+		d.uses++
+		result.variableAssociation[ss.StreamID] = i
+		return false
+	}
+	if freeSlot == len(result.variableData) {
+		result.variableData = append(result.variableData, variableDataCollection{})
+	}
+	result.variableData[freeSlot] = variableDataCollection{
+		uses: 1,
+		data: vdv,
+	}
+	result.variableAssociation[ss.StreamID] = freeSlot
+	return false
+}
+
+// merge adds all streams of the result of a single index to the result,
+// the indexes have to be merged from the newest to the oldest one.
+func (result *resultData) merge(other *resultData, grouper *grouper, sortingLess func(a, b *Stream) bool, limit uint) {
+	result.resultDropped += other.resultDropped
+	// the group keys might contain variables, so take them from the other result
+	groupKeys := make([]string, len(other.streams))
+	for k, pos := range other.groups {
+		groupKeys[pos] = k
+	}
+	for pos, ss := range other.streams {
+		groupKey := []byte(nil)
+		groupPos := -1
+		if grouper != nil {
+			groupKey = []byte(groupKeys[pos])
+			if p, ok := result.groups[groupKeys[pos]]; ok {
+				if sortingLess == nil || !sortingLess(ss, result.streams[p]) {
+					if len(grouper.vars) != 0 {
+						result.resultDropped++
+					}
+					continue
+				}
+				groupPos = p
+			}
+		}
+		matchingQueryParts := bitmask.ShortBitmask{}
+		for qpIdx := range other.matchingQueryPart {
+			if other.matchingQueryPart[qpIdx].IsSet(uint(pos)) {
+				matchingQueryParts.Set(uint(qpIdx))
+			}
+		}
+		vdv := []variableDataValue(nil)
+		if d, ok := other.variableAssociation[ss.StreamID]; ok {
+			vdv = other.variableData[d].data
+		}
+		if result.add(ss, groupKey, groupPos, matchingQueryParts, vdv, grouper, sortingLess, limit) {
+			// the other result is sorted, so all remaining streams would be dropped as well
+			return
+		}
+	}
+}
+
 func (r *Reader) searchStreams(ctx context.Context, result *resultData, subQueryResults map[string]resultData, queryParts []queryPart, grouper *grouper, sortingLess func(a, b *Stream) bool, limit uint, sortingLookup func() ([]uint32, error)) error {
 	// apply filters to lookup results or all streams, if no lookups could be used
 	filterAndAddToResult := func(activeQueryParts bitmask.ShortBitmask, si uint32) (bool, error) {
@@ -1236,78 +1464,9 @@ func (r *Reader) searchStreams(ctx context.Context, result *resultData, subQuery
 			}
 		}
 
-		replacePos := groupPos
-		if groupPos == -1 {
-			if limit == 0 || uint(len(result.streams)) < limit {
-				// we have no limit or the limit is not yet reached
-				replacePos = len(result.streams)
-				result.streams = append(result.streams, nil)
-			} else if sortingLess != nil && sortingLess(ss, result.streams[limit-1]) {
-				// we have a limit but we are better than the last
-				replacePos = len(result.streams) - 1
-			} else {
-				// we have a limit and are worse than the last
-				result.resultDropped++
-				return true, nil
-			}
-		}
-
-		if r := &result.streams[replacePos]; *r != nil {
-			if groupPos != -1 {
-				// we should replace the group slot
-				delete(result.groups, string(groupKey))
-			} else if grouper != nil {
-				// we should replace the last slot
-				delete(result.groups, string(grouper.key(*r)))
-			}
-			if d, ok := result.variableAssociation[(*r).StreamID]; ok {
-				result.variableData[d].uses--
-				delete(result.variableAssociation, (*r).StreamID)
-			}
-			for i := range result.matchingQueryPart {
-				result.matchingQueryPart[i].Extract(uint(replacePos))
-			}
-			*r = nil
-			if groupPos == -1 {
-				result.resultDropped++
-			}
-		}
-		// replacePos now points to the position of a nil slot that we can use
-
-		// insert the result at the right place
-		insertPos := replacePos
-		if sortingLess != nil {
-			insertPos = sort.Search(len(result.streams)-1, func(i int) bool {
-				if i >= replacePos {
-					i++
-				}
-				return sortingLess(ss, result.streams[i])
-			})
-			if replacePos < insertPos {
-				insertPos++
-				for ; replacePos < insertPos; replacePos++ {
-					result.streams[replacePos] = result.streams[replacePos+1]
-				}
-			} else if replacePos > insertPos {
-				for ; replacePos > insertPos; replacePos-- {
-					result.streams[replacePos] = result.streams[replacePos-1]
-				}
-			}
-		}
-		result.streams[insertPos] = ss
-
-		if grouper != nil {
-			if result.groups == nil {
-				result.groups = make(map[string]int)
-			}
-			result.groups[string(groupKey)] = insertPos
-		}
-
 		vdv := []variableDataValue(nil)
 		for scIdx, qpIdx, qpLen := -1, 0, matchingQueryParts.Len(); qpIdx < qpLen; qpIdx++ {
-			matching := matchingQueryParts.IsSet(uint(qpIdx))
-			result.matchingQueryPart[qpIdx].Inject(uint(insertPos), matching)
-			if !matching {
+			if !matchingQueryParts.IsSet(uint(qpIdx)) {
 				continue
 			}
 			scIdx++
@@ -1339,9 +1498,6 @@ func (r *Reader) searchStreams(ctx context.Context, result *resultData, subQuery
 				}
 			}
 		}
-		if len(vdv) == 0 {
-			return false, nil
-		}
 		sort.Slice(vdv, func(i, j int) bool {
 			a, b := &vdv[i], &vdv[j]
 			if a.name != b.name {
@@ -1349,43 +1505,7 @@ func (r *Reader) searchStreams(ctx context.Context, result *resultData, subQuery
 			}
 			return a.value < b.value
 		})
-		if result.variableAssociation == nil {
-			result.variableAssociation = make(map[uint64]int)
-		}
-		freeSlot := len(result.variableData)
-	varData:
-		for i := range result.variableData {
-			d := &result.variableData[i]
-			if d.uses == 0 {
-				freeSlot = i
-			}
-			if len(d.data) != len(vdv) {
-				continue
-			}
-			for j := range vdv {
-				if vdv[j].name != d.data[j].name {
-					continue varData
-				}
-				if vdv[j].value != d.data[j].value {
-					continue varData
-				}
-				if !vdv[j].queryParts.Equal(d.data[j].queryParts) {
-					continue varData
-				}
-			}
-			d.uses++
-			result.variableAssociation[s.StreamID] = i
-			return false, nil
-		}
-		if freeSlot == len(result.variableData) {
-			result.variableData = append(result.variableData, variableDataCollection{})
-		}
-		result.variableData[freeSlot] = variableDataCollection{
-			uses: 1,
-			data: vdv,
-		}
-		result.variableAssociation[s.StreamID] = freeSlot
-		return false, nil
+		return result.add(ss, groupKey, groupPos, matchingQueryParts, vdv, grouper, sortingLess, limit), nil
 	}
 
 	// check if all queries use lookups, if not don't use lookups
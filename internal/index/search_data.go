@@ -97,16 +97,23 @@ func (dcc *dataConditionsContainer) add(cc *query.DataCondition, subQuery string
 		return nil
 	}
 	converterName := cc.Elements[0].ConverterName
+	informative := cc.Elements[0].Flags & query.DataRequirementSequenceFlagsInformative
 	if len(dcc.conditions) != 0 {
 		if converterName != dcc.conditions[0].Elements[0].ConverterName {
 			return errors.New("all data conditions must have the same converter name")
 		}
+		if informative != dcc.conditions[0].Elements[0].Flags&query.DataRequirementSequenceFlagsInformative {
+			return errors.New("data and info conditions can't be combined")
+		}
 	}
 	shouldEvaluate, affectsSubquery := false, false
 	for _, e := range cc.Elements {
 		if e.ConverterName != converterName {
 			return errors.New("all data conditions must have the same converter name")
 		}
+		if e.Flags&query.DataRequirementSequenceFlagsInformative != informative {
+			return errors.New("data and info conditions can't be combined")
+		}
 		if e.SubQuery != subQuery {
 			if _, ok := previousResults[e.SubQuery]; !ok {
 				return nil
@@ -178,6 +185,7 @@ func (dcc *dataConditionsContainer) finalize(r *Reader, queryPartIndex int, prev
 		return alwaysSuccess, nil
 	}
 	converterName := dcc.conditions[0].Elements[0].ConverterName
+	informative := dcc.conditions[0].Elements[0].Flags&query.DataRequirementSequenceFlagsInformative != 0
 	if converterName != "" && converterName != "none" {
 		if _, ok := converters[converterName]; !ok {
 			return nil, fmt.Errorf("converter %q not found", converterName)
@@ -434,7 +442,7 @@ func (dcc *dataConditionsContainer) finalize(r *Reader, queryPartIndex int, prev
 
 	dataSources := []func(s *stream) ([][2]int, [2][]byte, error)(nil)
 	if converterName == "" || converterName == "none" {
-		br := seekbufio.NewSeekableBufferReader(r.sectionReader(sectionData))
+		br := seekbufio.NewSeekableBufferReader(r.dataReader())
 		buffers := [2][]byte{nil, nil}
 		bufferLengths := [][2]int{{}}
 		dataSources = append(dataSources, func(s *stream) ([][2]int, [2][]byte, error) {
@@ -497,7 +505,7 @@ func (dcc *dataConditionsContainer) finalize(r *Reader, queryPartIndex int, prev
 			converter := converters[c]
 			dataSources = append(dataSources, func(s *stream) ([][2]int, [2][]byte, error) {
 				// TODO: pass `buffers` through to DataForSearch to avoid re-allocating?
-				data, dataSizes, _, _, wasCached, err := converter.DataForSearch(s.StreamID)
+				data, dataSizes, _, _, wasCached, err := converter.DataForSearch(s.StreamID, informative)
 				if err != nil {
 					return nil, [2][]byte{}, fmt.Errorf("data for search %w", err)
 				}
@@ -0,0 +1,261 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/spq/pkappa2/internal/query"
+	filecarver "github.com/spq/pkappa2/internal/tools/fileCarver"
+	"github.com/spq/pkappa2/internal/tools/seekbufio"
+	"rsc.io/binaryregexp"
+)
+
+// The files carved from a stream are found while building the index.
+// Streams containing files are flagged with flagsStreamFiles, their data is
+// followed by the segmentation, the positions of the HTTP messages and the
+// list of files: the number of files, then for every file its direction,
+// the start and size of the raw data it was carved from, the index of its
+// multipart part, the size of its content and the length and content of
+// its source, MIME type and name, all numbers as uvarints. v5 indexes only
+// contain the distinct MIME types, older indexes don't contain anything.
+
+type (
+	// File is a file carved from the data of a stream.
+	File struct {
+		Name      string
+		MIMEType  string
+		Source    filecarver.Source
+		Direction Direction
+		Size      uint64
+		// the raw data the file was carved from in the data sent in its
+		// direction and the multipart part within it
+		rawStart, rawSize, part uint64
+	}
+)
+
+// carveFiles returns the files in the data sent by the client and server.
+func carveFiles(client, server []byte) []File {
+	files := []File(nil)
+	for _, f := range filecarver.Carve([2][]byte{client, server}) {
+		files = append(files, File{
+			Name:      f.Name,
+			MIMEType:  f.MIMEType,
+			Source:    f.Source,
+			Direction: Direction(f.Direction),
+			Size:      uint64(len(f.Data)),
+			rawStart:  uint64(f.Start),
+			rawSize:   uint64(f.End - f.Start),
+			part:      uint64(f.Part),
+		})
+	}
+	return files
+}
+
+// fileTypes returns the sorted distinct MIME types of the files.
+func fileTypes(files []File) []string {
+	types := []string(nil)
+	for _, f := range files {
+		types = append(types, f.MIMEType)
+	}
+	slices.Sort(types)
+	return slices.Compact(types)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readString(br *byteReader) (string, error) {
+	l, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, l)
+	if _, err := io.ReadFull(br, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// appendFiles appends the list of files to buf.
+func appendFiles(buf []byte, files []File) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(files)))
+	for _, f := range files {
+		buf = binary.AppendUvarint(buf, uint64(f.Direction))
+		buf = binary.AppendUvarint(buf, f.rawStart)
+		buf = binary.AppendUvarint(buf, f.rawSize)
+		buf = binary.AppendUvarint(buf, f.part)
+		buf = binary.AppendUvarint(buf, f.Size)
+		buf = appendString(buf, string(f.Source))
+		buf = appendString(buf, f.MIMEType)
+		buf = appendString(buf, f.Name)
+	}
+	return buf
+}
+
+// readFiles reads a list of files written by appendFiles.
+func readFiles(br *byteReader) ([]File, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	files := []File(nil)
+	for ; n != 0; n-- {
+		f := File{}
+		numbers := [5]uint64{}
+		for i := range numbers {
+			if numbers[i], err = binary.ReadUvarint(br); err != nil {
+				return nil, err
+			}
+		}
+		f.Direction = Direction(numbers[0])
+		f.rawStart, f.rawSize, f.part, f.Size = numbers[1], numbers[2], numbers[3], numbers[4]
+		source := ""
+		for _, s := range []*string{&source, &f.MIMEType, &f.Name} {
+			if *s, err = readString(br); err != nil {
+				return nil, err
+			}
+		}
+		f.Source = filecarver.Source(source)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// readFileTypes reads the list of MIME types of a stream of a v5 index.
+func readFileTypes(br *byteReader) ([]string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	types := []string(nil)
+	for ; n != 0; n-- {
+		t, err := readString(br)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// seekStreamFiles positions the reader at the files of a stream, it returns
+// nil if the stream doesn't contain files.
+func seekStreamFiles(br *seekbufio.SeekableBufferReader, s *stream) (*byteReader, error) {
+	if s.Flags&flagsStreamFiles == 0 {
+		return nil, nil
+	}
+	if _, err := br.Seek(int64(s.DataStart+s.ClientBytes+s.ServerBytes), io.SeekStart); err != nil {
+		return nil, err
+	}
+	bbr := &byteReader{Reader: br}
+	if err := skipSegmentation(bbr, s.ClientBytes+s.ServerBytes); err != nil {
+		return nil, err
+	}
+	if s.Flags&flagsStreamSegmentation == flagsStreamSegmentationHTTP {
+		if _, err := readHTTPMessages(bbr); err != nil {
+			return nil, err
+		}
+	}
+	return bbr, nil
+}
+
+// streamFiles returns the files of a stream, they are carved from the
+// stream data for indexes older than v6.
+func (r *Reader) streamFiles(br *seekbufio.SeekableBufferReader, s *stream, buffers *[2][]byte) ([]File, error) {
+	if !r.filePositions {
+		if err := readStreamData(br, s, buffers); err != nil {
+			return nil, err
+		}
+		return carveFiles(buffers[DirectionClientToServer], buffers[DirectionServerToClient]), nil
+	}
+	bbr, err := seekStreamFiles(br, s)
+	if bbr == nil || err != nil {
+		return nil, err
+	}
+	return readFiles(bbr)
+}
+
+// Files returns the files carved from the data of the stream.
+func (s *Stream) Files() ([]File, error) {
+	br := seekbufio.NewSeekableBufferReader(s.r.dataReader())
+	return s.r.streamFiles(br, &s.stream, &[2][]byte{})
+}
+
+// FileData returns the content of a file of the stream, only the raw data
+// the file was carved from is read.
+func (s *Stream) FileData(f File) ([]byte, error) {
+	start, end := s.DataStart, s.DataStart+s.ClientBytes
+	if f.Direction == DirectionServerToClient {
+		start, end = end, end+s.ServerBytes
+	}
+	if f.rawStart+f.rawSize > end-start {
+		return nil, fmt.Errorf("file %q is outside of the stream data", f.Name)
+	}
+	raw := make([]byte, f.rawSize)
+	if _, err := s.r.dataReader().ReadAt(raw, int64(start+f.rawStart)); err != nil {
+		return nil, err
+	}
+	data := filecarver.Extract(raw, f.Source, int(f.part))
+	if data == nil {
+		return nil, fmt.Errorf("unable to extract file %q", f.Name)
+	}
+	return data, nil
+}
+
+// makeFileConditionFilter returns a filter evaluating all file conditions of
+// a query part against the MIME types of the files of the stream.
+func (r *Reader) makeFileConditionFilter(conditions []*query.FileCondition) (func(*searchContext, *stream) (bool, error), error) {
+	regexes := []*binaryregexp.Regexp(nil)
+	needsFiles := false
+	for _, c := range conditions {
+		re, err := binaryregexp.Compile("^(?:" + c.Regex + ")$")
+		if err != nil {
+			return nil, err
+		}
+		regexes = append(regexes, re)
+		needsFiles = needsFiles || !c.Inverted
+	}
+	br := seekbufio.NewSeekableBufferReader(r.dataReader())
+	buffers := [2][]byte{}
+	return func(_ *searchContext, s *stream) (bool, error) {
+		types := []string(nil)
+		if r.fileTypes && s.Flags&flagsStreamFiles == 0 && needsFiles {
+			// streams without files can't match
+			return false, nil
+		}
+		if r.fileTypes && !r.filePositions {
+			bbr, err := seekStreamFiles(br, s)
+			if err != nil {
+				return false, err
+			}
+			if bbr != nil {
+				if types, err = readFileTypes(bbr); err != nil {
+					return false, err
+				}
+			}
+		} else {
+			files, err := r.streamFiles(br, s, &buffers)
+			if err != nil {
+				return false, err
+			}
+			types = fileTypes(files)
+		}
+		for i, c := range conditions {
+			matched := false
+			for _, t := range types {
+				if regexes[i].MatchString(t) {
+					matched = true
+					break
+				}
+			}
+			if matched == c.Inverted {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, nil
+}
@@ -0,0 +1,272 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/spq/pkappa2/internal/query"
+	httpmessages "github.com/spq/pkappa2/internal/tools/httpMessages"
+	"github.com/spq/pkappa2/internal/tools/seekbufio"
+	"rsc.io/binaryregexp"
+)
+
+// readStreamData reads the client and server data of a stream into
+// buffers, reusing their memory.
+func readStreamData(br *seekbufio.SeekableBufferReader, s *stream, buffers *[2][]byte) error {
+	if _, err := br.Seek(int64(s.DataStart), io.SeekStart); err != nil {
+		return err
+	}
+	for dir, l := range [2]uint64{s.ClientBytes, s.ServerBytes} {
+		if uint64(cap(buffers[dir])) < l {
+			buffers[dir] = make([]byte, l)
+		}
+		buffers[dir] = buffers[dir][:l]
+		if err := binary.Read(br, binary.LittleEndian, buffers[dir]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The data of HTTP streams is followed by the positions of their requests
+// and responses, so the http filters only have to read the headers. Both
+// lists start with the number of messages, every message is stored as its
+// distance to the end of the previous message, the size of its header and
+// the size of its body, all as uvarints. Indexes older than v4 don't
+// contain the positions.
+
+// byteReader reads single bytes from a buffered reader.
+type byteReader struct {
+	io.Reader
+	buf [1]byte
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(br.Reader, br.buf[:])
+	return br.buf[0], err
+}
+
+// appendHTTPMessages parses the client and server data of a HTTP stream
+// and appends the positions of the requests and responses to buf.
+func appendHTTPMessages(buf []byte, client, server []byte) []byte {
+	requests, responses := httpmessages.Parse(client, server)
+	messages := [2][]httpmessages.Message{}
+	for _, r := range requests {
+		messages[DirectionClientToServer] = append(messages[DirectionClientToServer], r.Message)
+	}
+	for _, r := range responses {
+		messages[DirectionServerToClient] = append(messages[DirectionServerToClient], r.Message)
+	}
+	return appendHTTPMessagePositions(buf, messages)
+}
+
+// appendHTTPMessagePositions appends the positions of the requests and
+// responses to buf.
+func appendHTTPMessagePositions(buf []byte, messages [2][]httpmessages.Message) []byte {
+	for _, l := range messages {
+		buf = binary.AppendUvarint(buf, uint64(len(l)))
+		end := 0
+		for _, m := range l {
+			buf = binary.AppendUvarint(buf, uint64(m.Start-end))
+			buf = binary.AppendUvarint(buf, uint64(m.HeaderEnd-m.Start))
+			buf = binary.AppendUvarint(buf, uint64(m.End-m.HeaderEnd))
+			end = m.End
+		}
+	}
+	return buf
+}
+
+// readHTTPMessages reads the positions of the requests and responses, the
+// headers of the messages are not set.
+func readHTTPMessages(br io.ByteReader) ([2][]httpmessages.Message, error) {
+	messages := [2][]httpmessages.Message{}
+	for dir := range messages {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return messages, err
+		}
+		end := uint64(0)
+		for ; n != 0; n-- {
+			v := [3]uint64{}
+			for i := range v {
+				if v[i], err = binary.ReadUvarint(br); err != nil {
+					return messages, err
+				}
+			}
+			m := httpmessages.Message{
+				Start: int(end + v[0]),
+			}
+			m.HeaderEnd = m.Start + int(v[1])
+			m.End = m.HeaderEnd + int(v[2])
+			messages[dir] = append(messages[dir], m)
+			end = uint64(m.End)
+		}
+	}
+	return messages, nil
+}
+
+// skipSegmentation reads the segmentation of the stream data, count is the
+// number of bytes sent by the client and server.
+func skipSegmentation(br io.ByteReader, count uint64) error {
+	for count != 0 {
+		sz := uint64(0)
+		for {
+			b, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			sz <<= 7
+			sz |= uint64(b & 0x7f)
+			if b < 0x80 {
+				break
+			}
+		}
+		if sz > count {
+			return errors.New("invalid segmentation")
+		}
+		count -= sz
+	}
+	return nil
+}
+
+// readHTTPHeaders reads the headers of the requests and responses of a HTTP
+// stream of a v4 index, the bodies are not read.
+func readHTTPHeaders(br *seekbufio.SeekableBufferReader, s *stream, wantRequests, wantResponses bool) ([]httpmessages.Request, []httpmessages.Response, error) {
+	if _, err := br.Seek(int64(s.DataStart+s.ClientBytes+s.ServerBytes), io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	bbr := &byteReader{Reader: br}
+	if err := skipSegmentation(bbr, s.ClientBytes+s.ServerBytes); err != nil {
+		return nil, nil, err
+	}
+	messages, err := readHTTPMessages(bbr)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := []byte(nil)
+	readHeader := func(start uint64, m httpmessages.Message) ([]byte, error) {
+		if _, err := br.Seek(int64(start)+int64(m.Start), io.SeekStart); err != nil {
+			return nil, err
+		}
+		header = slices.Grow(header[:0], m.HeaderEnd-m.Start)[:m.HeaderEnd-m.Start]
+		_, err := io.ReadFull(br, header)
+		return header, err
+	}
+	requests, responses := []httpmessages.Request(nil), []httpmessages.Response(nil)
+	for _, m := range messages[DirectionClientToServer] {
+		if !wantRequests {
+			break
+		}
+		h, err := readHeader(s.DataStart, m)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := httpmessages.ParseRequestHeader(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		requests = append(requests, req)
+	}
+	for _, m := range messages[DirectionServerToClient] {
+		if !wantResponses {
+			break
+		}
+		h, err := readHeader(s.DataStart+s.ClientBytes, m)
+		if err != nil {
+			return nil, nil, err
+		}
+		res, err := httpmessages.ParseResponseHeader(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		responses = append(responses, res)
+	}
+	return requests, responses, nil
+}
+
+// makeHTTPConditionFilter returns a filter evaluating all http conditions of
+// a query part, the requests and responses are only parsed for streams
+// that were detected as HTTP while building the index.
+func (r *Reader) makeHTTPConditionFilter(conditions []*query.HTTPCondition) (func(*searchContext, *stream) (bool, error), error) {
+	regexes := []*binaryregexp.Regexp(nil)
+	for _, c := range conditions {
+		re, err := binaryregexp.Compile("^(?:" + c.Regex + ")$")
+		if err != nil {
+			return nil, err
+		}
+		regexes = append(regexes, re)
+	}
+	wantRequests, wantResponses := false, false
+	for _, c := range conditions {
+		switch c.Field {
+		case query.HTTPConditionFieldStatus:
+			wantResponses = true
+		case query.HTTPConditionFieldHeader:
+			wantRequests = true
+			wantResponses = true
+		default:
+			wantRequests = true
+		}
+	}
+	br := seekbufio.NewSeekableBufferReader(r.dataReader())
+	buffers := [2][]byte{}
+	return func(_ *searchContext, s *stream) (bool, error) {
+		requests, responses := []httpmessages.Request(nil), []httpmessages.Response(nil)
+		if s.Flags&flagsStreamSegmentation == flagsStreamSegmentationHTTP {
+			if r.httpMessages {
+				var err error
+				if requests, responses, err = readHTTPHeaders(br, s, wantRequests, wantResponses); err != nil {
+					return false, err
+				}
+			} else {
+				// older indexes require parsing the whole stream
+				if err := readStreamData(br, s, &buffers); err != nil {
+					return false, err
+				}
+				requests, responses = httpmessages.Parse(buffers[DirectionClientToServer], buffers[DirectionServerToClient])
+			}
+		}
+		for i, c := range conditions {
+			values := []string(nil)
+			switch c.Field {
+			case query.HTTPConditionFieldMethod:
+				for _, req := range requests {
+					values = append(values, req.Method)
+				}
+			case query.HTTPConditionFieldPath:
+				for _, req := range requests {
+					values = append(values, req.Target)
+				}
+			case query.HTTPConditionFieldHost:
+				for _, req := range requests {
+					values = append(values, req.Host)
+				}
+			case query.HTTPConditionFieldStatus:
+				for _, res := range responses {
+					values = append(values, strconv.Itoa(res.StatusCode))
+				}
+			case query.HTTPConditionFieldHeader:
+				for _, req := range requests {
+					values = append(values, req.Header[c.Header]...)
+				}
+				for _, res := range responses {
+					values = append(values, res.Header[c.Header]...)
+				}
+			}
+			matched := false
+			for _, v := range values {
+				if regexes[i].MatchString(v) {
+					matched = true
+					break
+				}
+			}
+			if matched == c.Inverted {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, nil
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -140,11 +143,11 @@ func makeIndex(tmpDir string, streams map[uint64]streamInfo, converters *map[str
 	return r, nil
 }
 
-func (c *fakeConverter) Data(stream *Stream, moreDetails bool) (data []Data, clientBytes, serverBytes uint64, wasCached bool, err error) {
+func (c *fakeConverter) Data(stream *Stream, streamTags []string, moreDetails bool) (data []Data, clientBytes, serverBytes uint64, wasCached bool, err error) {
 	return nil, 0, 0, false, nil
 }
 
-func (c *fakeConverter) DataForSearch(streamID uint64) ([2][]byte, [][2]int, uint64, uint64, bool, error) {
+func (c *fakeConverter) DataForSearch(streamID uint64, informative bool) ([2][]byte, [][2]int, uint64, uint64, bool, error) {
 	const (
 		C2S = query.DataRequirementSequenceFlagsDirectionClientToServer / query.DataRequirementSequenceFlagsDirection
 		S2C = query.DataRequirementSequenceFlagsDirectionServerToClient / query.DataRequirementSequenceFlagsDirection
@@ -158,8 +161,12 @@ func (c *fakeConverter) DataForSearch(streamID uint64) ([2][]byte, [][2]int, uin
 	dataSizes := [][2]int{{}}
 	dir := C2S
 	for _, s := range d {
-		data[dir] = append(data[dir], []byte(s)...)
-		dataSizes = append(dataSizes, [2]int{len(data[0]), len(data[1])})
+		// chunks prefixed with "info:" are informative
+		content, isInfo := strings.CutPrefix(s, "info:")
+		if informative || !isInfo {
+			data[dir] = append(data[dir], []byte(content)...)
+			dataSizes = append(dataSizes, [2]int{len(data[0]), len(data[1])})
+		}
 		dir = (C2S ^ S2C) - dir
 	}
 	return data, dataSizes, 123, 123, true, nil
@@ -251,6 +258,23 @@ func TestSearchStreams(t *testing.T) {
 			"cdata.c1:ne*dle",
 			[]uint64{1},
 		},
+		{
+			"data query skips informative converter output",
+			[]streamInfo{
+				makeStream("192.168.0.100:123", "192.168.0.1:80", t1.Add(time.Hour*1), []string{"foo", "bar"}, []string{"foo", "info:needle"}),
+			},
+			"sdata:ne*dle",
+			[]uint64{},
+		},
+		{
+			"info query searches informative converter output",
+			[]streamInfo{
+				makeStream("192.168.0.100:123", "192.168.0.1:80", t1.Add(time.Hour*1), []string{"foo", "bar"}, []string{"foo", "info:needle"}),
+				makeStream("192.168.0.100:123", "192.168.0.1:80", t1.Add(time.Hour*2), []string{"foo", "bar"}, []string{"info:needle", "bar"}),
+			},
+			"sinfo.c0:ne*dle",
+			[]uint64{0},
+		},
 		{
 			"search for data only found in converter without searching in converter",
 			[]streamInfo{
@@ -519,6 +543,78 @@ func TestSearchStreams(t *testing.T) {
 			nil,
 		},
 	}
+	httpStreams := []streamInfo{
+		makeStream("1.2.3.4:1000", "5.6.7.8:80", t1.Add(time.Hour*1), []string{
+			"GET /flag?id=1 HTTP/1.1\r\nHost: service\r\nUser-Agent: python-requests/2.31\r\n\r\n",
+			"HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n",
+		}),
+		makeStream("1.2.3.4:1001", "5.6.7.8:80", t1.Add(time.Hour*2), []string{
+			"POST /login HTTP/1.1\r\nHost: service\r\nContent-Length: 3\r\n\r\nfoo" +
+				"GET /flag HTTP/1.1\r\nHost: other\r\n\r\n",
+			"HTTP/1.1 302 Found\r\nContent-Length: 0\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\nX-Flag: FLAG{abc}\r\nContent-Length: 2\r\n\r\nok",
+		}),
+		makeStream("1.2.3.4:1002", "5.6.7.8:80", t1.Add(time.Hour*3), []string{
+			"GET /flag HTTP/1.1 but not really",
+			"HTTP/1.1 200 OK\r\n\r\n",
+		}),
+	}
+	for _, tc := range []struct {
+		query    string
+		expected []uint64
+	}{
+		{"http.method:GET", []uint64{0, 1}},
+		{"http.method:POST", []uint64{1}},
+		{"http.method:GE", []uint64{}},
+		{"http.path:/flag.*", []uint64{0, 1}},
+		{"http.path:/flag", []uint64{1}},
+		{"http.status:200", []uint64{1}},
+		{"http.status:4..", []uint64{0}},
+		{"http.host:other", []uint64{1}},
+		{"http.header.x-flag:FLAG.*", []uint64{1}},
+		{"http.header.User-Agent:python.*", []uint64{0}},
+		{"-http.status:200", []uint64{0, 2}},
+		{"http.method:POST http.status:403", []uint64{}},
+		{"http.method:POST or http.status:403", []uint64{0, 1}},
+		{"http.method:GET -http.method:GET", []uint64{}},
+	} {
+		testCases = append(testCases, struct {
+			name     string
+			streams  []streamInfo
+			query    string
+			expected []uint64
+		}{tc.query, httpStreams, tc.query + " sort:id", tc.expected})
+	}
+	fileStreams := []streamInfo{
+		makeStream("1.2.3.4:1000", "5.6.7.8:80", t1.Add(time.Hour*1), []string{
+			"GET /logo HTTP/1.1\r\nHost: service\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: 3\r\n\r\nabc",
+		}),
+		makeStream("1.2.3.4:1001", "5.6.7.8:1337", t1.Add(time.Hour*2), []string{
+			"here is a pdf: %PDF-1.4 foo %%EOF",
+		}),
+		makeStream("1.2.3.4:1002", "5.6.7.8:1337", t1.Add(time.Hour*3), []string{
+			"nothing to see",
+		}),
+	}
+	for _, tc := range []struct {
+		query    string
+		expected []uint64
+	}{
+		{"file.type:image/png", []uint64{0}},
+		{"file.type:image/.*", []uint64{0}},
+		{"file.type:application/pdf", []uint64{1}},
+		{"file.type:image", []uint64{}},
+		{"-file.type:.*", []uint64{2}},
+		{"file.type:image/png or file.type:application/pdf", []uint64{0, 1}},
+	} {
+		testCases = append(testCases, struct {
+			name     string
+			streams  []streamInfo
+			query    string
+			expected []uint64
+		}{tc.query, fileStreams, tc.query + " sort:id", tc.expected})
+	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			converters := map[string]ConverterAccess{
@@ -552,10 +648,187 @@ func TestSearchStreams(t *testing.T) {
 			if !slices.Equal(got, tc.expected) {
 				t.Errorf("Unexpected streams: %v, want: %v", got, tc.expected)
 			}
+
+			// the result has to be the same if every stream is in its own index
+			readers := []*Reader(nil)
+			for i, s := range tc.streams {
+				r, err := makeIndex(tmpDir, map[uint64]streamInfo{uint64(i): s}, &converters)
+				if err != nil {
+					t.Fatalf("Error creating index: %v", err)
+				}
+				readers = append(readers, r)
+			}
+			results, _, _, err = SearchStreams(context.Background(), readers, nil, q.ReferenceTime, q.Conditions, q.Grouping, q.Sorting, l, 0, nil, converters, false)
+			if err != nil {
+				t.Fatalf("Error searching streams in multiple indexes: %v", err)
+			}
+			got = nil
+			for _, s := range results {
+				got = append(got, s.StreamID)
+			}
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("Unexpected streams in multiple indexes: %v, want: %v", got, tc.expected)
+			}
 		})
 	}
 }
 
+func TestSearchOlderIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	converters := map[string]ConverterAccess{}
+	r, err := makeIndex(tmpDir, map[uint64]streamInfo{
+		0: makeStream("1.2.3.4:1000", "5.6.7.8:80", t1.Add(time.Hour*1), []string{
+			"POST /login HTTP/1.1\r\nHost: service\r\nContent-Length: 3\r\n\r\nfoo" +
+				"GET /flag HTTP/1.1\r\nHost: other\r\n\r\n",
+			"HTTP/1.1 302 Found\r\nContent-Length: 0\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\nX-Flag: FLAG{abc}\r\nContent-Length: 2\r\n\r\nok",
+		}),
+		1: makeStream("1.2.3.4:1001", "5.6.7.8:80", t1.Add(time.Hour*2), []string{
+			"GET /flag?id=1 HTTP/1.1\r\nHost: service\r\n\r\n",
+			"HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n",
+		}),
+	}, &converters)
+	if err != nil {
+		t.Fatalf("makeIndex failed with error: %v", err)
+	}
+	if !r.httpMessages || !r.fileTypes || !r.filePositions {
+		t.Fatalf("Reader.httpMessages, Reader.fileTypes, Reader.filePositions = %v, %v, %v, want true, true, true", r.httpMessages, r.fileTypes, r.filePositions)
+	}
+
+	// v3 indexes don't contain the positions of the HTTP messages and the
+	// file types, readers ignore the data following the segmentation
+	content, err := os.ReadFile(r.Filename())
+	if err != nil {
+		t.Fatalf("os.ReadFile failed with error: %v", err)
+	}
+	copy(content, fileMagicV3)
+	fn := filepath.Join(tmpDir, "v3.idx")
+	if err := os.WriteFile(fn, content, 0644); err != nil {
+		t.Fatalf("os.WriteFile failed with error: %v", err)
+	}
+	older, err := NewReader(fn)
+	if err != nil {
+		t.Fatalf("NewReader failed with error: %v", err)
+	}
+	if older.httpMessages || older.fileTypes || older.filePositions {
+		t.Fatalf("Reader.httpMessages, Reader.fileTypes, Reader.filePositions = %v, %v, %v, want false, false, false", older.httpMessages, older.fileTypes, older.filePositions)
+	}
+
+	// merging adds the positions and file types
+	merged, err := Merge(tmpDir, []*Reader{older})
+	if err != nil {
+		t.Fatalf("Merge failed with error: %v", err)
+	}
+	if len(merged) != 1 || !merged[0].httpMessages || !merged[0].fileTypes || !merged[0].filePositions {
+		t.Fatalf("Merge() did not create an index containing the HTTP message positions and files")
+	}
+
+	// the files are carved from the stream data of older indexes
+	for _, r := range []*Reader{older, merged[0]} {
+		s, err := r.StreamByID(0)
+		if err != nil {
+			t.Fatalf("StreamByID failed with error: %v", err)
+		}
+		files, err := s.Files()
+		if err != nil {
+			t.Fatalf("Stream.Files failed with error: %v", err)
+		}
+		got := []string(nil)
+		for _, f := range files {
+			data, err := s.FileData(f)
+			if err != nil {
+				t.Fatalf("Stream.FileData failed with error: %v", err)
+			}
+			if uint64(len(data)) != f.Size {
+				t.Errorf("Stream.FileData returned %d bytes, want %d", len(data), f.Size)
+			}
+			got = append(got, fmt.Sprintf("%s:%s:%s", f.Name, f.MIMEType, data))
+		}
+		if want := []string{"request-0:text/plain:foo", "flag:text/plain:ok"}; !slices.Equal(got, want) {
+			t.Errorf("Files in %s = %q, want %q", r.Filename(), got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected []uint64
+	}{
+		{"http.method:POST", []uint64{0}},
+		{"http.path:/flag.*", []uint64{0, 1}},
+		{"http.status:200", []uint64{0}},
+		{"http.status:403", []uint64{1}},
+		{"http.header.x-flag:FLAG.*", []uint64{0}},
+		{"file.type:text/plain", []uint64{0}},
+		{"-file.type:.*", []uint64{1}},
+	} {
+		q, err := query.Parse(tc.query + " sort:id")
+		if err != nil {
+			t.Fatalf("Error parsing query: %v", err)
+		}
+		for _, r := range []*Reader{older, merged[0]} {
+			results, _, _, err := SearchStreams(context.Background(), []*Reader{r}, nil, q.ReferenceTime, q.Conditions, q.Grouping, q.Sorting, 100, 0, nil, converters, false)
+			if err != nil {
+				t.Fatalf("Error searching streams: %v", err)
+			}
+			got := []uint64(nil)
+			for _, s := range results {
+				got = append(got, s.StreamID)
+			}
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("Unexpected streams for %q in %s: %v, want: %v", tc.query, r.Filename(), got, tc.expected)
+			}
+		}
+	}
+}
+
+func TestSearchStreamsSuperseedingIndexes(t *testing.T) {
+	tmpDir := t.TempDir()
+	converters := map[string]ConverterAccess{}
+	older, err := makeIndex(tmpDir, map[uint64]streamInfo{
+		0: makeStream("1.2.3.4:1", "1.2.3.4:80", t1.Add(time.Hour*1), []string{"foo"}),
+		1: makeStream("1.2.3.4:2", "1.2.3.4:80", t1.Add(time.Hour*2), []string{"foo"}),
+	}, &converters)
+	if err != nil {
+		t.Fatalf("Error creating index: %v", err)
+	}
+	newer, err := makeIndex(tmpDir, map[uint64]streamInfo{
+		1: makeStream("1.2.3.4:2", "1.2.3.4:81", t1.Add(time.Hour*2), []string{"foo"}),
+		2: makeStream("1.2.3.4:3", "1.2.3.4:80", t1.Add(time.Hour*3), []string{"foo"}),
+	}, &converters)
+	if err != nil {
+		t.Fatalf("Error creating index: %v", err)
+	}
+	for _, tc := range []struct {
+		query    string
+		expected []uint64
+	}{
+		{"sport:80 sort:id", []uint64{0, 2}},
+		{"sport:81", []uint64{1}},
+		{"sort:-id limit:2", []uint64{2, 1}},
+		{"group:@sport@ sort:id", []uint64{0, 1}},
+	} {
+		q, err := query.Parse(tc.query)
+		if err != nil {
+			t.Fatalf("Error parsing query %q: %v", tc.query, err)
+		}
+		l := uint(100)
+		if q.Limit != nil {
+			l = *q.Limit
+		}
+		results, _, _, err := SearchStreams(context.Background(), []*Reader{older, newer}, nil, q.ReferenceTime, q.Conditions, q.Grouping, q.Sorting, l, 0, nil, converters, false)
+		if err != nil {
+			t.Fatalf("SearchStreams(%q) failed with error: %v", tc.query, err)
+		}
+		got := []uint64(nil)
+		for _, s := range results {
+			got = append(got, s.StreamID)
+		}
+		if !slices.Equal(got, tc.expected) {
+			t.Errorf("SearchStreams(%q) = %v, want %v", tc.query, got, tc.expected)
+		}
+	}
+}
+
 func TestSearch(t *testing.T) {
 
 }
@@ -0,0 +1,258 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"unsafe"
+)
+
+// Verify checks the structure of an index file and returns all problems
+// that were found. An index without problems can be loaded and all of its
+// streams can be read.
+func Verify(filename string) (problems []error) {
+	defer func() {
+		if e := recover(); e != nil {
+			problems = append(problems, fmt.Errorf("reading the index panicked: %v", e))
+		}
+	}()
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	// check the header and the section bounds before using the reader,
+	// it trusts the header and might crash otherwise
+	f, err := os.Open(filename)
+	if err != nil {
+		report("%w", err)
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		report("%w", err)
+		return
+	}
+	magic := [len(fileMagic)]byte{}
+	header := fileHeader{}
+	nSections := sectionsCount
+	if err := binary.Read(f, binary.LittleEndian, &magic); err != nil {
+		f.Close()
+		report("unable to read header: %w", err)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		report("%w", err)
+		return
+	}
+	switch string(magic[:]) {
+	case fileMagic, fileMagicV5, fileMagicV4, fileMagicV3:
+		err = binary.Read(f, binary.LittleEndian, &header)
+	case fileMagicV2:
+		headerV2 := fileHeaderV2{}
+		err = binary.Read(f, binary.LittleEndian, &headerV2)
+		copy(header.Sections[:], headerV2.Sections[:])
+		nSections = sectionsCountV2
+	default:
+		err = fmt.Errorf("wrong magic: %q", string(magic[:]))
+	}
+	f.Close()
+	if err != nil {
+		report("unable to read header: %w", err)
+		return
+	}
+	objectSizes := map[section]uint64{
+		sectionPackets:                    uint64(unsafe.Sizeof(packet{})),
+		sectionHostGroups:                 uint64(unsafe.Sizeof(hostGroupEntry{})),
+		sectionImports:                    uint64(unsafe.Sizeof(importEntry{})),
+		sectionStreams:                    uint64(unsafe.Sizeof(stream{})),
+		sectionStreamsByStreamID:          4,
+		sectionStreamsByFirstPacketSource: 4,
+		sectionStreamsByFirstPacketTime:   4,
+		sectionStreamsByLastPacketTime:    4,
+		sectionDataBlocks:                 uint64(unsafe.Sizeof(dataBlockEntry{})),
+		sectionV4Hosts:                    4,
+		sectionV6Hosts:                    16,
+	}
+	headerSize := uint64(unsafe.Sizeof(fileHeader{}))
+	if nSections == sectionsCountV2 {
+		headerSize = uint64(unsafe.Sizeof(fileHeaderV2{}))
+	}
+	sections := []section(nil)
+	for s := section(0); int(s) < nSections; s++ {
+		sec := header.Sections[s]
+		switch {
+		case sec.Begin > sec.End:
+			report("section %d: begin %d is after end %d", s, sec.Begin, sec.End)
+		case sec.Begin < headerSize:
+			report("section %d: begin %d overlaps the header", s, sec.Begin)
+		case sec.End > uint64(fi.Size()):
+			report("section %d: end %d is after the end of the file (%d bytes)", s, sec.End, fi.Size())
+		case objectSizes[s] != 0 && sec.size()%int64(objectSizes[s]) != 0:
+			report("section %d: size %d is not a multiple of %d", s, sec.size(), objectSizes[s])
+		default:
+			sections = append(sections, s)
+		}
+	}
+	sort.Slice(sections, func(i, j int) bool {
+		return header.Sections[sections[i]].Begin < header.Sections[sections[j]].Begin
+	})
+	for i := 1; i < len(sections); i++ {
+		a, b := sections[i-1], sections[i]
+		if header.Sections[b].Begin < header.Sections[a].End && header.Sections[b].size() != 0 {
+			report("sections %d and %d overlap", a, b)
+		}
+	}
+	if len(problems) != 0 {
+		return
+	}
+
+	r, err := NewReader(filename)
+	if err != nil {
+		report("unable to load index: %w", err)
+		return
+	}
+	defer r.Close()
+
+	// check the data blocks
+	if r.dataBlocks != nil {
+		last := r.dataBlocks[len(r.dataBlocks)-1]
+		if last.Offset != uint64(r.header.Sections[sectionData].size()) {
+			report("data blocks end at %d, but the data section has %d bytes", last.Offset, r.header.Sections[sectionData].size())
+		}
+		for i := 1; i < len(r.dataBlocks); i++ {
+			if r.dataBlocks[i].Offset < r.dataBlocks[i-1].Offset || r.dataBlocks[i].DataOffset < r.dataBlocks[i-1].DataOffset {
+				report("data block %d is not ordered", i)
+			}
+		}
+		if len(problems) != 0 {
+			return
+		}
+	}
+
+	// check the streams and their packets
+	streamCount, packetCount := r.StreamCount(), uint64(r.PacketCount())
+	dataSize := uint64(r.dataSize())
+	streamIDs := map[uint64]uint32{}
+	for sIdx := 0; sIdx < streamCount; sIdx++ {
+		s, err := r.streamByIndex(uint32(sIdx))
+		if err != nil {
+			report("stream %d: %w", sIdx, err)
+			continue
+		}
+		if other, ok := streamIDs[s.StreamID]; ok {
+			report("stream id %d is used by streams %d and %d", s.StreamID, other, sIdx)
+		}
+		streamIDs[s.StreamID] = uint32(sIdx)
+		if s.FirstPacketTimeNS > s.LastPacketTimeNS {
+			report("stream %d: first packet is after last packet", s.StreamID)
+		}
+		if int(s.HostGroup) >= len(r.hostGroups) {
+			report("stream %d: invalid host group %d", s.StreamID, s.HostGroup)
+		} else if hg := r.hostGroups[s.HostGroup]; int(s.ClientHost) >= hg.hostCount || int(s.ServerHost) >= hg.hostCount {
+			report("stream %d: invalid hosts %d/%d", s.StreamID, s.ClientHost, s.ServerHost)
+		}
+		if s.DataStart+s.ClientBytes+s.ServerBytes > dataSize {
+			report("stream %d: data is outside of the data section", s.StreamID)
+			continue
+		}
+		validPackets := true
+		for pIdx := uint64(s.PacketInfoStart); ; pIdx++ {
+			if pIdx >= packetCount {
+				report("stream %d: packets are outside of the packet section", s.StreamID)
+				validPackets = false
+				break
+			}
+			p, err := r.packetByIndex(pIdx)
+			if err != nil {
+				report("stream %d: %w", s.StreamID, err)
+				validPackets = false
+				break
+			}
+			if int(p.ImportID) >= len(r.imports) {
+				report("stream %d: packet %d references invalid import %d", s.StreamID, pIdx, p.ImportID)
+				validPackets = false
+				break
+			}
+			if p.Flags&flagsPacketHasNext == 0 {
+				break
+			}
+		}
+		if !validPackets {
+			continue
+		}
+		ws, err := s.wrap(r, uint32(sIdx))
+		if err == nil {
+			_, err = ws.Data()
+		}
+		if err != nil {
+			report("stream %d: unable to read data: %w", s.StreamID, err)
+		}
+	}
+	if len(problems) != 0 {
+		return
+	}
+
+	// check the lookup tables
+	type lookup struct {
+		section section
+		less    func(a, b *stream) bool
+	}
+	firstPacketSource := func(s *stream) (string, uint64) {
+		p, _ := r.packetByIndex(uint64(s.PacketInfoStart))
+		imp := r.imports[p.ImportID]
+		return imp.filename, imp.packetIndexOffset + uint64(p.PacketIndex)
+	}
+	for _, l := range []lookup{
+		{sectionStreamsByStreamID, func(a, b *stream) bool {
+			return a.StreamID < b.StreamID
+		}},
+		{sectionStreamsByFirstPacketSource, func(a, b *stream) bool {
+			afn, aidx := firstPacketSource(a)
+			bfn, bidx := firstPacketSource(b)
+			if afn != bfn {
+				return afn < bfn
+			}
+			return aidx < bidx
+		}},
+		{sectionStreamsByFirstPacketTime, func(a, b *stream) bool {
+			return a.FirstPacketTimeNS < b.FirstPacketTimeNS
+		}},
+		{sectionStreamsByLastPacketTime, func(a, b *stream) bool {
+			return a.LastPacketTimeNS < b.LastPacketTimeNS
+		}},
+	} {
+		if n := r.objectCount(l.section, 4); n != streamCount {
+			report("lookup %d: contains %d entries, expected %d", l.section, n, streamCount)
+			continue
+		}
+		seen := make([]bool, streamCount)
+		prev := (*stream)(nil)
+		for i := 0; i < streamCount; i++ {
+			sIdx, err := r.readLookup(l.section, i)
+			if err != nil {
+				report("lookup %d: %w", l.section, err)
+				break
+			}
+			if int(sIdx) >= streamCount || seen[sIdx] {
+				report("lookup %d: entry %d references invalid or duplicate stream %d", l.section, i, sIdx)
+				break
+			}
+			seen[sIdx] = true
+			s, err := r.streamByIndex(sIdx)
+			if err != nil {
+				report("lookup %d: %w", l.section, err)
+				break
+			}
+			if prev != nil && l.less(s, prev) {
+				report("lookup %d: entry %d is not ordered", l.section, i)
+				break
+			}
+			prev = s
+		}
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package index
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestVerify(t *testing.T) {
+	tmpDir := t.TempDir()
+	streams := map[uint64]streamInfo{
+		1: makeStream("1.2.3.4:1", "5.6.7.8:9", t1.Add(time.Hour*2), []string{"Lorem", "ipsum"}),
+		2: makeStream("1.2.3.4:2", "5.6.7.8:8", t1.Add(time.Hour*1), []string{"dolor", "sit"}),
+		3: makeStream("[1::2]:3", "[3::4]:7", t1.Add(time.Hour*3), []string{"amet", "consectetur"}),
+	}
+	r, err := makeIndex(tmpDir, streams, nil)
+	if err != nil {
+		t.Fatalf("makeIndex failed with error: %v", err)
+	}
+	fn := r.Filename()
+	header := r.header
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close failed with error: %v", err)
+	}
+	if problems := Verify(fn); len(problems) != 0 {
+		t.Fatalf("Verify() = %v, want no problems", problems)
+	}
+	original, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("ReadFile failed with error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func([]byte) []byte
+	}{
+		{"truncated", func(b []byte) []byte {
+			return b[:len(b)-16]
+		}},
+		{"unfinished", func(b []byte) []byte {
+			clear(b[:len(fileMagic)])
+			return b
+		}},
+		{"swapped lookup", func(b []byte) []byte {
+			lookup := b[header.Sections[sectionStreamsByFirstPacketTime].Begin:]
+			a, c := binary.LittleEndian.Uint32(lookup), binary.LittleEndian.Uint32(lookup[4:])
+			binary.LittleEndian.PutUint32(lookup, c)
+			binary.LittleEndian.PutUint32(lookup[4:], a)
+			return b
+		}},
+		{"duplicate stream id", func(b []byte) []byte {
+			streams := b[header.Sections[sectionStreams].Begin:]
+			copy(streams[int(unsafe.Sizeof(stream{})):][:8], streams[:8])
+			return b
+		}},
+		{"invalid packet import", func(b []byte) []byte {
+			packets := b[header.Sections[sectionPackets].Begin:]
+			binary.LittleEndian.PutUint32(packets[4:], 1000)
+			return b
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			broken := tc.modify(append([]byte(nil), original...))
+			if err := os.WriteFile(fn, broken, 0644); err != nil {
+				t.Fatalf("WriteFile failed with error: %v", err)
+			}
+			if problems := Verify(fn); len(problems) == 0 {
+				t.Errorf("Verify() found no problems")
+			} else {
+				t.Logf("Verify() = %v", problems)
+			}
+		})
+	}
+}
@@ -13,6 +13,8 @@ import (
 
 	"github.com/gopacket/gopacket/reassembly"
 	"github.com/spq/pkappa2/internal/index/streams"
+	"github.com/spq/pkappa2/internal/tools/bitmask"
+	httpmessages "github.com/spq/pkappa2/internal/tools/httpMessages"
 	pcapmetadata "github.com/spq/pkappa2/internal/tools/pcapMetadata"
 	"github.com/spq/pkappa2/internal/tools/seekbufio"
 )
@@ -35,6 +37,7 @@ type (
 		packets    []packet
 		streams    []stream
 		header     fileHeader
+		data       dataBlockWriter
 	}
 )
 
@@ -129,6 +132,7 @@ func NewWriter(filename string) (*Writer, error) {
 		hostGroups: make([]hostGroup, 0),
 		imports:    make(map[writerImportEntry]uint32),
 	}
+	w.data.w = &w
 	if err := w.write(&w.header); err != nil {
 		w.Close()
 		return nil, err
@@ -148,6 +152,21 @@ func (w *Writer) Filename() string {
 	return w.filename
 }
 
+// clientDataPrefix returns up to n bytes of the data sent by the client.
+func clientDataPrefix(s *streams.Stream, n int) []byte {
+	prefix := []byte(nil)
+	for _, d := range s.Data {
+		if len(prefix) >= n {
+			break
+		}
+		if s.PacketDirections[d.PacketIndex] != reassembly.TCPDirClientToServer {
+			continue
+		}
+		prefix = append(prefix, d.Bytes[:min(len(d.Bytes), n-len(prefix))]...)
+	}
+	return prefix
+}
+
 func (w *Writer) AddStream(s *streams.Stream, streamID uint64) (bool, error) {
 	// check if we can reference the stream.
 	if len(w.streams) > math.MaxUint32 {
@@ -191,6 +210,9 @@ func (w *Writer) AddStream(s *streams.Stream, streamID uint64) (bool, error) {
 	case streams.StreamFlagsProtocolUDP:
 		stream.Flags |= flagsStreamProtocolUDP
 	}
+	if stream.Flags&flagsStreamProtocol == flagsStreamProtocolTCP && httpmessages.IsRequest(clientDataPrefix(s, httpRequestLineMaxSize)) {
+		stream.Flags |= flagsStreamSegmentationHTTP
+	}
 
 	// when we can't add a stream to this writer, we might have
 	// to undo some operations, those will be collected here.
@@ -267,15 +289,10 @@ func (w *Writer) AddStream(s *streams.Stream, streamID uint64) (bool, error) {
 	}
 
 	// collect the packets and write the data
-	if err := w.setPos(&stream.DataStart); err != nil {
-		undo()
-		return false, err
-	}
-	stream.DataStart -= w.header.Sections[sectionData].Begin
+	stream.DataStart = w.data.pos()
 	undoable(func() {
-		w.buffer.Flush()
 		//nolint:errcheck
-		w.file.Seek(int64(stream.DataStart+w.header.Sections[sectionData].Begin), io.SeekStart)
+		w.data.truncate(stream.DataStart)
 		w.packets = w.packets[:stream.PacketInfoStart]
 	})
 	packetToData := map[uint64]int{}
@@ -347,7 +364,7 @@ func (w *Writer) AddStream(s *streams.Stream, streamID uint64) (bool, error) {
 			if dir := s.PacketDirections[d.PacketIndex]; dir != wantDir {
 				continue
 			}
-			if err := w.write(d.Bytes); err != nil {
+			if _, err := w.data.Write(d.Bytes); err != nil {
 				undo()
 				return false, err
 			}
@@ -395,7 +412,22 @@ func (w *Writer) AddStream(s *streams.Stream, streamID uint64) (bool, error) {
 		segmentation = append(segmentation, buf[pos:]...)
 		wantDir = wantDir.Reverse()
 	}
-	if err := w.write(segmentation); err != nil {
+	content := [2][]byte{}
+	for _, d := range s.Data {
+		dir := DirectionClientToServer
+		if s.PacketDirections[d.PacketIndex] == reassembly.TCPDirServerToClient {
+			dir = DirectionServerToClient
+		}
+		content[dir] = append(content[dir], d.Bytes...)
+	}
+	if stream.Flags&flagsStreamSegmentation == flagsStreamSegmentationHTTP {
+		segmentation = appendHTTPMessages(segmentation, content[DirectionClientToServer], content[DirectionServerToClient])
+	}
+	if files := carveFiles(content[DirectionClientToServer], content[DirectionServerToClient]); len(files) != 0 {
+		stream.Flags |= flagsStreamFiles
+		segmentation = appendFiles(segmentation, files)
+	}
+	if _, err := w.data.Write(segmentation); err != nil {
 		undo()
 		return false, err
 	}
@@ -404,7 +436,62 @@ func (w *Writer) AddStream(s *streams.Stream, streamID uint64) (bool, error) {
 	return true, nil
 }
 
+// copyStreamTrailer returns the HTTP message positions and files of the
+// stream, which follow its segmentation. The reader has to be positioned
+// after the segmentation. For streams of older indexes they are computed
+// from the stream data.
+func copyStreamTrailer(r *Reader, br *seekbufio.SeekableBufferReader, s *stream, newStream *stream) ([]byte, error) {
+	buf := []byte(nil)
+	content := (*[2][]byte)(nil)
+	readContent := func() error {
+		if content != nil {
+			return nil
+		}
+		content = &[2][]byte{}
+		return readStreamData(br, s, content)
+	}
+	if s.Flags&flagsStreamSegmentation == flagsStreamSegmentationHTTP {
+		if r.httpMessages {
+			messages, err := readHTTPMessages(&byteReader{Reader: br})
+			if err != nil {
+				return nil, err
+			}
+			buf = appendHTTPMessagePositions(buf, messages)
+		} else {
+			if err := readContent(); err != nil {
+				return nil, err
+			}
+			buf = appendHTTPMessages(buf, content[DirectionClientToServer], content[DirectionServerToClient])
+		}
+	}
+	if r.filePositions {
+		if s.Flags&flagsStreamFiles != 0 {
+			files, err := readFiles(&byteReader{Reader: br})
+			if err != nil {
+				return nil, err
+			}
+			buf = appendFiles(buf, files)
+		}
+	} else if s.ClientBytes+s.ServerBytes != 0 {
+		// the MIME types of v5 indexes are replaced by the files
+		if err := readContent(); err != nil {
+			return nil, err
+		}
+		newStream.Flags &^= flagsStreamFiles
+		if files := carveFiles(content[DirectionClientToServer], content[DirectionServerToClient]); len(files) != 0 {
+			newStream.Flags |= flagsStreamFiles
+			buf = appendFiles(buf, files)
+		}
+	}
+	return buf, nil
+}
+
 func (w *Writer) Finalize() (*Reader, error) {
+	dataBlocks, err := w.data.finish()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
 	if err := w.setSectionEnd(sectionData); err != nil {
 		w.Close()
 		return nil, err
@@ -434,6 +521,13 @@ func (w *Writer) Finalize() (*Reader, error) {
 		return nil
 	}
 
+	// write data blocks
+	if err := writeSection(sectionDataBlocks, func() error {
+		return w.write(dataBlocks)
+	}); err != nil {
+		return nil, err
+	}
+
 	importFilenams := []byte{}
 	importFilenameOffsets := map[string]uint64{}
 	importRecords := make([]importEntry, len(w.imports))
@@ -622,6 +716,12 @@ func (w *Writer) Finalize() (*Reader, error) {
 }
 
 func (w *Writer) AddIndex(r *Reader) (bool, error) {
+	return w.addIndex(r, nil)
+}
+
+// addIndex adds all streams of the index that are not yet contained in the
+// writer and not part of the excluded streams.
+func (w *Writer) addIndex(r *Reader, excludedStreams *bitmask.LongBitmask) (bool, error) {
 	// when we can't add a stream to this writer, we might have
 	// to undo some operations, those will be collected here.
 	undos := []func(){}
@@ -634,8 +734,10 @@ func (w *Writer) AddIndex(r *Reader) (bool, error) {
 		undos = append(undos, f)
 	}
 
-	// merge imports
-	importRemap := []uint32{}
+	// merge imports, they are added when the first packet referencing
+	// them is added so that imports of excluded streams are dropped
+	importRemap := make([]uint32, len(r.imports))
+	importMapped := make([]bool, len(r.imports))
 	importCountBefore := len(w.imports)
 	undoable(func() {
 		for imp, idx := range w.imports {
@@ -644,7 +746,11 @@ func (w *Writer) AddIndex(r *Reader) (bool, error) {
 			}
 		}
 	})
-	for _, i := range r.imports {
+	remapImport := func(importID uint32) (uint32, bool) {
+		if importMapped[importID] {
+			return importRemap[importID], true
+		}
+		i := r.imports[importID]
 		k := writerImportEntry{
 			filename: i.filename,
 			offset:   i.packetIndexOffset,
@@ -652,13 +758,14 @@ func (w *Writer) AddIndex(r *Reader) (bool, error) {
 		newIndex, ok := w.imports[k]
 		if !ok {
 			if len(w.imports) > math.MaxUint32 {
-				undo()
-				return false, nil
+				return 0, false
 			}
 			newIndex = uint32(len(w.imports))
 			w.imports[k] = newIndex
 		}
-		importRemap = append(importRemap, newIndex)
+		importRemap[importID] = newIndex
+		importMapped[importID] = true
+		return newIndex, true
 	}
 
 	// merge host groups
@@ -727,20 +834,14 @@ func (w *Writer) AddIndex(r *Reader) (bool, error) {
 	// merge streams tigether with data and packets
 	streamCountBefore := len(w.streams)
 	packetCountBefore := len(w.packets)
-	dataPosBefore := uint64(0)
-	if err := w.setPos(&dataPosBefore); err != nil {
-		undo()
-		return false, err
-	}
+	dataPosBefore := w.data.pos()
 	undoable(func() {
 		w.streams = w.streams[:streamCountBefore]
 		w.packets = w.packets[:packetCountBefore]
-		w.buffer.Flush()
 		//nolint:errcheck
-		w.file.Seek(int64(dataPosBefore), io.SeekStart)
+		w.data.truncate(dataPosBefore)
 	})
-	sr := io.NewSectionReader(r.file, int64(r.header.Sections[sectionData].Begin), r.header.Sections[sectionData].size())
-	br := seekbufio.NewSeekableBufferReader(sr)
+	br := seekbufio.NewSeekableBufferReader(r.dataReader())
 	minFirstPacketTimeNS := uint64(math.MaxUint64)
 	for sIdx, sCount := 0, r.StreamCount(); sIdx < sCount; sIdx++ {
 		s, err := r.streamByIndex(uint32(sIdx))
@@ -750,6 +851,9 @@ func (w *Writer) AddIndex(r *Reader) (bool, error) {
 		if _, ok := existingStreamIDs[s.StreamID]; ok {
 			continue
 		}
+		if excludedStreams != nil && excludedStreams.IsSet(uint(s.StreamID)) {
+			continue
+		}
 		if len(w.streams) > math.MaxUint32 || len(w.packets) > math.MaxUint32 {
 			undo()
 			return false, nil
@@ -766,31 +870,32 @@ func (w *Writer) AddIndex(r *Reader) (bool, error) {
 				return false, err
 			}
 			newPacket := *p
-			newPacket.ImportID = importRemap[newPacket.ImportID]
+			importID, ok := remapImport(newPacket.ImportID)
+			if !ok {
+				undo()
+				return false, nil
+			}
+			newPacket.ImportID = importID
 			w.packets = append(w.packets, newPacket)
 			if newPacket.Flags&flagsPacketHasNext == 0 {
 				break
 			}
 		}
 
-		if err := w.setPos(&newStream.DataStart); err != nil {
-			undo()
-			return false, err
-		}
-		newStream.DataStart -= w.header.Sections[sectionData].Begin
+		newStream.DataStart = w.data.pos()
 
 		if count := s.ClientBytes + s.ServerBytes; count != 0 {
 			if _, err := br.Seek(int64(s.DataStart), io.SeekStart); err != nil {
 				undo()
 				return false, err
 			}
-			if _, err := io.CopyN(w.buffer, br, int64(count)); err != nil {
+			if _, err := io.CopyN(&w.data, br, int64(count)); err != nil {
 				undo()
 				return false, err
 			}
 			for pos, buf := 0, [4096]byte{}; ; {
 				if count == 0 || pos >= len(buf)-((64+6)/7) {
-					if err := w.write(buf[:pos]); err != nil {
+					if _, err := w.data.Write(buf[:pos]); err != nil {
 						undo()
 						return false, err
 					}
@@ -820,6 +925,17 @@ func (w *Writer) AddIndex(r *Reader) (bool, error) {
 				count -= sz
 			}
 		}
+		// the positions of the HTTP messages and the files are copied,
+		// they are added to streams of older indexes
+		trailer, err := copyStreamTrailer(r, br, s, &newStream)
+		if err != nil {
+			undo()
+			return false, err
+		}
+		if _, err := w.data.Write(trailer); err != nil {
+			undo()
+			return false, err
+		}
 
 		if minFirstPacketTimeNS > newStream.FirstPacketTimeNS {
 			minFirstPacketTimeNS = newStream.FirstPacketTimeNS
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"net/textproto"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -18,6 +20,7 @@ type (
 	NumberConditionSummandType uint8
 	HostConditionSourceType    bool
 	TagConditionAccept         uint8
+	HTTPConditionField         uint8
 )
 
 const (
@@ -33,6 +36,8 @@ const (
 	DataRequirementSequenceFlagsDirection               = 0b1
 	DataRequirementSequenceFlagsDirectionClientToServer = 0b0
 	DataRequirementSequenceFlagsDirectionServerToClient = 0b1
+	// informative chunks of the converter output are searched as well
+	DataRequirementSequenceFlagsInformative = 0b10
 
 	FlagsHostConditionInverted     = 0b01
 	FlagsHostConditionSource       = 0b10
@@ -43,6 +48,12 @@ const (
 	TagConditionAcceptFailing           TagConditionAccept = 0b0010
 	TagConditionAcceptUncertainMatching TagConditionAccept = 0b0100
 	TagConditionAcceptUncertainFailing  TagConditionAccept = 0b1000
+
+	HTTPConditionFieldMethod HTTPConditionField = iota
+	HTTPConditionFieldPath
+	HTTPConditionFieldHost
+	HTTPConditionFieldStatus
+	HTTPConditionFieldHeader
 )
 
 type (
@@ -106,6 +117,23 @@ type (
 		Elements []DataConditionElement
 		Inverted bool
 	}
+	HTTPCondition struct {
+		// this is fulfilled, when a request or response of the stream
+		// has a field fully matching Regex, or none has if Inverted
+		SubQuery string
+		Field    HTTPConditionField
+		// the canonical header name for HTTPConditionFieldHeader
+		Header   string
+		Regex    string
+		Inverted bool
+	}
+	FileCondition struct {
+		// this is fulfilled, when a file carved from the stream has a
+		// MIME type fully matching Regex, or none has if Inverted
+		SubQuery string
+		Regex    string
+		Inverted bool
+	}
 	ImpossibleCondition struct{}
 	Condition           interface {
 		fmt.Stringer
@@ -297,9 +325,11 @@ func (c *DataCondition) String() string {
 	for i, e := range c.Elements {
 		inv := map[bool]string{false: "", true: "-"}[c.Inverted && (i == len(c.Elements)-1)]
 		who := map[uint8]string{
-			DataRequirementSequenceFlagsDirectionClientToServer: "cdata",
-			DataRequirementSequenceFlagsDirectionServerToClient: "sdata",
-		}[e.Flags&DataRequirementSequenceFlagsDirection]
+			DataRequirementSequenceFlagsDirectionClientToServer:                                           "cdata",
+			DataRequirementSequenceFlagsDirectionServerToClient:                                           "sdata",
+			DataRequirementSequenceFlagsDirectionClientToServer | DataRequirementSequenceFlagsInformative: "cinfo",
+			DataRequirementSequenceFlagsDirectionServerToClient | DataRequirementSequenceFlagsInformative: "sinfo",
+		}[e.Flags&(DataRequirementSequenceFlagsDirection|DataRequirementSequenceFlagsInformative)]
 		sq := e.SubQuery
 		if sq != "" {
 			sq += ":"
@@ -314,6 +344,31 @@ func (c *DataCondition) String() string {
 	return strings.Join(res, " > ")
 }
 
+func (c *HTTPCondition) String() string {
+	inv := map[bool]string{false: "", true: "-"}[c.Inverted]
+	sq := c.SubQuery
+	if sq != "" {
+		sq += ":"
+	}
+	field := map[HTTPConditionField]string{
+		HTTPConditionFieldMethod: "method",
+		HTTPConditionFieldPath:   "path",
+		HTTPConditionFieldHost:   "host",
+		HTTPConditionFieldStatus: "status",
+		HTTPConditionFieldHeader: "header." + c.Header,
+	}[c.Field]
+	return fmt.Sprintf("%s%shttp.%s:%q", inv, sq, field, c.Regex)
+}
+
+func (c *FileCondition) String() string {
+	inv := map[bool]string{false: "", true: "-"}[c.Inverted]
+	sq := c.SubQuery
+	if sq != "" {
+		sq += ":"
+	}
+	return fmt.Sprintf("%s%sfile.type:%q", inv, sq, c.Regex)
+}
+
 func (c *ImpossibleCondition) String() string {
 	return "false"
 }
@@ -342,6 +397,14 @@ func (c *DataCondition) impossible() bool {
 	return false
 }
 
+func (c *HTTPCondition) impossible() bool {
+	return false
+}
+
+func (c *FileCondition) impossible() bool {
+	return false
+}
+
 func (c *ImpossibleCondition) impossible() bool {
 	return true
 }
@@ -430,6 +493,16 @@ func (c *DataCondition) equal(d Condition) bool {
 	return true
 }
 
+func (c *HTTPCondition) equal(d Condition) bool {
+	o, ok := d.(*HTTPCondition)
+	return ok && *c == *o
+}
+
+func (c *FileCondition) equal(d Condition) bool {
+	o, ok := d.(*FileCondition)
+	return ok && *c == *o
+}
+
 func (c *ImpossibleCondition) equal(d Condition) bool {
 	_, ok := d.(*ImpossibleCondition)
 	return ok
@@ -528,16 +601,68 @@ func (c *DataCondition) invert() ConditionsSet {
 	return conds
 }
 
+func (c *HTTPCondition) invert() ConditionsSet {
+	cond := *c
+	cond.Inverted = !cond.Inverted
+	return ConditionsSet{Conditions{&cond}}
+}
+
+func (c *FileCondition) invert() ConditionsSet {
+	cond := *c
+	cond.Inverted = !cond.Inverted
+	return ConditionsSet{Conditions{&cond}}
+}
+
 func (c *ImpossibleCondition) invert() ConditionsSet {
 	return ConditionsSet{}
 }
 
 func (t *queryTerm) QueryConditions(pc *parserContext) (ConditionsSet, error) {
-	if t.ConverterName != "" && t.Key != "data" && t.Key != "cdata" && t.Key != "sdata" {
+	if t.ConverterName != "" && !slices.Contains([]string{"data", "cdata", "sdata", "info", "cinfo", "sinfo"}, t.Key) {
 		return nil, fmt.Errorf("converter %q not allowed for %q", t.ConverterName, t.Key)
 	}
 
 	conds := ConditionsSet(nil)
+	// keys are matched case insensitively
+	key := strings.ToLower(t.Key)
+	if strings.HasPrefix(key, "http.") {
+		cond := &HTTPCondition{
+			SubQuery: t.SubQuery,
+			Regex:    t.Value,
+		}
+		switch field := key[len("http."):]; field {
+		case "method":
+			cond.Field = HTTPConditionFieldMethod
+		case "path":
+			cond.Field = HTTPConditionFieldPath
+		case "host":
+			cond.Field = HTTPConditionFieldHost
+		case "status":
+			cond.Field = HTTPConditionFieldStatus
+		default:
+			if !strings.HasPrefix(field, "header.") || len(field) == len("header.") {
+				return nil, fmt.Errorf("unknown http field %q", field)
+			}
+			cond.Field = HTTPConditionFieldHeader
+			cond.Header = textproto.CanonicalMIMEHeaderKey(field[len("header."):])
+		}
+		if _, err := binaryregexp.Compile(t.Value); err != nil {
+			return nil, err
+		}
+		return ConditionsSet{Conditions{cond}}, nil
+	}
+	if strings.HasPrefix(key, "file.") {
+		if field := key[len("file."):]; field != "type" {
+			return nil, fmt.Errorf("unknown file field %q", field)
+		}
+		if _, err := binaryregexp.Compile(t.Value); err != nil {
+			return nil, err
+		}
+		return ConditionsSet{Conditions{&FileCondition{
+			SubQuery: t.SubQuery,
+			Regex:    t.Value,
+		}}}, nil
+	}
 	switch t.Key {
 	case "tag", "service", "mark", "generated":
 		for _, v := range strings.Split(t.Value, ",") {
@@ -841,7 +966,7 @@ func (t *queryTerm) QueryConditions(pc *parserContext) (ConditionsSet, error) {
 			}
 			conds = append(conds, cond)
 		}
-	case "cdata", "sdata", "data":
+	case "cdata", "sdata", "data", "cinfo", "sinfo", "info":
 		val, err := valueStringParser.ParseString("", t.Value)
 		if err != nil {
 			return nil, err
@@ -872,6 +997,12 @@ func (t *queryTerm) QueryConditions(pc *parserContext) (ConditionsSet, error) {
 			},
 			"cdata": {DataRequirementSequenceFlagsDirectionClientToServer},
 			"sdata": {DataRequirementSequenceFlagsDirectionServerToClient},
+			"info": {
+				DataRequirementSequenceFlagsDirectionClientToServer | DataRequirementSequenceFlagsInformative,
+				DataRequirementSequenceFlagsDirectionServerToClient | DataRequirementSequenceFlagsInformative,
+			},
+			"cinfo": {DataRequirementSequenceFlagsDirectionClientToServer | DataRequirementSequenceFlagsInformative},
+			"sinfo": {DataRequirementSequenceFlagsDirectionServerToClient | DataRequirementSequenceFlagsInformative},
 		}[t.Key]
 		for _, f := range flags {
 			conds = append(conds, Conditions{
@@ -1716,6 +1847,62 @@ outer:
 	return true
 }
 
+func cleanHTTPConditions(hcs *[]HTTPCondition) bool {
+	sort.Slice(*hcs, func(i, j int) bool {
+		a, b := (*hcs)[i], (*hcs)[j]
+		if a.SubQuery != b.SubQuery {
+			return a.SubQuery < b.SubQuery
+		}
+		if a.Field != b.Field {
+			return a.Field < b.Field
+		}
+		if a.Header != b.Header {
+			return a.Header < b.Header
+		}
+		if a.Regex != b.Regex {
+			return a.Regex < b.Regex
+		}
+		return !a.Inverted && b.Inverted
+	})
+	for i := 1; i < len(*hcs); i++ {
+		a, b := (*hcs)[i-1], (*hcs)[i]
+		if a.SubQuery != b.SubQuery || a.Field != b.Field || a.Header != b.Header || a.Regex != b.Regex {
+			continue
+		}
+		if a.Inverted != b.Inverted {
+			return false
+		}
+		*hcs = append((*hcs)[:i-1], (*hcs)[i:]...)
+		i--
+	}
+	return true
+}
+
+func cleanFileConditions(fcs *[]FileCondition) bool {
+	sort.Slice(*fcs, func(i, j int) bool {
+		a, b := (*fcs)[i], (*fcs)[j]
+		if a.SubQuery != b.SubQuery {
+			return a.SubQuery < b.SubQuery
+		}
+		if a.Regex != b.Regex {
+			return a.Regex < b.Regex
+		}
+		return !a.Inverted && b.Inverted
+	})
+	for i := 1; i < len(*fcs); i++ {
+		a, b := (*fcs)[i-1], (*fcs)[i]
+		if a.SubQuery != b.SubQuery || a.Regex != b.Regex {
+			continue
+		}
+		if a.Inverted != b.Inverted {
+			return false
+		}
+		*fcs = append((*fcs)[:i-1], (*fcs)[i:]...)
+		i--
+	}
+	return true
+}
+
 func (c Conditions) clean() Conditions {
 	lcs := []TagCondition(nil)
 	fcs := []FlagCondition(nil)
@@ -1723,6 +1910,8 @@ func (c Conditions) clean() Conditions {
 	ncs := []NumberCondition(nil)
 	tcs := []TimeCondition(nil)
 	dcs := []DataCondition(nil)
+	httpcs := []HTTPCondition(nil)
+	filecs := []FileCondition(nil)
 	for _, cc := range c {
 		switch ccc := cc.(type) {
 		case *TagCondition:
@@ -1737,6 +1926,10 @@ func (c Conditions) clean() Conditions {
 			tcs = append(tcs, *ccc)
 		case *DataCondition:
 			dcs = append(dcs, *ccc)
+		case *HTTPCondition:
+			httpcs = append(httpcs, *ccc)
+		case *FileCondition:
+			filecs = append(filecs, *ccc)
 		case *ImpossibleCondition:
 			return Conditions{
 				&impossibleCondition,
@@ -1750,6 +1943,8 @@ func (c Conditions) clean() Conditions {
 	possible = possible && cleanNumberConditions(&ncs)
 	possible = possible && cleanTimeConditions(&tcs)
 	possible = possible && cleanDataConditions(&dcs)
+	possible = possible && cleanHTTPConditions(&httpcs)
+	possible = possible && cleanFileConditions(&filecs)
 	if !possible {
 		return Conditions{&impossibleCondition}
 	}
@@ -1772,6 +1967,12 @@ func (c Conditions) clean() Conditions {
 	for i := range dcs {
 		res = append(res, &dcs[i])
 	}
+	for i := range httpcs {
+		res = append(res, &httpcs[i])
+	}
+	for i := range filecs {
+		res = append(res, &filecs[i])
+	}
 	return res
 }
 
@@ -1903,6 +2104,10 @@ func (cs *ConditionsSet) SubQueries() []string {
 					add(v.SubQuery)
 				}
 			}
+		case *HTTPCondition:
+			add(ccc.SubQuery)
+		case *FileCondition:
+			add(ccc.SubQuery)
 		case *ImpossibleCondition:
 		}
 		return res
@@ -2002,7 +2207,7 @@ func (cs *ConditionsSet) UpdateReferenceTime(oldReferenceTime, newReferenceTime
 }
 
 type (
-	Feature    uint8
+	Feature    uint16
 	FeatureSet struct {
 		MainFeatures, SubQueryFeatures Feature
 		MainTags, SubQueryTags         []string
@@ -2018,6 +2223,10 @@ const (
 	FeatureFilterTimeRelative
 	FeatureFilterTags
 	FeatureFilterData
+	// FeatureFilterDataMetadata filters on what the index stores about the
+	// stream data, like http messages and file types, which doesn't depend
+	// on converters
+	FeatureFilterDataMetadata
 )
 
 func (cs *ConditionsSet) Features() FeatureSet {
@@ -2106,6 +2315,14 @@ func (cs *ConditionsSet) Features() FeatureSet {
 					}
 				}
 				f = FeatureFilterData
+			case *HTTPCondition:
+				mq = ccc.SubQuery == ""
+				sq = ccc.SubQuery != ""
+				f = FeatureFilterDataMetadata
+			case *FileCondition:
+				mq = ccc.SubQuery == ""
+				sq = ccc.SubQuery != ""
+				f = FeatureFilterDataMetadata
 			}
 			if mq {
 				fs.MainFeatures |= f
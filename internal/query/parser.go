@@ -87,7 +87,7 @@ var (
 				Pattern: `(?i)@([a-z0-9]+):`,
 			}, {
 				Name:    "Key",
-				Pattern: `(?i)(id|tag|service|mark|protocol|generated|[fl]?time|[cs]?(data|port|host|bytes))`,
+				Pattern: `(?i)((http|file)\.[a-z0-9_.-]+|id|tag|service|mark|protocol|generated|[fl]?time|[cs]?(data|info|port|host|bytes))`,
 			}, {
 				Name:    "ConverterName",
 				Pattern: `\.([^:=]+)`,
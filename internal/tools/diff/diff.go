@@ -0,0 +1,190 @@
+package diff
+
+import "fmt"
+
+type (
+	Kind int
+
+	// Run is a range of elements in a and b that are equal, deleted from a
+	// or inserted from b. Deleted runs have an empty range in b and
+	// inserted runs have an empty range in a.
+	Run struct {
+		Kind         Kind
+		AStart, AEnd int
+		BStart, BEnd int
+	}
+)
+
+const (
+	Equal Kind = iota
+	Delete
+	Insert
+	// Replace is never returned by Diff, callers use it for pairs of
+	// deleted and inserted elements that they compared further.
+	Replace
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Equal:
+		return "equal"
+	case Delete:
+		return "delete"
+	case Insert:
+		return "insert"
+	case Replace:
+		return "replace"
+	}
+	return "unknown"
+}
+
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *Kind) UnmarshalText(text []byte) error {
+	for c := Equal; c <= Replace; c++ {
+		if c.String() == string(text) {
+			*k = c
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown diff kind %q", text)
+}
+
+// Diff computes a shortest edit script between two sequences of length n
+// and m using the algorithm of Myers. eq reports whether element i of the
+// first sequence equals element j of the second one. If more than
+// maxEdits insertions and deletions would be needed, everything between
+// the common prefix and suffix is reported as deleted and inserted.
+// A maxEdits of 0 means no limit.
+func Diff(n, m int, eq func(i, j int) bool, maxEdits int) []Run {
+	prefix := 0
+	for prefix < n && prefix < m && eq(prefix, prefix) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && suffix < m-prefix && eq(n-1-suffix, m-1-suffix) {
+		suffix++
+	}
+	res := runs{}
+	res.add(Equal, 0, 0, prefix)
+	res.middle(prefix, n-suffix, prefix, m-suffix, eq, maxEdits)
+	res.add(Equal, n-suffix, m-suffix, suffix)
+	return res
+}
+
+type runs []Run
+
+// add appends count elements of the given kind starting at a and b,
+// merging them into the last run if possible.
+func (r *runs) add(kind Kind, a, b, count int) {
+	if count == 0 {
+		return
+	}
+	aCount, bCount := count, count
+	switch kind {
+	case Delete:
+		bCount = 0
+	case Insert:
+		aCount = 0
+	}
+	if l := len(*r); l != 0 {
+		last := &(*r)[l-1]
+		if last.Kind == kind && last.AEnd == a && last.BEnd == b {
+			last.AEnd += aCount
+			last.BEnd += bCount
+			return
+		}
+	}
+	*r = append(*r, Run{
+		Kind:   kind,
+		AStart: a,
+		AEnd:   a + aCount,
+		BStart: b,
+		BEnd:   b + bCount,
+	})
+}
+
+// middle diffs a[aStart:aEnd] against b[bStart:bEnd].
+func (r *runs) middle(aStart, aEnd, bStart, bEnd int, eq func(i, j int) bool, maxEdits int) {
+	n, m := aEnd-aStart, bEnd-bStart
+	if n == 0 || m == 0 {
+		r.add(Delete, aStart, bStart, n)
+		r.add(Insert, aEnd, bStart, m)
+		return
+	}
+	limit := n + m
+	if maxEdits > 0 && limit > maxEdits {
+		limit = maxEdits
+	}
+
+	// v[offset+k] is the furthest x reached on diagonal k, trace[d] holds
+	// v[offset-d:offset+d+1] as it was before step d
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	trace := [][]int(nil)
+	found := -1
+	for d := 0; d <= limit && found < 0; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && eq(aStart+x, bStart+y) {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = d
+				break
+			}
+		}
+	}
+	if found < 0 {
+		r.add(Delete, aStart, bStart, n)
+		r.add(Insert, aEnd, bStart, m)
+		return
+	}
+
+	// walk back from the end and collect the runs in reverse order
+	rev := runs{}
+	x, y := n, m
+	for d := found; d > 0; d-- {
+		prev := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+			prevK = k + 1
+		}
+		prevX := prev[prevK+d]
+		prevY := prevX - prevK
+		if snake := x - prevX; prevK == k-1 {
+			snake--
+			rev = append(rev, Run{Equal, aStart + x - snake, aStart + x, bStart + y - snake, bStart + y})
+			rev = append(rev, Run{Delete, aStart + prevX, aStart + prevX + 1, bStart + prevY, bStart + prevY})
+		} else {
+			snake = y - prevY - 1
+			rev = append(rev, Run{Equal, aStart + x - snake, aStart + x, bStart + y - snake, bStart + y})
+			rev = append(rev, Run{Insert, aStart + prevX, aStart + prevX, bStart + prevY, bStart + prevY + 1})
+		}
+		x, y = prevX, prevY
+	}
+	rev = append(rev, Run{Equal, aStart, aStart + x, bStart, bStart + y})
+	for i := len(rev) - 1; i >= 0; i-- {
+		run := rev[i]
+		switch run.Kind {
+		case Equal:
+			r.add(Equal, run.AStart, run.BStart, run.AEnd-run.AStart)
+		case Delete:
+			r.add(Delete, run.AStart, run.BStart, 1)
+		case Insert:
+			r.add(Insert, run.AStart, run.BStart, 1)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package diff
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// apply rebuilds a and b from the runs and checks that they are consistent.
+func apply(t *testing.T, a, b string, runs []Run) {
+	t.Helper()
+	gotA, gotB := strings.Builder{}, strings.Builder{}
+	posA, posB := 0, 0
+	for i, r := range runs {
+		if r.AStart != posA || r.BStart != posB {
+			t.Fatalf("run %d starts at %d/%d, expected %d/%d", i, r.AStart, r.BStart, posA, posB)
+		}
+		switch r.Kind {
+		case Equal:
+			if a[r.AStart:r.AEnd] != b[r.BStart:r.BEnd] {
+				t.Fatalf("run %d: %q != %q", i, a[r.AStart:r.AEnd], b[r.BStart:r.BEnd])
+			}
+		case Delete:
+			if r.BStart != r.BEnd {
+				t.Fatalf("run %d: delete with non-empty b range", i)
+			}
+		case Insert:
+			if r.AStart != r.AEnd {
+				t.Fatalf("run %d: insert with non-empty a range", i)
+			}
+		}
+		if i != 0 && runs[i-1].Kind == r.Kind {
+			t.Fatalf("runs %d and %d were not merged", i-1, i)
+		}
+		gotA.WriteString(a[r.AStart:r.AEnd])
+		gotB.WriteString(b[r.BStart:r.BEnd])
+		posA, posB = r.AEnd, r.BEnd
+	}
+	if gotA.String() != a || gotB.String() != b {
+		t.Fatalf("runs rebuild %q/%q instead of %q/%q", gotA.String(), gotB.String(), a, b)
+	}
+}
+
+func edits(runs []Run) int {
+	n := 0
+	for _, r := range runs {
+		if r.Kind != Equal {
+			n += r.AEnd - r.AStart + r.BEnd - r.BStart
+		}
+	}
+	return n
+}
+
+func TestDiff(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  string
+		edits int
+	}{
+		{"", "", 0},
+		{"abc", "abc", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"abcabba", "cbabac", 5},
+		{"GET /flag HTTP/1.1", "GET /flags HTTP/1.0", 3},
+		{"xaaay", "aaa", 2},
+	} {
+		runs := Diff(len(tc.a), len(tc.b), func(i, j int) bool {
+			return tc.a[i] == tc.b[j]
+		}, 0)
+		apply(t, tc.a, tc.b, runs)
+		if n := edits(runs); n != tc.edits {
+			t.Errorf("Diff(%q, %q) needs %d edits, expected %d: %v", tc.a, tc.b, n, tc.edits, runs)
+		}
+	}
+}
+
+func TestDiffRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	gen := func() string {
+		s := make([]byte, r.Intn(50))
+		for i := range s {
+			s[i] = "abc"[r.Intn(3)]
+		}
+		return string(s)
+	}
+	for range 1000 {
+		a, b := gen(), gen()
+		runs := Diff(len(a), len(b), func(i, j int) bool {
+			return a[i] == b[j]
+		}, 0)
+		apply(t, a, b, runs)
+		if n, expected := edits(runs), len(a)+len(b)-2*lcs(a, b); n != expected {
+			t.Fatalf("Diff(%q, %q) needs %d edits, expected %d", a, b, n, expected)
+		}
+	}
+}
+
+// lcs returns the length of the longest common subsequence of a and b.
+func lcs(a, b string) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func TestDiffMaxEdits(t *testing.T) {
+	a, b := "prefix-abcdef-suffix", "prefix-uvwxyz-suffix"
+	runs := Diff(len(a), len(b), func(i, j int) bool {
+		return a[i] == b[j]
+	}, 4)
+	apply(t, a, b, runs)
+	if len(runs) != 4 || runs[1].Kind != Delete || runs[2].Kind != Insert {
+		t.Fatalf("unexpected runs %v", runs)
+	}
+}
@@ -0,0 +1,189 @@
+package filecarver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	httpmessages "github.com/spq/pkappa2/internal/tools/httpMessages"
+)
+
+type (
+	Source string
+
+	// File is an object transferred within a stream. Direction is 0 for
+	// data sent by the client and 1 for data sent by the server. Start and
+	// End are the offsets of the raw data the file was carved from in the
+	// data sent in its direction, Part is the index of a multipart file
+	// within the files of its request.
+	File struct {
+		Name       string
+		MIMEType   string
+		Source     Source
+		Direction  int
+		Start, End int
+		Part       int
+		Data       []byte
+	}
+)
+
+const (
+	SourceHTTPRequest  Source = "http-request"
+	SourceHTTPResponse Source = "http-response"
+	SourceMultipart    Source = "multipart"
+	SourceMagic        Source = "magic"
+
+	// gzip files are not decompressed beyond this size
+	maxDecompressedSize = 64 << 20
+)
+
+// Carve extracts the files from the data sent by the client and server.
+// HTTP/1.x streams are split into their message bodies and multipart
+// uploads, the raw data of all other streams is searched for known file
+// signatures.
+func Carve(data [2][]byte) []File {
+	if !httpmessages.IsRequest(data[0]) {
+		files := carveMagic(data[0], 0)
+		return append(files, carveMagic(data[1], 1)...)
+	}
+	requests, responses := httpmessages.ParseWithBodies(data[0], data[1])
+	files := []File(nil)
+	for i, req := range requests {
+		body := httpmessages.DecodeBody(req.Header, req.Body)
+		if len(body) == 0 {
+			continue
+		}
+		mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+			for _, f := range carveMultipart(body, params["boundary"]) {
+				f.Start, f.End = req.Start, req.End
+				files = append(files, f)
+			}
+			continue
+		}
+		files = append(files, File{
+			Name:      bodyName(req.Header, "", fmt.Sprintf("request-%d", i)),
+			MIMEType:  bodyMIMEType(req.Header, body),
+			Source:    SourceHTTPRequest,
+			Direction: 0,
+			Start:     req.Start,
+			End:       req.End,
+			Data:      body,
+		})
+	}
+	for i, res := range responses {
+		body := httpmessages.DecodeBody(res.Header, res.Body)
+		if len(body) == 0 {
+			continue
+		}
+		target := ""
+		if i < len(requests) {
+			target = requests[i].Target
+		}
+		files = append(files, File{
+			Name:      bodyName(res.Header, target, fmt.Sprintf("response-%d", i)),
+			MIMEType:  bodyMIMEType(res.Header, body),
+			Source:    SourceHTTPResponse,
+			Direction: 1,
+			Start:     res.Start,
+			End:       res.End,
+			Data:      body,
+		})
+	}
+	return files
+}
+
+// Extract returns the content of a file from the raw data between its
+// Start and End, nil is returned if it can't be extracted.
+func Extract(raw []byte, source Source, part int) []byte {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	switch source {
+	case SourceMagic:
+		return raw
+	case SourceHTTPResponse:
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return nil
+		}
+		body, _ := io.ReadAll(res.Body)
+		return httpmessages.DecodeBody(res.Header, body)
+	case SourceHTTPRequest, SourceMultipart:
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return nil
+		}
+		body, _ := io.ReadAll(req.Body)
+		body = httpmessages.DecodeBody(req.Header, body)
+		if source == SourceHTTPRequest {
+			return body
+		}
+		_, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		files := carveMultipart(body, params["boundary"])
+		if part < 0 || part >= len(files) {
+			return nil
+		}
+		return files[part].Data
+	}
+	return nil
+}
+
+func bodyMIMEType(header http.Header, body []byte) string {
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		return mediaType
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	return mediaType
+}
+
+// bodyName uses the name from the Content-Disposition header or the last
+// element of the request path, falling back to the given name.
+func bodyName(header http.Header, target, fallback string) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	if u, err := url.ParseRequestURI(target); err == nil {
+		if name := path.Base(u.Path); name != "/" && name != "." {
+			return name
+		}
+	}
+	return fallback
+}
+
+func carveMultipart(body []byte, boundary string) []File {
+	files := []File(nil)
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if err != nil {
+			break
+		}
+		name := part.FileName()
+		if name == "" {
+			continue
+		}
+		data, err := io.ReadAll(part)
+		if err != nil && len(data) == 0 {
+			break
+		}
+		mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+		}
+		files = append(files, File{
+			Name:      path.Base(name),
+			MIMEType:  mediaType,
+			Source:    SourceMultipart,
+			Direction: 0,
+			Part:      len(files),
+			Data:      data,
+		})
+	}
+	return files
+}
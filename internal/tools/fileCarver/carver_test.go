@@ -0,0 +1,91 @@
+package filecarver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+func makePNG() []byte {
+	chunk := func(typ string, data []byte) []byte {
+		res := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		res = append(res, typ...)
+		res = append(res, data...)
+		return binary.BigEndian.AppendUint32(res, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+	}
+	res := []byte("\x89PNG\r\n\x1a\n")
+	res = append(res, chunk("IHDR", make([]byte, 13))...)
+	res = append(res, chunk("IDAT", []byte("not really compressed"))...)
+	return append(res, chunk("IEND", nil)...)
+}
+
+func makeGzip(content string) []byte {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(content))
+	w.Close()
+	return buf.Bytes()
+}
+
+func describe(files []File) string {
+	res := []string(nil)
+	for _, f := range files {
+		res = append(res, fmt.Sprintf("%d:%s:%s:%s:%d", f.Direction, f.Source, f.Name, f.MIMEType, len(f.Data)))
+	}
+	return strings.Join(res, " ")
+}
+
+// checkExtract checks that the content of every file can be extracted from
+// its raw data.
+func checkExtract(t *testing.T, data [2][]byte, files []File) {
+	t.Helper()
+	for i, f := range files {
+		if got := Extract(data[f.Direction][f.Start:f.End], f.Source, f.Part); !bytes.Equal(got, f.Data) {
+			t.Errorf("Extract() of file %d = %q, want %q", i, got, f.Data)
+		}
+	}
+}
+
+func TestCarveMagic(t *testing.T) {
+	png := makePNG()
+	gz := makeGzip("hello world")
+	client := append(append([]byte("upload "), png...), " done"...)
+	server := append(append([]byte("ok\n"), gz...), "\xff\xd8\xff truncated jpeg"...)
+	files := Carve([2][]byte{client, server})
+	want := fmt.Sprintf("0:magic:client-7.png:image/png:%d 1:magic:server-3.gz:application/gzip:%d 1:magic:server-%d.jpg:image/jpeg:18", len(png), len(gz), 3+len(gz))
+	if got := describe(files); got != want {
+		t.Fatalf("Carve() = %s, want %s", got, want)
+	}
+	if !bytes.Equal(files[0].Data, png) {
+		t.Errorf("carved png differs")
+	}
+	checkExtract(t, [2][]byte{client, server}, files)
+}
+
+func TestCarveHTTP(t *testing.T) {
+	gz := makeGzip("<html>flag</html>")
+	client := "" +
+		"GET /static/logo.png HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"POST /upload HTTP/1.1\r\nHost: a\r\nContent-Type: multipart/form-data; boundary=xyz\r\nContent-Length: 184\r\n\r\n" +
+		"--xyz\r\nContent-Disposition: form-data; name=\"comment\"\r\n\r\nhi\r\n" +
+		"--xyz\r\nContent-Disposition: form-data; name=\"file\"; filename=\"../exploit.py\"\r\nContent-Type: text/x-python\r\n\r\nprint(1)\r\n" +
+		"--xyz--\r\n" +
+		"GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+	server := "" +
+		fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: %d\r\n\r\n%s", len(makePNG()), makePNG()) +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Disposition: attachment; filename=\"index.html\"\r\nContent-Length: %d\r\n\r\n%s", len(gz), gz)
+	files := Carve([2][]byte{[]byte(client), []byte(server)})
+	want := fmt.Sprintf("0:multipart:exploit.py:text/x-python:8 1:http-response:logo.png:image/png:%d 1:http-response:upload:text/plain:3 1:http-response:index.html:text/html:17", len(makePNG()))
+	if got := describe(files); got != want {
+		t.Fatalf("Carve() = %s, want %s", got, want)
+	}
+	if string(files[3].Data) != "<html>flag</html>" {
+		t.Errorf("gzip body was not decoded: %q", files[3].Data)
+	}
+	checkExtract(t, [2][]byte{[]byte(client), []byte(server)}, files)
+}
@@ -0,0 +1,177 @@
+package filecarver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type (
+	signature struct {
+		magic     []byte
+		mimeType  string
+		extension string
+		// length returns the length of the file at the start of data,
+		// -1 if it is invalid and 0 if the end is unknown
+		length func(data []byte) int
+	}
+)
+
+var (
+	signatures = []signature{
+		{[]byte("\x89PNG\r\n\x1a\n"), "image/png", "png", pngLength},
+		{[]byte("\xff\xd8\xff"), "image/jpeg", "jpg", func(data []byte) int {
+			return endAfter(data, []byte("\xff\xd9"), 3)
+		}},
+		{[]byte("GIF87a"), "image/gif", "gif", gifLength},
+		{[]byte("GIF89a"), "image/gif", "gif", gifLength},
+		{[]byte("%PDF-"), "application/pdf", "pdf", func(data []byte) int {
+			return endAfter(data, []byte("%%EOF"), 5)
+		}},
+		{[]byte("PK\x03\x04"), "application/zip", "zip", zipLength},
+		{[]byte("\x1f\x8b\x08"), "application/gzip", "gz", gzipLength},
+		{[]byte("\x7fELF"), "application/x-elf", "elf", elfLength},
+	}
+)
+
+// endAfter returns the length up to the end of the first occurrence of
+// trailer after skipping the first skip bytes.
+func endAfter(data, trailer []byte, skip int) int {
+	if len(data) < skip {
+		return -1
+	}
+	pos := bytes.Index(data[skip:], trailer)
+	if pos < 0 {
+		return 0
+	}
+	return skip + pos + len(trailer)
+}
+
+func pngLength(data []byte) int {
+	pos := 8
+	for pos+12 <= len(data) {
+		l := int(binary.BigEndian.Uint32(data[pos:]))
+		if l > len(data) {
+			return 0
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		pos += 12 + l
+		if chunkType == "IEND" {
+			return min(pos, len(data))
+		}
+	}
+	return 0
+}
+
+func gifLength(data []byte) int {
+	return endAfter(data, []byte("\x00\x3b"), 13)
+}
+
+func zipLength(data []byte) int {
+	pos := bytes.Index(data, []byte("PK\x05\x06"))
+	if pos < 0 || pos+22 > len(data) {
+		return 0
+	}
+	return min(pos+22+int(binary.LittleEndian.Uint16(data[pos+20:])), len(data))
+}
+
+func gzipLength(data []byte) int {
+	r := bytes.NewReader(data)
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return -1
+	}
+	gr.Multistream(false)
+	if _, err := io.Copy(io.Discard, io.LimitReader(gr, maxDecompressedSize)); err != nil {
+		return 0
+	}
+	return len(data) - r.Len()
+}
+
+func elfLength(data []byte) int {
+	if len(data) < 64 {
+		return -1
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	switch data[5] {
+	case 1:
+	case 2:
+		order = binary.BigEndian
+	default:
+		return -1
+	}
+	phoff, shoff := uint64(0), uint64(0)
+	phentsize, phnum, shentsize, shnum := uint64(0), uint64(0), uint64(0), uint64(0)
+	switch data[4] {
+	case 1:
+		phoff, shoff = uint64(order.Uint32(data[28:])), uint64(order.Uint32(data[32:]))
+		phentsize, phnum = uint64(order.Uint16(data[42:])), uint64(order.Uint16(data[44:]))
+		shentsize, shnum = uint64(order.Uint16(data[46:])), uint64(order.Uint16(data[48:]))
+	case 2:
+		phoff, shoff = order.Uint64(data[32:]), order.Uint64(data[40:])
+		phentsize, phnum = uint64(order.Uint16(data[54:])), uint64(order.Uint16(data[56:]))
+		shentsize, shnum = uint64(order.Uint16(data[58:])), uint64(order.Uint16(data[60:]))
+	default:
+		return -1
+	}
+	// the section headers are usually at the end of the file
+	end := max(phoff+phentsize*phnum, shoff+shentsize*shnum)
+	if end > uint64(len(data)) {
+		return 0
+	}
+	return int(end)
+}
+
+// carveMagic extracts the files with known signatures from the data of
+// one direction. Files without a detectable end extend to the end of the
+// data.
+func carveMagic(data []byte, direction int) []File {
+	dirName := [2]string{"client", "server"}[direction]
+	files := []File(nil)
+	next := make([]int, len(signatures))
+	for i := range next {
+		next[i] = -1
+	}
+	for pos := 0; pos < len(data); {
+		// find the first signature at or after pos
+		first, firstPos := -1, len(data)
+		for i, sig := range signatures {
+			if next[i] < pos && next[i] != len(data) {
+				idx := bytes.Index(data[pos:], sig.magic)
+				if idx < 0 {
+					next[i] = len(data)
+				} else {
+					next[i] = pos + idx
+				}
+			}
+			if next[i] < firstPos {
+				first, firstPos = i, next[i]
+			}
+		}
+		if first < 0 {
+			break
+		}
+		sig := signatures[first]
+		l := sig.length(data[firstPos:])
+		if l < 0 {
+			pos = firstPos + 1
+			continue
+		}
+		if l == 0 {
+			l = len(data) - firstPos
+		}
+		files = append(files, File{
+			Name:      fmt.Sprintf("%s-%d.%s", dirName, firstPos, sig.extension),
+			MIMEType:  sig.mimeType,
+			Source:    SourceMagic,
+			Direction: direction,
+			Start:     firstPos,
+			End:       firstPos + l,
+			Data:      data[firstPos:][:l],
+		})
+		pos = firstPos + l
+	}
+	return files
+}
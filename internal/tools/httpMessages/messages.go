@@ -0,0 +1,224 @@
+package httpmessages
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type (
+	// Message is a HTTP/1.x request or response. Start and End are the
+	// offsets of the message in the data sent in its direction, the body
+	// starts at HeaderEnd.
+	Message struct {
+		Start, HeaderEnd, End int
+		Header                http.Header
+		// Body is the body without transfer encoding, it is only set by
+		// ParseWithBodies
+		Body []byte
+	}
+	Request struct {
+		Message
+		Method string
+		// Target is the request target as sent, including the query
+		Target string
+		Host   string
+	}
+	Response struct {
+		Message
+		StatusCode int
+	}
+)
+
+const (
+	// bodies are not decompressed beyond this size
+	maxDecodedBodySize = 64 << 20
+)
+
+var (
+	requestLine = regexp.MustCompile(`^[A-Z]+ [^ \r\n]+ HTTP/1\.[01]\r?\n`)
+)
+
+// IsRequest returns whether data starts with a HTTP/1.x request line.
+func IsRequest(data []byte) bool {
+	return requestLine.Match(data)
+}
+
+// offsetReader tracks how much of the data was consumed by a bufio.Reader.
+type offsetReader struct {
+	data []byte
+	r    *bytes.Reader
+	br   *bufio.Reader
+}
+
+func newOffsetReader(data []byte) *offsetReader {
+	r := bytes.NewReader(data)
+	return &offsetReader{
+		data: data,
+		r:    r,
+		br:   bufio.NewReader(r),
+	}
+}
+
+func (o *offsetReader) offset() int {
+	return len(o.data) - o.r.Len() - o.br.Buffered()
+}
+
+// Parse splits the client and server data of a stream into requests and
+// responses. Parsing stops at the first malformed message and after a
+// protocol switch, truncated bodies end at the end of the data.
+func Parse(client, server []byte) ([]Request, []Response) {
+	return parse(client, server, false)
+}
+
+// ParseWithBodies works like Parse, but also returns the bodies.
+func ParseWithBodies(client, server []byte) ([]Request, []Response) {
+	return parse(client, server, true)
+}
+
+// readBody consumes the body and returns it if keep is set.
+func readBody(body io.Reader, keep bool) ([]byte, error) {
+	if !keep {
+		_, err := io.Copy(io.Discard, body)
+		return nil, err
+	}
+	return io.ReadAll(body)
+}
+
+func parse(client, server []byte, keepBodies bool) ([]Request, []Response) {
+	requests := []Request(nil)
+	o := newOffsetReader(client)
+	for o.offset() < len(client) {
+		start := o.offset()
+		req, err := http.ReadRequest(o.br)
+		if err != nil {
+			break
+		}
+		headerEnd := o.offset()
+		body, err := readBody(req.Body, keepBodies)
+		requests = append(requests, Request{
+			Message: Message{
+				Start:     start,
+				HeaderEnd: headerEnd,
+				End:       o.offset(),
+				Header:    req.Header,
+				Body:      body,
+			},
+			Method: req.Method,
+			Target: req.RequestURI,
+			Host:   req.Host,
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	responses := []Response(nil)
+	o = newOffsetReader(server)
+	for answered := 0; o.offset() < len(server); {
+		// the method of the request decides whether the response has a body
+		req := (*http.Request)(nil)
+		if answered < len(requests) {
+			req = &http.Request{Method: requests[answered].Method}
+		}
+		start := o.offset()
+		res, err := http.ReadResponse(o.br, req)
+		if err != nil {
+			break
+		}
+		headerEnd := o.offset()
+		body, err := readBody(res.Body, keepBodies)
+		responses = append(responses, Response{
+			Message: Message{
+				Start:     start,
+				HeaderEnd: headerEnd,
+				End:       o.offset(),
+				Header:    res.Header,
+				Body:      body,
+			},
+			StatusCode: res.StatusCode,
+		})
+		if err != nil || res.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		if req != nil && req.Method == http.MethodConnect && res.StatusCode/100 == 2 {
+			break
+		}
+		// informational responses precede the final one
+		if res.StatusCode/100 != 1 {
+			answered++
+		}
+	}
+	return requests, responses
+}
+
+// ParseRequestHeader parses the header of a request found by Parse, data
+// is the message up to its HeaderEnd.
+func ParseRequestHeader(data []byte) (Request, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return Request{}, err
+	}
+	return Request{
+		Message: Message{
+			HeaderEnd: len(data),
+			End:       len(data),
+			Header:    req.Header,
+		},
+		Method: req.Method,
+		Target: req.RequestURI,
+		Host:   req.Host,
+	}, nil
+}
+
+// ParseResponseHeader parses the header of a response found by Parse, data
+// is the message up to its HeaderEnd.
+func ParseResponseHeader(data []byte) (Response, error) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{
+		Message: Message{
+			HeaderEnd: len(data),
+			End:       len(data),
+			Header:    res.Header,
+		},
+		StatusCode: res.StatusCode,
+	}, nil
+}
+
+// DecodeBody removes the content encoding, the body is returned unchanged
+// if it can't be decoded.
+func DecodeBody(header http.Header, body []byte) []byte {
+	r := io.Reader(nil)
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body
+		}
+		r = gr
+	case "deflate":
+		// deflate is supposed to be zlib wrapped, but often isn't
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(body))
+		} else {
+			r = zr
+		}
+	default:
+		return body
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedBodySize))
+	if err != nil && len(decoded) == 0 {
+		return body
+	}
+	return decoded
+}
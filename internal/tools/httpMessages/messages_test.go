@@ -0,0 +1,93 @@
+package httpmessages
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsRequest(t *testing.T) {
+	for data, want := range map[string]bool{
+		"GET / HTTP/1.1\r\nHost: a\r\n\r\n": true,
+		"POST /login HTTP/1.0\n":            true,
+		"GET / HTTP/2\r\n":                  false,
+		"get / HTTP/1.1\r\n":                false,
+		"SSH-2.0-OpenSSH_9.6\r\n":           false,
+		"GET / HTTP/1.1":                    false,
+	} {
+		if got := IsRequest([]byte(data)); got != want {
+			t.Errorf("IsRequest(%q) = %v, want %v", data, got, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	clientParts := []string{
+		"POST /login?next=/ HTTP/1.1\r\nHost: service:8080\r\nContent-Length: 5\r\n\r\nhello",
+		"HEAD /flag HTTP/1.1\r\nHost: service:8080\r\n\r\n",
+		"PUT /upload HTTP/1.1\r\nHost: service:8080\r\nExpect: 100-continue\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		"GET /truncated HTTP/1.1\r\nHost: other\r\nContent-Length: 100\r\n\r\nabc",
+	}
+	client := strings.Join(clientParts, "")
+	server := "" +
+		"HTTP/1.1 302 Found\r\nLocation: /\r\nContent-Length: 2\r\n\r\nok" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 1234\r\n\r\n" +
+		"HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 201 Created\r\nX-Flag: FLAG{abc}\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.0 500 Internal Server Error\r\n\r\ncrashed"
+	requests, responses := Parse([]byte(client), []byte(server))
+
+	type req struct {
+		method, target, host string
+	}
+	wantRequests := []req{
+		{"POST", "/login?next=/", "service:8080"},
+		{"HEAD", "/flag", "service:8080"},
+		{"PUT", "/upload", "service:8080"},
+		{"GET", "/truncated", "other"},
+	}
+	if len(requests) != len(wantRequests) {
+		t.Fatalf("got %d requests, want %d: %+v", len(requests), len(wantRequests), requests)
+	}
+	start := 0
+	for i, r := range requests {
+		got := req{r.Method, r.Target, r.Host}
+		if got != wantRequests[i] {
+			t.Errorf("request %d: got %+v, want %+v", i, got, wantRequests[i])
+		}
+		if end := start + len(clientParts[i]); r.Start != start || r.End != end {
+			t.Errorf("request %d: got boundaries %d-%d, want %d-%d", i, r.Start, r.End, start, end)
+		}
+		start += len(clientParts[i])
+		if h, err := ParseRequestHeader([]byte(client[r.Start:r.HeaderEnd])); err != nil || (req{h.Method, h.Target, h.Host}) != got {
+			t.Errorf("ParseRequestHeader of request %d = %+v, %v, want %+v", i, h, err, got)
+		}
+	}
+
+	wantStatus := []int{302, 200, 100, 201, 500}
+	if len(responses) != len(wantStatus) {
+		t.Fatalf("got %d responses, want %d: %+v", len(responses), len(wantStatus), responses)
+	}
+	for i, r := range responses {
+		if r.StatusCode != wantStatus[i] {
+			t.Errorf("response %d: got status %d, want %d", i, r.StatusCode, wantStatus[i])
+		}
+		if h, err := ParseResponseHeader([]byte(server[r.Start:r.HeaderEnd])); err != nil || h.StatusCode != r.StatusCode {
+			t.Errorf("ParseResponseHeader of response %d = %+v, %v, want status %d", i, h, err, r.StatusCode)
+		}
+		if i != 0 && r.Start != responses[i-1].End {
+			t.Errorf("response %d starts at %d, previous ended at %d", i, r.Start, responses[i-1].End)
+		}
+	}
+	if last := responses[len(responses)-1]; last.End != len(server) {
+		t.Errorf("last response ends at %d, want %d", last.End, len(server))
+	}
+	if v := responses[3].Header.Get("x-flag"); v != "FLAG{abc}" {
+		t.Errorf("got header %q", v)
+	}
+
+	// garbage stops the parser
+	requests, responses = Parse([]byte("GET / HTTP/1.1\r\n\r\n\x00\x01binary"), []byte("nope"))
+	if len(requests) != 1 || len(responses) != 0 {
+		t.Errorf("got %d requests and %d responses, want 1 and 0", len(requests), len(responses))
+	}
+}
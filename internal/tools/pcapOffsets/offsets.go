@@ -0,0 +1,480 @@
+// Package pcapoffsets stores the byte offsets of all packets of a pcap or
+// pcapng file in a sidecar file, so single packets can be read without
+// reading the file from the start.
+package pcapoffsets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+type (
+	// Table contains the offsets of all packets of a pcap file.
+	Table struct {
+		// PcapSize is the size of the pcap file when the table was built.
+		PcapSize uint64
+		Pcapng   bool
+		Sections []Section
+		Offsets  []uint64
+	}
+	// Section contains the bytes that are needed to decode the packets
+	// of a part of the file: the file header of a pcap or the section
+	// header and all interface descriptions of a pcapng section.
+	Section struct {
+		FirstPacket uint64
+		Header      []byte
+	}
+
+	fileHeader struct {
+		Magic    [4]byte
+		Version  uint32
+		PcapSize uint64
+		Pcapng   bool
+	}
+
+	// scanner finds the packets of a pcap file, only the headers of the
+	// packets are read.
+	scanner struct {
+		r         io.ReaderAt
+		size      uint64
+		offset    uint64
+		pcapng    bool
+		byteOrder binary.ByteOrder
+	}
+
+	// Collector collects the offsets of the packets of a pcap file while
+	// they are read by another reader.
+	Collector struct {
+		file    *os.File
+		scanner *scanner
+		table   Table
+		err     error
+	}
+
+	// Reader reads single packets of a pcap file using its offset table.
+	Reader struct {
+		file  *os.File
+		table *Table
+	}
+)
+
+const (
+	fileMagic   = "P2PO"
+	fileVersion = 1
+
+	pcapHeaderSize       = 24
+	pcapRecordHeaderSize = 16
+
+	pcapngBlockTypeSectionHeader  = 0x0a0d0d0a
+	pcapngBlockTypeInterface      = 0x00000001
+	pcapngBlockTypePacket         = 0x00000002
+	pcapngBlockTypeSimplePacket   = 0x00000003
+	pcapngBlockTypeEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic          = 0x1a2b3c4d
+)
+
+var (
+	errUnknownFormat = errors.New("unknown pcap format")
+)
+
+// Filename returns the name of the offset table file of a pcap.
+func Filename(pcapFilename string) string {
+	return pcapFilename + ".offsets"
+}
+
+// Build reads the pcap file and creates its offset table. The packets are
+// counted like libpcap does, so the packet indexes match.
+func Build(pcapFilename string) (*Table, error) {
+	f, err := os.Open(pcapFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &Table{}
+	s, err := newScanner(f, t)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if err := s.next(t); err == io.EOF {
+			return t, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// newScanner reads the file header of the pcap, it is the first section
+// of the table.
+func newScanner(f *os.File, t *Table) (*scanner, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s := &scanner{
+		r:    f,
+		size: uint64(fi.Size()),
+	}
+	t.PcapSize = s.size
+	magic := [4]byte{}
+	if _, err := f.ReadAt(magic[:], 0); err != nil {
+		return nil, errUnknownFormat
+	}
+	switch binary.LittleEndian.Uint32(magic[:]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		s.byteOrder = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		s.byteOrder = binary.BigEndian
+	case pcapngBlockTypeSectionHeader:
+		// the byte order is set by the section headers
+		t.Pcapng = true
+		s.pcapng = true
+		s.byteOrder = binary.LittleEndian
+		return s, nil
+	default:
+		return nil, errUnknownFormat
+	}
+	header := make([]byte, pcapHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	t.Sections = []Section{{Header: header}}
+	s.offset = pcapHeaderSize
+	return s, nil
+}
+
+// next adds the offset of the next packet to the table, it returns io.EOF
+// after the last packet.
+func (s *scanner) next(t *Table) error {
+	if s.pcapng {
+		return s.nextPcapng(t)
+	}
+	if s.offset == s.size {
+		return io.EOF
+	}
+	record := [pcapRecordHeaderSize]byte{}
+	if _, err := s.r.ReadAt(record[:], int64(s.offset)); err != nil {
+		return unexpectedEOF(err)
+	}
+	captureLength := s.byteOrder.Uint32(record[8:12])
+	t.Offsets = append(t.Offsets, s.offset)
+	s.offset += pcapRecordHeaderSize + uint64(captureLength)
+	if s.offset > s.size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (s *scanner) nextPcapng(t *Table) error {
+	block := [12]byte{}
+	for {
+		if s.offset == s.size {
+			return io.EOF
+		}
+		if _, err := s.r.ReadAt(block[:8], int64(s.offset)); err != nil {
+			return unexpectedEOF(err)
+		}
+		blockType := s.byteOrder.Uint32(block[:4])
+		if blockType == pcapngBlockTypeSectionHeader {
+			if _, err := s.r.ReadAt(block[8:12], int64(s.offset)+8); err != nil {
+				return unexpectedEOF(err)
+			}
+			switch {
+			case binary.LittleEndian.Uint32(block[8:12]) == pcapngByteOrderMagic:
+				s.byteOrder = binary.LittleEndian
+			case binary.BigEndian.Uint32(block[8:12]) == pcapngByteOrderMagic:
+				s.byteOrder = binary.BigEndian
+			default:
+				return errUnknownFormat
+			}
+		}
+		blockLength := s.byteOrder.Uint32(block[4:8])
+		if blockLength < 12 || blockLength%4 != 0 || s.offset+uint64(blockLength) > s.size {
+			return fmt.Errorf("invalid block length %d at offset %d", blockLength, s.offset)
+		}
+		offset := s.offset
+		s.offset += uint64(blockLength)
+		switch blockType {
+		case pcapngBlockTypeSectionHeader, pcapngBlockTypeInterface:
+			// the section header and interface blocks are copied
+			if blockType == pcapngBlockTypeSectionHeader {
+				t.Sections = append(t.Sections, Section{
+					FirstPacket: uint64(len(t.Offsets)),
+				})
+			} else if len(t.Sections) == 0 {
+				return errUnknownFormat
+			}
+			sec := &t.Sections[len(t.Sections)-1]
+			start := len(sec.Header)
+			sec.Header = append(sec.Header, make([]byte, blockLength)...)
+			if _, err := s.r.ReadAt(sec.Header[start:], int64(offset)); err != nil {
+				return unexpectedEOF(err)
+			}
+		case pcapngBlockTypePacket, pcapngBlockTypeSimplePacket, pcapngBlockTypeEnhancedPacket:
+			t.Offsets = append(t.Offsets, offset)
+			return nil
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// NewCollector prepares collecting the offsets of the packets of a pcap
+// file while another reader like libpcap reads the packets, Add has to
+// be called after every packet. Only the headers of the packets are read.
+func NewCollector(pcapFilename string) (*Collector, error) {
+	f, err := os.Open(pcapFilename)
+	if err != nil {
+		return nil, err
+	}
+	c := &Collector{
+		file: f,
+	}
+	if c.scanner, err = newScanner(f, &c.table); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Add records the offset of the packet that was read last.
+func (c *Collector) Add() {
+	if c.err != nil {
+		return
+	}
+	if c.err = c.scanner.next(&c.table); c.err == io.EOF {
+		c.err = errors.New("more packets were read than the pcap contains")
+	}
+}
+
+// Save writes the offset table after all packets were read.
+func (c *Collector) Save() error {
+	if c.err != nil {
+		return c.err
+	}
+	if err := c.scanner.next(&c.table); err != io.EOF {
+		if err == nil {
+			err = errors.New("fewer packets were read than the pcap contains")
+		}
+		return err
+	}
+	return c.table.Save(Filename(c.file.Name()))
+}
+
+func (c *Collector) Close() error {
+	return c.file.Close()
+}
+
+// Save writes the table to a file, the file is replaced atomically.
+func (t *Table) Save(filename string) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "*.offsets.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	buf := []byte(nil)
+	buf = append(buf, fileMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, fileVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, t.PcapSize)
+	if t.Pcapng {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(t.Sections)))
+	for _, s := range t.Sections {
+		buf = binary.AppendUvarint(buf, s.FirstPacket)
+		buf = binary.AppendUvarint(buf, uint64(len(s.Header)))
+		buf = append(buf, s.Header...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(t.Offsets)))
+	if _, err := bw.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	// the offsets are stored as the difference to the previous offset
+	prev := uint64(0)
+	for _, o := range t.Offsets {
+		buf = binary.AppendUvarint(buf[:0], o-prev)
+		if _, err := bw.Write(buf); err != nil {
+			f.Close()
+			return err
+		}
+		prev = o
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Load reads a table that was written by Save.
+func Load(filename string) (*Table, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	fh := fileHeader{}
+	if err := binary.Read(br, binary.LittleEndian, &fh); err != nil {
+		return nil, err
+	}
+	if string(fh.Magic[:]) != fileMagic || fh.Version != fileVersion {
+		return nil, fmt.Errorf("wrong magic or version: %q/%d", string(fh.Magic[:]), fh.Version)
+	}
+	t := &Table{
+		PcapSize: fh.PcapSize,
+		Pcapng:   fh.Pcapng,
+	}
+	nSections, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	for ; nSections != 0; nSections-- {
+		s := Section{}
+		if s.FirstPacket, err = binary.ReadUvarint(br); err != nil {
+			return nil, err
+		}
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxUint32 {
+			return nil, fmt.Errorf("section header too large: %d", n)
+		}
+		s.Header = make([]byte, n)
+		if _, err := io.ReadFull(br, s.Header); err != nil {
+			return nil, err
+		}
+		t.Sections = append(t.Sections, s)
+	}
+	nOffsets, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if nOffsets > fh.PcapSize/pcapRecordHeaderSize {
+		return nil, fmt.Errorf("too many offsets: %d", nOffsets)
+	}
+	t.Offsets = make([]uint64, nOffsets)
+	prev := uint64(0)
+	for i := range t.Offsets {
+		d, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		prev += d
+		t.Offsets[i] = prev
+	}
+	return t, nil
+}
+
+// Open returns the offset table of a pcap, the table is built and saved
+// if it is missing or outdated.
+func Open(pcapFilename string) (*Table, error) {
+	fi, err := os.Stat(pcapFilename)
+	if err != nil {
+		return nil, err
+	}
+	if t, err := Load(Filename(pcapFilename)); err == nil && t.PcapSize == uint64(fi.Size()) {
+		return t, nil
+	}
+	t, err := Build(pcapFilename)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Save(Filename(pcapFilename)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewReader opens a pcap file and its offset table.
+func NewReader(pcapFilename string) (*Reader, error) {
+	t, err := Open(pcapFilename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(pcapFilename)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		file:  f,
+		table: t,
+	}, nil
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// PacketCount returns the number of packets in the pcap.
+func (r *Reader) PacketCount() uint64 {
+	return uint64(len(r.table.Offsets))
+}
+
+// ReadPacket reads the packet with the given index and returns its data,
+// capture info and link type.
+func (r *Reader) ReadPacket(packetIndex uint64) ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	if packetIndex >= uint64(len(r.table.Offsets)) {
+		return nil, gopacket.CaptureInfo{}, 0, io.EOF
+	}
+	sIdx := sort.Search(len(r.table.Sections), func(i int) bool {
+		return r.table.Sections[i].FirstPacket > packetIndex
+	}) - 1
+	if sIdx < 0 {
+		return nil, gopacket.CaptureInfo{}, 0, fmt.Errorf("packet %d is not in any section", packetIndex)
+	}
+	// decode the packet as if it directly followed the section header
+	src := io.MultiReader(
+		bytes.NewReader(r.table.Sections[sIdx].Header),
+		io.NewSectionReader(r.file, int64(r.table.Offsets[packetIndex]), math.MaxInt64-int64(r.table.Offsets[packetIndex])),
+	)
+	if !r.table.Pcapng {
+		pr, err := pcapgo.NewReader(src)
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, 0, err
+		}
+		// like libpcap, accept packets that are larger than the snaplen
+		pr.SetSnaplen(math.MaxUint32 >> 1)
+		data, ci, err := pr.ReadPacketData()
+		return data, ci, pr.LinkType(), err
+	}
+	nr, err := pcapgo.NewNgReader(src, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, 0, err
+	}
+	data, ci, err := nr.ReadPacketData()
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, 0, err
+	}
+	linkType := layers.LinkType(0)
+	if len(ci.AncillaryData) != 0 {
+		linkType, _ = ci.AncillaryData[0].(layers.LinkType)
+	}
+	ci.AncillaryData = nil
+	return data, ci, linkType, nil
+}
@@ -0,0 +1,216 @@
+package pcapoffsets
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+type testPacket struct {
+	data     []byte
+	ci       gopacket.CaptureInfo
+	linkType layers.LinkType
+}
+
+func makeTestPackets() []testPacket {
+	t1 := time.Date(2020, 1, 1, 12, 0, 0, 123456789, time.UTC)
+	packets := []testPacket(nil)
+	for i := 0; i < 10; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 10+i*7)
+		lt := layers.LinkTypeEthernet
+		if i%3 == 0 {
+			lt = layers.LinkTypeRaw
+		}
+		packets = append(packets, testPacket{
+			data: data,
+			ci: gopacket.CaptureInfo{
+				Timestamp:     t1.Add(time.Duration(i) * time.Millisecond),
+				CaptureLength: len(data),
+				Length:        len(data) + i,
+			},
+			linkType: lt,
+		})
+	}
+	return packets
+}
+
+func writePcap(t *testing.T, filename string, packets []testPacket) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriterNanos(f)
+	if err := w.WriteFileHeader(64, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("WriteFileHeader failed: %v", err)
+	}
+	for _, p := range packets {
+		if err := w.WritePacket(p.ci, p.data); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+}
+
+func writePcapng(t *testing.T, filename string, packets []testPacket) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer f.Close()
+	// the interfaces are added when they are used first, so some of
+	// them are described after the first packets
+	var w *pcapgo.NgWriter
+	interfaces := map[layers.LinkType]int{}
+	for _, p := range packets {
+		id, ok := interfaces[p.linkType]
+		if !ok {
+			intf := pcapgo.DefaultNgInterface
+			intf.LinkType = p.linkType
+			if w == nil {
+				w, err = pcapgo.NewNgWriterInterface(f, intf, pcapgo.DefaultNgWriterOptions)
+			} else {
+				id, err = w.AddInterface(intf)
+			}
+			if err != nil {
+				t.Fatalf("adding interface failed: %v", err)
+			}
+			interfaces[p.linkType] = id
+		}
+		ci := p.ci
+		ci.InterfaceIndex = id
+		if err := w.WritePacket(ci, p.data); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	packets := makeTestPackets()
+	pcapPackets := append([]testPacket(nil), packets...)
+	for i := range pcapPackets {
+		pcapPackets[i].linkType = layers.LinkTypeEthernet
+	}
+	for _, tc := range []struct {
+		name    string
+		write   func(*testing.T, string, []testPacket)
+		packets []testPacket
+	}{
+		{"pcap", writePcap, pcapPackets},
+		{"pcapng", writePcapng, packets},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "test."+tc.name)
+			tc.write(t, fn, tc.packets)
+			r, err := NewReader(fn)
+			if err != nil {
+				t.Fatalf("NewReader failed: %v", err)
+			}
+			defer r.Close()
+			if got, want := r.PacketCount(), uint64(len(tc.packets)); got != want {
+				t.Fatalf("PacketCount() = %d, want %d", got, want)
+			}
+			// read the packets in reverse order to make sure they are not
+			// read sequentially
+			for i := len(tc.packets) - 1; i >= 0; i-- {
+				want := tc.packets[i]
+				data, ci, lt, err := r.ReadPacket(uint64(i))
+				if err != nil {
+					t.Fatalf("ReadPacket(%d) failed: %v", i, err)
+				}
+				if !bytes.Equal(data, want.data) || lt != want.linkType || !ci.Timestamp.Equal(want.ci.Timestamp) || ci.Length != want.ci.Length {
+					t.Errorf("ReadPacket(%d) = %v, %+v, %v; want %v, %+v, %v", i, data, ci, lt, want.data, want.ci, want.linkType)
+				}
+			}
+			if _, _, _, err := r.ReadPacket(uint64(len(tc.packets))); err == nil {
+				t.Errorf("ReadPacket after the last packet succeeded")
+			}
+
+			// the saved table is used by the next reader
+			saved, err := Load(Filename(fn))
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			built, err := Build(fn)
+			if err != nil {
+				t.Fatalf("Build failed: %v", err)
+			}
+			if fmt.Sprint(saved) != fmt.Sprint(built) {
+				t.Errorf("Load() = %v, want %v", saved, built)
+			}
+		})
+	}
+}
+
+func TestOffsetsOutdated(t *testing.T) {
+	packets := makeTestPackets()
+	fn := filepath.Join(t.TempDir(), "test.pcap")
+	writePcap(t, fn, packets[:5])
+	if _, err := Open(fn); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	writePcap(t, fn, packets)
+	table, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if len(table.Offsets) != len(packets) {
+		t.Errorf("outdated table with %d offsets was used, want %d", len(table.Offsets), len(packets))
+	}
+	if err := os.WriteFile(fn, []byte("no pcap"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := Open(fn); err == nil {
+		t.Errorf("Open of an invalid pcap succeeded")
+	}
+}
+
+func TestCollector(t *testing.T) {
+	packets := makeTestPackets()
+	for _, tc := range []struct {
+		name  string
+		write func(*testing.T, string, []testPacket)
+	}{
+		{"pcap", writePcap},
+		{"pcapng", writePcapng},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "test."+tc.name)
+			tc.write(t, fn, packets)
+			for _, n := range []int{len(packets) - 1, len(packets) + 1, len(packets)} {
+				c, err := NewCollector(fn)
+				if err != nil {
+					t.Fatalf("NewCollector failed: %v", err)
+				}
+				for range n {
+					c.Add()
+				}
+				err = c.Save()
+				c.Close()
+				if (err == nil) != (n == len(packets)) {
+					t.Fatalf("Save after %d packets = %v", n, err)
+				}
+			}
+			saved, err := Load(Filename(fn))
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			built, err := Build(fn)
+			if err != nil {
+				t.Fatalf("Build failed: %v", err)
+			}
+			if fmt.Sprint(saved) != fmt.Sprint(built) || len(saved.Offsets) != len(packets) {
+				t.Errorf("Load() = %v, want %v", saved, built)
+			}
+		})
+	}
+}
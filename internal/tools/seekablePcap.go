@@ -4,14 +4,18 @@ import (
 	"math"
 
 	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
 	"github.com/gopacket/gopacket/pcap"
+	pcapoffsets "github.com/spq/pkappa2/internal/tools/pcapOffsets"
 )
 
 type (
 	SeekablePcapHolder struct {
-		filename    string
+		filename string
+		offsets  *pcapoffsets.Reader
+		// the pcap is read sequentially if it has no offset table
+		noOffsets   bool
 		handle      *pcap.Handle
-		source      *gopacket.PacketSource
 		packetIndex uint64
 	}
 )
@@ -24,34 +28,60 @@ func NewSeekablePcapHolder(filename string) *SeekablePcapHolder {
 }
 
 func (s *SeekablePcapHolder) Close() {
+	if s.offsets != nil {
+		s.offsets.Close()
+		s.offsets = nil
+	}
 	if s.handle != nil {
 		s.handle.Close()
 		s.handle = nil
 	}
 }
 
-func (s *SeekablePcapHolder) Packet(packetIndex uint64) (gopacket.Packet, error) {
+// PacketData returns the data, capture info and link type of a packet.
+func (s *SeekablePcapHolder) PacketData(packetIndex uint64) ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	if s.offsets == nil && !s.noOffsets {
+		r, err := pcapoffsets.NewReader(s.filename)
+		if err != nil {
+			s.noOffsets = true
+		} else {
+			s.offsets = r
+		}
+	}
+	if s.offsets != nil {
+		return s.offsets.ReadPacket(packetIndex)
+	}
 	if s.packetIndex > packetIndex {
-		s.Close()
+		if s.handle != nil {
+			s.handle.Close()
+		}
 		handle, err := pcap.OpenOffline(s.filename)
 		if err != nil {
-			return nil, err
+			return nil, gopacket.CaptureInfo{}, 0, err
 		}
 		s.handle = handle
-		s.source = gopacket.NewPacketSource(handle, handle.LinkType())
 		s.packetIndex = 0
 	}
 	for s.packetIndex < packetIndex {
-		_, err := s.source.NextPacket()
-		if err != nil {
-			return nil, err
+		if _, _, err := s.handle.ZeroCopyReadPacketData(); err != nil {
+			return nil, gopacket.CaptureInfo{}, 0, err
 		}
 		s.packetIndex++
 	}
-	pkt, err := s.source.NextPacket()
+	data, ci, err := s.handle.ReadPacketData()
 	if err != nil {
-		return nil, err
+		return nil, gopacket.CaptureInfo{}, 0, err
 	}
 	s.packetIndex++
+	return data, ci, s.handle.LinkType(), nil
+}
+
+func (s *SeekablePcapHolder) Packet(packetIndex uint64) (gopacket.Packet, error) {
+	data, ci, linkType, err := s.PacketData(packetIndex)
+	if err != nil {
+		return nil, err
+	}
+	pkt := gopacket.NewPacket(data, linkType, gopacket.Default)
+	pkt.Metadata().CaptureInfo = ci
 	return pkt, nil
 }
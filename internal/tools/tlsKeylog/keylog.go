@@ -0,0 +1,188 @@
+package tlskeylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type (
+	// ClientRandom identifies a TLS connection in a keylog file.
+	ClientRandom [32]byte
+
+	// Entry is a line of a keylog file in the NSS key log format, see
+	// https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+	Entry struct {
+		Label        string
+		ClientRandom ClientRandom
+		Secret       []byte
+	}
+
+	// Secrets maps the labels of the secrets of a connection to their values.
+	Secrets map[string][]byte
+
+	// Store holds the secrets of all known connections, it is safe for
+	// concurrent use.
+	Store struct {
+		mutex   sync.RWMutex
+		secrets map[ClientRandom]Secrets
+	}
+)
+
+const (
+	// Labels of the secrets used by TLS 1.2 and TLS 1.3
+	LabelClientRandom                 = "CLIENT_RANDOM"
+	LabelClientEarlyTrafficSecret     = "CLIENT_EARLY_TRAFFIC_SECRET"
+	LabelClientHandshakeTrafficSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	LabelServerHandshakeTrafficSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	LabelClientTrafficSecret0         = "CLIENT_TRAFFIC_SECRET_0"
+	LabelServerTrafficSecret0         = "SERVER_TRAFFIC_SECRET_0"
+)
+
+func (r ClientRandom) String() string {
+	return hex.EncodeToString(r[:])
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s %s %x", e.Label, e.ClientRandom, e.Secret)
+}
+
+// ParseEntry parses a line of a keylog file. ok is false for empty lines
+// and comments.
+func ParseEntry(line string) (entry Entry, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return Entry{}, false, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return Entry{}, false, fmt.Errorf("expected 3 fields, got %d", len(fields))
+	}
+	random, err := hex.DecodeString(fields[1])
+	if err != nil || len(random) != len(entry.ClientRandom) {
+		return Entry{}, false, fmt.Errorf("invalid client random %q", fields[1])
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil || len(secret) == 0 {
+		return Entry{}, false, fmt.Errorf("invalid secret for client random %s", fields[1])
+	}
+	entry.Label = fields[0]
+	copy(entry.ClientRandom[:], random)
+	entry.Secret = secret
+	return entry, true, nil
+}
+
+// Parse reads all entries of a keylog file. Invalid lines are reported in
+// the error, the valid entries are returned anyway.
+func Parse(r io.Reader) ([]Entry, error) {
+	entries := []Entry(nil)
+	errs := []string(nil)
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		entry, ok, err := ParseEntry(scanner.Text())
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %v", lineNumber, err))
+			continue
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, err
+	}
+	if len(errs) != 0 {
+		return entries, fmt.Errorf("invalid keylog lines: %s", strings.Join(errs, ", "))
+	}
+	return entries, nil
+}
+
+func NewStore() *Store {
+	return &Store{
+		secrets: map[ClientRandom]Secrets{},
+	}
+}
+
+// Add stores the entries and returns the ones that were not known yet.
+func (s *Store) Add(entries []Entry) []Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	added := []Entry(nil)
+	for _, e := range entries {
+		secrets := s.secrets[e.ClientRandom]
+		if secrets == nil {
+			secrets = Secrets{}
+			s.secrets[e.ClientRandom] = secrets
+		}
+		if old, ok := secrets[e.Label]; ok && bytes.Equal(old, e.Secret) {
+			continue
+		}
+		secrets[e.Label] = slices.Clone(e.Secret)
+		added = append(added, e)
+	}
+	return added
+}
+
+// Lookup returns the secrets of the connection, or nil if none are known.
+func (s *Store) Lookup(random ClientRandom) Secrets {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	secrets, ok := s.secrets[random]
+	if !ok {
+		return nil
+	}
+	res := make(Secrets, len(secrets))
+	for label, secret := range secrets {
+		res[label] = secret
+	}
+	return res
+}
+
+// Len returns the number of connections with known secrets.
+func (s *Store) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.secrets)
+}
+
+// WriteTo writes all secrets in the keylog format.
+func (s *Store) WriteTo(w io.Writer) (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	randoms := make([]ClientRandom, 0, len(s.secrets))
+	for random := range s.secrets {
+		randoms = append(randoms, random)
+	}
+	slices.SortFunc(randoms, func(a, b ClientRandom) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	written := int64(0)
+	for _, random := range randoms {
+		labels := make([]string, 0, len(s.secrets[random]))
+		for label := range s.secrets[random] {
+			labels = append(labels, label)
+		}
+		slices.Sort(labels)
+		for _, label := range labels {
+			n, err := fmt.Fprintln(w, Entry{
+				Label:        label,
+				ClientRandom: random,
+				Secret:       s.secrets[random][label],
+			})
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,40 @@
+package tlskeylog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	keylog := "# comment\n\nCLIENT_RANDOM " + random + " 0102\nSERVER_TRAFFIC_SECRET_0 " + random + " 03\ninvalid line\nCLIENT_RANDOM 00 01\n"
+	entries, err := Parse(strings.NewReader(keylog))
+	if err == nil || !strings.Contains(err.Error(), "line 5") || !strings.Contains(err.Error(), "line 6") {
+		t.Errorf("Parse returned error %v, want errors for lines 5 and 6", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Parse returned %d entries, want 2", len(entries))
+	}
+	s := NewStore()
+	if added := s.Add(entries); len(added) != 2 {
+		t.Errorf("Store.Add returned %v, want 2 new entries", added)
+	}
+	if added := s.Add(entries[:1]); len(added) != 0 {
+		t.Errorf("Store.Add returned %v for known entries", added)
+	}
+	secrets := s.Lookup(entries[0].ClientRandom)
+	if string(secrets[LabelClientRandom]) != "\x01\x02" || string(secrets[LabelServerTrafficSecret0]) != "\x03" {
+		t.Errorf("Store.Lookup returned %v", secrets)
+	}
+	if s.Lookup(ClientRandom{}) != nil {
+		t.Errorf("Store.Lookup returned secrets of unknown connection")
+	}
+	out := strings.Builder{}
+	if _, err := s.WriteTo(&out); err != nil {
+		t.Fatalf("Store.WriteTo failed: %v", err)
+	}
+	want := "CLIENT_RANDOM " + random + " 0102\nSERVER_TRAFFIC_SECRET_0 " + random + " 03\n"
+	if out.String() != want {
+		t.Errorf("Store.WriteTo wrote %q, want %q", out.String(), want)
+	}
+}
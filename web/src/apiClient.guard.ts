@@ -2,7 +2,7 @@
  * Generated type guards for "apiClient.ts".
  * WARNING: Do not manually change this file.
  */
-import { Error, SearchResult, SearchResponse, StreamData, Statistics, MainStderr, Config, PcapsResponse, ConvertersResponse, ProcessStderr, PcapOverIPResponse, Webhooks, TagInfo, TagsResponse, GraphResponse } from "./apiClient";
+import { Error, SearchResult, SearchResponse, StreamData, Statistics, RetentionStatistics, MainStderr, Config, PcapsResponse, ConvertersResponse, ProcessStderr, PcapOverIPResponse, Webhooks, TagInfo, TagsResponse, GraphResponse } from "./apiClient";
 
 export function isError(obj: unknown): obj is Error {
     const typedObj = obj as Error
@@ -117,7 +117,11 @@ export function isStreamData(obj: unknown): obj is StreamData {
             (typeof e["Time"] === "undefined" ||
                 typeof e["Time"] === "string") &&
             (typeof e["ContentType"] === "undefined" ||
-                typeof e["ContentType"] === "string")
+                typeof e["ContentType"] === "string") &&
+            (typeof e["Kind"] === "undefined" ||
+                e["Kind"] === "data" ||
+                e["Kind"] === "info" ||
+                e["Kind"] === "annotation")
         ) &&
         Array.isArray(typedObj["Tags"]) &&
         typedObj["Tags"].every((e: any) =>
@@ -147,7 +151,23 @@ export function isStatistics(obj: unknown): obj is Statistics {
         typeof typedObj["PacketRecordCount"] === "number" &&
         typeof typedObj["MergeJobRunning"] === "boolean" &&
         typeof typedObj["TaggingJobRunning"] === "boolean" &&
-        typeof typedObj["ConverterJobRunning"] === "boolean"
+        typeof typedObj["ConverterJobRunning"] === "boolean" &&
+        typeof typedObj["RetentionJobRunning"] === "boolean" &&
+        typeof typedObj["DiskUsage"] === "number" &&
+        isRetentionStatistics(typedObj["Retention"]) as boolean
+    )
+}
+
+export function isRetentionStatistics(obj: unknown): obj is RetentionStatistics {
+    const typedObj = obj as RetentionStatistics
+    return (
+        (typedObj !== null &&
+            typeof typedObj === "object" ||
+            typeof typedObj === "function") &&
+        typeof typedObj["DroppedPcapCount"] === "number" &&
+        typeof typedObj["DroppedStreamCount"] === "number" &&
+        typeof typedObj["FreedBytes"] === "number" &&
+        typeof typedObj["LastRun"] === "string"
     )
 }
 
@@ -167,7 +187,39 @@ export function isConfig(obj: unknown): obj is Config {
         (typedObj !== null &&
             typeof typedObj === "object" ||
             typeof typedObj === "function") &&
-        typeof typedObj["AutoInsertLimitToQuery"] === "boolean"
+        typeof typedObj["AutoInsertLimitToQuery"] === "boolean" &&
+        typeof typedObj["RetentionMaxAge"] === "number" &&
+        typeof typedObj["RetentionMaxBytes"] === "number" &&
+        (typedObj["ConverterLimits"] !== null &&
+            typeof typedObj["ConverterLimits"] === "object" ||
+            typeof typedObj["ConverterLimits"] === "function") &&
+        typeof typedObj["ConverterLimits"]["TimeoutSeconds"] === "number" &&
+        typeof typedObj["ConverterLimits"]["MaxOutputBytes"] === "number" &&
+        typeof typedObj["ConverterLimits"]["MaxMemoryBytes"] === "number" &&
+        typeof typedObj["ConverterLimits"]["MaxCPUSeconds"] === "number" &&
+        (typeof typedObj["ConverterLimitOverrides"] === "undefined" ||
+            (typedObj["ConverterLimitOverrides"] !== null &&
+                typeof typedObj["ConverterLimitOverrides"] === "object" ||
+                typeof typedObj["ConverterLimitOverrides"] === "function") &&
+            Object.entries<any>(typedObj["ConverterLimitOverrides"])
+                .every(([key, value]) => ((value !== null &&
+                    typeof value === "object" ||
+                    typeof value === "function") &&
+                    typeof value["TimeoutSeconds"] === "number" &&
+                    typeof value["MaxOutputBytes"] === "number" &&
+                    typeof value["MaxMemoryBytes"] === "number" &&
+                    typeof value["MaxCPUSeconds"] === "number" &&
+                    typeof key === "string"))) &&
+        (typeof typedObj["ConverterTags"] === "undefined" ||
+            (typedObj["ConverterTags"] !== null &&
+                typeof typedObj["ConverterTags"] === "object" ||
+                typeof typedObj["ConverterTags"] === "function") &&
+            Object.entries<any>(typedObj["ConverterTags"])
+                .every(([key, value]) => (Array.isArray(value) &&
+                    value.every((e: any) =>
+                        typeof e === "string"
+                    ) &&
+                    typeof key === "string")))
     )
 }
 
@@ -199,6 +251,7 @@ export function isConvertersResponse(obj: unknown): obj is ConvertersResponse {
                 typeof e === "function") &&
             typeof e["Name"] === "string" &&
             typeof e["CachedStreamCount"] === "number" &&
+            typeof e["FailedStreamCount"] === "number" &&
             Array.isArray(e["Processes"]) &&
             e["Processes"].every((e: any) =>
                 (e !== null &&
@@ -207,8 +260,44 @@ export function isConvertersResponse(obj: unknown): obj is ConvertersResponse {
                 typeof e["Running"] === "boolean" &&
                 typeof e["ExitCode"] === "number" &&
                 typeof e["Pid"] === "number" &&
-                typeof e["Errors"] === "number"
-            )
+                typeof e["Errors"] === "number" &&
+                (typeof e["Converter"] === "undefined" ||
+                    typeof e["Converter"] === "string") &&
+                (e["State"] === "awaiting-metadata" ||
+                    e["State"] === "sending-chunks" ||
+                    e["State"] === "awaiting-output" ||
+                    e["State"] === "awaiting-trailer") &&
+                typeof e["StateChanged"] === "string" &&
+                typeof e["StreamID"] === "number" &&
+                (typeof e["LastFailure"] === "undefined" ||
+                    (e["LastFailure"] !== null &&
+                        typeof e["LastFailure"] === "object" ||
+                        typeof e["LastFailure"] === "function") &&
+                    typeof e["LastFailure"]["StreamID"] === "number" &&
+                    typeof e["LastFailure"]["Started"] === "string" &&
+                    (e["LastFailure"]["State"] === "awaiting-metadata" ||
+                        e["LastFailure"]["State"] === "sending-chunks" ||
+                        e["LastFailure"]["State"] === "awaiting-output" ||
+                        e["LastFailure"]["State"] === "awaiting-trailer") &&
+                    typeof e["LastFailure"]["StateChanged"] === "string" &&
+                    (typeof e["LastFailure"]["Error"] === "undefined" ||
+                        typeof e["LastFailure"]["Error"] === "string") &&
+                    (typeof e["LastFailure"]["Stderr"] === "undefined" ||
+                        Array.isArray(e["LastFailure"]["Stderr"]) &&
+                        e["LastFailure"]["Stderr"].every((e: any) =>
+                            typeof e === "string"
+                        )))
+            ) &&
+            (typeof e["Native"] === "undefined" ||
+                e["Native"] === false ||
+                e["Native"] === true) &&
+            (typeof e["Stages"] === "undefined" ||
+                Array.isArray(e["Stages"]) &&
+                e["Stages"].every((e: any) =>
+                    typeof e === "string"
+                )) &&
+            (typeof e["Address"] === "undefined" ||
+                typeof e["Address"] === "string")
         )
     )
 }
@@ -223,6 +312,26 @@ export function isProcessStderr(obj: unknown): obj is ProcessStderr {
         Array.isArray(typedObj["Stderr"]) &&
         typedObj["Stderr"].every((e: any) =>
             typeof e === "string"
+        ) &&
+        Array.isArray(typedObj["Conversions"]) &&
+        typedObj["Conversions"].every((e: any) =>
+            (e !== null &&
+                typeof e === "object" ||
+                typeof e === "function") &&
+            typeof e["StreamID"] === "number" &&
+            typeof e["Started"] === "string" &&
+            (e["State"] === "awaiting-metadata" ||
+                e["State"] === "sending-chunks" ||
+                e["State"] === "awaiting-output" ||
+                e["State"] === "awaiting-trailer") &&
+            typeof e["StateChanged"] === "string" &&
+            (typeof e["Error"] === "undefined" ||
+                typeof e["Error"] === "string") &&
+            (typeof e["Stderr"] === "undefined" ||
+                Array.isArray(e["Stderr"]) &&
+                e["Stderr"].every((e: any) =>
+                    typeof e === "string"
+                ))
         )
     )
 }
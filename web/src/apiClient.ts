@@ -73,6 +73,7 @@ export type Data = {
   Content: Base64;
   Time?: DateTimeString;
   ContentType: string | undefined;
+  Kind?: "data" | "info" | "annotation";
 };
 
 /** @see {isStreamData} ts-auto-guard:type-guard */
@@ -97,6 +98,16 @@ export type Statistics = {
   MergeJobRunning: boolean;
   TaggingJobRunning: boolean;
   ConverterJobRunning: boolean;
+  RetentionJobRunning: boolean;
+  DiskUsage: number;
+  Retention: RetentionStatistics;
+};
+
+export type RetentionStatistics = {
+  DroppedPcapCount: number;
+  DroppedStreamCount: number;
+  FreedBytes: number;
+  LastRun: DateTimeString;
 };
 
 /** @see {isMainStderr} ts-auto-guard:type-guard */
@@ -105,6 +116,18 @@ export type MainStderr = string[];
 /** @see {isConfig} ts-auto-guard:type-guard */
 export type Config = {
   AutoInsertLimitToQuery: boolean;
+  RetentionMaxAge: number;
+  RetentionMaxBytes: number;
+  ConverterLimits: ConverterLimits;
+  ConverterLimitOverrides?: { [name: string]: ConverterLimits };
+  ConverterTags?: { [name: string]: string[] };
+};
+
+export type ConverterLimits = {
+  TimeoutSeconds: number;
+  MaxOutputBytes: number;
+  MaxMemoryBytes: number;
+  MaxCPUSeconds: number;
 };
 
 export type PcapInfo = {
@@ -119,17 +142,41 @@ export type PcapInfo = {
 /** @see {isPcapsResponse} ts-auto-guard:type-guard */
 export type PcapsResponse = PcapInfo[];
 
+export type ProcessState =
+  | "awaiting-metadata"
+  | "sending-chunks"
+  | "awaiting-output"
+  | "awaiting-trailer";
+
+export type Conversion = {
+  StreamID: number;
+  Started: DateTimeString;
+  State: ProcessState;
+  StateChanged: DateTimeString;
+  Error?: string;
+  Stderr?: string[];
+};
+
 export type ProcessStats = {
   Running: boolean;
   ExitCode: number;
   Pid: number;
   Errors: number;
+  Converter?: string;
+  State: ProcessState;
+  StateChanged: DateTimeString;
+  StreamID: number;
+  LastFailure?: Conversion;
 };
 
 export type ConverterStatistics = {
   Name: string;
   CachedStreamCount: number;
+  FailedStreamCount: number;
   Processes: ProcessStats[];
+  Native?: boolean;
+  Stages?: string[];
+  Address?: string;
 };
 
 /** @see {isConvertersResponse} ts-auto-guard:type-guard */
@@ -139,6 +186,7 @@ export type ConvertersResponse = ConverterStatistics[];
 export type ProcessStderr = {
   Pid: number;
   Stderr: string[];
+  Conversions: Conversion[];
 };
 
 export type PcapOverIPEndpoint = {
@@ -31,10 +31,10 @@ const lexer = moo.compile({
     lparen: '(',
     rparen: ')',
     subquery: {match: /@[a-z0-9]+:/, value: x => x.slice(1, -1)},
-    converter: {match: /\.[a-z0-9]*/, value: x => x.slice(1)},
+    converter: {match: /\.[a-zA-Z0-9_.-]*/, value: x => x.slice(1)},
     negation: /[!-]/,
     keyword_or_error: {match: /[a-zA-Z]+/, error: true, type: moo.keywords({
-        kw: ['id', 'tag', 'service', 'mark', 'generated', 'protocol', 'ftime', 'ltime', 'time', 'cdata', 'sdata', 'data', 'cport', 'sport', 'port', 'chost', 'shost', 'host', 'cbytes', 'sbytes', 'bytes', 'sort', 'limit', 'group'],
+        kw: ['http', 'file', 'id', 'tag', 'service', 'mark', 'generated', 'protocol', 'ftime', 'ltime', 'time', 'cdata', 'sdata', 'data', 'cinfo', 'sinfo', 'info', 'cport', 'sport', 'port', 'chost', 'shost', 'host', 'cbytes', 'sbytes', 'bytes', 'sort', 'limit', 'group'],
         'kw_or': 'or',
         'kw_and': 'and',
         'kw_then': 'then',
@@ -59,7 +59,7 @@ export default function suggest(
       type: keyword,
     };
   } else if (
-    keyword.endsWith("data") &&
+    (keyword.endsWith("data") || keyword.endsWith("info")) &&
     targetElem.converter != null &&
     converters !== null
   ) {
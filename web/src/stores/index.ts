@@ -39,6 +39,14 @@ export const useRootStore = defineStore("root", {
       config: {
         // Default should match the ones in the backend at Manager::New
         AutoInsertLimitToQuery: false,
+        RetentionMaxAge: 0,
+        RetentionMaxBytes: 0,
+        ConverterLimits: {
+          TimeoutSeconds: 60,
+          MaxOutputBytes: 256 << 20,
+          MaxMemoryBytes: 0,
+          MaxCPUSeconds: 0,
+        },
       },
     };
   },
@@ -56,6 +56,7 @@ export function isConverterEvent(obj: unknown): obj is ConverterEvent {
             typeof typedObj["Converter"] === "function") &&
         typeof typedObj["Converter"]["Name"] === "string" &&
         typeof typedObj["Converter"]["CachedStreamCount"] === "number" &&
+        typeof typedObj["Converter"]["FailedStreamCount"] === "number" &&
         Array.isArray(typedObj["Converter"]["Processes"]) &&
         typedObj["Converter"]["Processes"].every((e: any) =>
             (e !== null &&
@@ -64,8 +65,18 @@ export function isConverterEvent(obj: unknown): obj is ConverterEvent {
             typeof e["Running"] === "boolean" &&
             typeof e["ExitCode"] === "number" &&
             typeof e["Pid"] === "number" &&
-            typeof e["Errors"] === "number"
-        )
+            typeof e["Errors"] === "number" &&
+            (typeof e["Converter"] === "undefined" ||
+                typeof e["Converter"] === "string")
+        ) &&
+        (typeof typedObj["Converter"]["Native"] === "undefined" ||
+            typedObj["Converter"]["Native"] === false ||
+            typedObj["Converter"]["Native"] === true) &&
+        (typeof typedObj["Converter"]["Stages"] === "undefined" ||
+            Array.isArray(typedObj["Converter"]["Stages"]) &&
+            typedObj["Converter"]["Stages"].every((e: any) =>
+                typeof e === "string"
+            ))
     )
 }
 
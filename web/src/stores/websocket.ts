@@ -211,11 +211,13 @@ export function setupWebsocket() {
           break;
         case "pcapProcessed":
         case "indexesMerged":
+        case "pcapsDropped":
           if (!isPcapStatsEvent(e)) {
             console.error("Invalid pcap stats event:", e);
             return;
           }
-          if (e.Type == "pcapProcessed") streamsStore.outdated = true;
+          if (e.Type == "pcapProcessed" || e.Type == "pcapsDropped")
+            streamsStore.outdated = true;
           if (store.status != null) {
             store.status.PcapCount = e.PcapStats.PcapCount;
             store.status.PacketCount = e.PcapStats.PacketCount;
@@ -231,7 +233,7 @@ export function setupWebsocket() {
             console.error("Invalid config event:", e);
             return;
           }
-          store.config.AutoInsertLimitToQuery = e.Config.AutoInsertLimitToQuery;
+          store.config = e.Config;
           break;
         case "webhooksUpdated":
           if (!isWebhooksEvent(e)) {